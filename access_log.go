@@ -0,0 +1,153 @@
+package goapi
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// What the access log writes, read by initAccessLog
+type accessLogSettings struct {
+	Enabled bool
+	SampleRates map[int]float64 // by status class, 2 for 2xx. Missing classes are all logged.
+	ExcludePaths []string
+	Fields []string
+}
+
+var accessLog = accessLogSettings{}
+
+// Fields an access log line can hold, and the default ACCESS_LOG_FIELDS
+var accessLogFields = []string{"method", "path", "route", "status", "latency", "account_id", "user_id", "request_id", "ip", "user_agent", "bytes"}
+
+const accessLogDefaultFields = "method,path,status,latency,account_id,user_id,request_id"
+
+// ====================
+//        Setup
+// ====================
+
+// Reads ACCESS_LOG, which turns the access log on when "true",
+// ACCESS_LOG_SAMPLE_RATES, e.g. "2xx=0.1,3xx=0.1" to keep a tenth of
+// successes and redirects, ACCESS_LOG_EXCLUDE_PATHS, e.g. "/readyz,/docs*",
+// and ACCESS_LOG_FIELDS
+func initAccessLog() {
+	rates, _ := parseSampleRates(os.Getenv("ACCESS_LOG_SAMPLE_RATES"))
+	accessLog = accessLogSettings{
+		Enabled: os.Getenv("ACCESS_LOG") == "true",
+		SampleRates: rates,
+		ExcludePaths: splitList(os.Getenv("ACCESS_LOG_EXCLUDE_PATHS")),
+		Fields: splitList(os.Getenv("ACCESS_LOG_FIELDS")),
+	}
+}
+
+// ====================
+//      Middleware
+// ====================
+
+// Writes a line to the log for each request once it's answered, through
+// the same logger and redaction as everything else
+func logAccess(c *fiber.Ctx) error {
+	settings := accessLog
+	if !settings.Enabled || settings.excludes(strings.TrimPrefix(c.Path(), mountPrefix)) {
+		return c.Next()
+	}
+
+	start := time.Now()
+	err := c.Next()
+	latency := time.Since(start)
+
+	status := responseStatus(c, err)
+	if rate, ok := settings.SampleRates[status/100]; ok && rand.Float64() >= rate {
+		return err
+	}
+
+	event := logger.Info()
+	for _, field := range settings.Fields {
+		switch field {
+			case "method":
+				event = event.Str("method", c.Method())
+			case "path":
+				event = event.Str("path", c.Path())
+			case "route":
+				event = event.Str("route", c.Route().Path)
+			case "status":
+				event = event.Int("status", status)
+			case "latency":
+				event = event.Float64("latency_ms", float64(latency.Microseconds())/1000)
+			case "account_id":
+				if accountId := accessLogAccountId(c); accountId != "" {
+					event = event.Str("account_id", accountId)
+				}
+			case "user_id":
+				if user, ok := c.Locals("user").(*User); ok {
+					event = event.Str("user_id", user.ID.String())
+				}
+			case "request_id":
+				event = event.Str("request_id", requestId(c))
+			case "ip":
+				event = event.Str("ip", c.IP())
+			case "user_agent":
+				event = event.Str("user_agent", c.Get(fiber.HeaderUserAgent))
+			case "bytes":
+				event = event.Int("bytes", len(c.Response().Body()))
+		}
+	}
+	event.Msg("request")
+
+	return err
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Whether a path, below the mount prefix, is left out of the log. A
+// trailing "*" excludes everything beginning with what's before it.
+func (settings accessLogSettings) excludes(path string) bool {
+	for _, excluded := range settings.ExcludePaths {
+		if prefix := strings.TrimSuffix(excluded, "*"); prefix != excluded {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == excluded {
+			return true
+		}
+	}
+	return false
+}
+
+// The account of the signed in user or account key, without looking it up
+func accessLogAccountId(c *fiber.Ctx) string {
+	if user, ok := c.Locals("user").(*User); ok {
+		return user.AccountId.String()
+	}
+	return scopedAccountId(c.UserContext())
+}
+
+// Reads rates like "2xx=0.1,4xx=1" into the share of each status class to keep
+func parseSampleRates(value string) (map[int]float64, error) {
+	rates := map[int]float64{}
+	for _, item := range splitList(value) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("must be a comma separated list of class=rate, like 2xx=0.1, got %q", item)
+		}
+
+		class := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(class) != 3 || class[0] < '1' || class[0] > '5' || class[1:] != "xx" {
+			return nil, fmt.Errorf("has an unknown status class %q, expected 1xx to 5xx", class)
+		}
+
+		rate, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("rate for %s must be from 0 to 1, got %q", class, parts[1])
+		}
+
+		rates[int(class[0]-'0')] = rate
+	}
+	return rates, nil
+}
@@ -1,9 +1,7 @@
-package main
+package goapi
 
 import (
 	"context"
-	"errors"
-	"fmt"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -14,20 +12,58 @@ import (
 // Account DB model
 type Account struct {
 	bun.BaseModel `bun:"table:accounts"`
-	ID uuid.UUID `bun:",pk,type:uuid,default:gen_random_uuid()"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
 	Name string
+	ReservedUsernames []string `bun:",array"`
+	RoutePermissions map[string]string `bun:",type:jsonb"`
+	Retention map[string]int `bun:",type:jsonb"` // days to keep rows, per table
+	Cors *CorsConfig `bun:",type:jsonb"`
+	Locale string `bun:",nullzero"` // default for users who don't ask for one
+	EmailSender *EmailSender `bun:",type:jsonb"`
+	EmailVariables map[string]string `bun:",type:jsonb"` // given to email templates as Vars
+	Slug string `bun:",nullzero"` // has unique idx, names the hosted pages
+	HostedPages *HostedPages `bun:",type:jsonb"`
+	Plan string `bun:",nullzero"` // in QUOTA_PLANS, or DEFAULT_PLAN when empty
 	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 
 	// Relations
-	Users []*User `bun:"rel:has-many,join:id=account_id"`
-	Keys []*Key `bun:"rel:has-many,join:id=account_id"`
+	Users []*User `bun:"rel:has-many,join:id=account_id" json:",omitempty"`
+	Keys []*Key `bun:"rel:has-many,join:id=account_id" json:",omitempty"`
+}
+
+// Client-facing summary of an account, as its users ?include= it
+type PublicAccount struct {
+	ID uuid.UUID
+	Name string
+	Slug string `json:",omitempty"`
+	Locale string `json:",omitempty"`
+	CreatedAt time.Time
+}
+
+// The relations account reads can ?include=
+var accountIncludes = map[string]string{"keys": "Keys"}
+
+// Creating an account, with its owner's credentials
+type CreateAccountInput struct {
+	Name string `validate:"max=100"`
+	RegisterInput
+}
+
+// Binding a key to a client certificate, given as PEM or its SHA-256
+// fingerprint. The request must come over a connection presenting that
+// certificate, which is bound when none is given.
+type KeyCertificateInput struct {
+	Certificate string
 }
 
 // Key DB model
 type Key struct {
 	bun.BaseModel `bun:"table:keys"`
-	ID uuid.UUID `bun:",pk,type:uuid,default:gen_random_uuid()"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Hash string `bun:",nullzero" json:"-"` // of the secret, has unique idx
+	Secret string `bun:"-" json:",omitempty"` // only on a key just made
+	ClientCertificate string `bun:",nullzero" json:",omitempty"` // fingerprint, has unique idx
 	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 
@@ -36,14 +72,17 @@ type Key struct {
 	Account *Account `bun:"rel:belongs-to,join:account_id=id"`
 }
 
+// The /accounts routes
+type accountHandlers struct {
+	handlerDeps
+}
+
 // ====================
 //        Setup
 // ====================
 
-func initAccountTables(db *bun.DB) {
-	ctx := context.Background()
-	db.NewCreateTable().IfNotExists().Model((*Account)(nil)).Exec(ctx)
-	db.NewCreateTable().IfNotExists().Model((*Key)(nil)).Exec(ctx)
+func newAccountHandlers(deps handlerDeps) *accountHandlers {
+	return &accountHandlers{handlerDeps: deps}
 }
 
 func (a *Account) BeforeAppendModel(ctx context.Context, query bun.Query) error {
@@ -62,10 +101,54 @@ func (k *Key) BeforeAppendModel(ctx context.Context, query bun.Query) error {
 	return nil
 }
 
-func initAccountRoutes(app *fiber.App, db *bun.DB) {
-	app.Post("/api/v1/accounts", func(c *fiber.Ctx) error {
-		return createAccount(c, db)
-	})
+func initAccountRoutes(api fiber.Router, h *accountHandlers) {
+	api.Post("/accounts", idempotent(h.db), h.createAccount)
+
+	routes := api.Group("/accounts", authenticated(h.auth, h.quotas))
+
+	routes.Get("/", permit(h.db, permissionAccountsManage), h.getAccount)
+
+	routes.Get("/reserved-usernames", permit(h.db, permissionAccountsManage), h.getReservedUsernames)
+
+	routes.Put("/reserved-usernames", permit(h.db, permissionAccountsManage), h.updateReservedUsernames)
+
+	routes.Get("/route-permissions", permit(h.db, permissionAccountsManage), h.getRoutePermissions)
+
+	routes.Put("/route-permissions", permit(h.db, permissionAccountsManage), h.updateRoutePermissions)
+
+	routes.Get("/retention", permit(h.db, permissionAccountsManage), h.getRetention)
+
+	routes.Put("/retention", permit(h.db, permissionAccountsManage), h.updateRetention)
+
+	routes.Get("/cors", permit(h.db, permissionAccountsManage), h.getCors)
+
+	routes.Put("/cors", permit(h.db, permissionAccountsManage), h.updateCors)
+
+	routes.Get("/locale", permit(h.db, permissionAccountsManage), h.getLocale)
+
+	routes.Put("/locale", permit(h.db, permissionAccountsManage), h.updateLocale)
+
+	routes.Get("/email-sender", permit(h.db, permissionAccountsManage), h.getEmailSender)
+
+	routes.Put("/email-sender", permit(h.db, permissionAccountsManage), h.updateEmailSender)
+
+	routes.Get("/quota", permit(h.db, permissionAccountsManage), h.getQuota)
+
+	routes.Get("/activity", permit(h.db, permissionAccountsManage), h.getActivity)
+
+	routes.Get("/hosted-pages", permit(h.db, permissionAccountsManage), h.getHostedPages)
+
+	routes.Put("/hosted-pages", permit(h.db, permissionAccountsManage), h.updateHostedPages)
+
+	routes.Get("/keys", permit(h.db, permissionKeysManage), h.getKeys)
+
+	routes.Post("/keys", permit(h.db, permissionKeysManage), h.createKey)
+
+	routes.Delete("/keys/:id", permit(h.db, permissionKeysManage), h.revokeKey)
+
+	routes.Put("/keys/:id/client-certificate", permit(h.db, permissionKeysManage), h.bindKeyCertificate)
+
+	routes.Delete("/keys/:id/client-certificate", permit(h.db, permissionKeysManage), h.unbindKeyCertificate)
 }
 
 // ====================
@@ -73,86 +156,262 @@ func initAccountRoutes(app *fiber.App, db *bun.DB) {
 // ====================
 
 // Creates an account, a key, an owner user, and a token for the user
-func createAccount(c *fiber.Ctx, db *bun.DB) error {
-	ctx := context.Background()
+func (h *accountHandlers) createAccount(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	input := new(CreateAccountInput)
+	if err := parseBody(c, input); err != nil {
+		return err
+	}
 
-	// Create an account
 	account := new(Account)
-	if err := c.BodyParser(account); err != nil {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "invalid input"})
+	account.ID = newId()
+	account.Name = input.Name
+
+	user := new(User)
+	user.Username = input.Username
+	user.Email = input.Email
+	user.Password = input.Password
+	user.DisplayName = input.DisplayName
+	user.Metadata = input.Metadata
+
+	key, err := h.accounts.Create(ctx, account, user)
+	if err != nil {
+		return err
 	}
 
-	account.ID = uuid.New()
-	_, err := db.NewInsert().Model(account).Exec(ctx)
+	// Get a token for the owner. The account is made either way, and they
+	// can sign in for one.
+	token, err := h.auth.StartSession(user.ID, user.AccountId)
 	if err != nil {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "error creating the account"})
+		requestLogger(c).Error().Err(err).Send()
 	}
+	user.Token = token
+
+	return created(c, "", fiber.Map{
+		"key": key.Secret,
+		"user": render(c, user.ToPublicUser()),
+	})
+}
+
+// The signed in user's account and its settings
+func (h *accountHandlers) getAccount(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
 
-	// Generate a key for the account
-	key := new(Key)
-	key.ID = uuid.New()
-	key.AccountId = account.ID
-	_, err = db.NewInsert().Model(key).Exec(ctx)
+	include, err := includeRelations(c, accountIncludes)
 	if err != nil {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "error creating the key"})
+		return err
 	}
 
-	// Create the owner
-	user := new(User)
-	if err := c.BodyParser(user); err != nil {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "invalid input"})
+	account := new(Account)
+	err = h.db.NewSelect().Model(account).Where("id = ?", currentUser.AccountId).Apply(include).Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("account not found").WithCode(codeAccountNotFound)
 	}
-	user.Role = "owner"
-	if _, err := user.New(db); err != nil {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "something went wrong"})
+
+	body, err := sparseFields(c, account)
+	if err != nil {
+		return err
 	}
 
-	// Get a token for the owner
-	token, err := createJwt(user.ID, user.AccountId, db)
+	return c.JSON(body)
+}
+
+func (h *accountHandlers) getReservedUsernames(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	account := new(Account)
+	err := h.db.NewSelect().Model(account).Where("id = ?", currentUser.AccountId).Scan(ctx)
 	if err != nil {
-		fmt.Println(err)
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("account not found").WithCode(codeAccountNotFound)
 	}
-	user.Token = token
 
 	return c.JSON(fiber.Map{
-		"key": key.ID,
-		"user": user.ToPublicUser(),
+		"defaults": reservedUsernames(),
+		"account": account.ReservedUsernames,
 	})
 }
 
-// ====================
-//     Middleware
-// ====================
+// Replaces the account's own additions to the reserved username list
+func (h *accountHandlers) updateReservedUsernames(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(Account)
+	if err := c.BodyParser(input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	usernames := []string{}
+	for _, username := range input.ReservedUsernames {
+		username = normalizeUsername(username)
+		if username != "" {
+			usernames = append(usernames, username)
+		}
+	}
+
+	account := new(Account)
+	account.ID = currentUser.AccountId
+	account.ReservedUsernames = usernames
+	account.UpdatedAt = h.clock()
+	_, err := h.db.NewUpdate().Model(account).Column("reserved_usernames", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(fiber.Map{
+		"defaults": reservedUsernames(),
+		"account": account.ReservedUsernames,
+	})
+}
+
+func (h *accountHandlers) getKeys(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
 
-func requireAccount(c *fiber.Ctx, db *bun.DB) error {
-	accountKey, err := getAccountKeyFromHeaders(c)
+	keys, err := h.accounts.Keys(ctx, currentUser.AccountId)
 	if err != nil {
-		fmt.Println(err)
-		return errors.New("no account key provided")
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return an empty array
 	}
 
-	key := new(Key)
-	ctx := context.Background()
-	err = db.NewSelect().Model(key).Where("id = ?", accountKey).Scan(ctx)
+	body, err := sparseFields(c, keys)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(body)
+}
 
+func (h *accountHandlers) createKey(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	key, err := h.accounts.CreateKey(ctx, currentUser.AccountId)
 	if err != nil {
-		fmt.Println(err)
-		return errors.New("invalid account key")
+		return err
+	}
+
+	return created(c, apiPath(c, "/accounts/keys/"+key.ID.String()), key)
+}
+
+// Deletes a key, refusing to remove the account's last one
+func (h *accountHandlers) revokeKey(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	if err := h.accounts.RevokeKey(ctx, currentUser.AccountId, c.Params("id")); err != nil {
+		return err
 	}
 
-	return c.Next()
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// Binds a key to a client certificate, for service clients connecting
+// with mutual TLS
+func (h *accountHandlers) bindKeyCertificate(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(KeyCertificateInput)
+	if len(c.Body()) > 0 {
+		if err := parseBody(c, input); err != nil {
+			return err
+		}
+	}
+
+	// Binding takes proof of holding the certificate, or anyone knowing
+	// another tenant's fingerprint could capture its service clients
+	fingerprint := clientCertificate(c)
+	if fingerprint == "" {
+		return forbidden("present the client certificate to bind it").WithCode(codeKeyCertificateInvalid)
+	}
+	if input.Certificate != "" {
+		given, ok := parseCertificateFingerprint(input.Certificate)
+		if !ok {
+			return badRequest("invalid client certificate").WithCode(codeKeyCertificateInvalid)
+		}
+		if given != fingerprint {
+			return forbidden("present the client certificate to bind it").WithCode(codeKeyCertificateInvalid)
+		}
+	}
+
+	if err := h.accounts.BindKey(ctx, currentUser.AccountId, c.Params("id"), fingerprint); err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+func (h *accountHandlers) unbindKeyCertificate(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	if err := h.accounts.BindKey(ctx, currentUser.AccountId, c.Params("id"), ""); err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// ====================
+//     Middleware
+// ====================
+
+// Requires a valid Account-Key, or a client certificate bound to a key,
+// and scopes the request to its account
+func requireAccount(accounts *AccountService, quotas *QuotaService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Get("Account-Key") == "" && clientCertificate(c) == "" {
+			return unauthorized("no account key provided").WithCode(codeAccountKeyInvalid)
+		}
+
+		accountId, err := accountIdForRequest(c, accounts)
+		if err != nil {
+			return err
+		}
+
+		scopeRequestToAccount(c, accountId)
+		if err := meterRequest(c, quotas, accountId); err != nil {
+			return err
+		}
+		return c.Next()
+	}
 }
 
 // ====================
 //      Utilities
 // ====================
 
-func getAccountKeyFromHeaders(c *fiber.Ctx) (uuid.UUID, error) {
-	headers := c.GetReqHeaders()
-	return uuid.Parse(headers["Account-Key"])
+func (account *Account) ToPublicAccount() *PublicAccount {
+	return &PublicAccount{
+		ID: account.ID,
+		Name: account.Name,
+		Slug: account.Slug,
+		Locale: account.Locale,
+		CreatedAt: account.CreatedAt,
+	}
+}
+
+// A key for the account. Only a hash of its secret is stored, so the
+// secret is seen once, in the response that makes it. Secrets are random
+// UUIDs, the form Account-Key has always taken.
+func newKey(accountId uuid.UUID) *Key {
+	secret := uuid.New().String()
+	return &Key{ID: newId(), Hash: hashSecret(secret), Secret: secret, AccountId: accountId}
+}
+
+// The account a request is for: its signed in user's, else its account
+// key's or client certificate's, else uuid.Nil
+func requestAccountId(c *fiber.Ctx, db *bun.DB) uuid.UUID {
+	if user, ok := c.Locals("user").(*User); ok {
+		return user.AccountId
+	}
+
+	accountId, _ := accountIdForRequest(c, newAccountService(db))
+	return accountId
 }
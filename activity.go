@@ -0,0 +1,255 @@
+package goapi
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// One line of an account's activity feed, newest first. Spikes of failed
+// logins are summed up by the hour rather than listed one by one.
+type ActivityItem struct {
+	Type string
+	Message string
+	User string `json:",omitempty"` // the username the item is about
+	UserId *uuid.UUID `json:",omitempty"`
+	Actor string `json:",omitempty"` // the username of whoever did it
+	ActorId *uuid.UUID `json:",omitempty"`
+	Count int `json:",omitempty"` // failed logins in the hour, for spikes
+	At time.Time
+}
+
+// A page of the feed. Next is the cursor for the page after it, if any.
+type ActivityPage struct {
+	Activity []ActivityItem `json:"activity"`
+	Next string `json:"next,omitempty"`
+}
+
+// The failed-login summary's type, alongside the event types
+const activityFailedLoginSpike = "login.failed_spike"
+
+// Items per page unless ?limit asks for another number, up to the most
+// the account's other lists return
+const (
+	activityDefaultPageSize = 25
+	activityMaxPageSize = 100
+)
+
+// Events an account's owners want to hear about
+func activityEventTypes() []string {
+	return []string{
+		eventUserCreated,
+		eventUserDeleted,
+		eventUserSuspended,
+		eventUserUnsuspended,
+		eventUserErased,
+		eventUserRoleChanged,
+		eventKeyCreated,
+		eventKeyRevoked,
+		eventQuotaWarning,
+	}
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Notable events on the account, newest first, e.g.
+// GET /accounts/activity?limit=25&cursor=... with the previous page's next
+func (h *accountHandlers) getActivity(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+	locale := requestLocale(c)
+
+	limit := activityDefaultPageSize
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > activityMaxPageSize {
+			return badRequest("limit must be between 1 and 100").WithCode(codeInvalidInput)
+		}
+		limit = parsed
+	}
+
+	query := h.db.NewSelect().Model((*Event)(nil)).
+		Where("account_id = ?", currentUser.AccountId).
+		Where("type IN (?)", bun.In(activityEventTypes()))
+
+	until := h.clock()
+	if cursor := c.Query("cursor"); cursor != "" {
+		createdAt, id, err := decodeCursor(cursor)
+		if err != nil {
+			return badRequest("invalid cursor").WithCode(codeInvalidInput)
+		}
+		query = query.Where("(created_at, id) < (?, ?)", createdAt, id)
+		until = createdAt
+	}
+
+	events := []Event{}
+	err := query.OrderExpr("created_at DESC, id DESC").Limit(limit + 1).Scan(ctx, &events)
+	if err != nil {
+		return internalError(err)
+	}
+
+	next := ""
+	since := time.Time{}
+	if len(events) > limit {
+		events = events[:limit]
+		last := events[len(events)-1]
+		next = encodeCursor(last.CreatedAt, last.ID)
+		since = last.CreatedAt
+	}
+
+	usernames, err := activityUsernames(c, h.db, events)
+	if err != nil {
+		return internalError(err)
+	}
+
+	items := []ActivityItem{}
+	for _, event := range events {
+		items = append(items, activityItem(event, usernames, locale))
+	}
+
+	spikes, err := failedLoginSpikes(c, h.db, currentUser.AccountId, since, until, locale)
+	if err != nil {
+		return internalError(err)
+	}
+	items = append(items, spikes...)
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].At.After(items[j].At)
+	})
+
+	return c.JSON(ActivityPage{Activity: items, Next: next})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Describes an event in the reader's language
+func activityItem(event Event, usernames map[uuid.UUID]string, locale string) ActivityItem {
+	item := ActivityItem{Type: event.Type, At: event.CreatedAt}
+
+	if event.UserId != uuid.Nil {
+		id := event.UserId
+		item.UserId = &id
+		item.User = usernames[id]
+	}
+	if actorId := activityActorId(event); actorId != uuid.Nil {
+		item.ActorId = &actorId
+		item.Actor = usernames[actorId]
+	}
+
+	user := item.User
+	if user == "" {
+		user = translate(locale, "a user")
+	}
+	actor := item.Actor
+	if actor == "" {
+		actor = translate(locale, "someone")
+	}
+
+	switch event.Type {
+		case eventUserCreated:
+			item.Message = localize("%s joined the account", user).in(locale)
+		case eventUserDeleted:
+			item.Message = localize("%s was removed by %s", user, actor).in(locale)
+		case eventUserSuspended:
+			item.Message = localize("%s was suspended by %s", user, actor).in(locale)
+		case eventUserUnsuspended:
+			item.Message = localize("%s was reinstated by %s", user, actor).in(locale)
+		case eventUserErased:
+			item.Message = localize("%s's personal data was erased", user).in(locale)
+		case eventUserRoleChanged:
+			role, _ := event.Data["role"].(string)
+			item.Message = localize("%s's role was changed to %s by %s", user, role, actor).in(locale)
+		case eventKeyCreated:
+			item.Message = localize("An account key was created").in(locale)
+		case eventKeyRevoked:
+			item.Message = localize("An account key was revoked").in(locale)
+		case eventQuotaWarning:
+			item.Message = localize("The account is nearing its monthly request quota").in(locale)
+	}
+
+	return item
+}
+
+// Who acted on the event's user, as recorded in its data
+func activityActorId(event Event) uuid.UUID {
+	by, _ := event.Data["by"].(string)
+	id, _ := uuid.Parse(by)
+	return id
+}
+
+// The usernames of everyone the events mention, deleted users included
+func activityUsernames(c *fiber.Ctx, db *bun.DB, events []Event) (map[uuid.UUID]string, error) {
+	usernames := map[uuid.UUID]string{}
+
+	ids := []uuid.UUID{}
+	for _, event := range events {
+		for _, id := range []uuid.UUID{event.UserId, activityActorId(event)} {
+			if id != uuid.Nil {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return usernames, nil
+	}
+
+	users := []User{}
+	err := db.NewSelect().Model(&users).
+		Column("id", "username").
+		Where("id IN (?)", bun.In(ids)).
+		WhereAllWithDeleted().
+		Scan(c.UserContext())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		usernames[user.ID] = user.Username
+	}
+	return usernames, nil
+}
+
+// An item for each hour from since until until holding at least
+// ACTIVITY_FAILED_LOGIN_SPIKE failed logins. Hours are counted whole, so
+// a spike reads the same whichever page it falls on.
+func failedLoginSpikes(c *fiber.Ctx, db *bun.DB, accountId uuid.UUID, since time.Time, until time.Time, locale string) ([]ActivityItem, error) {
+	var times []time.Time
+	err := db.NewSelect().Model((*Event)(nil)).
+		Column("created_at").
+		Where("account_id = ?", accountId).
+		Where("type = ?", eventLoginFailed).
+		Where("created_at >= ?", since.Truncate(time.Hour)).
+		Where("created_at < ?", until.Truncate(time.Hour).Add(time.Hour)).
+		Scan(c.UserContext(), &times)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[time.Time]int{}
+	for _, at := range times {
+		counts[at.UTC().Truncate(time.Hour)]++
+	}
+
+	spikes := []ActivityItem{}
+	threshold := intSetting("ACTIVITY_FAILED_LOGIN_SPIKE")
+	for hour, count := range counts {
+		if count < threshold || hour.Before(since) || !hour.Before(until) {
+			continue
+		}
+		spikes = append(spikes, ActivityItem{
+			Type: activityFailedLoginSpike,
+			Message: localize("%d failed logins in an hour", count).in(locale),
+			Count: count,
+			At: hour,
+		})
+	}
+
+	return spikes, nil
+}
@@ -0,0 +1,265 @@
+package goapi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// Metrics rolled up per account per day
+const (
+	metricSignups = "signups"
+	metricLogins = "logins"
+	metricFailedLogins = "failed_logins"
+	metricActiveUsers = "active_users"
+	metricActiveSessions = "active_sessions"
+	metricRequests = "requests"
+	metricErrors = "errors"
+)
+
+// DailyMetric DB model, the roll-up the analytics endpoints read from
+type DailyMetric struct {
+	bun.BaseModel `bun:"table:daily_metrics"`
+	AccountId uuid.UUID `bun:",pk,type:uuid"` // uuid.Nil for requests made without a user
+	Day time.Time `bun:",pk,type:date"`
+	Metric string `bun:",pk"`
+	Value int64 `bun:",notnull,default:0"`
+}
+
+// A metric's value for a single day
+type MetricPoint struct {
+	Day time.Time `bun:"day"`
+	Metric string `bun:"metric"`
+	Value int64 `bun:"value"`
+}
+
+// Requests and server errors counted in memory until the next roll-up
+type requestCountKey struct {
+	AccountId uuid.UUID
+	Day time.Time
+}
+
+type requestCount struct {
+	Requests int64
+	Errors int64
+}
+
+var (
+	requestCountsMutex sync.Mutex
+	requestCounts = map[requestCountKey]*requestCount{}
+)
+
+// ====================
+//        Setup
+// ====================
+
+func initAnalyticsRoutes(api fiber.Router, db *bun.DB) {
+	routes := api.Group("/metrics", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	})
+
+	routes.Get("/", permit(db, permissionMetricsRead), func(c *fiber.Ctx) error {
+		currentUser := c.Locals("user").(*User)
+		return getMetrics(c, db, currentUser.AccountId)
+	})
+
+	operator := api.Group("/operator", requireOperator)
+
+	// Across every account, or one with ?account=<id>
+	operator.Get("/metrics", func(c *fiber.Ctx) error {
+		if account := c.Query("account"); account != "" {
+			accountId, err := uuid.Parse(account)
+			if err != nil {
+				return badRequest("invalid account")
+			}
+			return getMetrics(c, db, accountId)
+		}
+		return getMetrics(c, db, uuid.Nil)
+	})
+}
+
+// Rolls up metrics every METRICS_ROLLUP_INTERVAL_MINUTES (default 15)
+func startMetricsRollup(db *bun.DB) {
+	minutes, err := strconv.Atoi(os.Getenv("METRICS_ROLLUP_INTERVAL_MINUTES"))
+	if err != nil || minutes <= 0 {
+		minutes = 15
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(minutes) * time.Minute)
+		for range ticker.C {
+			rollupMetrics(db)
+		}
+	}()
+}
+
+// ====================
+//     Middleware
+// ====================
+
+// Counts requests and server errors towards the account's metrics
+func countRequests(c *fiber.Ctx) error {
+	err := c.Next()
+
+	key := requestCountKey{Day: time.Now().UTC().Truncate(time.Hour * 24)}
+	if user, ok := c.Locals("user").(*User); ok {
+		key.AccountId = user.AccountId
+	}
+
+	requestCountsMutex.Lock()
+	count, ok := requestCounts[key]
+	if !ok {
+		count = &requestCount{}
+		requestCounts[key] = count
+	}
+	count.Requests++
+	if responseStatus(c, err) >= 500 {
+		count.Errors++
+	}
+	requestCountsMutex.Unlock()
+
+	return err
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Every metric per day over the last ?days= (default 30) for an account,
+// or summed across accounts when accountId is uuid.Nil
+func getMetrics(c *fiber.Ctx, db *bun.DB, accountId uuid.UUID) error {
+	ctx := c.UserContext()
+
+	days, err := strconv.Atoi(c.Query("days", "30"))
+	if err != nil || days < 1 || days > 365 {
+		return badRequest("days must be between 1 and 365")
+	}
+	since := time.Now().UTC().AddDate(0, 0, -days+1).Truncate(time.Hour * 24)
+
+	query := db.NewSelect().Model((*DailyMetric)(nil)).
+		ColumnExpr("day, metric, sum(value) AS value").
+		Where("day >= ?", since).
+		Group("day", "metric").
+		Order("day ASC")
+	if accountId != uuid.Nil {
+		query = query.Where("account_id = ?", accountId)
+	}
+
+	points := []MetricPoint{}
+	if err := query.Scan(ctx, &points); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	metrics := map[string][]DayCount{}
+	requests := map[time.Time]int64{}
+	errors := map[time.Time]int64{}
+	for _, point := range points {
+		metrics[point.Metric] = append(metrics[point.Metric], DayCount{Day: point.Day, Count: int(point.Value)})
+		switch point.Metric {
+			case metricRequests:
+				requests[point.Day] = point.Value
+			case metricErrors:
+				errors[point.Day] = point.Value
+		}
+	}
+
+	errorRate := []fiber.Map{}
+	for _, point := range metrics[metricRequests] {
+		if requests[point.Day] > 0 {
+			errorRate = append(errorRate, fiber.Map{
+				"day": point.Day,
+				"rate": float64(errors[point.Day]) / float64(requests[point.Day]),
+			})
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"since": since,
+		"metrics": metrics,
+		"errorRate": errorRate,
+	})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Recomputes yesterday's and today's metrics from their source tables and
+// adds the requests counted since the last roll-up
+func rollupMetrics(db *bun.DB) {
+	ctx := context.Background()
+	today := time.Now().UTC().Truncate(time.Hour * 24)
+
+	for _, day := range []time.Time{today.AddDate(0, 0, -1), today} {
+		queries := map[string]string{
+			metricSignups: `SELECT account_id, day, ? AS metric, count AS value FROM daily_signups WHERE day = ?`,
+			metricLogins: `SELECT account_id, ` + dateParam(db) + ` AS day, ? AS metric, count(*) AS value FROM login_attempts
+				WHERE success AND created_at >= ? AND created_at < ? GROUP BY account_id`,
+			metricFailedLogins: `SELECT account_id, ` + dateParam(db) + ` AS day, ? AS metric, count(*) AS value FROM login_attempts
+				WHERE NOT success AND created_at >= ? AND created_at < ? GROUP BY account_id`,
+			metricActiveUsers: `SELECT account_id, day, ? AS metric, count(*) AS value FROM user_activities WHERE day = ? GROUP BY account_id, day`,
+		}
+
+		for metric, query := range queries {
+			var args []interface{}
+			switch metric {
+				case metricLogins, metricFailedLogins:
+					args = []interface{}{day, metric, day, day.AddDate(0, 0, 1)}
+				default:
+					args = []interface{}{metric, day}
+			}
+
+			_, err := db.ExecContext(ctx, `INSERT INTO daily_metrics (account_id, day, metric, value) `+query+` `+
+				upsertClause(db, "account_id, day, metric", "value"), args...)
+			if err != nil {
+				logger.Error().Err(err).Str("metric", metric).Msg("metrics roll-up failed")
+			}
+		}
+	}
+
+	// Tokens live 14 days, so any newer than that is a session that may still be in use
+	_, err := db.ExecContext(ctx, `INSERT INTO daily_metrics (account_id, day, metric, value)
+		SELECT u.account_id, `+dateParam(db)+`, ?, count(*) FROM tokens AS t JOIN users AS u ON u.id = t.user_id
+		WHERE t.created_at > ? GROUP BY u.account_id `+upsertClause(db, "account_id, day, metric", "value"),
+		today, metricActiveSessions, time.Now().Add(-time.Hour*24*14))
+	if err != nil {
+		logger.Error().Err(err).Str("metric", metricActiveSessions).Msg("metrics roll-up failed")
+	}
+
+	flushRequestCounts(db)
+}
+
+// Adds the in-memory request counts to the roll-up
+func flushRequestCounts(db *bun.DB) {
+	requestCountsMutex.Lock()
+	counts := requestCounts
+	requestCounts = map[requestCountKey]*requestCount{}
+	requestCountsMutex.Unlock()
+
+	metrics := []DailyMetric{}
+	for key, count := range counts {
+		metrics = append(metrics,
+			DailyMetric{AccountId: key.AccountId, Day: key.Day, Metric: metricRequests, Value: count.Requests},
+			DailyMetric{AccountId: key.AccountId, Day: key.Day, Metric: metricErrors, Value: count.Errors},
+		)
+	}
+	if len(metrics) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	q := db.NewInsert().Model(&metrics)
+	_, err := upsert(q, "account_id, day, metric").
+		Set(fmt.Sprintf("value = %s + %s", existingValue(q, "daily_metric", "value"), insertedValue(q, "value"))).
+		Exec(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("flushing request counts failed")
+	}
+}
@@ -0,0 +1,87 @@
+package goapi
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/uptrace/bun"
+)
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Creates a credential-less guest user in the key's account and logs them in
+func (h *authHandlers) registerAnonymous(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+
+	accountId, err := accountIdForRequest(c, h.accounts)
+	if err != nil {
+		return err
+	}
+
+	if !IsEnabled(accountId, flagAnonymousUsers, h.db) {
+		return forbidden("anonymous users are disabled").WithCode(codeFeatureDisabled)
+	}
+
+	// Guests have no credentials to check, so they're inserted directly,
+	// still recording that they were created
+	user := new(User)
+	user.Username = fmt.Sprintf("guest-%s", strings.ReplaceAll(newId().String(), "-", ""))
+	user.AccountId = accountId
+	user.IsAnonymous = true
+	if _, err := user.insert(ctx, h.db); err != nil {
+		return err
+	}
+
+	token, err := h.auth.StartSession(user.ID, user.AccountId)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// continue without a token
+	}
+	if err := issueSession(c, user, token); err != nil {
+		return internalError(err)
+	}
+
+	return created(c, apiPath(c, "/me"), render(c, user.ToPublicUser()))
+}
+
+// Gives a guest user real credentials, keeping their ID and metadata
+func upgradeAnonymous(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	if !currentUser.IsAnonymous {
+		return badRequest("user is not anonymous")
+	}
+
+	input := new(User)
+	if err := c.BodyParser(input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	input.ID = currentUser.ID
+	input.AccountId = currentUser.AccountId
+	if err := input.checkCredentials(ctx, db); err != nil {
+		return err
+	}
+
+	currentUser.Username = input.Username
+	currentUser.Email = input.Email
+	currentUser.Password, _ = hashPassword(input.Password)
+	currentUser.IsAnonymous = false
+	currentUser.UpdatedAt = time.Now()
+	_, err := db.NewUpdate().Model(currentUser).
+		Column("username", "email", "password", "is_anonymous", "updated_at").
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		return userWriteError(err)
+	}
+	forgetUserTokens(currentUser.ID)
+
+	return c.JSON(render(c, currentUser.ToPublicUser()))
+}
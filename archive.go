@@ -0,0 +1,109 @@
+package goapi
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Rows moved to archive tables by the archival worker, per table
+var archivedRows = expvar.NewMap("archived_rows")
+
+// ====================
+//        Setup
+// ====================
+
+// Tables whose rows move to <name>_archive once they're
+// ARCHIVE_<TABLE>_DAYS old, keeping the tables requests read small. 0, the
+// default, leaves them where they are. Archived rows are still purged by
+// retention, erased, and exported, but the API no longer lists or counts
+// them, and an archived token no longer signs anyone in. Archival rather
+// than partitioning works the same on every dialect and doesn't need
+// created_at in the tables' primary keys. A migration that changes one of
+// these tables changes its archive the same way.
+func archivedTables() []string {
+	return []string{"tokens", "login_attempts", "audit_logs"}
+}
+
+// Archives old rows every ARCHIVE_INTERVAL_MINUTES
+func startArchival(db *bun.DB) {
+	go func() {
+		ticker := time.NewTicker(time.Duration(intSetting("ARCHIVE_INTERVAL_MINUTES")) * time.Minute)
+		for range ticker.C {
+			archiveOldRows(db)
+		}
+	}()
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func archiveOldRows(db *bun.DB) {
+	ctx := context.Background()
+	batchSize := intSetting("ARCHIVE_BATCH_SIZE")
+
+	for _, table := range archivedTables() {
+		days := intSetting(fmt.Sprintf("ARCHIVE_%s_DAYS", strings.ToUpper(table)))
+		if days == 0 {
+			continue
+		}
+
+		total := 0
+		for {
+			moved, err := archiveBatch(ctx, db, table, days, batchSize)
+			if err != nil {
+				logger.Error().Err(err).Str("table", table).Msg("archiving rows failed")
+				break
+			}
+			total += moved
+			if moved < batchSize {
+				break
+			}
+		}
+
+		archivedRows.Add(table, int64(total))
+		if total > 0 {
+			logger.Info().Str("table", table).Int("rows", total).Msg("archived old rows")
+		}
+	}
+}
+
+// Moves up to batchSize of the table's oldest rows past days into its
+// archive, returning how many moved. Rows another instance is moving are
+// passed over.
+func archiveBatch(ctx context.Context, db *bun.DB, table string, days int, batchSize int) (int, error) {
+	moved := 0
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		ids := []string{}
+		err := forUpdate(tx.NewSelect().TableExpr("?", bun.Ident(table)), true).
+			Column("id").
+			Where(fmt.Sprintf("created_at < %s", daysAgo(tx, "?")), days).
+			OrderExpr("created_at ASC").
+			Limit(batchSize).
+			Scan(ctx, &ids)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO ? SELECT * FROM ? WHERE id IN (?)",
+			bun.Ident(table+"_archive"), bun.Ident(table), bun.In(ids))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().TableExpr("?", bun.Ident(table)).Where("id IN (?)", bun.In(ids)).Exec(ctx)
+		moved = len(ids)
+		return err
+	})
+	return moved, err
+}
+
+// Whether the table's old rows are moved to an archive table
+func isArchived(table string) bool {
+	return stringInSlice(table, archivedTables())
+}
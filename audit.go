@@ -0,0 +1,73 @@
+package goapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// AuditLog DB model
+type AuditLog struct {
+	bun.BaseModel `bun:"table:audit_logs"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Method string
+	Path string
+	Status int
+	IP string
+	RequestId string
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	AccountId uuid.UUID `bun:",type:uuid"` // has idx
+	ActorId uuid.UUID `bun:",type:uuid"` // who really made the request
+	UserId uuid.UUID `bun:",type:uuid"` // who the request was made as
+}
+
+// ====================
+//     Middleware
+// ====================
+
+// Records every change an authenticated user makes, and every request at all
+// made under impersonation, attributed to whoever is really behind it
+func auditRequests(c *fiber.Ctx, db *bun.DB) error {
+	err := c.Next()
+
+	user, ok := c.Locals("user").(*User)
+	if !ok {
+		return err
+	}
+
+	impersonated := user.ImpersonatorId != uuid.Nil
+	if c.Method() == fiber.MethodGet && !impersonated {
+		return err
+	}
+
+	entry := new(AuditLog)
+	entry.ID = newId()
+	entry.Method = c.Method()
+	entry.Path = c.Path()
+	entry.Status = responseStatus(c, err)
+	entry.IP = c.IP()
+	entry.RequestId = requestId(c)
+	entry.AccountId = user.AccountId
+	entry.UserId = user.ID
+	entry.ActorId = user.ID
+	if impersonated {
+		entry.ActorId = user.ImpersonatorId
+	}
+
+	// The request context is reused once the handler returns
+	log := requestLogger(c)
+	go func() {
+		ctx := context.Background()
+		_, err := db.NewInsert().Model(entry).Exec(ctx)
+		if err != nil {
+			log.Error().Err(err).Send()
+		}
+	}()
+
+	return err
+}
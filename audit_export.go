@@ -0,0 +1,299 @@
+package goapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// How many audit log entries are read from the DB at a time while exporting
+const auditExportBatchSize = 1000
+
+// Arbitrary key for the advisory lock that keeps instances from exporting at once
+const auditExportLockId = 7311
+
+// AuditExport DB model, one per NDJSON file written to storage
+type AuditExport struct {
+	bun.BaseModel `bun:"table:audit_exports"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Key string `json:"-"`
+	URL string `bun:"-" json:",omitempty"` // the API's download link, if it has entries
+	From time.Time
+	To time.Time
+	Count int
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	AccountId uuid.UUID `bun:",type:uuid"` // has idx
+}
+
+// ====================
+//        Setup
+// ====================
+
+func initAuditRoutes(api fiber.Router, db *bun.DB, store Storage) {
+	routes := api.Group("/audit-logs", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	})
+
+	routes.Get("/exports", permit(db, permissionAuditExport), func(c *fiber.Ctx) error {
+		return getAuditExports(c, db)
+	})
+
+	routes.Post("/exports", permit(db, permissionAuditExport), func(c *fiber.Ctx) error {
+		return createAuditExport(c, db, store)
+	})
+
+	routes.Get("/exports/:exportId/download", permit(db, permissionAuditExport), func(c *fiber.Ctx) error {
+		return downloadAuditExport(c, db, store)
+	})
+}
+
+// Exports every account's new audit log entries each AUDIT_EXPORT_INTERVAL_HOURS,
+// and removes exports older than AUDIT_EXPORT_RETENTION_DAYS. Off unless the interval is set.
+func startAuditExports(db *bun.DB, store Storage) {
+	hours, err := strconv.Atoi(os.Getenv("AUDIT_EXPORT_INTERVAL_HOURS"))
+	if err != nil || hours <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(hours) * time.Hour)
+		for range ticker.C {
+			runAuditExports(db, store)
+		}
+	}()
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func getAuditExports(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	exports := []AuditExport{}
+	err := db.NewSelect().Model(&exports).
+		Where("account_id = ?", currentUser.AccountId).
+		Order("to DESC").
+		Limit(100).
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return an empty array
+	}
+
+	for i := range exports {
+		exports[i].linkDownload(c)
+	}
+	return c.JSON(exports)
+}
+
+// The export's NDJSON file, for the account it belongs to
+func downloadAuditExport(c *fiber.Ctx, db *bun.DB, store Storage) error {
+	currentUser := c.Locals("user").(*User)
+
+	export := new(AuditExport)
+	err := db.NewSelect().Model(export).
+		Where("id = ?", c.Params("exportId")).
+		Where("account_id = ?", currentUser.AccountId).
+		Scan(c.UserContext())
+	if err != nil || export.Key == "" {
+		return notFound("export not found")
+	}
+
+	filename := fmt.Sprintf("audit-logs-%s.ndjson", export.To.UTC().Format("20060102T150405Z"))
+	return sendStoredFile(c, store, export.Key, "application/x-ndjson", filename)
+}
+
+// Exports the account's audit log between ?from and ?to (RFC 3339),
+// defaulting to everything since the last export
+func createAuditExport(c *fiber.Ctx, db *bun.DB, store Storage) error {
+	currentUser := c.Locals("user").(*User)
+
+	from := lastAuditExportTime(currentUser.AccountId, db)
+	to := time.Now()
+
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return badRequest("invalid from")
+		}
+		from = parsed
+	}
+
+	if value := c.Query("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return badRequest("invalid to")
+		}
+		to = parsed
+	}
+
+	if !from.Before(to) {
+		return badRequest("from must be before to")
+	}
+
+	export, err := exportAuditLogs(currentUser.AccountId, from, to, db, store)
+	if err != nil {
+		return internalError(err)
+	}
+	export.linkDownload(c)
+
+	return created(c, "", export)
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Exports each account's entries since its last export, then applies retention.
+// Only one instance does this at a time.
+func runAuditExports(db *bun.DB, store Storage) {
+	ctx := context.Background()
+
+	err := withAdvisoryLock(ctx, db, auditExportLockId, func() error {
+		accountIds := []uuid.UUID{}
+		err := db.NewSelect().Model((*Account)(nil)).Column("id").Scan(ctx, &accountIds)
+		if err != nil {
+			return err
+		}
+
+		to := time.Now()
+		for _, accountId := range accountIds {
+			from := lastAuditExportTime(accountId, db)
+			if _, err := exportAuditLogs(accountId, from, to, db, store); err != nil {
+				logger.Error().Err(err).Str("account_id", accountId.String()).Msg("audit export failed")
+			}
+		}
+
+		purgeAuditExports(db, store)
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+}
+
+// Writes the account's entries in [from, to) as NDJSON to storage.
+// Empty ranges are recorded without writing a file.
+func exportAuditLogs(accountId uuid.UUID, from time.Time, to time.Time, db *bun.DB, store Storage) (*AuditExport, error) {
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	count := 0
+	for offset := 0; ; offset += auditExportBatchSize {
+		entries := []AuditLog{}
+		err := db.NewSelect().Model(&entries).
+			Where("account_id = ?", accountId).
+			Where("created_at >= ?", from).
+			Where("created_at < ?", to).
+			Order("created_at ASC", "id ASC").
+			Limit(auditExportBatchSize).
+			Offset(offset).
+			Scan(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return nil, err
+			}
+		}
+		count += len(entries)
+
+		if len(entries) < auditExportBatchSize {
+			break
+		}
+	}
+
+	export := new(AuditExport)
+	export.ID = newId()
+	export.AccountId = accountId
+	export.From = from
+	export.To = to
+	export.Count = count
+
+	// Files are only handed out through the download route
+	if count > 0 {
+		export.Key = fmt.Sprintf("audit-logs/%s/%s-%s.ndjson", accountId, to.UTC().Format("20060102T150405Z"), export.ID)
+
+		if _, err := store.Put(export.Key, "application/x-ndjson", buf.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err := db.NewInsert().Model(export).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// Points the export at the route its file is downloaded from, if it has one
+func (e *AuditExport) linkDownload(c *fiber.Ctx) {
+	if e.Key != "" {
+		e.URL = apiPath(c, "/audit-logs/exports/"+e.ID.String()+"/download")
+	}
+}
+
+// Where the account's next export starts: the end of its last one, or the beginning
+func lastAuditExportTime(accountId uuid.UUID, db *bun.DB) time.Time {
+	ctx := context.Background()
+
+	export := new(AuditExport)
+	err := db.NewSelect().Model(export).
+		Where("account_id = ?", accountId).
+		Order("to DESC").
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return export.To
+}
+
+// Removes exports, and their files, older than AUDIT_EXPORT_RETENTION_DAYS
+func purgeAuditExports(db *bun.DB, store Storage) {
+	days, err := strconv.Atoi(os.Getenv("AUDIT_EXPORT_RETENTION_DAYS"))
+	if err != nil || days <= 0 {
+		return
+	}
+
+	ctx := context.Background()
+	exports := []AuditExport{}
+	err = db.NewSelect().Model(&exports).
+		Where("created_at < ?", time.Now().AddDate(0, 0, -days)).
+		Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	for _, export := range exports {
+		if export.Key != "" {
+			if err := store.Delete(export.Key); err != nil {
+				logger.Error().Err(err).Str("key", export.Key).Send()
+				continue
+			}
+		}
+
+		_, err := db.NewDelete().Model(&export).WherePK().Exec(ctx)
+		if err != nil {
+			logger.Error().Err(err).Send()
+		}
+	}
+}
@@ -1,15 +1,11 @@
-package main
+package goapi
 
 import (
 	"context"
-	"errors"
-	"fmt"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
 	"github.com/uptrace/bun"
 	"golang.org/x/crypto/bcrypt"
@@ -18,23 +14,52 @@ import (
 // Token DB model
 type Token struct {
 	bun.BaseModel `bun:"table:tokens"`
-	ID uuid.UUID `bun:",pk,type:uuid,default:gen_random_uuid()"`
-	Value string // has idx
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Value string // the token's digest, has unique idx
 	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 	
 	// Relations
 	UserId uuid.UUID `bun:",type:uuid"`
 	User *User `bun:"rel:belongs-to,join:user_id=id"`
+	ActorId uuid.UUID `bun:",type:uuid,nullzero"` // set on impersonation tokens
+}
+
+// Client-facing Token model, which leaves out the value
+type PublicToken struct {
+	ID uuid.UUID
+	Impersonated bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Fields a user registers with
+type RegisterInput struct {
+	Username string `validate:"required,min=3,max=32"`
+	Email string `validate:"omitempty,email,max=254"`
+	Password string `validate:"required,min=8,max=72"`
+	DisplayName string `validate:"max=100"`
+	Metadata map[string]interface{}
+}
+
+// Users log in with their username or their email
+type LoginInput struct {
+	Username string `validate:"required_without=Email,max=254"`
+	Email string `validate:"omitempty,email,max=254"`
+	Password string `validate:"required,max=72"`
+}
+
+// The /auth routes
+type authHandlers struct {
+	handlerDeps
 }
 
 // ====================
 //        Setup
 // ====================
 
-func initTokenTable(db *bun.DB) {
-	ctx := context.Background()
-	db.NewCreateTable().IfNotExists().Model((*Token)(nil)).Exec(ctx)
+func newAuthHandlers(deps handlerDeps) *authHandlers {
+	return &authHandlers{handlerDeps: deps}
 }
 
 var _ bun.BeforeAppendModelHook = (*Token)(nil)
@@ -46,310 +71,322 @@ func (t *Token) BeforeAppendModel(ctx context.Context, query bun.Query) error {
 	return nil
 }
 
-var _ bun.AfterCreateTableHook = (*Token)(nil)
-func (*Token) AfterCreateTable(ctx context.Context, query *bun.CreateTableQuery) error {
-	_, err := query.DB().NewCreateIndex().
-		Model((*Token)(nil)).
-		Index("value_idx").
-		IfNotExists().
-		Column("value").
-		Exec(ctx)
-	return err
-}
+func initAuthRoutes(api fiber.Router, h *authHandlers) {
+	routes := api.Group("/auth")
+
+	routes.Get("/", h.getCurrentUser)
+
+	routes.Patch("/", h.updatePassword)
 
-func initAuthRoutes(app *fiber.App, db *bun.DB) {
-	routes := app.Group("/api/v1/auth")
+	routes.Delete("/", h.logout)
 
-	routes.Get("/", func(c *fiber.Ctx) error {
-		return getCurrentUser(c, db)
-	})
+	routes.Delete("/impersonation", h.endImpersonation)
 
-	routes.Patch("/", func(c *fiber.Ctx) error {
-		return updatePassword(c, db)
-	})
+	routes = routes.Group("/", requireAccount(h.accounts, h.quotas))
 
-	routes.Delete("/", func(c *fiber.Ctx) error {
-		return logout(c, db)
-	})
+	routes.Post("/", idempotent(h.db), h.register)
 
-	routes = routes.Group("/", func(c *fiber.Ctx) error {
-		return requireAccount(c, db)
-	})
+	routes.Put("/", h.login)
 
-	routes.Post("/", func(c *fiber.Ctx) error {
-		return register(c, db)
-	})
+	routes.Post("/anonymous", idempotent(h.db), h.registerAnonymous)
 
-	routes.Put("/", func(c *fiber.Ctx) error {
-		return login(c, db)
-	})
+	routes.Post("/reset", h.createPasswordReset)
+
+	routes.Put("/reset", h.completePasswordReset)
 }
 
 // ====================
 //    Route Handlers
 // ====================
 
-func getCurrentUser(c *fiber.Ctx, db *bun.DB) error {
+func (h *authHandlers) getCurrentUser(c *fiber.Ctx) error {
 	tokenString := getTokenStringFromHeaders(c)
 
 	if tokenString == "" {
 		return c.JSON(nil)
 	}
 
-	user, err := getUserFromJwt(tokenString, db)
+	user, err := h.auth.Authenticate(c.UserContext(), tokenString)
 	if err != nil {
-		fmt.Println(err)
+		requestLogger(c).Error().Err(err).Send()
 		return c.JSON(nil)
 	}
 
-	return c.JSON(user.ToPublicUser())
+	return c.JSON(render(c, user.ToPublicUser()))
 }
 
-func updatePassword(c *fiber.Ctx, db *bun.DB) error {
+func (h *authHandlers) updatePassword(c *fiber.Ctx) error {
 	tokenString := getTokenStringFromHeaders(c)
 
 	if tokenString == "" {
-		return c.Status(401).JSON(fiber.Map{"message": "user not found"})
+		return unauthorized("user not found").WithCode(codeAuthUnauthorized)
 	}
 
-	currentUser, err := getUserFromJwt(tokenString, db)
+	currentUser, err := h.auth.Authenticate(c.UserContext(), tokenString)
 	if err != nil {
-		fmt.Println(err)
-		return c.Status(401).JSON(fiber.Map{"message": "user not found"})
+		requestLogger(c).Error().Err(err).Send()
+		return unauthorized("user not found").WithCode(codeAuthUnauthorized)
 	}
+	c.Locals("user", currentUser)
 
-	userInput := new(User)
-	if err := c.BodyParser(userInput); err != nil || userInput.NewPassword == "" {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "invalid input"})
+	if currentUser.ImpersonatorId != uuid.Nil {
+		return forbidden("cannot change password while impersonating")
 	}
 
-	match := checkPasswordHash(userInput.Password, currentUser.Password)
-	if !match {
-		return c.Status(400).JSON(fiber.Map{"message": "invalid old password"})
+	userInput := new(User)
+	if err := c.BodyParser(userInput); err != nil || userInput.NewPassword == "" {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
 	}
 
-	currentUser.Password, _ = hashPassword(userInput.NewPassword)
-	ctx := context.Background()
-	_, err = db.NewUpdate().Model(currentUser).Where("id = ?", currentUser.ID).Exec(ctx)
+	err = h.auth.ChangePassword(c.UserContext(), currentUser, userInput.Password, userInput.NewPassword)
 	if err != nil {
-		fmt.Println(err)
-		return c.Status(401).JSON(fiber.Map{"message": "something went wrong"})
+		return err
 	}
 
 	return c.JSON(fiber.Map{"success": true})
 }
 
-func logout(c *fiber.Ctx, db *bun.DB) error {
+func (h *authHandlers) logout(c *fiber.Ctx) error {
+	ctx := c.UserContext()
 	token := getTokenStringFromHeaders(c)
 	if token != "" {
 		// Go through the token verification process
 		// so that we can do nothing if invalid
-		_, err := getUserFromJwt(token, db)
+		user, err := h.auth.Authenticate(ctx, token)
 		if err == nil {
 			// At this point, we're clear to delete the token
-			ctx := context.Background()
-			_, err := db.NewDelete().Model(new(Token)).Where("value = ?", unsignToken(token)).Exec(ctx)
+			_, err := h.auth.Revoke(ctx, user, token, map[string]interface{}{"reason": "logout"})
 			if err != nil {
-				fmt.Println(err)
+				requestLogger(c).Error().Err(err).Send()
 			}
 		} else {
-			fmt.Println(err)
+			requestLogger(c).Error().Err(err).Send()
 		}
 	}
 
+	clearSessionCookie(c)
+
 	// So as not to enumerate, always return success
 	return c.JSON(fiber.Map{"success": true})
 }
 
-func register(c *fiber.Ctx, db *bun.DB) error {
-	user := new(User)
-	
-	if err := c.BodyParser(user); err != nil {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "invalid input"})
+func (h *authHandlers) register(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	input := new(RegisterInput)
+	if err := parseBody(c, input); err != nil {
+		return err
 	}
 
-	accountKey, err := getAccountKeyFromHeaders(c)
+	accountId, err := accountIdForRequest(c, h.accounts)
 	if err != nil {
-		fmt.Println(err)
-		return c.Status(401).JSON(fiber.Map{"message": "invalid account key"})
+		return err
 	}
 
-	key := new(Key)
-	ctx := context.Background()
-	err = db.NewSelect().Model(key).Where("id = ?", accountKey).Scan(ctx)
+	user, token, err := h.auth.Register(ctx, accountId, input)
 	if err != nil {
-		fmt.Println(err)
-		return c.Status(401).JSON(fiber.Map{"message": "invalid account key"})
+		return err
 	}
-
-	user.AccountId = key.AccountId
-	user.Role = ""
-	_, err = user.New(db)
-
-	if err != nil {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "invalid username or password"})
+	if err := issueSession(c, user, token); err != nil {
+		return internalError(err)
 	}
-
-	token, err := createJwt(user.ID, user.AccountId, db)
-	if err != nil {
-		fmt.Println(err)
-		// continue without a token
-		// return c.Status(400).JSON(fiber.Map{"message": "unable to create token"})
-	}
-	user.Token = token
 	
-	return c.JSON(user.ToPublicUser())
+	return created(c, apiPath(c, "/me"), render(c, user.ToPublicUser()))
 }
 
-func login(c * fiber.Ctx, db *bun.DB) error {
-	ctx := context.Background()
-	user := new(User)
-	
-	if err := c.BodyParser(user); err != nil {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "invalid input"})
+func (h *authHandlers) login(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	input := new(LoginInput)
+	if err := parseBody(c, input); err != nil {
+		return err
 	}
 
-	accountKey, err := getAccountKeyFromHeaders(c)
+	accountId, err := accountIdForRequest(c, h.accounts)
 	if err != nil {
-		fmt.Println(err)
-		return c.Status(401).JSON(fiber.Map{"message": "invalid account key"})
+		return err
 	}
 
-	key := new(Key)
-	err = db.NewSelect().Model(key).Where("id = ?", accountKey).Scan(ctx)
+	found, token, err := h.auth.Login(ctx, accountId, input, requestLoginOrigin(c))
 	if err != nil {
-		fmt.Println(err)
-		return c.Status(401).JSON(fiber.Map{"message": "invalid account key"})
+		return err
 	}
-
-	found := new(User)
-	db.NewSelect().Model(found).Where("username = ?", user.Username).
-		Where("account_id = ?", key.AccountId).Scan(ctx)
-
-	match := checkPasswordHash(user.Password, found.Password)
-	if !match || found.Password == "" {
-		return c.Status(400).JSON(fiber.Map{"message": "invalid username or password"})
+	if err := issueSession(c, found, token); err != nil {
+		return internalError(err)
 	}
 
-	token, err := createJwt(found.ID, found.AccountId, db)
-	if err != nil {
-		fmt.Println(err)
-		// continue without a token
-		// return c.Status(400).JSON(fiber.Map{"message": "unable to create token"})
-	}
-	found.Token = token
+	publicUser := found.ToPublicUser()
+	publicUser.PendingConsents = pendingConsents(ctx, found, h.db)
 
-	return c.JSON(found.ToPublicUser())
+	return c.JSON(render(c, publicUser))
 }
 
 // ====================
 //     Middleware
 // ====================
 
-func requireAdmin(c * fiber.Ctx, db *bun.DB) error {
+// Requires a valid token and makes the user available as c.Locals("user")
+func requireUser(c *fiber.Ctx, db *bun.DB) error {
+	return authenticated(newAuthService(db), newQuotaService(db))(c)
+}
+
+// requireUser, for handler structs given their AuthService
+func authenticated(auth *AuthService, quotas *QuotaService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tokenString := getTokenStringFromHeaders(c)
+		if tokenString == "" {
+			return unauthorized("unauthorized").WithCode(codeAuthUnauthorized)
+		}
+
+		user, err := auth.Authenticate(c.UserContext(), tokenString)
+		if err != nil {
+			requestLogger(c).Error().Err(err).Send()
+			return unauthorized("unauthorized").WithCode(codeAuthUnauthorized)
+		}
+
+		setRequestUser(c, user)
+		if err := meterRequest(c, quotas, user.AccountId); err != nil {
+			return err
+		}
+		return c.Next()
+	}
+}
+
+// Requires a valid token for a user whose role is minRole or inherits from it
+func requireRole(c *fiber.Ctx, db *bun.DB, minRole string) error {
+	ctx := c.UserContext()
 	tokenString := getTokenStringFromHeaders(c)
 	if tokenString == "" {
-		return c.Status(400).JSON(fiber.Map{ "message": "no token provided" })
+		return badRequest("no token provided")
 	}
 
-	user, err := getUserFromJwt(tokenString, db)
+	user, err := newAuthService(db).Authenticate(ctx, tokenString)
 	if err != nil {
-		fmt.Println(err)
-		return c.Status(401).JSON(fiber.Map{ "message": "unauthorized" })
+		requestLogger(c).Error().Err(err).Send()
+		return unauthorized("unauthorized").WithCode(codeAuthUnauthorized)
 	}
 
-	if !stringInSlice(user.Role, adminRoles()) {
-		return c.Status(401).JSON(fiber.Map{ "message": "unauthorized" })
+	if !userHasRole(ctx, user, minRole, db) {
+		return forbidden("forbidden").WithCode(codeAuthForbidden)
 	}
 
+	setRequestUser(c, user)
+	if err := meterRequest(c, newQuotaService(db), user.AccountId); err != nil {
+		return err
+	}
 	return c.Next()
 }
 
-// ====================
-//      Utilities
-// ====================
-
-func createJwt(userId uuid.UUID, accountId uuid.UUID, db *bun.DB) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"uid": userId,
-		"aid": accountId,
-		"iss": time.Now().Unix(),
-		"exp": time.Now().Add(time.Hour*24*14).Unix(),
-	})
-	
-	hmacSampleSecret := []byte(os.Getenv("JWT_SECRET"))
+// Requires the user set by requireUser to have a permission
+func requirePermission(c *fiber.Ctx, db *bun.DB, permission string) error {
+	user, ok := c.Locals("user").(*User)
+	if !ok {
+		return unauthorized("unauthorized").WithCode(codeAuthUnauthorized)
+	}
 
-	// Sign and get the complete encoded token as a string using the secret
-	tokenString, err := token.SignedString(hmacSampleSecret)
-	if err != nil {
-		return "", err
+	if !userHasPermission(c.UserContext(), user, permission, db) {
+		return forbidden("forbidden").WithCode(codeAuthForbidden)
 	}
 
-	ctx := context.Background()
+	return c.Next()
+}
 
-	tokenRecord := new(Token)
-	tokenRecord.Value = unsignToken(tokenString)
-	tokenRecord.ID = uuid.New()
-	tokenRecord.UserId = userId
+// A route handler requiring a permission, for use after requireUser. The
+// permission is a default that deployments and accounts can override per route.
+func permit(db *bun.DB, permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, ok := c.Locals("user").(*User)
+		if !ok {
+			return unauthorized("unauthorized").WithCode(codeAuthUnauthorized)
+		}
 
-	go db.NewInsert().Model(tokenRecord).Exec(ctx)
+		if !userSatisfiesRule(c.UserContext(), user, routeRule(c, user, permission, db), db) {
+			return forbidden("forbidden").WithCode(codeAuthForbidden)
+		}
 
-	return tokenString, nil
+		return c.Next()
+	}
 }
 
-func unsignToken(token string) string {
-	pieces := strings.Split(token, ".")
-	return strings.Join([]string{pieces[0], pieces[1]}, ".")
+// ====================
+//      Utilities
+// ====================
+
+func (token *Token) ToPublicToken() PublicToken {
+	return PublicToken{
+		ID: token.ID,
+		Impersonated: token.ActorId != uuid.Nil,
+		CreatedAt: token.CreatedAt,
+		UpdatedAt: token.UpdatedAt,
+	}
 }
 
-func getUserFromJwt(tokenString string, db *bun.DB) (*User, error) {
-	ctx := context.Background()
+// The account an Account-Key belongs to, given the fingerprint of the
+// verified client certificate it came with, or ""
+func accountIdForKey(ctx context.Context, key string, certificate string, accounts *AccountService) (uuid.UUID, error) {
+	secret, err := uuid.Parse(key)
+	if err != nil {
+		return uuid.Nil, unauthorized("invalid account key").WithCode(codeAccountKeyInvalid)
+	}
 
-	tokenObj := new(Token)
-	err := db.NewSelect().Model(tokenObj).Where("value = ?", unsignToken(tokenString)).Scan(ctx)
+	accountId, err := accounts.AccountForKey(ctx, secret, certificate)
 	if err != nil {
-		fmt.Println(err)
-		return nil, err
+		logger.Debug().Err(err).Send()
+		return uuid.Nil, unauthorized("invalid account key").WithCode(codeAccountKeyInvalid)
 	}
 
-	hmacSampleSecret := []byte(os.Getenv("JWT_SECRET"))
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
+	return accountId, nil
+}
 
-		return hmacSampleSecret, nil
-	})
+// The account a request is for by its Account-Key or, without one, by
+// the key its client certificate is bound to
+func accountIdForRequest(c *fiber.Ctx, accounts *AccountService) (uuid.UUID, error) {
+	ctx := c.UserContext()
+	certificate := clientCertificate(c)
+	if c.Get("Account-Key") != "" || certificate == "" {
+		return accountIdForKey(ctx, c.Get("Account-Key"), certificate, accounts)
+	}
 
+	accountId, err := accounts.AccountForCertificate(ctx, certificate)
 	if err != nil {
-		return nil, err
+		logger.Debug().Err(err).Send()
+		return uuid.Nil, unauthorized("invalid account key").WithCode(codeAccountKeyInvalid)
 	}
+	return accountId, nil
+}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		
-		user := new(User)
-		err := db.NewSelect().Model(user).Where("id = ?", claims["uid"]).Where("account_id = ?", claims["aid"]).Scan(ctx)
-		if err != nil {
-			return nil, err
-		}
+func (input *RegisterInput) ToUser() *User {
+	user := new(User)
+	user.Username = input.Username
+	user.Email = input.Email
+	user.Password = input.Password
+	user.DisplayName = input.DisplayName
+	user.Metadata = input.Metadata
+	return user
+}
 
-		user.Token = tokenString
-		return user, nil
-	}
+func unsignToken(token string) string {
+	pieces := strings.Split(token, ".")
+	return strings.Join([]string{pieces[0], pieces[1]}, ".")
+}
 
-	return nil, errors.New("invalid token")
+// What a token is stored and looked up by. Only the digest is kept, so
+// the tokens table holds nothing that could be signed in with.
+func tokenDigest(token string) string {
+	return hashSecret(unsignToken(token))
 }
 
 func hashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
 	return string(bytes), err
 }
 
+// Checks a password against its stored hash, which is bcrypt unless it
+// was imported in another format
 func checkPasswordHash(password, hash string) bool {
+	if strings.HasPrefix(hash, passwordFormatFirebaseScrypt+"$") {
+		return checkFirebaseScryptHash(password, hash)
+	}
+
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
@@ -358,7 +395,8 @@ func getTokenStringFromHeaders(c *fiber.Ctx) string {
 	headers := c.GetReqHeaders()
 	bearerToken := headers["Authorization"]
 	if bearerToken == "" {
-		return ""
+		// Browser apps in cookie mode send the session cookie instead
+		return c.Cookies(sessionCookieName)
 	}
 
 	pieces := strings.Split(bearerToken, " ")
@@ -0,0 +1,125 @@
+package goapi
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// An authorization question about a user in the caller's account
+type AuthzCheckInput struct {
+	Subject uuid.UUID // defaults to the caller
+	Action string
+	Resource string
+}
+
+// The answer and the role permission that decided it
+type AuthzDecision struct {
+	Allow bool
+	Role string `json:",omitempty"`
+	Rule string `json:",omitempty"`
+}
+
+// ====================
+//        Setup
+// ====================
+
+func initAuthzRoutes(api fiber.Router, db *bun.DB) {
+	routes := api.Group("/authz", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	})
+
+	routes.Post("/check", func(c *fiber.Ctx) error {
+		return checkAuthz(c, db)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Decides whether the subject may perform the action on the resource.
+// Asking about anyone but yourself needs the authz.check permission.
+func checkAuthz(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(AuthzCheckInput)
+	if err := c.BodyParser(input); err != nil || input.Action == "" {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	subject := currentUser
+	if input.Subject != uuid.Nil && input.Subject != currentUser.ID {
+		if !userHasPermission(ctx, currentUser, permissionAuthzCheck, db) {
+			return forbidden("forbidden").WithCode(codeAuthForbidden)
+		}
+
+		subject = new(User)
+		err := db.NewSelect().Model(subject).
+			Where("id = ?", input.Subject).
+			Where("account_id = ?", currentUser.AccountId).
+			Scan(ctx)
+		if err != nil {
+			requestLogger(c).Error().Err(err).Send()
+			return notFound("user not found").WithCode(codeUserNotFound)
+		}
+	}
+
+	if !subject.IsActive() {
+		return c.JSON(AuthzDecision{Allow: false, Rule: "user suspended"})
+	}
+
+	return c.JSON(authorize(ctx, subject, input.Action, input.Resource, db))
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Consults the account's policy first, if it has one, and then the user's roles
+func authorize(ctx context.Context, user *User, action string, resource string, db *bun.DB) AuthzDecision {
+	if decision, ok := enforcePolicy(ctx, policyEnforcer(user.AccountId, db), user, action, resource, db); ok {
+		return decision
+	}
+	return authorizeByRole(ctx, user, action, resource, db)
+}
+
+// Walks the user's roles, including those from groups, for the first
+// permission granting the action on the resource
+func authorizeByRole(ctx context.Context, user *User, action string, resource string, db *bun.DB) AuthzDecision {
+	for _, role := range userRoles(ctx, user, db) {
+		for _, permission := range role.Permissions {
+			if permissionMatches(permission, action, resource) {
+				return AuthzDecision{Allow: true, Role: role.Name, Rule: permission}
+			}
+		}
+	}
+	return AuthzDecision{Allow: false}
+}
+
+// Permissions are "action" or "action:resource", where the action may end in
+// ".*" to cover a namespace and "*" stands for anything. Permissions without
+// a resource apply to every resource.
+func permissionMatches(permission string, action string, resource string) bool {
+	pattern, resourcePattern := permission, "*"
+	if i := strings.Index(permission, ":"); i >= 0 {
+		pattern, resourcePattern = permission[:i], permission[i+1:]
+	}
+
+	if resourcePattern != "*" && resourcePattern != resource {
+		return false
+	}
+
+	switch {
+		case pattern == permissionAll || pattern == action:
+			return true
+		case strings.HasSuffix(pattern, ".*"):
+			return strings.HasPrefix(action, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package goapi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"golang.org/x/image/draw"
+)
+
+const (
+	maxAvatarBytes = 2 * 1024 * 1024
+	avatarSize = 256
+
+	// Small files can declare huge images, so they're checked before decoding
+	maxAvatarPixels = 4096 * 4096
+)
+
+var errAvatarTooLarge = errors.New("avatar dimensions too large")
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Accepts a multipart "avatar" image, scales it down, and stores it as a PNG
+func uploadAvatar(c *fiber.Ctx, db *bun.DB, store Storage) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	header, err := c.FormFile("avatar")
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("no avatar provided")
+	}
+
+	if header.Size > maxAvatarBytes {
+		return badRequest("avatar must be 2MB or smaller")
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid avatar")
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid avatar")
+	}
+
+	avatar, err := resizeAvatar(data)
+	if errors.Is(err, errAvatarTooLarge) {
+		return badRequest("avatar must be 16 megapixels or smaller")
+	}
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("avatar must be a PNG, JPEG, or GIF image")
+	}
+
+	key := fmt.Sprintf("avatars/%s-%s.png", currentUser.ID, uuid.New())
+	url, err := store.Put(key, "image/png", avatar)
+	if err != nil {
+		return internalError(err)
+	}
+
+	oldURL := currentUser.AvatarURL
+	currentUser.AvatarURL = url
+	currentUser.UpdatedAt = time.Now()
+	_, err = db.NewUpdate().Model(currentUser).Column("avatar_url", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	forgetUserTokens(currentUser.ID)
+
+	if oldKey := avatarKey(store, currentUser.ID, oldURL); oldKey != "" {
+		log := requestLogger(c)
+		go func() {
+			if err := store.Delete(oldKey); err != nil {
+				log.Error().Err(err).Send()
+			}
+		}()
+	}
+
+	return c.JSON(render(c, currentUser.ToPublicUser()))
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// The key of a user's avatar, or "" if the URL isn't one of theirs
+func avatarKey(store Storage, userId uuid.UUID, url string) string {
+	key := store.KeyFromURL(url)
+	if !strings.HasPrefix(key, fmt.Sprintf("avatars/%s-", userId)) {
+		return ""
+	}
+	return key
+}
+
+// Decodes an image and fits it within avatarSize x avatarSize, encoded as PNG
+func resizeAvatar(data []byte) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width * config.Height > maxAvatarPixels {
+		return nil, errAvatarTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("empty image")
+	}
+
+	if width > avatarSize || height > avatarSize {
+		if width > height {
+			height = height * avatarSize / width
+			width = avatarSize
+		} else {
+			width = width * avatarSize / height
+			height = avatarSize
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	buffer := new(bytes.Buffer)
+	if err := png.Encode(buffer, dst); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
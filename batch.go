@@ -0,0 +1,148 @@
+package goapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/uptrace/bun"
+	"github.com/valyala/fasthttp"
+)
+
+// One request within a batch. Paths are under the batch's version unless
+// they start with /api/, e.g. {"Method": "PATCH", "Path": "/users/<id>",
+// "Body": {"Role": "admin"}}
+type BatchRequest struct {
+	Method string
+	Path string
+	Body json.RawMessage
+}
+
+// What one request in a batch answered. JSON bodies are inlined, and
+// anything else is sent as a string.
+type BatchResult struct {
+	Status int
+	Location string `json:",omitempty"`
+	Body interface{} `json:",omitempty"`
+}
+
+// Headers every request in a batch shares with the batch itself
+var batchSharedHeaders = []string{
+	fiber.HeaderAuthorization,
+	fiber.HeaderCookie,
+	fiber.HeaderAccept,
+	fiber.HeaderAcceptLanguage,
+	fiber.HeaderXRequestID,
+	"Account-Key",
+	csrfHeaderName,
+}
+
+// ====================
+//        Setup
+// ====================
+
+func initBatchRoutes(api fiber.Router, app *fiber.App, db *bun.DB) {
+	api.Post("/batch", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	}, func(c *fiber.Ctx) error {
+		return runBatch(c, app)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Runs each request in order through the whole app, with the caller's
+// credentials, and answers 200 with every result. Each request is
+// authorized on its own, so one failing doesn't stop the rest.
+func runBatch(c *fiber.Ctx, app *fiber.App) error {
+	requests := []BatchRequest{}
+	if err := json.Unmarshal(c.Body(), &requests); err != nil {
+		requestLogger(c).Debug().Err(err).Send()
+		return badRequest("batch must be an array of requests").WithCode(codeInvalidInput)
+	}
+
+	limit := intSetting("BATCH_MAX_REQUESTS")
+	if len(requests) == 0 || len(requests) > limit {
+		return badRequest(fmt.Sprintf("batch must have between 1 and %d requests", limit)).WithCode(codeInvalidInput)
+	}
+
+	methods := []string{fiber.MethodGet, fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete}
+	for i := range requests {
+		request := &requests[i]
+		request.Method = strings.ToUpper(request.Method)
+		if !stringInSlice(request.Method, methods) {
+			return badRequest(fmt.Sprintf("request %d has an invalid method", i)).WithCode(codeInvalidInput)
+		}
+
+		if !strings.HasPrefix(request.Path, "/") {
+			return badRequest(fmt.Sprintf("request %d has an invalid path", i)).WithCode(codeInvalidInput)
+		}
+		if !strings.HasPrefix(request.Path, mountPrefix+"/api/") {
+			request.Path = apiPath(c, request.Path)
+		}
+		if isBatchPath(request.Path) {
+			return badRequest(fmt.Sprintf("request %d cannot be a batch", i)).WithCode(codeInvalidInput)
+		}
+	}
+
+	handler := app.Handler()
+	results := make([]BatchResult, 0, len(requests))
+	for _, request := range requests {
+		results = append(results, runBatchRequest(c, handler, request))
+	}
+
+	return c.JSON(results)
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func runBatchRequest(c *fiber.Ctx, handler fasthttp.RequestHandler, request BatchRequest) BatchResult {
+	req := new(fasthttp.Request)
+	req.Header.SetMethod(request.Method)
+	req.SetRequestURI(request.Path)
+	for _, name := range batchSharedHeaders {
+		if value := c.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	if len(request.Body) > 0 && string(request.Body) != "null" {
+		req.Header.SetContentType(fiber.MIMEApplicationJSON)
+		req.SetBody(request.Body)
+	}
+
+	sub := new(fasthttp.RequestCtx)
+	sub.Init(req, c.Context().RemoteAddr(), nil)
+	handler(sub)
+
+	response := &sub.Response
+	result := BatchResult{
+		Status: response.StatusCode(),
+		Location: string(response.Header.Peek(fiber.HeaderLocation)),
+	}
+
+	body := response.Body()
+	if len(body) == 0 {
+		return result
+	}
+	if json.Valid(body) {
+		result.Body = json.RawMessage(append([]byte(nil), body...))
+	} else {
+		result.Body = string(body)
+	}
+	return result
+}
+
+// Whether a path is a batch, which can't be nested
+func isBatchPath(path string) bool {
+	for _, version := range apiVersions() {
+		if strings.EqualFold(strings.TrimRight(strings.SplitN(path, "?", 2)[0], "/"), versionPrefix(version)+"/batch") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package goapi
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/uptrace/bun"
+)
+
+// Watches the primary database's queries and, once
+// DATABASE_BREAKER_FAILURES in a row fail to reach it, opens: requests
+// are turned away with a 503 at once rather than each waiting on a
+// database that isn't there. After DATABASE_BREAKER_COOLDOWN_SECONDS one
+// request is let through to try it, closing the breaker if it's answered
+// and keeping it open for another cooldown if not. Background workers
+// aren't held back, and their queries count the same.
+type circuitBreaker struct {
+	mutex sync.Mutex
+	failures int
+	open bool
+	openedAt time.Time
+	trips int64
+}
+
+var _ bun.QueryHook = (*circuitBreaker)(nil)
+
+var databaseBreaker = new(circuitBreaker)
+
+func init() {
+	expvar.Publish("database_breaker", expvar.Func(func() interface{} {
+		return databaseBreaker.stats()
+	}))
+}
+
+// ====================
+//        Setup
+// ====================
+
+// /readyz answers 200 while the database does, for load balancers and
+// orchestrators. It's registered ahead of the breaker, which it reports on.
+func initReadinessRoutes(router fiber.Router, db *bun.DB) {
+	router.Get("/readyz", func(c *fiber.Ctx) error {
+		return getReadiness(c, db)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func getReadiness(c *fiber.Ctx, db *bun.DB) error {
+	if !databaseBreaker.allow() {
+		return databaseUnavailable(nil)
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), 2*time.Second)
+	defer cancel()
+	err := db.PingContext(ctx)
+	databaseBreaker.record(err)
+	if err != nil {
+		return databaseUnavailable(err)
+	}
+
+	return c.JSON(fiber.Map{"status": "ready", "database": databaseBreaker.stats()})
+}
+
+// ====================
+//     Middleware
+// ====================
+
+// Turns requests away while the breaker is open
+func checkDatabaseBreaker(c *fiber.Ctx) error {
+	if !databaseBreaker.allow() {
+		return databaseUnavailable(nil)
+	}
+	return c.Next()
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Whether a request may use the database. While the breaker is open, the
+// first request after each cooldown is let through to try it.
+func (b *circuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.open {
+		return true
+	}
+	if time.Since(b.openedAt) < breakerCooldown() {
+		return false
+	}
+	b.openedAt = time.Now()
+	return true
+}
+
+// Counts a query's result. Only failing to reach the database counts
+// against it; any other error means it answered, except running out of
+// time, which says neither.
+func (b *circuitBreaker) record(err error) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	threshold := intSetting("DATABASE_BREAKER_FAILURES")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err == nil || !isConnectionError(err) {
+		b.failures = 0
+		if b.open {
+			b.open = false
+			logger.Info().Msg("database reachable again, closing the circuit breaker")
+		}
+		return
+	}
+
+	b.failures++
+	if b.open {
+		b.openedAt = time.Now()
+		return
+	}
+	if threshold > 0 && b.failures >= threshold {
+		b.open = true
+		b.openedAt = time.Now()
+		b.trips++
+		logger.Error().Err(err).Int("failures", b.failures).Msg("database unreachable, opening the circuit breaker")
+	}
+}
+
+// How long until the breaker lets a request try the database, rounded up
+// to whole seconds for Retry-After
+func (b *circuitBreaker) retryAfter() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	wait := breakerCooldown()
+	if b.open {
+		wait -= time.Since(b.openedAt)
+	}
+	return int(math.Max(1, math.Ceil(wait.Seconds())))
+}
+
+// The breaker's state, for /readyz and /debug/vars
+func (b *circuitBreaker) stats() interface{} {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	state := "closed"
+	if b.open {
+		state = "open"
+	}
+	stats := map[string]interface{}{"breaker": state, "failures": b.failures, "trips": b.trips}
+	if b.open {
+		stats["opened_at"] = b.openedAt
+	}
+	return stats
+}
+
+func (b *circuitBreaker) BeforeQuery(ctx context.Context, event *bun.QueryEvent) context.Context {
+	return ctx
+}
+
+func (b *circuitBreaker) AfterQuery(ctx context.Context, event *bun.QueryEvent) {
+	b.record(event.Err)
+}
+
+func breakerCooldown() time.Duration {
+	return time.Duration(intSetting("DATABASE_BREAKER_COOLDOWN_SECONDS")) * time.Second
+}
+
+// The 503 for a database that can't be reached, with Retry-After set by
+// errorHandler
+func databaseUnavailable(err error) *AppError {
+	return &AppError{Status: fiber.StatusServiceUnavailable, Code: codeDatabaseUnavailable, Message: "the database is unavailable", Err: err}
+}
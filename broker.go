@@ -0,0 +1,129 @@
+package goapi
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// Where events are published for streaming consumers, besides webhooks
+type EventBroker interface {
+	// Publishes the events in order, returning once the broker has them
+	Publish(ctx context.Context, events []Event) error
+}
+
+// An event as it's published. SchemaVersion changes only when a field is
+// renamed, removed, or changes meaning; new fields are added without it.
+type EventMessage struct {
+	SchemaVersion int
+	Event
+}
+
+// Publishes each event to the subject <topic>.<type>, e.g.
+// goapi.events.login.failed, so consumers may subscribe to goapi.events.>
+// or to a single type
+type NatsBroker struct {
+	Topic string
+	conn *nats.Conn
+}
+
+// Publishes every event to one topic, keyed by account so each account's
+// events stay in order
+type KafkaBroker struct {
+	writer *kafka.Writer
+}
+
+const eventSchemaVersion = 1
+
+// ====================
+//        Setup
+// ====================
+
+// Picks the broker from EVENT_BROKER ("nats" or "kafka"), or none when
+// it's unset. EVENT_BROKER_URL is the NATS server URL or the comma
+// separated Kafka brokers, and EVENT_BROKER_TOPIC names where events go.
+func initBroker() EventBroker {
+	url := os.Getenv("EVENT_BROKER_URL")
+	topic := os.Getenv("EVENT_BROKER_TOPIC")
+
+	switch os.Getenv("EVENT_BROKER") {
+		case "nats":
+			conn, err := nats.Connect(url, nats.Name("goapi"), nats.MaxReconnects(-1))
+			if err != nil {
+				logger.Fatal().Err(err).Msg("connecting to NATS failed")
+			}
+			return &NatsBroker{Topic: topic, conn: conn}
+
+		case "kafka":
+			return &KafkaBroker{
+				writer: &kafka.Writer{
+					Addr: kafka.TCP(strings.Split(url, ",")...),
+					Topic: topic,
+					Balancer: &kafka.Hash{},
+					RequiredAcks: kafka.RequireAll,
+					BatchTimeout: 10 * time.Millisecond,
+				},
+			}
+
+		default:
+			return nil
+	}
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Each message carries the event id as Nats-Msg-Id, so a JetStream stream
+// on the subjects drops the duplicates a retried dispatch may send
+func (b *NatsBroker) Publish(ctx context.Context, events []Event) error {
+	for i := range events {
+		data, err := json.Marshal(newEventMessage(&events[i]))
+		if err != nil {
+			return err
+		}
+
+		msg := nats.NewMsg(b.Topic + "." + events[i].Type)
+		msg.Data = data
+		msg.Header.Set(nats.MsgIdHdr, events[i].ID.String())
+		msg.Header.Set("Schema-Version", strconv.Itoa(eventSchemaVersion))
+		if err := b.conn.PublishMsg(msg); err != nil {
+			return err
+		}
+	}
+
+	// Only report success once the server has every message
+	return b.conn.FlushWithContext(ctx)
+}
+
+func (b *KafkaBroker) Publish(ctx context.Context, events []Event) error {
+	messages := []kafka.Message{}
+	for i := range events {
+		data, err := json.Marshal(newEventMessage(&events[i]))
+		if err != nil {
+			return err
+		}
+
+		messages = append(messages, kafka.Message{
+			Key: []byte(events[i].AccountId.String()),
+			Value: data,
+			Headers: []kafka.Header{
+				{Key: "event-id", Value: []byte(events[i].ID.String())},
+				{Key: "event-type", Value: []byte(events[i].Type)},
+				{Key: "schema-version", Value: []byte(strconv.Itoa(eventSchemaVersion))},
+			},
+		})
+	}
+
+	return b.writer.WriteMessages(ctx, messages...)
+}
+
+func newEventMessage(event *Event) *EventMessage {
+	return &EventMessage{SchemaVersion: eventSchemaVersion, Event: *event}
+}
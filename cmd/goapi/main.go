@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/joho/godotenv"
+
+	"goapi"
+)
+
+func main() {
+	// Settings may come from the environment alone, so .env is optional
+	err := godotenv.Load()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Error loading .env file:", err)
+		os.Exit(1)
+	}
+	if err := goapi.LoadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+			case "seed":
+				seed(os.Args[2:])
+				return
+			case "migrate":
+				migrate(os.Args[2:])
+				return
+		}
+	}
+
+	app := fiber.New(goapi.ServerConfig())
+	db := goapi.OpenDB()
+
+	// With prefork the first process migrates, runs the workers, and serves
+	// gRPC, and the ones it starts only serve HTTP
+	child := fiber.IsChild()
+	goapi.Mount(app, db, goapi.Config{SkipWorkers: child, SkipMigrations: child})
+	if !child {
+		goapi.ServeGrpc(db)
+	}
+
+	goapi.Logger().Fatal().Err(goapi.Listen(app)).Send()
+}
+
+// goapi seed [-users 25] [-name Demo] [-password password] [-seed 1]
+// creates a demo account and prints what's needed to use it
+func seed(args []string) {
+	options := goapi.SeedOptions{}
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	flags.IntVar(&options.Users, "users", 25, "how many fake users to create")
+	flags.StringVar(&options.AccountName, "name", "Demo", "the account's name")
+	flags.StringVar(&options.Password, "password", "password", "every user's password")
+	flags.Int64Var(&options.RandomSeed, "seed", 1, "the same seed makes the same users")
+	flags.Parse(args)
+
+	result, err := goapi.Seed(goapi.OpenDB(), options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(result)
+}
+
+// goapi migrate [up|down|status] applies the migrations not yet applied,
+// undoes the last group applied, or lists them all
+func migrate(args []string) {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	db := goapi.OpenDB()
+	var err error
+	switch command {
+		case "up":
+			err = goapi.Migrate(db)
+		case "down":
+			err = goapi.Rollback(db)
+		case "status":
+			var statuses []goapi.MigrationStatus
+			statuses, err = goapi.MigrationStatuses(db)
+			for _, status := range statuses {
+				applied := "pending"
+				if status.Applied {
+					applied = "applied " + status.MigratedAt.Format(time.RFC3339)
+				}
+				fmt.Printf("%s  %s\n", status.Name, applied)
+			}
+		default:
+			err = fmt.Errorf("unknown migrate command %q, expected up, down, or status", command)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,72 @@
+package goapi
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// ====================
+//      Middleware
+// ====================
+
+// Compresses JSON responses of at least COMPRESSION_MIN_BYTES (default
+// 1024) with the first of COMPRESSION_ENCODINGS (default "br,gzip") the
+// client accepts. COMPRESSION_ENCODINGS=none turns compression off.
+func compressResponses(c *fiber.Ctx) error {
+	err := c.Next()
+
+	response := c.Response()
+	if response.IsBodyStream() || len(response.Header.Peek(fiber.HeaderContentEncoding)) > 0 {
+		return err
+	}
+	if !strings.HasPrefix(string(response.Header.ContentType()), fiber.MIMEApplicationJSON) &&
+		!strings.HasPrefix(string(response.Header.ContentType()), "application/problem+json") {
+		return err
+	}
+
+	minBytes, parseErr := strconv.Atoi(os.Getenv("COMPRESSION_MIN_BYTES"))
+	if parseErr != nil || minBytes < 0 {
+		minBytes = 1024
+	}
+	if len(response.Body()) < minBytes {
+		return err
+	}
+
+	c.Vary(fiber.HeaderAcceptEncoding)
+
+	for _, encoding := range compressionEncodings() {
+		if !c.Context().Request.Header.HasAcceptEncoding(encoding) {
+			continue
+		}
+
+		switch encoding {
+			case "br":
+				response.SetBodyRaw(fasthttp.AppendBrotliBytesLevel(nil, response.Body(), fasthttp.CompressBrotliDefaultCompression))
+			case "gzip":
+				response.SetBodyRaw(fasthttp.AppendGzipBytesLevel(nil, response.Body(), fasthttp.CompressDefaultCompression))
+		}
+		response.Header.Set(fiber.HeaderContentEncoding, encoding)
+		break
+	}
+
+	return err
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func compressionEncodings() []string {
+	value := os.Getenv("COMPRESSION_ENCODINGS")
+	if value == "" {
+		return []string{"br", "gzip"}
+	}
+	if value == "none" {
+		return []string{}
+	}
+	return splitList(strings.ToLower(value))
+}
@@ -0,0 +1,426 @@
+package goapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// An environment variable the app reads, how to check it, and its default
+type setting struct {
+	Name string
+	Required bool
+	Default string
+	// Returns why the value is invalid, or nil. Only called for non-empty values.
+	Validate func(value string) error
+}
+
+// ====================
+//        Setup
+// ====================
+
+// Every setting with a rule or a default. Anything not listed is optional
+// and read as is where it's used.
+func settings() []setting {
+	return []setting{
+		{Name: "APP_ENV", Default: "production"},
+		{Name: "PORT", Default: "8080", Validate: validatePort},
+		{Name: "GRPC_PORT", Validate: validatePort},
+		{Name: "BODY_LIMIT_BYTES", Default: "4194304", Validate: validatePositiveInt},
+		{Name: "HEADER_LIMIT_BYTES", Default: "8192", Validate: validatePositiveInt},
+		{Name: "READ_TIMEOUT_SECONDS", Default: "15", Validate: validatePositiveInt},
+		{Name: "WRITE_TIMEOUT_SECONDS", Default: "60", Validate: validatePositiveInt},
+		{Name: "IDLE_TIMEOUT_SECONDS", Default: "120", Validate: validatePositiveInt},
+		{Name: "SERVER_PREFORK", Default: "false", Validate: validateOneOf("true", "false")},
+		{Name: "SERVER_CONCURRENCY", Default: "262144", Validate: validatePositiveInt},
+		{Name: "PROXY_HEADER"},
+		{Name: "TRUSTED_PROXIES", Validate: validateProxies},
+		{Name: "TLS_CERT_FILE"},
+		{Name: "TLS_KEY_FILE"},
+		{Name: "TLS_AUTOCERT_DOMAINS", Validate: validateDomains},
+		{Name: "TLS_AUTOCERT_EMAIL"},
+		{Name: "TLS_AUTOCERT_CACHE_DIR", Default: "autocert"},
+		{Name: "TLS_REDIRECT_PORT", Validate: validatePort},
+		{Name: "TLS_CLIENT_CA_FILE"},
+		{Name: "TLS_CLIENT_CERT_REQUIRED", Default: "false", Validate: validateOneOf("true", "false")},
+		{Name: "REQUEST_TIMEOUT_SECONDS", Default: "30", Validate: validateNonNegativeInt},
+		{Name: "DATABASE_DIALECT", Default: "postgres", Validate: validateOneOf("postgres", "sqlite", "mysql")},
+		{Name: "DATABASE_URI", Required: true, Validate: validateDatabaseURI},
+		{Name: "DATABASE_REPLICA_URIS", Validate: validateReplicaURIs},
+		{Name: "DATABASE_MAX_OPEN_CONNS", Default: "25", Validate: validateNonNegativeInt},
+		{Name: "DATABASE_MAX_IDLE_CONNS", Default: "25", Validate: validateNonNegativeInt},
+		{Name: "DATABASE_CONN_MAX_LIFETIME_SECONDS", Default: "1800", Validate: validateNonNegativeInt},
+		{Name: "DATABASE_CONN_MAX_IDLE_SECONDS", Default: "300", Validate: validateNonNegativeInt},
+		{Name: "DATABASE_CONNECT_TIMEOUT_SECONDS", Default: "30", Validate: validateNonNegativeInt},
+		{Name: "DATABASE_BREAKER_FAILURES", Default: "5", Validate: validateNonNegativeInt},
+		{Name: "DATABASE_BREAKER_COOLDOWN_SECONDS", Default: "10", Validate: validatePositiveInt},
+		{Name: "DATABASE_ROW_LEVEL_SECURITY", Default: "false", Validate: validateOneOf("true", "false")},
+		{Name: "UUID_VERSION", Default: "4", Validate: validateOneOf("4", "7")},
+		{Name: "JWT_SECRET", Required: true},
+		{Name: "TOKEN_CACHE", Validate: validateOneOf("memory", "redis")},
+		{Name: "TOKEN_CACHE_TTL_SECONDS", Default: "60", Validate: validatePositiveInt},
+		{Name: "REDIS_URL", Validate: validateURL},
+		{Name: "KEY_CACHE_SIZE", Default: "1000", Validate: validateNonNegativeInt},
+		{Name: "KEY_CACHE_TTL_SECONDS", Default: "60", Validate: validatePositiveInt},
+		{Name: "SECRETS_PROVIDER", Validate: validateOneOf("vault", "aws")},
+		{Name: "SECRETS_REFRESH_MINUTES", Default: "15", Validate: validatePositiveInt},
+		{Name: "DEFAULT_LOCALE", Default: "en", Validate: validateLocale},
+		{Name: "LOG_LEVEL", Default: "info", Validate: validateLogLevel},
+		{Name: "LOG_FORMAT", Default: "json", Validate: validateOneOf("json", "console")},
+		{Name: "ACCESS_LOG", Default: "false", Validate: validateOneOf("true", "false")},
+		{Name: "ACCESS_LOG_SAMPLE_RATES", Validate: validateSampleRates},
+		{Name: "ACCESS_LOG_EXCLUDE_PATHS"},
+		{Name: "ACCESS_LOG_FIELDS", Default: accessLogDefaultFields, Validate: validateAccessLogFields},
+		{Name: "STORAGE_DRIVER", Default: "local", Validate: validateOneOf("local", "s3")},
+		{Name: "SMTP_PORT", Default: "587", Validate: validatePort},
+		{Name: "EMAIL_DRIVER", Validate: validateOneOf("log", "smtp", "sendgrid", "ses")},
+		{Name: "EMAIL_MAX_ATTEMPTS", Default: "5", Validate: validatePositiveInt},
+		{Name: "SENTRY_DSN", Validate: validateSentryDSN},
+		{Name: "ROUTE_PERMISSIONS", Validate: validateJSONObject},
+		{Name: "CORS_ALLOW_ORIGINS", Validate: validateOrigins},
+		{Name: "CORS_MAX_AGE_SECONDS", Validate: validateNonNegativeInt},
+		{Name: "COOKIE_SECURE", Default: "true", Validate: validateOneOf("true", "false")},
+		{Name: "COMPRESSION_MIN_BYTES", Default: "1024", Validate: validateNonNegativeInt},
+		{Name: "COMPRESSION_ENCODINGS", Default: "br,gzip", Validate: validateCompressionEncodings},
+		{Name: "BATCH_MAX_REQUESTS", Default: "20", Validate: validatePositiveInt},
+		{Name: "WEBHOOK_MAX_ATTEMPTS", Default: "8", Validate: validatePositiveInt},
+		{Name: "WEBHOOK_TIMEOUT_SECONDS", Default: "10", Validate: validatePositiveInt},
+		{Name: "WEBHOOK_ALLOW_PRIVATE", Default: "false", Validate: validateOneOf("true", "false")},
+		{Name: "EVENT_BROKER", Validate: validateOneOf("nats", "kafka")},
+		{Name: "EVENT_BROKER_TOPIC", Default: "goapi.events"},
+		{Name: "INVITE_URL", Validate: validateURL},
+		{Name: "INVITE_LINK_URL", Validate: validateURL},
+		{Name: "RESET_URL", Validate: validateURL},
+		{Name: "POLICY_CACHE_TTL_SECONDS", Default: "60", Validate: validatePositiveInt},
+		{Name: "ROLE_HIERARCHY", Default: "admin,owner", Validate: validateRoleHierarchy},
+		{Name: "IMPERSONATION_TTL_MINUTES", Default: "15", Validate: validatePositiveInt},
+		{Name: "USERNAME_COOLDOWN_DAYS", Validate: validateNonNegativeInt},
+		{Name: "SLOW_QUERY_MS", Default: "200", Validate: validateNonNegativeInt},
+		{Name: "AUDIT_EXPORT_INTERVAL_HOURS", Validate: validateNonNegativeInt},
+		{Name: "AUDIT_EXPORT_RETENTION_DAYS", Validate: validateNonNegativeInt},
+		{Name: "DATA_EXPORT_EXPIRY_HOURS", Default: "72", Validate: validatePositiveInt},
+		{Name: "ERASURE_GRACE_DAYS", Default: "30", Validate: validateNonNegativeInt},
+		{Name: "RETENTION_PURGE_INTERVAL_MINUTES", Default: "60", Validate: validatePositiveInt},
+		{Name: "RETENTION_TOKENS_DAYS", Validate: validateNonNegativeInt},
+		{Name: "RETENTION_LOGIN_ATTEMPTS_DAYS", Validate: validateNonNegativeInt},
+		{Name: "RETENTION_AUDIT_LOGS_DAYS", Validate: validateNonNegativeInt},
+		{Name: "RETENTION_WEBHOOK_DELIVERIES_DAYS", Validate: validateNonNegativeInt},
+		{Name: "RETENTION_EMAILS_DAYS", Validate: validateNonNegativeInt},
+		{Name: "ARCHIVE_INTERVAL_MINUTES", Default: "60", Validate: validatePositiveInt},
+		{Name: "ARCHIVE_BATCH_SIZE", Default: "1000", Validate: validatePositiveInt},
+		{Name: "ARCHIVE_TOKENS_DAYS", Validate: validateNonNegativeInt},
+		{Name: "ARCHIVE_LOGIN_ATTEMPTS_DAYS", Validate: validateNonNegativeInt},
+		{Name: "ARCHIVE_AUDIT_LOGS_DAYS", Validate: validateNonNegativeInt},
+		{Name: "METRICS_ROLLUP_INTERVAL_MINUTES", Default: "15", Validate: validatePositiveInt},
+		{Name: "QUOTA_PLANS", Validate: validateQuotaPlans},
+		{Name: "DEFAULT_PLAN"},
+		{Name: "QUOTA_SYNC_SECONDS", Default: "30", Validate: validatePositiveInt},
+		{Name: "QUOTA_WARNING_PERCENT", Default: "80", Validate: validatePercent},
+		{Name: "ACTIVITY_FAILED_LOGIN_SPIKE", Default: "10", Validate: validatePositiveInt},
+		{Name: "OPERATOR_TOKEN", Validate: validateMinLength(32)},
+		{Name: "API_V1_DEPRECATED_AT", Validate: validateTime},
+		{Name: "API_V1_SUNSET_AT", Validate: validateTime},
+	}
+}
+
+// Fiber's settings. The limits and timeouts keep oversized payloads and
+// slow clients from tying up the server. With SERVER_PREFORK a process per
+// CPU serves requests, each with its own DATABASE_MAX_OPEN_CONNS. Client
+// IPs are read from PROXY_HEADER, but only for requests from
+// TRUSTED_PROXIES when that's set. Call after loadConfig.
+func serverConfig() fiber.Config {
+	return fiber.Config{
+		ErrorHandler: errorHandler,
+		BodyLimit: intSetting("BODY_LIMIT_BYTES"),
+		ReadBufferSize: intSetting("HEADER_LIMIT_BYTES"),
+		ReadTimeout: time.Duration(intSetting("READ_TIMEOUT_SECONDS")) * time.Second,
+		WriteTimeout: time.Duration(intSetting("WRITE_TIMEOUT_SECONDS")) * time.Second,
+		IdleTimeout: time.Duration(intSetting("IDLE_TIMEOUT_SECONDS")) * time.Second,
+		Prefork: os.Getenv("SERVER_PREFORK") == "true",
+		Concurrency: intSetting("SERVER_CONCURRENCY"),
+		ProxyHeader: os.Getenv("PROXY_HEADER"),
+		EnableTrustedProxyCheck: os.Getenv("TRUSTED_PROXIES") != "",
+		TrustedProxies: splitList(os.Getenv("TRUSTED_PROXIES")),
+	}
+}
+
+// Applies defaults and checks every setting, reporting all problems at once.
+// Defaults are written to the environment so they apply wherever settings are read.
+func loadConfig() error {
+	problems := []string{}
+
+	for _, s := range settings() {
+		value := strings.TrimSpace(os.Getenv(s.Name))
+		if value == "" && s.Default != "" {
+			value = s.Default
+			os.Setenv(s.Name, value)
+		}
+
+		if value == "" {
+			if s.Required {
+				problems = append(problems, fmt.Sprintf("%s is required", s.Name))
+			}
+			continue
+		}
+
+		if s.Validate != nil {
+			if err := s.Validate(value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s %s", s.Name, err))
+			}
+		}
+	}
+
+	// Settings that only matter in combination
+	if os.Getenv("STORAGE_DRIVER") == "s3" {
+		for _, name := range []string{"S3_BUCKET", "S3_ACCESS_KEY_ID", "S3_SECRET_ACCESS_KEY"} {
+			if os.Getenv(name) == "" {
+				problems = append(problems, fmt.Sprintf("%s is required when STORAGE_DRIVER is s3", name))
+			}
+		}
+	}
+	if (os.Getenv("TLS_CERT_FILE") == "") != (os.Getenv("TLS_KEY_FILE") == "") {
+		problems = append(problems, "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if os.Getenv("TLS_CERT_FILE") != "" && os.Getenv("TLS_AUTOCERT_DOMAINS") != "" {
+		problems = append(problems, "TLS_AUTOCERT_DOMAINS can't be set with TLS_CERT_FILE")
+	}
+	if os.Getenv("TLS_CLIENT_CA_FILE") != "" && os.Getenv("TLS_CERT_FILE") == "" && os.Getenv("TLS_AUTOCERT_DOMAINS") == "" {
+		problems = append(problems, "TLS_CLIENT_CA_FILE needs TLS_CERT_FILE or TLS_AUTOCERT_DOMAINS")
+	}
+	if os.Getenv("TLS_CLIENT_CERT_REQUIRED") == "true" && os.Getenv("TLS_CLIENT_CA_FILE") == "" {
+		problems = append(problems, "TLS_CLIENT_CERT_REQUIRED needs TLS_CLIENT_CA_FILE")
+	}
+	// Prefork's processes can't share the listener HTTPS is served through
+	if os.Getenv("SERVER_PREFORK") == "true" && (os.Getenv("TLS_CERT_FILE") != "" || os.Getenv("TLS_AUTOCERT_DOMAINS") != "") {
+		problems = append(problems, "SERVER_PREFORK can't be set with TLS_CERT_FILE or TLS_AUTOCERT_DOMAINS")
+	}
+	if plan := os.Getenv("DEFAULT_PLAN"); plan != "" && !isQuotaPlan(plan) {
+		problems = append(problems, "DEFAULT_PLAN must be one of the plans in QUOTA_PLANS")
+	}
+	if os.Getenv("EVENT_BROKER") != "" && os.Getenv("EVENT_BROKER_URL") == "" {
+		problems = append(problems, "EVENT_BROKER_URL is required when EVENT_BROKER is set")
+	}
+	if os.Getenv("SMTP_HOST") != "" && os.Getenv("SMTP_FROM") == "" && os.Getenv("EMAIL_FROM") == "" {
+		problems = append(problems, "EMAIL_FROM is required when SMTP_HOST is set")
+	}
+	switch os.Getenv("EMAIL_DRIVER") {
+		case "smtp":
+			if os.Getenv("SMTP_HOST") == "" {
+				problems = append(problems, "SMTP_HOST is required when EMAIL_DRIVER is smtp")
+			}
+		case "sendgrid":
+			if os.Getenv("SENDGRID_API_KEY") == "" {
+				problems = append(problems, "SENDGRID_API_KEY is required when EMAIL_DRIVER is sendgrid")
+			}
+		case "ses":
+			for _, name := range []string{"SES_REGION", "SES_ACCESS_KEY_ID", "SES_SECRET_ACCESS_KEY"} {
+				if os.Getenv(name) == "" {
+					problems = append(problems, fmt.Sprintf("%s is required when EMAIL_DRIVER is ses", name))
+				}
+			}
+	}
+	if driver := os.Getenv("EMAIL_DRIVER"); (driver == "sendgrid" || driver == "ses") && os.Getenv("EMAIL_FROM") == "" {
+		problems = append(problems, fmt.Sprintf("EMAIL_FROM is required when EMAIL_DRIVER is %s", driver))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// A setting loadConfig has already checked is a number
+func intSetting(name string) int {
+	value, _ := strconv.Atoi(os.Getenv(name))
+	return value
+}
+
+func validatePort(value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("must be a port number, got %q", value)
+	}
+	return nil
+}
+
+func validatePositiveInt(value string) error {
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 1 {
+		return fmt.Errorf("must be a positive whole number, got %q", value)
+	}
+	return nil
+}
+
+func validateNonNegativeInt(value string) error {
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return fmt.Errorf("must be a whole number of at least 0, got %q", value)
+	}
+	return nil
+}
+
+func validateURL(value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return fmt.Errorf("must be a URL with a scheme and host")
+	}
+	return nil
+}
+
+func validateTime(value string) error {
+	if _, err := time.Parse(time.RFC3339, value); err != nil {
+		return fmt.Errorf("must be an RFC 3339 time like 2030-01-01T00:00:00Z, got %q", value)
+	}
+	return nil
+}
+
+func validateLogLevel(value string) error {
+	if _, err := zerolog.ParseLevel(strings.ToLower(value)); err != nil {
+		return fmt.Errorf("must be one of trace, debug, info, warn, error, fatal, panic, got %q", value)
+	}
+	return nil
+}
+
+func validateSentryDSN(value string) error {
+	if _, err := newSentryReporter(value); err != nil {
+		return fmt.Errorf("must be a DSN like https://<key>@<host>/<project>")
+	}
+	return nil
+}
+
+func validateJSONObject(value string) error {
+	object := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(value), &object); err != nil {
+		return fmt.Errorf("must be a JSON object: %s", err)
+	}
+	return nil
+}
+
+func validateOneOf(options ...string) func(string) error {
+	return func(value string) error {
+		if !stringInSlice(value, options) {
+			return fmt.Errorf("must be one of %s, got %q", strings.Join(options, ", "), value)
+		}
+		return nil
+	}
+}
+
+func validateLocale(value string) error {
+	return validateOneOf(supportedLocales()...)(value)
+}
+
+func validateMinLength(length int) func(string) error {
+	return func(value string) error {
+		if len(value) < length {
+			return fmt.Errorf("must be at least %d characters", length)
+		}
+		return nil
+	}
+}
+
+func validateOrigins(value string) error {
+	for _, origin := range splitList(value) {
+		if origin == "*" {
+			continue
+		}
+		if _, err := normalizeCorsConfig(&CorsConfig{AllowOrigins: []string{origin}}); err != nil {
+			return fmt.Errorf("must be * or a comma separated list of origins like https://app.example.com, got %q", origin)
+		}
+	}
+	return nil
+}
+
+func validateProxies(value string) error {
+	for _, proxy := range splitList(value) {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return fmt.Errorf("must be a comma separated list of IPs and CIDR ranges, got %q", proxy)
+			}
+		}
+	}
+	return nil
+}
+
+func validateDomains(value string) error {
+	for _, domain := range splitList(value) {
+		if strings.ContainsAny(domain, ":/*") || !strings.Contains(domain, ".") {
+			return fmt.Errorf("must be a comma separated list of domain names like api.example.com, got %q", domain)
+		}
+	}
+	return nil
+}
+
+func validatePercent(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 100 {
+		return fmt.Errorf("must be a whole number from 1 to 100, got %q", value)
+	}
+	return nil
+}
+
+func validateSampleRates(value string) error {
+	_, err := parseSampleRates(value)
+	return err
+}
+
+func validateAccessLogFields(value string) error {
+	for _, field := range splitList(value) {
+		if !stringInSlice(field, accessLogFields) {
+			return fmt.Errorf("must be a comma separated list of %s, got %q", strings.Join(accessLogFields, ", "), field)
+		}
+	}
+	return nil
+}
+
+func validateQuotaPlans(value string) error {
+	plans := map[string]int64{}
+	if err := json.Unmarshal([]byte(value), &plans); err != nil {
+		return fmt.Errorf(`must be a JSON object of plans to monthly requests, like {"free": 10000}: %s`, err)
+	}
+	for plan, quota := range plans {
+		if quota < 0 {
+			return fmt.Errorf("plan %q can't have a negative quota", plan)
+		}
+	}
+	return nil
+}
+
+// Owners are created with the owner role and admins are what they manage, so
+// both must stay, with owner at the top
+func validateRoleHierarchy(value string) error {
+	names := parseRoleHierarchy(value)
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			return fmt.Errorf("lists %q more than once", name)
+		}
+		seen[name] = true
+	}
+	if !seen[roleAdmin] || len(names) == 0 || names[len(names)-1] != roleOwner {
+		return fmt.Errorf("must include admin and end with owner, like admin,owner, got %q", value)
+	}
+	return nil
+}
+
+func validateCompressionEncodings(value string) error {
+	if value == "none" {
+		return nil
+	}
+	for _, encoding := range splitList(strings.ToLower(value)) {
+		if encoding != "br" && encoding != "gzip" {
+			return fmt.Errorf("must be none or a comma separated list of br and gzip, got %q", value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package goapi
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// ConsentDocument DB model, one row per version of a document like the terms of service
+type ConsentDocument struct {
+	bun.BaseModel `bun:"table:consent_documents"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Slug string // has unique idx with account and version
+	Version int `bun:",notnull"`
+	Title string
+	URL string
+	Body string
+	Required bool `bun:",notnull,default:false"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	AccountId uuid.UUID `bun:",type:uuid"`
+}
+
+// Consent DB model, a user's acceptance of a document version
+type Consent struct {
+	bun.BaseModel `bun:"table:consents"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Slug string
+	Version int `bun:",notnull"`
+	IP string
+	AcceptedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	UserId uuid.UUID `bun:",type:uuid"` // has idx
+	AccountId uuid.UUID `bun:",type:uuid"`
+	DocumentId uuid.UUID `bun:",type:uuid"`
+}
+
+// A document's latest version and whether the user has accepted it
+type ConsentStatus struct {
+	Document ConsentDocument
+	Accepted bool
+	AcceptedVersion int `json:",omitempty"`
+}
+
+// ====================
+//        Setup
+// ====================
+
+func initConsentRoutes(api fiber.Router, db *bun.DB) {
+	routes := api.Group("/consents", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	})
+
+	routes.Get("/documents", permit(db, permissionConsentsManage), func(c *fiber.Ctx) error {
+		return getConsentDocuments(c, db)
+	})
+
+	routes.Post("/documents", permit(db, permissionConsentsManage), func(c *fiber.Ctx) error {
+		return createConsentDocument(c, db)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Lists the latest version of each of the account's documents
+func getConsentDocuments(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+	return c.JSON(latestConsentDocuments(c.UserContext(), currentUser.AccountId, db))
+}
+
+// Publishes a new version of a document. If it's required,
+// everyone has to accept it again.
+func createConsentDocument(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	document := new(ConsentDocument)
+	if err := c.BodyParser(document); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	document.Slug = strings.ToLower(strings.TrimSpace(document.Slug))
+	if document.Slug == "" {
+		return badRequest("no slug provided")
+	}
+
+	var latest int
+	err := db.NewSelect().Model((*ConsentDocument)(nil)).
+		ColumnExpr("coalesce(max(version), 0)").
+		Where("account_id = ?", currentUser.AccountId).
+		Where("slug = ?", document.Slug).
+		Scan(ctx, &latest)
+	if err != nil {
+		return internalError(err)
+	}
+
+	document.ID = newId()
+	document.Version = latest + 1
+	document.AccountId = currentUser.AccountId
+	_, err = db.NewInsert().Model(document).Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return created(c, "", document)
+}
+
+func getMyConsents(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+	return c.JSON(consentStatuses(c.UserContext(), currentUser, db))
+}
+
+// Records that the user accepted the latest version of a document
+func acceptConsent(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(ConsentDocument)
+	if err := c.BodyParser(input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	document := new(ConsentDocument)
+	query := db.NewSelect().Model(document).
+		Where("account_id = ?", currentUser.AccountId).
+		Where("slug = ?", strings.ToLower(strings.TrimSpace(input.Slug)))
+	if input.Version > 0 {
+		query.Where("version = ?", input.Version)
+	} else {
+		query.Order("version DESC").Limit(1)
+	}
+	if err := query.Scan(ctx); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("document not found").WithCode(codeConsentDocumentNotFound)
+	}
+
+	consent := new(Consent)
+	consent.ID = newId()
+	consent.Slug = document.Slug
+	consent.Version = document.Version
+	consent.IP = c.IP()
+	consent.UserId = currentUser.ID
+	consent.AccountId = currentUser.AccountId
+	consent.DocumentId = document.ID
+	_, err := db.NewInsert().Model(consent).Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(consentStatuses(ctx, currentUser, db))
+}
+
+// ====================
+//     Middleware
+// ====================
+
+// Blocks users who haven't accepted the latest version of every required document
+func requireConsent(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+
+	pending := pendingConsents(c.UserContext(), currentUser, db)
+	if len(pending) > 0 {
+		return forbidden("consent required").WithCode(codeConsentRequired).With(fiber.Map{"pending": pending})
+	}
+
+	return c.Next()
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func latestConsentDocuments(ctx context.Context, accountId uuid.UUID, db *bun.DB) []ConsentDocument {
+	documents := []ConsentDocument{}
+	err := db.NewSelect().Model(&documents).
+		Where("account_id = ?", accountId).
+		Order("slug ASC", "version DESC").
+		Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+
+	// The first of each slug is its latest version
+	latest := []ConsentDocument{}
+	for _, document := range documents {
+		if len(latest) == 0 || latest[len(latest)-1].Slug != document.Slug {
+			latest = append(latest, document)
+		}
+	}
+
+	return latest
+}
+
+func consentStatuses(ctx context.Context, user *User, db *bun.DB) []ConsentStatus {
+	accepted := []Consent{}
+	err := db.NewSelect().Model(&accepted).
+		Where("user_id = ?", user.ID).
+		Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+
+	acceptedVersions := map[string]int{}
+	for _, consent := range accepted {
+		if consent.Version > acceptedVersions[consent.Slug] {
+			acceptedVersions[consent.Slug] = consent.Version
+		}
+	}
+
+	statuses := []ConsentStatus{}
+	for _, document := range latestConsentDocuments(ctx, user.AccountId, db) {
+		statuses = append(statuses, ConsentStatus{
+			Document: document,
+			Accepted: acceptedVersions[document.Slug] >= document.Version,
+			AcceptedVersion: acceptedVersions[document.Slug],
+		})
+	}
+
+	return statuses
+}
+
+// The slugs of required documents the user still has to accept
+func pendingConsents(ctx context.Context, user *User, db *bun.DB) []string {
+	pending := []string{}
+	for _, status := range consentStatuses(ctx, user, db) {
+		if status.Document.Required && !status.Accepted {
+			pending = append(pending, status.Document.Slug)
+		}
+	}
+	return pending
+}
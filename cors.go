@@ -0,0 +1,289 @@
+package goapi
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// Which browser origins may call the API, and with what. The deployment's
+// rules come from CORS_ALLOW_ORIGINS, CORS_ALLOW_METHODS, and
+// CORS_ALLOW_HEADERS, and an account's rules replace them for its requests.
+type CorsConfig struct {
+	AllowOrigins []string
+	AllowMethods []string
+	AllowHeaders []string
+}
+
+var (
+	corsAccountsMutex sync.Mutex
+	corsAccounts map[uuid.UUID]*CorsConfig // nil until read
+)
+
+// ====================
+//      Middleware
+// ====================
+
+// Answers preflights and adds the CORS headers to requests from
+// allowed origins. Preflights can't say which account they're for,
+// so they pass if the deployment or any account allows the origin.
+func handleCors(c *fiber.Ctx, db *bun.DB) error {
+	origin := c.Get(fiber.HeaderOrigin)
+	if origin == "" {
+		return c.Next()
+	}
+
+	c.Vary(fiber.HeaderOrigin)
+
+	if c.Method() == fiber.MethodOptions && c.Get(fiber.HeaderAccessControlRequestMethod) != "" {
+		if config := preflightCorsConfig(origin, db); config != nil {
+			c.Set(fiber.HeaderAccessControlAllowOrigin, origin)
+			c.Set(fiber.HeaderAccessControlAllowMethods, strings.Join(config.AllowMethods, ","))
+			c.Set(fiber.HeaderAccessControlAllowHeaders, strings.Join(config.AllowHeaders, ","))
+			if config.allowsCredentials(origin) {
+				c.Set(fiber.HeaderAccessControlAllowCredentials, "true")
+			}
+			if maxAge := os.Getenv("CORS_MAX_AGE_SECONDS"); maxAge != "" {
+				c.Set(fiber.HeaderAccessControlMaxAge, maxAge)
+			}
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+
+	err := c.Next()
+
+	// The user is only known once the route has authenticated them
+	if config := requestCorsConfig(c, db); config.allows(origin) {
+		c.Set(fiber.HeaderAccessControlAllowOrigin, origin)
+		c.Set(fiber.HeaderAccessControlExposeHeaders, "Location,X-Request-Id,Idempotent-Replayed,Deprecation,Sunset,Link,X-Quota-Limit,X-Quota-Remaining,X-Quota-Reset")
+		if config.allowsCredentials(origin) {
+			c.Set(fiber.HeaderAccessControlAllowCredentials, "true")
+		}
+	}
+
+	return err
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func (h *accountHandlers) getCors(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	account := new(Account)
+	err := h.db.NewSelect().Model(account).Where("id = ?", currentUser.AccountId).Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("account not found").WithCode(codeAccountNotFound)
+	}
+
+	return c.JSON(fiber.Map{
+		"defaults": defaultCorsConfig(),
+		"account": account.Cors,
+	})
+}
+
+// Replaces the account's CORS rules. An empty body goes back to the defaults.
+func (h *accountHandlers) updateCors(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(CorsConfig)
+	if err := c.BodyParser(input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	config, err := normalizeCorsConfig(input)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+
+	account := new(Account)
+	account.ID = currentUser.AccountId
+	account.Cors = config
+	account.UpdatedAt = h.clock()
+	_, err = h.db.NewUpdate().Model(account).Column("cors", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	forgetCorsConfigs()
+
+	return c.JSON(fiber.Map{
+		"defaults": defaultCorsConfig(),
+		"account": account.Cors,
+	})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// The deployment's CORS rules. No origins are allowed unless configured.
+func defaultCorsConfig() *CorsConfig {
+	config := &CorsConfig{
+		AllowOrigins: splitList(os.Getenv("CORS_ALLOW_ORIGINS")),
+		AllowMethods: splitList(os.Getenv("CORS_ALLOW_METHODS")),
+		AllowHeaders: splitList(os.Getenv("CORS_ALLOW_HEADERS")),
+	}
+
+	if len(config.AllowMethods) == 0 {
+		config.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+	}
+	if len(config.AllowHeaders) == 0 {
+		config.AllowHeaders = []string{"Accept", "Authorization", "Content-Type", "Account-Key", "X-Request-Id", csrfHeaderName, idempotencyHeaderName}
+	}
+
+	return config
+}
+
+// The rules for a request, from its user's or account key's account
+func requestCorsConfig(c *fiber.Ctx, db *bun.DB) *CorsConfig {
+	if config, ok := accountCorsConfigs(db)[requestAccountId(c, db)]; ok {
+		return config
+	}
+	return defaultCorsConfig()
+}
+
+// The deployment's rules if they allow the origin, otherwise those of
+// every account allowing it, combined
+func preflightCorsConfig(origin string, db *bun.DB) *CorsConfig {
+	if config := defaultCorsConfig(); config.allows(origin) {
+		return config
+	}
+
+	var combined *CorsConfig
+	for _, config := range accountCorsConfigs(db) {
+		if !config.allows(origin) {
+			continue
+		}
+		if combined == nil {
+			combined = new(CorsConfig)
+		}
+		combined.AllowOrigins = mergeList(combined.AllowOrigins, []string{origin})
+		combined.AllowMethods = mergeList(combined.AllowMethods, config.AllowMethods)
+		combined.AllowHeaders = mergeList(combined.AllowHeaders, config.AllowHeaders)
+	}
+
+	return combined
+}
+
+// The CORS rules of every account that has its own, read once and cached
+func accountCorsConfigs(db *bun.DB) map[uuid.UUID]*CorsConfig {
+	corsAccountsMutex.Lock()
+	defer corsAccountsMutex.Unlock()
+
+	if corsAccounts != nil {
+		return corsAccounts
+	}
+
+	ctx := context.Background()
+	accounts := []Account{}
+	err := db.NewSelect().Model(&accounts).Column("id", "cors").Where("cors IS NOT NULL").Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return map[uuid.UUID]*CorsConfig{}
+	}
+
+	corsAccounts = map[uuid.UUID]*CorsConfig{}
+	for _, account := range accounts {
+		if account.Cors != nil {
+			corsAccounts[account.ID] = account.Cors
+		}
+	}
+
+	return corsAccounts
+}
+
+// Drops the cached account rules so the next request reads them again
+func forgetCorsConfigs() {
+	corsAccountsMutex.Lock()
+	defer corsAccountsMutex.Unlock()
+	corsAccounts = nil
+}
+
+func (config *CorsConfig) allows(origin string) bool {
+	if config == nil {
+		return false
+	}
+	return stringInSlice("*", config.AllowOrigins) || stringInSlice(origin, config.AllowOrigins)
+}
+
+// Session cookies are only sent to origins listed by name, never to "*"
+func (config *CorsConfig) allowsCredentials(origin string) bool {
+	return config != nil && stringInSlice(origin, config.AllowOrigins)
+}
+
+// Checks an account's rules, filling in the deployment's methods and
+// headers where none are given. No origins means no rules of its own.
+func normalizeCorsConfig(input *CorsConfig) (*CorsConfig, error) {
+	if len(input.AllowOrigins) == 0 {
+		return nil, nil
+	}
+
+	config := new(CorsConfig)
+	for _, origin := range input.AllowOrigins {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		parsed, err := url.Parse(origin)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.Path != "" {
+			return nil, fmt.Errorf("invalid origin: %s", origin)
+		}
+		config.AllowOrigins = mergeList(config.AllowOrigins, []string{strings.ToLower(origin)})
+	}
+
+	for _, method := range input.AllowMethods {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if !stringInSlice(method, []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}) {
+			return nil, fmt.Errorf("invalid method: %s", method)
+		}
+		config.AllowMethods = mergeList(config.AllowMethods, []string{method})
+	}
+
+	for _, header := range input.AllowHeaders {
+		header = strings.TrimSpace(header)
+		if header == "" || strings.ContainsAny(header, " ,:") {
+			return nil, fmt.Errorf("invalid header: %s", header)
+		}
+		config.AllowHeaders = mergeList(config.AllowHeaders, []string{header})
+	}
+
+	defaults := defaultCorsConfig()
+	if len(config.AllowMethods) == 0 {
+		config.AllowMethods = defaults.AllowMethods
+	}
+	if len(config.AllowHeaders) == 0 {
+		config.AllowHeaders = defaults.AllowHeaders
+	}
+
+	return config, nil
+}
+
+// A comma separated list, trimmed, without empty items
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// The items of both lists, without duplicates
+func mergeList(list []string, items []string) []string {
+	for _, item := range items {
+		if !stringInSlice(item, list) {
+			list = append(list, item)
+		}
+	}
+	return list
+}
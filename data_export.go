@@ -0,0 +1,398 @@
+package goapi
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// DataExport DB model, an archive of everything stored about a user,
+// built in the background for them to download
+type DataExport struct {
+	bun.BaseModel `bun:"table:data_exports"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Status string `bun:",notnull"`
+	Key string `json:"-"`
+	URL string `bun:"-" json:",omitempty"` // the API's download link, while ready
+	ExpiresAt time.Time `bun:",nullzero"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	UserId uuid.UUID `bun:",type:uuid"` // has idx
+	AccountId uuid.UUID `bun:",type:uuid"`
+	RequestedBy uuid.UUID `bun:",type:uuid"` // the user or an admin
+}
+
+// A session as it appears in an export, without its token
+type ExportedSession struct {
+	ID uuid.UUID
+	Impersonated bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Data export statuses
+const (
+	dataExportPending = "pending"
+	dataExportReady = "ready"
+	dataExportFailed = "failed"
+)
+
+// Exports still pending after this long are taken to have failed,
+// e.g. because the instance building them stopped
+const dataExportTimeout = time.Hour
+
+// ====================
+//        Setup
+// ====================
+
+var _ bun.BeforeAppendModelHook = (*DataExport)(nil)
+func (e *DataExport) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+		case *bun.UpdateQuery:
+			e.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+// Purges old exports, and their archives, every hour
+func startDataExportPurge(db *bun.DB, store Storage) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		for range ticker.C {
+			purgeDataExports(db, store)
+		}
+	}()
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Starts building an archive of the current user's data
+func createMyDataExport(c *fiber.Ctx, db *bun.DB, store Storage) error {
+	currentUser := c.Locals("user").(*User)
+
+	export, err := requestDataExport(c.UserContext(), currentUser, currentUser, db, store)
+	if err != nil {
+		return err
+	}
+
+	c.Location(apiPath(c, "/me/export"))
+	return c.Status(fiber.StatusAccepted).JSON(export)
+}
+
+// The current user's latest export, with its download link once it's ready
+func getMyDataExport(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+
+	export, err := latestDataExport(c.UserContext(), currentUser.ID, db)
+	if err != nil {
+		return err
+	}
+	export.linkDownload(apiPath(c, "/me/export/download"))
+
+	return c.JSON(export)
+}
+
+// The archive of the current user's latest export, until it expires
+func downloadMyDataExport(c *fiber.Ctx, db *bun.DB, store Storage) error {
+	currentUser := c.Locals("user").(*User)
+
+	export, err := latestDataExport(c.UserContext(), currentUser.ID, db)
+	if err != nil {
+		return err
+	}
+
+	return sendDataExport(c, export, store)
+}
+
+// Starts building an archive of a user's data on their behalf, e.g. for a
+// request they made outside the app
+func createUserDataExport(c *fiber.Ctx, db *bun.DB, store Storage) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	user, err := findAccountUser(ctx, currentUser.AccountId, c.Params("id"), db)
+	if err != nil {
+		return err
+	}
+
+	export, err := requestDataExport(ctx, user, currentUser, db, store)
+	if err != nil {
+		return err
+	}
+
+	c.Location(apiPath(c, "/users/"+user.ID.String()+"/export"))
+	return c.Status(fiber.StatusAccepted).JSON(export)
+}
+
+func getUserDataExport(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	user, err := findAccountUser(ctx, currentUser.AccountId, c.Params("id"), db)
+	if err != nil {
+		return err
+	}
+
+	export, err := latestDataExport(ctx, user.ID, db)
+	if err != nil {
+		return err
+	}
+	export.linkDownload(apiPath(c, "/users/"+user.ID.String()+"/export/download"))
+
+	return c.JSON(export)
+}
+
+func downloadUserDataExport(c *fiber.Ctx, db *bun.DB, store Storage) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	user, err := findAccountUser(ctx, currentUser.AccountId, c.Params("id"), db)
+	if err != nil {
+		return err
+	}
+
+	export, err := latestDataExport(ctx, user.ID, db)
+	if err != nil {
+		return err
+	}
+
+	return sendDataExport(c, export, store)
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Records a pending export of the user's data and builds it in the
+// background. Only one may be in progress at a time.
+func requestDataExport(ctx context.Context, user *User, requester *User, db *bun.DB, store Storage) (*DataExport, error) {
+	inProgress, err := db.NewSelect().Model((*DataExport)(nil)).
+		Where("user_id = ?", user.ID).
+		Where("status = ?", dataExportPending).
+		Where("created_at > ?", time.Now().Add(-dataExportTimeout)).
+		Exists(ctx)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if inProgress {
+		return nil, conflict("export already in progress").WithCode(codeDataExportInProgress)
+	}
+
+	export := new(DataExport)
+	export.ID = newId()
+	export.Status = dataExportPending
+	export.UserId = user.ID
+	export.AccountId = user.AccountId
+	export.RequestedBy = requester.ID
+	if _, err := db.NewInsert().Model(export).Exec(ctx); err != nil {
+		return nil, internalError(err)
+	}
+
+	go buildDataExport(*export, db, store)
+
+	return export, nil
+}
+
+// The user's most recent export. One left pending too long is reported as failed.
+func latestDataExport(ctx context.Context, userId uuid.UUID, db *bun.DB) (*DataExport, error) {
+	export := new(DataExport)
+	err := db.NewSelect().Model(export).
+		Where("user_id = ?", userId).
+		Order("created_at DESC").
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		return nil, notFound("export not found").WithCode(codeDataExportNotFound)
+	}
+
+	if export.Status == dataExportPending && time.Since(export.CreatedAt) > dataExportTimeout {
+		export.Status = dataExportFailed
+	}
+
+	return export, nil
+}
+
+// Whether the export's archive can still be downloaded
+func (e *DataExport) downloadable() bool {
+	return e.Status == dataExportReady && e.Key != "" && time.Now().Before(e.ExpiresAt)
+}
+
+// Points the export at the route its archive is downloaded from, while it can be
+func (e *DataExport) linkDownload(path string) {
+	if e.downloadable() {
+		e.URL = path
+	}
+}
+
+func sendDataExport(c *fiber.Ctx, export *DataExport, store Storage) error {
+	if !export.downloadable() {
+		return notFound("export not found").WithCode(codeDataExportNotFound)
+	}
+	return sendStoredFile(c, store, export.Key, "application/zip", "data-export.zip")
+}
+
+// Writes the archive to storage and marks the export ready, or failed.
+// Archives are only handed out through the download routes.
+func buildDataExport(export DataExport, db *bun.DB, store Storage) {
+	ctx := context.Background()
+
+	archive, err := dataExportArchive(export.UserId, export.AccountId, db)
+	if err == nil {
+		export.Key = fmt.Sprintf("data-exports/%s/%s/%s.zip", export.AccountId, export.UserId, export.ID)
+		_, err = store.Put(export.Key, "application/zip", archive)
+	}
+
+	columns := []string{"status", "updated_at"}
+	if err != nil {
+		logger.Error().Err(err).Str("user_id", export.UserId.String()).Msg("data export failed")
+		export.Status = dataExportFailed
+	} else {
+		export.Status = dataExportReady
+		export.ExpiresAt = time.Now().Add(time.Duration(intSetting("DATA_EXPORT_EXPIRY_HOURS")) * time.Hour)
+		columns = append(columns, "key", "expires_at")
+	}
+
+	_, err = db.NewUpdate().Model(&export).Column(columns...).WherePK().Exec(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+}
+
+// A zip of JSON files, one per kind of data held about the user
+func dataExportArchive(userId uuid.UUID, accountId uuid.UUID, db *bun.DB) ([]byte, error) {
+	ctx := context.Background()
+
+	user := new(User)
+	err := db.NewSelect().Model(user).
+		Where("id = ?", userId).
+		Where("account_id = ?", accountId).
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []Token{}
+	err = db.NewSelect().Model(&tokens).Where("user_id = ?", userId).Order("created_at ASC").Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []ExportedSession{}
+	for _, token := range tokens {
+		sessions = append(sessions, ExportedSession{
+			ID: token.ID,
+			Impersonated: token.ActorId != uuid.Nil,
+			CreatedAt: token.CreatedAt,
+			UpdatedAt: token.UpdatedAt,
+		})
+	}
+
+	// Archived attempts are all older than those still in login_attempts
+	logins := []LoginAttempt{}
+	for _, table := range []string{"login_attempts_archive", "login_attempts"} {
+		found := []LoginAttempt{}
+		err = db.NewSelect().Model(&found).
+			ModelTableExpr("? AS login_attempt", bun.Ident(table)).
+			Where("user_id = ?", userId).
+			Where("account_id = ?", accountId).
+			Order("created_at ASC").
+			Scan(ctx)
+		if err != nil {
+			return nil, err
+		}
+		logins = append(logins, found...)
+	}
+
+	consents := []Consent{}
+	err = db.NewSelect().Model(&consents).Where("user_id = ?", userId).Order("accepted_at ASC").Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []string{}
+	err = db.NewSelect().Model((*Group)(nil)).
+		Column("name").
+		Where("id IN (SELECT group_id FROM group_members WHERE user_id = ?)", userId).
+		Order("name ASC").
+		Scan(ctx, &groups)
+	if err != nil {
+		return nil, err
+	}
+
+	usernames := []UsernameHistory{}
+	err = db.NewSelect().Model(&usernames).Where("user_id = ?", userId).Order("created_at ASC").Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []struct {
+		Name string
+		Data interface{}
+	}{
+		{"profile.json", user.ToAdminUser()},
+		{"sessions.json", sessions},
+		{"logins.json", logins},
+		{"consents.json", consents},
+		{"groups.json", groups},
+		{"usernames.json", usernames},
+	}
+
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for _, file := range files {
+		w, err := writer.Create(file.Name)
+		if err != nil {
+			return nil, err
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(file.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Removes expired exports and their archives, along with exports that
+// never became ready once they're a day old
+func purgeDataExports(db *bun.DB, store Storage) {
+	ctx := context.Background()
+
+	exports := []DataExport{}
+	err := db.NewSelect().Model(&exports).
+		WhereOr("expires_at < ?", time.Now()).
+		WhereOr("status != ? AND created_at < ?", dataExportReady, time.Now().AddDate(0, 0, -1)).
+		Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	for _, export := range exports {
+		if export.Key != "" {
+			if err := store.Delete(export.Key); err != nil {
+				logger.Error().Err(err).Str("key", export.Key).Send()
+				continue
+			}
+		}
+
+		_, err := db.NewDelete().Model(&export).WherePK().Exec(ctx)
+		if err != nil {
+			logger.Error().Err(err).Send()
+		}
+	}
+}
@@ -1,35 +1,282 @@
-package main
+package goapi
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
 	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/mysqldialect"
 	"github.com/uptrace/bun/dialect/pgdialect"
+	"github.com/uptrace/bun/dialect/sqlitedialect"
 	"github.com/uptrace/bun/driver/pgdriver"
 	"github.com/uptrace/bun/extra/bundebug"
 )
 
+// The databases DATABASE_DIALECT can name
+const (
+	dialectPostgres = "postgres"
+	dialectSqlite = "sqlite"
+	dialectMysql = "mysql"
+)
+
+// Opens connections with whatever URI the setting holds at the time, so
+// a rotated password is picked up by new connections without a restart
+type rotatingConnector struct {
+	uri func() string
+}
+
+func (c rotatingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	connector, err := newConnector(c.uri())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return scopeConnection(conn), nil
+}
+
+// The event listener connects through the driver's own connector
+func (c rotatingConnector) Driver() driver.Driver {
+	switch databaseDialect() {
+		case dialectSqlite:
+			return sqliteConnector{}.Driver()
+		case dialectMysql:
+			return &mysql.MySQLDriver{}
+	}
+	return pgdriver.NewConnector(pgdriver.WithDSN(c.uri())).Driver()
+}
+
+// SQLite's driver opens by name rather than through a connector
+type sqliteConnector struct {
+	dsn string
+}
+
+func (c sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.Driver().Open(c.dsn)
+}
+
+func (sqliteConnector) Driver() driver.Driver {
+	return &sqlite3.SQLiteDriver{ConnectHook: registerSqliteFunctions}
+}
+
+// SQLite has nothing built in for what some migrations need, so it's
+// given the app's own: sha256_hex(value) and new_id()
+func registerSqliteFunctions(conn *sqlite3.SQLiteConn) error {
+	if err := conn.RegisterFunc("sha256_hex", hashSecret, true); err != nil {
+		return err
+	}
+	return conn.RegisterFunc("new_id", func() string {
+		return newId().String()
+	}, false)
+}
+
+// SQLite reports the columns of a unique index rather than its name, unless
+// it's on an expression. These are the unique indexes on columns alone.
+var sqliteUniqueIndexes = map[string]string{
+	"users.account_id, users.email": "account_id_email_idx",
+	"accounts.slug": "accounts_slug_idx",
+	"consent_documents.account_id, consent_documents.slug, consent_documents.version": "consent_documents_account_id_slug_version_idx",
+	"roles.account_id, roles.name": "roles_account_id_name_idx",
+	"groups.account_id, groups.name": "groups_account_id_name_idx",
+	"idempotency_keys.scope, idempotency_keys.key": "idempotency_keys_scope_key_idx",
+	"email_templates.account_id, email_templates.kind, email_templates.locale": "email_templates_account_id_kind_locale_idx",
+	"erasure_requests.user_id": "erasure_requests_pending_user_id_idx",
+	"tokens.value": "tokens_value_idx",
+	"keys.hash": "keys_hash_idx",
+	"keys.client_certificate": "keys_client_certificate_idx",
+}
+
+var (
+	sqliteIndexPattern = regexp.MustCompile(`UNIQUE constraint failed: index '([^']+)'`)
+	sqliteColumnsPattern = regexp.MustCompile(`UNIQUE constraint failed: (.+)$`)
+	mysqlKeyPattern = regexp.MustCompile(`for key '(?:[^'.]+\.)?([^']+)'`)
+)
+
+// The connection pool /debug/vars reports on, the last one opened
+var (
+	poolStatsDb *sql.DB
+	publishPoolStats sync.Once
+)
+
 func initDb() (*bun.DB) {
-	dsn := os.Getenv("DATABASE_URI")
-	sqldb := sql.OpenDB(pgdriver.NewConnector(pgdriver.WithDSN(dsn)))
-	db := bun.NewDB(sqldb, pgdialect.New())
-	
+	sqldb := openPool(func() string {
+		return os.Getenv("DATABASE_URI")
+	})
+
+	if err := waitForDatabase(sqldb); err != nil {
+		logger.Fatal().Err(err).Msg("connecting to the database failed")
+	}
+	poolStatsDb = sqldb
+	publishPoolStats.Do(func() {
+		expvar.Publish("database", expvar.Func(func() interface{} {
+			return poolStatsDb.Stats()
+		}))
+	})
+
+	db := newBunDb(sqldb)
 	initHooks(db)
-	initTables(db)
+	db.AddQueryHook(databaseBreaker)
+	initReplicas()
 
 	return db
 }
 
-func initTables(db *bun.DB) {
-	initUserTable(db)
-	initTokenTable(db)
-	initAccountTables(db)
+// A connection pool for the URI, sized by the DATABASE_* settings
+func openPool(uri func() string) *sql.DB {
+	sqldb := sql.OpenDB(rotatingConnector{uri: uri})
+	sqldb.SetMaxOpenConns(intSetting("DATABASE_MAX_OPEN_CONNS"))
+	sqldb.SetMaxIdleConns(intSetting("DATABASE_MAX_IDLE_CONNS"))
+	sqldb.SetConnMaxLifetime(time.Duration(intSetting("DATABASE_CONN_MAX_LIFETIME_SECONDS")) * time.Second)
+	sqldb.SetConnMaxIdleTime(time.Duration(intSetting("DATABASE_CONN_MAX_IDLE_SECONDS")) * time.Second)
+	return sqldb
+}
+
+func newBunDb(sqldb *sql.DB) *bun.DB {
+	switch databaseDialect() {
+		case dialectSqlite:
+			return bun.NewDB(sqldb, sqlitedialect.New())
+		case dialectMysql:
+			return bun.NewDB(sqldb, mysqldialect.New())
+	}
+	return bun.NewDB(sqldb, pgdialect.New())
+}
+
+// Pings the database until it answers, backing off between tries, for up
+// to DATABASE_CONNECT_TIMEOUT_SECONDS, so the app can start alongside it
+func waitForDatabase(sqldb *sql.DB) error {
+	deadline := time.Now().Add(time.Duration(intSetting("DATABASE_CONNECT_TIMEOUT_SECONDS")) * time.Second)
+	wait := 500 * time.Millisecond
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := sqldb.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return err
+		}
+
+		logger.Warn().Err(err).Dur("retry_in", wait).Msg("database not reachable yet")
+		time.Sleep(wait)
+		if wait *= 2; wait > 10*time.Second {
+			wait = 10 * time.Second
+		}
+	}
+}
+
+// Postgres unless DATABASE_DIALECT says otherwise
+func databaseDialect() string {
+	if dialect := os.Getenv("DATABASE_DIALECT"); dialect != "" {
+		return dialect
+	}
+	return dialectPostgres
+}
+
+// A connector for the dialect's driver. SQLite waits for a lock rather
+// than failing and takes it when a transaction begins, so concurrent
+// writers queue up. MySQL's times are read as UTC, the way they're written.
+func newConnector(uri string) (driver.Connector, error) {
+	switch databaseDialect() {
+		case dialectSqlite:
+			return sqliteConnector{dsn: sqliteDsn(uri)}, nil
+		case dialectMysql:
+			cfg, err := mysql.ParseDSN(uri)
+			if err != nil {
+				return nil, err
+			}
+			cfg.ParseTime = true
+			cfg.Loc = time.UTC
+			return mysql.NewConnector(cfg)
+	}
+	return pgdriver.NewConnector(pgdriver.WithDSN(uri)), nil
+}
+
+// The SQLite DSN with defaults for anything it doesn't set
+func sqliteDsn(uri string) string {
+	path, query, _ := strings.Cut(uri, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return uri
+	}
+
+	defaults := map[string]string{"_busy_timeout": "5000", "_txlock": "immediate", "_journal_mode": "WAL"}
+	for name, value := range defaults {
+		if params.Get(name) == "" {
+			params.Set(name, value)
+		}
+	}
+	return path + "?" + params.Encode()
+}
+
+// Whether DATABASE_URI can be connected to with DATABASE_DIALECT
+func validateDatabaseURI(value string) error {
+	switch databaseDialect() {
+		case dialectSqlite:
+			return nil
+		case dialectMysql:
+			if _, err := mysql.ParseDSN(value); err != nil {
+				return fmt.Errorf("must be a MySQL DSN like user:password@tcp(host:3306)/name")
+			}
+			return nil
+	}
+	return validateURL(value)
+}
+
+// The unique index a write would have duplicated a value in, or "" if
+// that's not why it failed
+func uniqueViolation(err error) string {
+	var pgErr pgdriver.Error
+	if errors.As(err, &pgErr) && pgErr.Field('C') == "23505" {
+		return pgErr.Field('n')
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		message := sqliteErr.Error()
+		if match := sqliteIndexPattern.FindStringSubmatch(message); match != nil {
+			return match[1]
+		}
+		if match := sqliteColumnsPattern.FindStringSubmatch(message); match != nil {
+			if name, ok := sqliteUniqueIndexes[match[1]]; ok {
+				return name
+			}
+			return match[1]
+		}
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+		if match := mysqlKeyPattern.FindStringSubmatch(mysqlErr.Message); match != nil {
+			return match[1]
+		}
+		return "unknown"
+	}
+
+	return ""
 }
 
 func initHooks(db *bun.DB) {
+	// Verbose output includes bound parameters, so it is redacted like the logs
 	db.AddQueryHook(bundebug.NewQueryHook(
 		bundebug.WithVerbose(true),
 		bundebug.FromEnv("BUNDEBUG"),
+		bundebug.WithWriter(newRedactingWriter(os.Stdout)),
 	))
+	db.AddQueryHook(newSlowQueryHook())
 }
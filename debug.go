@@ -0,0 +1,52 @@
+package goapi
+
+import (
+	"expvar"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	fiberexpvar "github.com/gofiber/fiber/v2/middleware/expvar"
+	"github.com/gofiber/fiber/v2/middleware/pprof"
+)
+
+var startedAt = time.Now()
+
+// The DEBUG_ADDR listener is the process's, however many apps mount the API
+var debugListener sync.Once
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("uptime_seconds", expvar.Func(func() interface{} {
+		return int64(time.Since(startedAt).Seconds())
+	}))
+}
+
+// ====================
+//        Setup
+// ====================
+
+// Exposes pprof profiles at /debug/pprof and runtime stats at /debug/vars,
+// on the internal DEBUG_ADDR listener and, for operators holding
+// OPERATOR_TOKEN, on the main app. Neither is enabled unless configured.
+func initDebugRoutes(router fiber.Router) {
+	if addr := os.Getenv("DEBUG_ADDR"); addr != "" {
+		debugListener.Do(func() {
+			go func() {
+				// net/http/pprof and expvar register themselves on the default mux
+				err := http.ListenAndServe(addr, http.DefaultServeMux)
+				logger.Error().Err(err).Str("addr", addr).Msg("debug listener stopped")
+			}()
+		})
+	}
+
+	if os.Getenv("OPERATOR_TOKEN") != "" {
+		router.Group("/debug", requireOperator, pprof.New(), fiberexpvar.New())
+	}
+}
@@ -0,0 +1,317 @@
+package goapi
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect"
+	"github.com/uptrace/bun/dialect/feature"
+	"github.com/uptrace/bun/dialect/pgdialect"
+	"github.com/uptrace/bun/schema"
+)
+
+// A database or query, which knows the dialect of the SQL it writes.
+// The SQL that differs between Postgres, SQLite, and MySQL is chosen
+// here from it.
+type dialectOf interface {
+	Dialect() schema.Dialect
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func isDialect(d dialectOf, name dialect.Name) bool {
+	return d.Dialect().Name() == name
+}
+
+// Makes an insert update the row it conflicts with on the unique columns,
+// e.g. "account_id, day", with the Sets that follow. MySQL finds the
+// conflict from the table's unique indexes itself.
+func upsert(q *bun.InsertQuery, columns string) *bun.InsertQuery {
+	if isDialect(q, dialect.MySQL) {
+		return q.On("DUPLICATE KEY UPDATE")
+	}
+	return q.On(fmt.Sprintf("CONFLICT (%s) DO UPDATE", columns))
+}
+
+// The ON CONFLICT clause of a raw upsert setting each of set's columns to
+// the value that was to be inserted
+func upsertClause(d dialectOf, columns string, set ...string) string {
+	assignments := []string{}
+	for _, column := range set {
+		assignments = append(assignments, fmt.Sprintf("%s = %s", column, insertedValue(d, column)))
+	}
+	if isDialect(d, dialect.MySQL) {
+		return "ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ", ")
+	}
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", columns, strings.Join(assignments, ", "))
+}
+
+// Adds Sets to an upsert, as column and value pairs, that apply only where
+// the row already there meets condition. MySQL can't filter an upsert, so
+// there each Set checks the condition itself, in the order given, which
+// must change the condition's columns last.
+func upsertWhere(q *bun.InsertQuery, sets [][2]string, condition string, args ...interface{}) *bun.InsertQuery {
+	mysql := isDialect(q, dialect.MySQL)
+	for _, set := range sets {
+		if mysql {
+			q = q.Set(fmt.Sprintf("%s = IF(%s, %s, %s)", set[0], condition, set[1], set[0]), args...)
+		} else {
+			q = q.Set(set[0] + " = " + set[1])
+		}
+	}
+	if !mysql {
+		q = q.Where(condition, args...)
+	}
+	return q
+}
+
+// How an upsert's Sets refer to the value that was to be inserted
+func insertedValue(d dialectOf, column string) string {
+	if isDialect(d, dialect.MySQL) {
+		return fmt.Sprintf("VALUES(%s)", column)
+	}
+	return "EXCLUDED." + column
+}
+
+// How an upsert's Sets refer to the value already in the row, where alias
+// is the model's table alias
+func existingValue(d dialectOf, alias string, column string) string {
+	if isDialect(d, dialect.MySQL) {
+		return column
+	}
+	return alias + "." + column
+}
+
+// Locks the rows a select finds until its transaction ends, passing over
+// rows another transaction has locked when skipLocked is set. SQLite has
+// no row locks, but only lets one transaction write at a time.
+func forUpdate(q *bun.SelectQuery, skipLocked bool) *bun.SelectQuery {
+	if isDialect(q, dialect.SQLite) {
+		return q
+	}
+	if skipLocked {
+		return q.For("UPDATE SKIP LOCKED")
+	}
+	return q.For("UPDATE")
+}
+
+// The case-insensitive LIKE operator. MySQL's collation and SQLite's LIKE
+// already ignore case.
+func ilike(d dialectOf) string {
+	if isDialect(d, dialect.PG) {
+		return "ILIKE"
+	}
+	return "LIKE"
+}
+
+// The clause making backslash LIKE's escape character, doubled for MySQL,
+// whose string literals treat it as an escape too
+func likeEscape(d dialectOf) string {
+	if isDialect(d, dialect.MySQL) {
+		return `ESCAPE '\\'`
+	}
+	return `ESCAPE '\'`
+}
+
+// A LIKE pattern matching term anywhere, its own %, _ and \ matched as
+// themselves. Use with likeEscape.
+func containsPattern(term string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term)
+	return "%" + escaped + "%"
+}
+
+// Orders a select by how closely column resembles term, using pg_trgm on
+// Postgres and otherwise simply by the column
+func orderBySimilarity(q *bun.SelectQuery, column string, term string) *bun.SelectQuery {
+	if isDialect(q, dialect.PG) {
+		return q.OrderExpr(fmt.Sprintf("similarity(%s, ?) DESC", column), term)
+	}
+	return q.Order(column + " ASC")
+}
+
+// A placeholder for a date in raw SQL, which Postgres and MySQL need
+// typed. SQLite keeps dates as the text they're written as.
+func dateParam(d dialectOf) string {
+	switch d.Dialect().Name() {
+		case dialect.PG:
+			return "?::date"
+		case dialect.MySQL:
+			return "CAST(? AS DATE)"
+	}
+	return "?"
+}
+
+// The text of a JSON object column's field, as an expression with one
+// placeholder and its argument
+func jsonText(d dialectOf, column string, field string) (string, interface{}) {
+	switch d.Dialect().Name() {
+		case dialect.SQLite:
+			return fmt.Sprintf("json_extract(%s, ?)", column), jsonPath([]string{field})
+		case dialect.MySQL:
+			return fmt.Sprintf("JSON_UNQUOTE(JSON_EXTRACT(%s, ?))", column), jsonPath([]string{field})
+	}
+	return column + "->>?", field
+}
+
+// The integer in a JSON object column's field. The field is written into
+// the SQL, so it must not come from a request.
+func jsonInt(d dialectOf, column string, field string) string {
+	switch d.Dialect().Name() {
+		case dialect.SQLite:
+			return fmt.Sprintf("json_extract(%s, '%s')", column, jsonPath([]string{field}))
+		case dialect.MySQL:
+			return fmt.Sprintf("CAST(JSON_EXTRACT(%s, '%s') AS SIGNED)", column, jsonPath([]string{field}))
+	}
+	return fmt.Sprintf("(%s->>'%s')::int", column, field)
+}
+
+// Whether a JSON object column holds value at the path of keys, as an
+// expression with placeholders and their arguments. Postgres and MySQL
+// check containment, SQLite compares the value and its JSON type.
+func jsonContains(d dialectOf, column string, path []string, value interface{}) (string, []interface{}) {
+	switch d.Dialect().Name() {
+		case dialect.SQLite:
+			at := jsonPath(path)
+			switch value := value.(type) {
+				case nil:
+					return fmt.Sprintf("json_type(%s, ?) = 'null'", column), []interface{}{at}
+				case bool:
+					return fmt.Sprintf("json_type(%s, ?) = ?", column), []interface{}{at, fmt.Sprint(value)}
+				case float64:
+					return fmt.Sprintf("json_type(%s, ?) IN ('integer', 'real') AND json_extract(%s, ?) = ?", column, column),
+						[]interface{}{at, at, value}
+				default:
+					return fmt.Sprintf("json_type(%s, ?) = 'text' AND json_extract(%s, ?) = ?", column, column),
+						[]interface{}{at, at, value}
+			}
+	}
+
+	contained := value
+	for i := len(path) - 1; i >= 0; i-- {
+		contained = map[string]interface{}{path[i]: contained}
+	}
+	encoded, _ := json.Marshal(contained)
+	if isDialect(d, dialect.MySQL) {
+		return fmt.Sprintf("JSON_CONTAINS(%s, ?)", column), []interface{}{string(encoded)}
+	}
+	return fmt.Sprintf("%s @> ?::jsonb", column), []interface{}{string(encoded)}
+}
+
+// Whether an array column, kept as JSON outside Postgres, holds value, as
+// an expression with one placeholder and its argument
+func arrayContains(d dialectOf, column string, value string) (string, interface{}) {
+	switch d.Dialect().Name() {
+		case dialect.SQLite:
+			return fmt.Sprintf("EXISTS (SELECT 1 FROM json_each(%s) WHERE json_each.value = ?)", column), value
+		case dialect.MySQL:
+			encoded, _ := json.Marshal(value)
+			return fmt.Sprintf("JSON_CONTAINS(%s, ?)", column), string(encoded)
+	}
+	return column + " @> ?", pgdialect.Array([]string{value})
+}
+
+// A time days ago, where days is a SQL expression
+func daysAgo(d dialectOf, days string) string {
+	switch d.Dialect().Name() {
+		case dialect.SQLite:
+			return fmt.Sprintf("datetime('now', '-' || (%s) || ' days')", days)
+		case dialect.MySQL:
+			return fmt.Sprintf("UTC_TIMESTAMP(6) - INTERVAL (%s) DAY", days)
+	}
+	return fmt.Sprintf("now() - make_interval(days => %s)", days)
+}
+
+// A JSON path to the keys, quoted so any key is taken literally
+func jsonPath(keys []string) string {
+	path := "$"
+	for _, key := range keys {
+		path += "." + quoteJSONKey(key)
+	}
+	return path
+}
+
+func quoteJSONKey(key string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(key) + `"`
+}
+
+// Runs fn unless another instance holds the lock with the id, which is
+// held until fn returns. SQLite is only used by one instance, so there fn
+// always runs.
+func withAdvisoryLock(ctx context.Context, db *bun.DB, id int64, fn func() error) error {
+	switch db.Dialect().Name() {
+		case dialect.SQLite:
+			return fn()
+		case dialect.MySQL:
+			// MySQL's locks are the connection's rather than a transaction's
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			name := fmt.Sprintf("goapi:%d", id)
+			var locked sql.NullInt64
+			if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", name).Scan(&locked); err != nil || locked.Int64 != 1 {
+				return err
+			}
+			defer func() {
+				if _, err := conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", name); err != nil {
+					logger.Error().Err(err).Send()
+				}
+			}()
+			return fn()
+	}
+
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var locked bool
+		if err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock(?)", id).Scan(&locked); err != nil || !locked {
+			return err
+		}
+		return fn()
+	})
+}
+
+// Runs an update of the rows filter finds and fills model with them, as
+// RETURNING * does. MySQL has no RETURNING, so there the rows are locked
+// and read first, then updated by primary key and read again.
+func updateReturning(ctx context.Context, db bun.IDB, model interface{}, filter func(bun.QueryBuilder) bun.QueryBuilder, set func(*bun.UpdateQuery) *bun.UpdateQuery) error {
+	if db.Dialect().Features().Has(feature.Returning) {
+		q := db.NewUpdate().Model(model).Apply(set)
+		filter(q.Query())
+		_, err := q.Returning("*").Exec(ctx)
+		return err
+	}
+
+	update := func(ctx context.Context, tx bun.IDB) error {
+		selected := forUpdate(tx.NewSelect().Model(model), false)
+		filter(selected.Query())
+		if err := selected.Scan(ctx); err != nil {
+			// Nothing matched, as an update that changed nothing
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return err
+		}
+
+		q := tx.NewUpdate().Model(model).Apply(set).WherePK()
+		filter(q.Query())
+		if _, err := q.Exec(ctx); err != nil {
+			return err
+		}
+		return tx.NewSelect().Model(model).WherePK().Scan(ctx)
+	}
+
+	if conn, ok := db.(*bun.DB); ok {
+		return conn.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			return update(ctx, tx)
+		})
+	}
+	return update(ctx, db)
+}
@@ -0,0 +1,522 @@
+package goapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// Email DB model. Emails are queued and sent in the background, retrying
+// failures, so a slow or failing provider never holds up a request.
+type Email struct {
+	bun.BaseModel `bun:"table:emails"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	To string
+	From string // "Name <address>"
+	ReplyTo string `bun:",nullzero"`
+	Subject string
+	Body string `json:"-"` // plain text, cleared once sent
+	HTML string `bun:",nullzero" json:"-"` // cleared once sent
+	Status string `bun:",nullzero,notnull,default:'pending'"`
+	Attempts int `bun:",notnull,default:0"`
+	Error string `bun:",nullzero"`
+	NextAttemptAt time.Time `bun:",nullzero"` // has idx with status
+	SentAt time.Time `bun:",nullzero"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	AccountId uuid.UUID `bun:",type:uuid,nullzero"`
+}
+
+// What an email says, in plain text and optionally HTML
+type EmailContent struct {
+	Subject string
+	Text string
+	HTML string
+}
+
+// Who an account's emails come from, instead of EMAIL_FROM
+type EmailSender struct {
+	Address string `validate:"required,email"`
+	Name string `validate:"max=100"`
+	ReplyTo string `validate:"omitempty,email"`
+}
+
+// Sends emails through a provider
+type Mailer interface {
+	Send(email *Email) error
+}
+
+// Writes emails to the log, used when no provider is configured so flows
+// stay usable locally
+type LogMailer struct{}
+
+// Sends emails through an SMTP server
+type SmtpMailer struct {
+	Host string
+	Port string
+	Username string
+	Password string
+}
+
+// Sends emails through SendGrid's v3 API
+type SendgridMailer struct {
+	APIKey string
+	client *http.Client
+}
+
+// Sends emails through Amazon SES's v2 API
+type SesMailer struct {
+	Region string
+	AccessKeyId string
+	SecretAccessKey string
+	client *http.Client
+}
+
+// Email statuses
+const (
+	emailPending = "pending"
+	emailSent = "sent"
+	emailFailed = "failed"
+)
+
+// How long an email is held by the worker sending it, so others don't send
+// it too. Longer than any provider call may take.
+const emailLease = 5 * time.Minute
+
+// Send attempts, by outcome
+var emailResults = expvar.NewMap("emails")
+
+// The provider emails are sent through, set once at startup
+var mailer Mailer = &LogMailer{}
+
+// ====================
+//        Setup
+// ====================
+
+// Picks the provider from EMAIL_DRIVER ("smtp", "sendgrid", "ses", or
+// "log"). Without one, SMTP is used when SMTP_HOST is set.
+func initMailer() {
+	driver := os.Getenv("EMAIL_DRIVER")
+	if driver == "" && os.Getenv("SMTP_HOST") != "" {
+		driver = "smtp"
+	}
+
+	switch driver {
+		case "smtp":
+			mailer = &SmtpMailer{
+				Host: os.Getenv("SMTP_HOST"),
+				Port: os.Getenv("SMTP_PORT"),
+				Username: os.Getenv("SMTP_USERNAME"),
+				Password: os.Getenv("SMTP_PASSWORD"),
+			}
+		case "sendgrid":
+			mailer = &SendgridMailer{
+				APIKey: os.Getenv("SENDGRID_API_KEY"),
+				client: &http.Client{Timeout: 10 * time.Second},
+			}
+		case "ses":
+			mailer = &SesMailer{
+				Region: os.Getenv("SES_REGION"),
+				AccessKeyId: os.Getenv("SES_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("SES_SECRET_ACCESS_KEY"),
+				client: &http.Client{Timeout: 10 * time.Second},
+			}
+		default:
+			mailer = &LogMailer{}
+	}
+}
+
+// Retries due emails every 30 seconds. First attempts are made as soon as
+// an email is queued.
+func startEmailDeliveries(db *bun.DB) {
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		for range ticker.C {
+			retryEmails(db)
+		}
+	}()
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func (h *accountHandlers) getEmailSender(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	account := new(Account)
+	err := h.db.NewSelect().Model(account).Where("id = ?", currentUser.AccountId).Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("account not found").WithCode(codeAccountNotFound)
+	}
+
+	return c.JSON(fiber.Map{
+		"default": defaultEmailFrom(),
+		"account": account.EmailSender,
+	})
+}
+
+// Sets who the account's emails come from, e.g. {"Address":
+// "hello@example.com", "Name": "Example"}. The address must be on one of
+// EMAIL_SENDER_DOMAINS when it's set. An empty body goes back to EMAIL_FROM.
+func (h *accountHandlers) updateEmailSender(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	var sender *EmailSender
+	if len(c.Body()) > 0 {
+		sender = new(EmailSender)
+		if err := parseBody(c, sender); err != nil {
+			return err
+		}
+		if !emailSenderDomainAllowed(sender.Address) {
+			return badRequest("sender domain not allowed").With(fiber.Map{"domains": splitList(os.Getenv("EMAIL_SENDER_DOMAINS"))})
+		}
+	}
+
+	account := new(Account)
+	account.ID = currentUser.AccountId
+	account.EmailSender = sender
+	account.UpdatedAt = h.clock()
+	_, err := h.db.NewUpdate().Model(account).Column("email_sender", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(fiber.Map{
+		"default": defaultEmailFrom(),
+		"account": account.EmailSender,
+	})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Queues an email from the account's sender, or EMAIL_FROM when accountId
+// is uuid.Nil or it has none, and sends it in the background. It's leased
+// to this instance, so should the attempt never finish, the worker
+// retries it.
+func queueEmail(ctx context.Context, db *bun.DB, accountId uuid.UUID, to string, content *EmailContent) error {
+	email := new(Email)
+	email.ID = newId()
+	email.AccountId = accountId
+	email.To = to
+	email.Subject = content.Subject
+	email.Body = content.Text
+	email.HTML = content.HTML
+	email.From = defaultEmailFrom()
+	email.NextAttemptAt = time.Now().Add(emailLease)
+
+	if sender := accountEmailSender(ctx, accountId, db); sender != nil {
+		email.From = (&mail.Address{Name: sender.Name, Address: sender.Address}).String()
+		email.ReplyTo = sender.ReplyTo
+	}
+
+	if _, err := db.NewInsert().Model(email).Exec(ctx); err != nil {
+		return err
+	}
+
+	go attemptEmail(db, *email)
+
+	return nil
+}
+
+// Leases due emails and attempts each in the background
+func retryEmails(db *bun.DB) {
+	ctx := context.Background()
+
+	emails := []Email{}
+	leasedUntil := time.Now().Add(emailLease)
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := forUpdate(tx.NewSelect().Model(&emails).
+			Where("status = ?", emailPending).
+			Where("next_attempt_at <= ?", time.Now()).
+			Order("next_attempt_at ASC").
+			Limit(100), true).
+			Scan(ctx)
+		if err != nil || len(emails) == 0 {
+			return err
+		}
+
+		ids := []uuid.UUID{}
+		for i := range emails {
+			emails[i].NextAttemptAt = leasedUntil
+			ids = append(ids, emails[i].ID)
+		}
+		_, err = tx.NewUpdate().Model((*Email)(nil)).
+			Set("next_attempt_at = ?", leasedUntil).
+			Where("id IN (?)", bun.In(ids)).
+			Exec(ctx)
+		return err
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("email retry failed")
+		return
+	}
+
+	for _, email := range emails {
+		go attemptEmail(db, email)
+	}
+}
+
+// Sends the email and records the result, retrying failures with
+// exponential backoff until EMAIL_MAX_ATTEMPTS (default 5) have failed.
+// The content is cleared once sent, since it may hold single-use links.
+func attemptEmail(db *bun.DB, email Email) {
+	ctx := context.Background()
+
+	email.Attempts++
+	email.Error = ""
+
+	err := mailer.Send(&email)
+	switch {
+		case err == nil:
+			email.Status = emailSent
+			email.SentAt = time.Now()
+			email.NextAttemptAt = time.Time{}
+			email.Body = ""
+			email.HTML = ""
+		case email.Attempts >= intSetting("EMAIL_MAX_ATTEMPTS"):
+			email.Status = emailFailed
+			email.Error = err.Error()
+			email.NextAttemptAt = time.Time{}
+		default:
+			email.Error = err.Error()
+			email.NextAttemptAt = time.Now().Add(retryDelay(email.Attempts))
+	}
+
+	outcome := email.Status
+	if outcome == emailPending {
+		outcome = "retrying"
+	}
+	emailResults.Add(outcome, 1)
+	if err != nil {
+		logger.Warn().Err(err).Str("email", email.ID.String()).Int("attempt", email.Attempts).Msg("email not sent")
+	}
+
+	email.UpdatedAt = time.Now()
+	_, err = db.NewUpdate().Model(&email).
+		Column("status", "attempts", "error", "next_attempt_at", "sent_at", "body", "html", "updated_at").
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		logger.Error().Err(err).Str("email", email.ID.String()).Send()
+	}
+}
+
+// EMAIL_FROM, or SMTP_FROM from before there were other providers
+func defaultEmailFrom() string {
+	if from := os.Getenv("EMAIL_FROM"); from != "" {
+		return from
+	}
+	return os.Getenv("SMTP_FROM")
+}
+
+func accountEmailSender(ctx context.Context, accountId uuid.UUID, db *bun.DB) *EmailSender {
+	if accountId == uuid.Nil {
+		return nil
+	}
+
+	account := new(Account)
+	err := db.NewSelect().Model(account).Column("email_sender").Where("id = ?", accountId).Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return nil
+	}
+	return account.EmailSender
+}
+
+// Whether accounts may send from the address. Any domain may be used when
+// EMAIL_SENDER_DOMAINS isn't set.
+func emailSenderDomainAllowed(address string) bool {
+	domains := splitList(strings.ToLower(os.Getenv("EMAIL_SENDER_DOMAINS")))
+	if len(domains) == 0 {
+		return true
+	}
+
+	at := strings.LastIndex(address, "@")
+	return at >= 0 && stringInSlice(strings.ToLower(address[at+1:]), domains)
+}
+
+// The start of a provider's error response, for the email's error
+func providerError(provider string, res *http.Response) error {
+	start, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	return fmt.Errorf("%s responded %d: %s", provider, res.StatusCode, start)
+}
+
+// ====================
+//       Mailers
+// ====================
+
+func (m *LogMailer) Send(email *Email) error {
+	logger.Info().Str("to", email.To).Str("subject", email.Subject).Str("body", email.Body).Msg("email not sent, no provider configured")
+	return nil
+}
+
+func (m *SmtpMailer) Send(email *Email) error {
+	from, err := mail.ParseAddress(email.From)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	headers := []string{
+		fmt.Sprintf("From: %s", from.String()),
+		fmt.Sprintf("To: %s", email.To),
+		fmt.Sprintf("Subject: %s", mime.QEncoding.Encode("UTF-8", email.Subject)),
+		fmt.Sprintf("Date: %s", time.Now().Format(time.RFC1123Z)),
+		"MIME-Version: 1.0",
+	}
+	if email.ReplyTo != "" {
+		headers = append(headers, fmt.Sprintf("Reply-To: %s", email.ReplyTo))
+	}
+
+	var message string
+	if email.HTML == "" {
+		message = strings.Join(append(headers,
+			"Content-Type: text/plain; charset=UTF-8",
+			"",
+			email.Body,
+		), "\r\n")
+	} else {
+		random := make([]byte, 12)
+		if _, err := rand.Read(random); err != nil {
+			return err
+		}
+		boundary := hex.EncodeToString(random)
+
+		message = strings.Join(append(headers,
+			fmt.Sprintf("Content-Type: multipart/alternative; boundary=%s", boundary),
+			"",
+			"--"+boundary,
+			"Content-Type: text/plain; charset=UTF-8",
+			"",
+			email.Body,
+			"--"+boundary,
+			"Content-Type: text/html; charset=UTF-8",
+			"",
+			email.HTML,
+			"--"+boundary+"--",
+		), "\r\n")
+	}
+
+	return smtp.SendMail(fmt.Sprintf("%s:%s", m.Host, m.Port), auth, from.Address, []string{email.To}, []byte(message))
+}
+
+func (m *SendgridMailer) Send(email *Email) error {
+	from, err := mail.ParseAddress(email.From)
+	if err != nil {
+		return err
+	}
+
+	content := []fiber.Map{{"type": "text/plain", "value": email.Body}}
+	if email.HTML != "" {
+		content = append(content, fiber.Map{"type": "text/html", "value": email.HTML})
+	}
+	payload := fiber.Map{
+		"personalizations": []fiber.Map{{"to": []fiber.Map{{"email": email.To}}}},
+		"from": fiber.Map{"email": from.Address, "name": from.Name},
+		"subject": email.Subject,
+		"content": content,
+	}
+	if email.ReplyTo != "" {
+		payload["reply_to"] = fiber.Map{"email": email.ReplyTo}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "https://api.sendgrid.com/v3/mail/send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+m.APIKey)
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return providerError("sendgrid", res)
+	}
+	return nil
+}
+
+func (m *SesMailer) Send(email *Email) error {
+	if email.From == "" {
+		return errors.New("no sender address")
+	}
+
+	bodyContent := fiber.Map{"Text": fiber.Map{"Data": email.Body, "Charset": "UTF-8"}}
+	if email.HTML != "" {
+		bodyContent["Html"] = fiber.Map{"Data": email.HTML, "Charset": "UTF-8"}
+	}
+	payload := fiber.Map{
+		"FromEmailAddress": email.From,
+		"Destination": fiber.Map{"ToAddresses": []string{email.To}},
+		"Content": fiber.Map{
+			"Simple": fiber.Map{
+				"Subject": fiber.Map{"Data": email.Subject, "Charset": "UTF-8"},
+				"Body": bodyContent,
+			},
+		},
+	}
+	if email.ReplyTo != "" {
+		payload["ReplyToAddresses"] = []string{email.ReplyTo}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("https://email.%s.amazonaws.com/v2/email/outbound-emails", m.Region)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{"Content-Type": fiber.MIMEApplicationJSON}
+	signAwsRequest(req, headers, body, m.Region, "ses", m.AccessKeyId, m.SecretAccessKey)
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return providerError("ses", res)
+	}
+	return nil
+}
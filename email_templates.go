@@ -0,0 +1,517 @@
+package goapi
+
+import (
+	"bytes"
+	"context"
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect"
+)
+
+// EmailTemplate DB model. An account's own wording for one kind of email,
+// in one locale or, with no locale, in any its users ask for.
+type EmailTemplate struct {
+	bun.BaseModel `bun:"table:email_templates"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Kind string
+	Locale string `bun:",notnull,default:''"`
+	Subject string
+	Text string
+	HTML string `bun:",nullzero"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	AccountId uuid.UUID `bun:",type:uuid"` // has unique idx with kind and locale
+}
+
+// Fields an email template is saved with. Each is a Go template, e.g.
+// "Hi {{.Username}}", and HTML is escaped as it's rendered.
+type EmailTemplateInput struct {
+	Subject string `validate:"required,max=200"`
+	Text string `validate:"required,max=20000"`
+	HTML string `validate:"max=100000"`
+}
+
+// A kind of email, what its templates are given, and its wording when the
+// account hasn't written its own
+type emailTemplateKind struct {
+	Name string
+	Variables []string
+	Sample map[string]interface{}
+	Default EmailContent
+}
+
+// Email template kinds
+const (
+	emailTemplateVerification = "verification"
+	emailTemplateReset = "reset"
+	emailTemplateInvite = "invite"
+	emailTemplateNewDevice = "new-device"
+)
+
+// ====================
+//        Setup
+// ====================
+
+var _ bun.BeforeAppendModelHook = (*EmailTemplate)(nil)
+func (t *EmailTemplate) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+		case *bun.UpdateQuery:
+			t.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func initEmailTemplateRoutes(api fiber.Router, db *bun.DB) {
+	routes := api.Group("/email-templates", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	})
+
+	routes.Get("/", permit(db, permissionEmailsManage), func(c *fiber.Ctx) error {
+		return getEmailTemplates(c, db)
+	})
+
+	routes.Get("/variables", permit(db, permissionEmailsManage), func(c *fiber.Ctx) error {
+		return getEmailVariables(c, db)
+	})
+
+	routes.Put("/variables", permit(db, permissionEmailsManage), func(c *fiber.Ctx) error {
+		return updateEmailVariables(c, db)
+	})
+
+	routes.Get("/:kind", permit(db, permissionEmailsManage), func(c *fiber.Ctx) error {
+		return getEmailTemplate(c, db)
+	})
+
+	routes.Put("/:kind", permit(db, permissionEmailsManage), func(c *fiber.Ctx) error {
+		return saveEmailTemplate(c, db)
+	})
+
+	routes.Delete("/:kind", permit(db, permissionEmailsManage), func(c *fiber.Ctx) error {
+		return deleteEmailTemplate(c, db)
+	})
+
+	routes.Post("/:kind/preview", permit(db, permissionEmailsManage), func(c *fiber.Ctx) error {
+		return previewEmailTemplate(c, db)
+	})
+
+	routes.Post("/:kind/test", permit(db, permissionEmailsManage), func(c *fiber.Ctx) error {
+		return testEmailTemplate(c, db)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Every kind of email with its variables and default wording, along with
+// the account's own templates
+func getEmailTemplates(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	templates := []EmailTemplate{}
+	err := db.NewSelect().Model(&templates).
+		Where("account_id = ?", currentUser.AccountId).
+		Order("kind ASC", "locale ASC").
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return no templates
+	}
+
+	return c.JSON(fiber.Map{
+		"kinds": emailTemplateKinds(),
+		"account": templates,
+	})
+}
+
+func getEmailTemplate(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	kind, err := findEmailTemplateKind(c.Params("kind"))
+	if err != nil {
+		return err
+	}
+
+	templates := []EmailTemplate{}
+	err = db.NewSelect().Model(&templates).
+		Where("account_id = ?", currentUser.AccountId).
+		Where("kind = ?", kind.Name).
+		Order("locale ASC").
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return no templates
+	}
+
+	return c.JSON(fiber.Map{
+		"kind": kind,
+		"account": templates,
+	})
+}
+
+// Saves the account's template for a kind in ?locale=, or for every locale
+// without one. It's checked by rendering it with sample values.
+func saveEmailTemplate(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	kind, err := findEmailTemplateKind(c.Params("kind"))
+	if err != nil {
+		return err
+	}
+
+	locale, err := emailTemplateLocale(c.Query("locale"))
+	if err != nil {
+		return err
+	}
+
+	input := new(EmailTemplateInput)
+	if err := parseBody(c, input); err != nil {
+		return err
+	}
+
+	content := &EmailContent{Subject: input.Subject, Text: input.Text, HTML: input.HTML}
+	if _, err := content.render(emailTemplateValues(ctx, currentUser.AccountId, kind.Sample, db)); err != nil {
+		return badRequest("invalid template").With(fiber.Map{"error": err.Error(), "variables": kind.Variables})
+	}
+
+	saved := new(EmailTemplate)
+	saved.ID = newId()
+	saved.AccountId = currentUser.AccountId
+	saved.Kind = kind.Name
+	saved.Locale = locale
+	saved.Subject = input.Subject
+	saved.Text = input.Text
+	saved.HTML = input.HTML
+	q := db.NewInsert().Model(saved)
+	_, err = upsert(q, "account_id, kind, locale").
+		Set("subject = " + insertedValue(q, "subject")).
+		Set("text = " + insertedValue(q, "text")).
+		Set("html = " + insertedValue(q, "html")).
+		Set("updated_at = ?", time.Now()).
+		Returning("*").
+		Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	// MySQL can't return the row, which keeps its id when it's replaced
+	if isDialect(db, dialect.MySQL) {
+		err := db.NewSelect().Model(saved).
+			Where("account_id = ?", saved.AccountId).
+			Where("kind = ?", saved.Kind).
+			Where("locale = ?", saved.Locale).
+			Scan(ctx)
+		if err != nil {
+			return internalError(err)
+		}
+	}
+
+	return c.JSON(saved)
+}
+
+// Goes back to the default wording for a kind in ?locale=
+func deleteEmailTemplate(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	kind, err := findEmailTemplateKind(c.Params("kind"))
+	if err != nil {
+		return err
+	}
+
+	locale, err := emailTemplateLocale(c.Query("locale"))
+	if err != nil {
+		return err
+	}
+
+	_, err = db.NewDelete().Model((*EmailTemplate)(nil)).
+		Where("account_id = ?", currentUser.AccountId).
+		Where("kind = ?", kind.Name).
+		Where("locale = ?", locale).
+		Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// Renders a kind with sample values in ?locale=, the requester's locale by
+// default. A body previews a draft instead of the saved template.
+func previewEmailTemplate(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+
+	content, err := emailTemplatePreview(c, currentUser, db)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(content)
+}
+
+// Sends the preview to the requester's own address
+func testEmailTemplate(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+
+	if currentUser.Email == "" {
+		return badRequest("you have no email address")
+	}
+
+	content, err := emailTemplatePreview(c, currentUser, db)
+	if err != nil {
+		return err
+	}
+
+	if err := queueEmail(c.UserContext(), db, currentUser.AccountId, currentUser.Email, content); err != nil {
+		return internalError(err)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"success": true, "to": currentUser.Email})
+}
+
+func getEmailVariables(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+	return c.JSON(accountEmailVariables(c.UserContext(), currentUser.AccountId, db))
+}
+
+// Replaces the account's own template variables, e.g. {"SupportEmail":
+// "help@example.com"}, used in templates as {{.Vars.SupportEmail}}
+func updateEmailVariables(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := map[string]string{}
+	if err := c.BodyParser(&input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	account := new(Account)
+	account.ID = currentUser.AccountId
+	account.EmailVariables = input
+	account.UpdatedAt = time.Now()
+	_, err := db.NewUpdate().Model(account).Column("email_variables", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(account.EmailVariables)
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Every kind of email, with the values its templates may use besides
+// AccountName and Vars
+func emailTemplateKinds() []emailTemplateKind {
+	return []emailTemplateKind{
+		{
+			Name: emailTemplateVerification,
+			Variables: []string{"Username", "Link", "ExpiresInHours"},
+			Sample: map[string]interface{}{"Username": "jane", "Link": "https://example.com/verify?token=sample", "ExpiresInHours": 24},
+			Default: EmailContent{
+				Subject: "Confirm your email",
+				Text: "Hi {{.Username}},\n\nConfirm your email address for {{.AccountName}} here:\n\n{{.Link}}\n\nThis link expires in {{.ExpiresInHours}} hours.",
+				HTML: `<p>Hi {{.Username}},</p><p>Confirm your email address for {{.AccountName}}:</p><p><a href="{{.Link}}">Confirm email</a></p><p>This link expires in {{.ExpiresInHours}} hours.</p>`,
+			},
+		},
+		{
+			Name: emailTemplateReset,
+			Variables: []string{"Username", "Link", "ExpiresInMinutes"},
+			Sample: map[string]interface{}{"Username": "jane", "Link": "https://example.com/reset?token=sample", "ExpiresInMinutes": 30},
+			Default: EmailContent{
+				Subject: "Reset your password",
+				Text: "Hi {{.Username}},\n\nSomeone asked to reset your {{.AccountName}} password. If it was you, choose a new one here:\n\n{{.Link}}\n\nThis link expires in {{.ExpiresInMinutes}} minutes. If it wasn't you, you can ignore this email.",
+				HTML: `<p>Hi {{.Username}},</p><p>Someone asked to reset your {{.AccountName}} password. If it was you, choose a new one:</p><p><a href="{{.Link}}">Reset password</a></p><p>This link expires in {{.ExpiresInMinutes}} minutes. If it wasn't you, you can ignore this email.</p>`,
+			},
+		},
+		{
+			Name: emailTemplateInvite,
+			Variables: []string{"Link", "ExpiresInDays"},
+			Sample: map[string]interface{}{"Link": "https://example.com/invite?token=sample", "ExpiresInDays": 7},
+			Default: EmailContent{
+				Subject: "You've been invited",
+				Text: "You've been invited to join {{.AccountName}}. Set your password here:\n\n{{.Link}}\n\nThis link expires in {{.ExpiresInDays}} days.",
+				HTML: `<p>You've been invited to join {{.AccountName}}.</p><p><a href="{{.Link}}">Set your password</a></p><p>This link expires in {{.ExpiresInDays}} days.</p>`,
+			},
+		},
+		{
+			Name: emailTemplateNewDevice,
+			Variables: []string{"Username", "IP", "UserAgent", "Time"},
+			Sample: map[string]interface{}{"Username": "jane", "IP": "203.0.113.7", "UserAgent": "Mozilla/5.0", "Time": "2030-01-01 12:00 UTC"},
+			Default: EmailContent{
+				Subject: "New sign-in to your account",
+				Text: "Hi {{.Username}},\n\nYour {{.AccountName}} account was signed in to from a new device:\n\n{{.UserAgent}}\n{{.IP}}\n{{.Time}}\n\nIf this wasn't you, change your password right away.",
+				HTML: `<p>Hi {{.Username}},</p><p>Your {{.AccountName}} account was signed in to from a new device:</p><p>{{.UserAgent}}<br>{{.IP}}<br>{{.Time}}</p><p>If this wasn't you, change your password right away.</p>`,
+			},
+		},
+	}
+}
+
+func findEmailTemplateKind(name string) (*emailTemplateKind, error) {
+	for _, kind := range emailTemplateKinds() {
+		if kind.Name == name {
+			return &kind, nil
+		}
+	}
+	return nil, notFound("email template not found").WithCode(codeEmailTemplateNotFound)
+}
+
+// A supported locale, or "" for every locale
+func emailTemplateLocale(value string) (string, error) {
+	locale := strings.ToLower(strings.TrimSpace(value))
+	if _, ok := localeBundles[locale]; locale != "" && !ok {
+		return "", badRequest("invalid locale").With(fiber.Map{"supported": supportedLocales()})
+	}
+	return locale, nil
+}
+
+// Renders a kind of email for an account in a locale. The account's
+// template for the locale is used first, then its template for every
+// locale, then the default wording in the locale.
+func renderEmail(ctx context.Context, kindName string, accountId uuid.UUID, locale string, values map[string]interface{}, db *bun.DB) (*EmailContent, error) {
+	kind, err := findEmailTemplateKind(kindName)
+	if err != nil {
+		return nil, err
+	}
+
+	content := accountEmailTemplate(ctx, kind, accountId, locale, db)
+	return content.render(emailTemplateValues(ctx, accountId, values, db))
+}
+
+// The preview the request asks for, rendered with sample values
+func emailTemplatePreview(c *fiber.Ctx, currentUser *User, db *bun.DB) (*EmailContent, error) {
+	ctx := c.UserContext()
+	kind, err := findEmailTemplateKind(c.Params("kind"))
+	if err != nil {
+		return nil, err
+	}
+
+	locale := requestLocale(c)
+	if c.Query("locale") != "" {
+		if locale, err = emailTemplateLocale(c.Query("locale")); err != nil {
+			return nil, err
+		}
+	}
+
+	content := accountEmailTemplate(ctx, kind, currentUser.AccountId, locale, db)
+	if len(c.Body()) > 0 {
+		input := new(EmailTemplateInput)
+		if err := parseBody(c, input); err != nil {
+			return nil, err
+		}
+		content = &EmailContent{Subject: input.Subject, Text: input.Text, HTML: input.HTML}
+	}
+
+	rendered, err := content.render(emailTemplateValues(ctx, currentUser.AccountId, kind.Sample, db))
+	if err != nil {
+		return nil, badRequest("invalid template").With(fiber.Map{"error": err.Error(), "variables": kind.Variables})
+	}
+	return rendered, nil
+}
+
+// The account's template for a kind, or the default in the locale
+func accountEmailTemplate(ctx context.Context, kind *emailTemplateKind, accountId uuid.UUID, locale string, db *bun.DB) *EmailContent {
+	templates := []EmailTemplate{}
+	err := db.NewSelect().Model(&templates).
+		Where("account_id = ?", accountId).
+		Where("kind = ?", kind.Name).
+		Where("locale IN (?)", bun.In([]string{locale, ""})).
+		Order("locale DESC").
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	if len(templates) > 0 {
+		return &EmailContent{Subject: templates[0].Subject, Text: templates[0].Text, HTML: templates[0].HTML}
+	}
+
+	return &EmailContent{
+		Subject: translate(locale, kind.Default.Subject),
+		Text: translate(locale, kind.Default.Text),
+		HTML: translate(locale, kind.Default.HTML),
+	}
+}
+
+// The values a template is given: the kind's own, AccountName, and the
+// account's own variables as Vars
+func emailTemplateValues(ctx context.Context, accountId uuid.UUID, values map[string]interface{}, db *bun.DB) map[string]interface{} {
+	account := new(Account)
+	err := db.NewSelect().Model(account).Column("name", "email_variables").Where("id = ?", accountId).Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+
+	all := map[string]interface{}{}
+	for key, value := range values {
+		all[key] = value
+	}
+	all["AccountName"] = account.Name
+	all["Vars"] = account.EmailVariables
+	if account.EmailVariables == nil {
+		all["Vars"] = map[string]string{}
+	}
+	return all
+}
+
+func accountEmailVariables(ctx context.Context, accountId uuid.UUID, db *bun.DB) map[string]string {
+	return emailTemplateValues(ctx, accountId, nil, db)["Vars"].(map[string]string)
+}
+
+// Executes the templates. Unknown values are an error rather than blank,
+// so mistakes show when a template is saved.
+func (content *EmailContent) render(values map[string]interface{}) (*EmailContent, error) {
+	rendered := new(EmailContent)
+
+	subject, err := renderTextTemplate(content.Subject, values)
+	if err != nil {
+		return nil, err
+	}
+	// A value with a line break mustn't start another header
+	rendered.Subject = strings.Join(strings.Fields(subject), " ")
+
+	if rendered.Text, err = renderTextTemplate(content.Text, values); err != nil {
+		return nil, err
+	}
+	if content.HTML == "" {
+		return rendered, nil
+	}
+
+	parsed, err := htmltemplate.New("html").Option("missingkey=error").Parse(content.HTML)
+	if err != nil {
+		return nil, err
+	}
+	var html bytes.Buffer
+	if err := parsed.Execute(&html, values); err != nil {
+		return nil, err
+	}
+	rendered.HTML = html.String()
+
+	return rendered, nil
+}
+
+func renderTextTemplate(source string, values map[string]interface{}) (string, error) {
+	parsed, err := template.New("text").Option("missingkey=error").Parse(source)
+	if err != nil {
+		return "", err
+	}
+
+	var text bytes.Buffer
+	if err := parsed.Execute(&text, values); err != nil {
+		return "", err
+	}
+	return text.String(), nil
+}
@@ -0,0 +1,433 @@
+package goapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// ErasureRequest DB model. A user asks to be forgotten and, unless the
+// request is cancelled within the grace period, everything stored about
+// them is deleted or pseudonymized and a signed confirmation kept.
+type ErasureRequest struct {
+	bun.BaseModel `bun:"table:erasure_requests"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Status string `bun:",notnull"`
+	ScheduledFor time.Time `bun:",notnull"` // has idx with status
+	CompletedAt time.Time `bun:",nullzero"`
+	Confirmation *ErasureConfirmation `bun:"type:jsonb"`
+	Signature string `bun:",nullzero"` // of the confirmation
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	UserId uuid.UUID `bun:",type:uuid"` // has unique idx while pending
+	AccountId uuid.UUID `bun:",type:uuid"`
+	RequestedBy uuid.UUID `bun:",type:uuid"` // the user or an admin
+}
+
+// What an erasure removed, per table. The signature is the hex
+// HMAC-SHA256 of its JSON with the server's secret, so the record can be
+// shown not to have been changed since.
+type ErasureConfirmation struct {
+	RequestId uuid.UUID
+	AccountId uuid.UUID
+	UserId uuid.UUID
+	Deleted map[string]int64
+	Pseudonymized map[string]int64
+	ErasedAt time.Time
+}
+
+// Rows an erasure deletes from one table
+type erasureDelete struct {
+	Table string
+	Query *bun.DeleteQuery
+}
+
+// Erasure request statuses
+const (
+	erasurePending = "pending"
+	erasureCancelled = "cancelled"
+	erasureCompleted = "completed"
+)
+
+// ====================
+//        Setup
+// ====================
+
+var _ bun.BeforeAppendModelHook = (*ErasureRequest)(nil)
+func (r *ErasureRequest) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+		case *bun.UpdateQuery:
+			r.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+// Carries out erasures that are due every hour
+func startErasures(db *bun.DB, store Storage) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		for range ticker.C {
+			runErasures(db, store)
+		}
+	}()
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Schedules the current user's erasure after confirming their password
+func requestMyErasure(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+
+	input := new(User)
+	if err := c.BodyParser(input); err != nil || input.Password == "" {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("password confirmation required")
+	}
+
+	if !checkPasswordHash(input.Password, currentUser.Password) {
+		return badRequest("invalid password").WithCode(codeAuthInvalidPassword)
+	}
+
+	request, err := requestErasure(c.UserContext(), currentUser, currentUser, db)
+	if err != nil {
+		return err
+	}
+
+	c.Location(apiPath(c, "/me/erasure"))
+	return c.Status(fiber.StatusAccepted).JSON(request)
+}
+
+func getMyErasure(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+
+	request, err := latestErasureRequest(c.UserContext(), currentUser.ID, currentUser.AccountId, db)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(request)
+}
+
+func cancelMyErasure(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+
+	if err := cancelErasure(c.UserContext(), currentUser.ID, currentUser.AccountId, db); err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// Schedules a user's erasure on their behalf, e.g. for a request they
+// made outside the app
+func requestUserErasure(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	if err := validateUserChange(ctx, currentUser, c.Params("id"), db); err != nil {
+		return err
+	}
+
+	user, err := findAccountUser(ctx, currentUser.AccountId, c.Params("id"), db)
+	if err != nil {
+		return err
+	}
+
+	request, err := requestErasure(ctx, user, currentUser, db)
+	if err != nil {
+		return err
+	}
+
+	c.Location(apiPath(c, "/users/"+user.ID.String()+"/erasure"))
+	return c.Status(fiber.StatusAccepted).JSON(request)
+}
+
+// The user's latest erasure request, which outlives the user once it's
+// carried out
+func getUserErasure(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+
+	userId, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return notFound("erasure request not found").WithCode(codeErasureNotFound)
+	}
+
+	request, err := latestErasureRequest(c.UserContext(), userId, currentUser.AccountId, db)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(request)
+}
+
+func cancelUserErasure(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	userId, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return notFound("erasure request not found").WithCode(codeErasureNotFound)
+	}
+
+	if err := validateUserChange(ctx, currentUser, c.Params("id"), db); err != nil {
+		return err
+	}
+
+	if err := cancelErasure(ctx, userId, currentUser.AccountId, db); err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Schedules the user's erasure ERASURE_GRACE_DAYS from now
+func requestErasure(ctx context.Context, user *User, requester *User, db *bun.DB) (*ErasureRequest, error) {
+	request := new(ErasureRequest)
+	request.ID = newId()
+	request.Status = erasurePending
+	request.ScheduledFor = time.Now().AddDate(0, 0, intSetting("ERASURE_GRACE_DAYS"))
+	request.UserId = user.ID
+	request.AccountId = user.AccountId
+	request.RequestedBy = requester.ID
+
+	// The pending index only lets one request wait at a time
+	res, err := db.NewInsert().Model(request).Ignore().Exec(ctx)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return nil, conflict("erasure already requested").WithCode(codeErasurePending)
+	}
+
+	return request, nil
+}
+
+func latestErasureRequest(ctx context.Context, userId uuid.UUID, accountId uuid.UUID, db *bun.DB) (*ErasureRequest, error) {
+	request := new(ErasureRequest)
+	err := db.NewSelect().Model(request).
+		Where("user_id = ?", userId).
+		Where("account_id = ?", accountId).
+		Order("created_at DESC").
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		return nil, notFound("erasure request not found").WithCode(codeErasureNotFound)
+	}
+
+	return request, nil
+}
+
+// Cancels the user's pending erasure, if it hasn't been carried out yet
+func cancelErasure(ctx context.Context, userId uuid.UUID, accountId uuid.UUID, db *bun.DB) error {
+	res, err := db.NewUpdate().Model((*ErasureRequest)(nil)).
+		Set("status = ?", erasureCancelled).
+		Set("updated_at = ?", time.Now()).
+		Where("user_id = ?", userId).
+		Where("account_id = ?", accountId).
+		Where("status = ?", erasurePending).
+		Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return notFound("erasure request not found").WithCode(codeErasureNotFound)
+	}
+
+	return nil
+}
+
+// Carries out due erasures one at a time, so instances can share them
+func runErasures(db *bun.DB, store Storage) {
+	ctx := context.Background()
+
+	for {
+		files := []string{}
+		found := false
+		request := new(ErasureRequest)
+		err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			err := forUpdate(tx.NewSelect().Model(request).
+				Where("status = ?", erasurePending).
+				Where("scheduled_for <= ?", time.Now()).
+				Order("scheduled_for ASC").
+				Limit(1), true).
+				Scan(ctx)
+			if err != nil {
+				return nil
+			}
+			found = true
+
+			files, err = eraseUser(ctx, tx, request, store)
+			return err
+		})
+		if err != nil {
+			logger.Error().Err(err).Msg("erasure failed")
+			return
+		}
+		if !found {
+			return
+		}
+		forgetUserTokens(request.UserId)
+
+		// Files can't be put back, so they go once the rows are gone for good
+		for _, key := range files {
+			if err := store.Delete(key); err != nil {
+				logger.Error().Err(err).Str("key", key).Send()
+			}
+		}
+	}
+}
+
+// Deletes the user and what's stored about them, pseudonymizes the
+// audit log and events they appear in, and completes the request with a
+// signed confirmation. Returns the stored files to delete once committed.
+func eraseUser(ctx context.Context, tx bun.Tx, request *ErasureRequest, store Storage) ([]string, error) {
+	userId := request.UserId
+	confirmation := &ErasureConfirmation{
+		RequestId: request.ID,
+		AccountId: request.AccountId,
+		UserId: userId,
+		Deleted: map[string]int64{},
+		Pseudonymized: map[string]int64{},
+	}
+
+	// The user may already have been hard deleted, leaving only the rest
+	user := new(User)
+	tx.NewSelect().Model(user).WhereAllWithDeleted().
+		Where("id = ?", userId).
+		Where("account_id = ?", request.AccountId).
+		Scan(ctx)
+
+	files := []string{}
+	if key := avatarKey(store, userId, user.AvatarURL); key != "" {
+		files = append(files, key)
+	}
+
+	exportKeys := []string{}
+	err := tx.NewSelect().Model((*DataExport)(nil)).
+		Column("key").
+		Where("user_id = ?", userId).
+		Where("key != ''").
+		Scan(ctx, &exportKeys)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, exportKeys...)
+
+	deletes := []erasureDelete{
+		{"tokens", tx.NewDelete().Model((*Token)(nil)).Where("user_id = ?", userId)},
+		{"login_attempts", tx.NewDelete().Model((*LoginAttempt)(nil)).Where("user_id = ?", userId)},
+		{"tokens_archive", tx.NewDelete().TableExpr("tokens_archive").Where("user_id = ?", userId)},
+		{"login_attempts_archive", tx.NewDelete().TableExpr("login_attempts_archive").Where("user_id = ?", userId)},
+		{"consents", tx.NewDelete().Model((*Consent)(nil)).Where("user_id = ?", userId)},
+		{"group_members", tx.NewDelete().Model((*GroupMember)(nil)).Where("user_id = ?", userId)},
+		{"username_histories", tx.NewDelete().Model((*UsernameHistory)(nil)).Where("user_id = ?", userId)},
+		{"user_notes", tx.NewDelete().Model((*UserNote)(nil)).Where("user_id = ?", userId)},
+		{"user_activities", tx.NewDelete().Model((*UserActivity)(nil)).Where("user_id = ?", userId)},
+		{"password_resets", tx.NewDelete().Model((*PasswordReset)(nil)).Where("user_id = ?", userId)},
+		{"invites", tx.NewDelete().Model((*Invite)(nil)).Where("user_id = ?", userId)},
+		{"data_exports", tx.NewDelete().Model((*DataExport)(nil)).Where("user_id = ?", userId)},
+		{"users", tx.NewDelete().Model((*User)(nil)).WhereAllWithDeleted().ForceDelete().Where("id = ?", userId)},
+	}
+	if user.Email != "" {
+		deletes = append(deletes, erasureDelete{"emails", tx.NewDelete().Model((*Email)(nil)).
+			Where("account_id = ?", request.AccountId).
+			Where("? = ?", bun.Ident("to"), user.Email)})
+	}
+
+	for _, step := range deletes {
+		res, err := step.Query.Exec(ctx)
+		if err != nil {
+			return nil, err
+		}
+		confirmation.Deleted[step.Table], _ = res.RowsAffected()
+	}
+
+	// Entries stay countable and linked to each other, but no longer to the user
+	pseudonym := erasurePseudonym(userId)
+	for _, table := range []string{"audit_logs", "audit_logs_archive"} {
+		res, err := tx.NewUpdate().TableExpr("?", bun.Ident(table)).
+			Set("user_id = CASE WHEN user_id = ? THEN ? ELSE user_id END", userId, pseudonym).
+			Set("actor_id = CASE WHEN actor_id = ? THEN ? ELSE actor_id END", userId, pseudonym).
+			Set("path = replace(path, ?, ?)", userId.String(), pseudonym.String()).
+			Set("ip = ''").
+			Where("user_id = ? OR actor_id = ?", userId, userId).
+			Exec(ctx)
+		if err != nil {
+			return nil, err
+		}
+		confirmation.Pseudonymized[table], _ = res.RowsAffected()
+	}
+
+	res, err := tx.NewUpdate().Model((*Event)(nil)).
+		Set("user_id = ?", pseudonym).
+		Set("data = '{}'").
+		Where("user_id = ?", userId).
+		Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	confirmation.Pseudonymized["events"], _ = res.RowsAffected()
+
+	// Recorded after the events are pseudonymized, so subscribers learn
+	// which user to forget
+	err = recordEvent(ctx, tx, eventUserErased, request.AccountId, userId, map[string]interface{}{
+		"request": request.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	confirmation.ErasedAt = time.Now().UTC()
+	signature, err := signErasureConfirmation(confirmation)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Status = erasureCompleted
+	request.CompletedAt = confirmation.ErasedAt
+	request.Confirmation = confirmation
+	request.Signature = signature
+	_, err = tx.NewUpdate().Model(request).
+		Column("status", "completed_at", "confirmation", "signature", "updated_at").
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// A stable stand-in for an erased user's id. It can't be traced back to
+// them without the server's secret.
+func erasurePseudonym(userId uuid.UUID) uuid.UUID {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("JWT_SECRET")))
+	return uuid.NewHash(mac, uuid.Nil, userId[:], 8)
+}
+
+func signErasureConfirmation(confirmation *ErasureConfirmation) (string, error) {
+	data, err := json.Marshal(confirmation)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, []byte(os.Getenv("JWT_SECRET")))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,180 @@
+package goapi
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// Stable codes for every error the API returns, so clients can branch on
+// them instead of messages. Codes are never renamed or reused.
+const (
+	// Used when nothing more specific applies
+	codeBadRequest = "BAD_REQUEST"
+	codeUnauthorized = "UNAUTHORIZED"
+	codeForbidden = "FORBIDDEN"
+	codeNotFound = "NOT_FOUND"
+	codeConflict = "CONFLICT"
+	codeRateLimited = "RATE_LIMITED"
+	codeRequestTimeout = "REQUEST_TIMEOUT"
+	codeTimedOut = "TIMED_OUT"
+	codeDatabaseUnavailable = "DATABASE_UNAVAILABLE"
+	codePayloadTooLarge = "PAYLOAD_TOO_LARGE"
+	codeHeadersTooLarge = "HEADERS_TOO_LARGE"
+	codeInternal = "INTERNAL_ERROR"
+
+	codeInvalidInput = "INVALID_INPUT"
+	codeValidationFailed = "VALIDATION_FAILED"
+	codeInvalidFields = "INVALID_FIELDS"
+	codeInvalidIncludes = "INVALID_INCLUDES"
+	codePatchFailed = "PATCH_FAILED"
+	codeRequestFailed = "REQUEST_FAILED"
+	codeRouteNotFound = "ROUTE_NOT_FOUND"
+	codeApiVersionSunset = "API_VERSION_SUNSET"
+	codeFeatureDisabled = "FEATURE_DISABLED"
+	codeAlreadyExists = "ALREADY_EXISTS"
+	codeIdempotencyKeyReused = "IDEMPOTENCY_KEY_REUSED"
+	codeIdempotencyInProgress = "IDEMPOTENCY_IN_PROGRESS"
+
+	codeAuthUnauthorized = "AUTH_UNAUTHORIZED"
+	codeAuthForbidden = "AUTH_FORBIDDEN"
+	codeAuthInvalidCredentials = "AUTH_INVALID_CREDENTIALS"
+	codeAuthInvalidPassword = "AUTH_INVALID_PASSWORD"
+	codeAuthUserSuspended = "AUTH_USER_SUSPENDED"
+	codeAuthTokenFailed = "AUTH_TOKEN_FAILED"
+	codeCsrfInvalid = "AUTH_CSRF_INVALID"
+	codeAccountKeyInvalid = "ACCOUNT_KEY_INVALID"
+	codeConsentRequired = "CONSENT_REQUIRED"
+
+	codeAccountNotFound = "ACCOUNT_NOT_FOUND"
+	codeUserNotFound = "USER_NOT_FOUND"
+	codeUserEmailTaken = "USER_EMAIL_TAKEN"
+	codeUsernameTaken = "USER_USERNAME_TAKEN"
+	codeGroupNotFound = "GROUP_NOT_FOUND"
+	codeRoleNotFound = "ROLE_NOT_FOUND"
+	codeInviteNotFound = "INVITE_NOT_FOUND"
+	codeInviteInvalid = "INVITE_INVALID"
+	codePasswordResetInvalid = "PASSWORD_RESET_INVALID"
+	codeNoteNotFound = "NOTE_NOT_FOUND"
+	codeConsentDocumentNotFound = "CONSENT_DOCUMENT_NOT_FOUND"
+	codeWebhookNotFound = "WEBHOOK_NOT_FOUND"
+	codeWebhookDeliveryNotFound = "WEBHOOK_DELIVERY_NOT_FOUND"
+	codeEmailTemplateNotFound = "EMAIL_TEMPLATE_NOT_FOUND"
+	codeDataExportNotFound = "DATA_EXPORT_NOT_FOUND"
+	codeDataExportInProgress = "DATA_EXPORT_IN_PROGRESS"
+	codeErasureNotFound = "ERASURE_NOT_FOUND"
+	codeErasurePending = "ERASURE_PENDING"
+	codeHostedPagesSlugTaken = "HOSTED_PAGES_SLUG_TAKEN"
+	codeHostedPagesRedirectInvalid = "HOSTED_PAGES_REDIRECT_INVALID"
+	codeKeyNotFound = "KEY_NOT_FOUND"
+	codeKeyCertificateTaken = "KEY_CERTIFICATE_TAKEN"
+	codeKeyCertificateInvalid = "KEY_CERTIFICATE_INVALID"
+	codeQuotaExceeded = "QUOTA_EXCEEDED"
+	codePlanInvalid = "PLAN_INVALID"
+)
+
+// ====================
+//        Setup
+// ====================
+
+func initErrorCodeRoutes(api fiber.Router) {
+	api.Get("/errors", func(c *fiber.Ctx) error {
+		return c.JSON(errorCodes())
+	})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Every code with what it means, published for SDKs
+func errorCodes() map[string]string {
+	return map[string]string{
+		codeBadRequest: "The request could not be processed",
+		codeUnauthorized: "Authentication is required",
+		codeForbidden: "The request is not allowed",
+		codeNotFound: "The resource does not exist",
+		codeConflict: "The request conflicts with existing data",
+		codeRateLimited: "Too many requests",
+		codeRequestTimeout: "The request was not received in time",
+		codeTimedOut: "The request took longer than the server allows to handle",
+		codeDatabaseUnavailable: "The database can't be reached; retry after the Retry-After header's seconds",
+		codePayloadTooLarge: "The request body is larger than the server accepts",
+		codeHeadersTooLarge: "The request headers are larger than the server accepts",
+		codeInternal: "An unexpected server error",
+		codeInvalidInput: "The request body or parameters are malformed",
+		codeValidationFailed: "Fields in the request body are invalid, see fields",
+		codeInvalidFields: "?fields= names a field the response doesn't have, see fields",
+		codeInvalidIncludes: "?include= names a relation the response can't include, see includes",
+		codePatchFailed: "The patch could not be applied to the resource",
+		codeRequestFailed: "The change could not be made",
+		codeRouteNotFound: "No route matches the method and path",
+		codeApiVersionSunset: "The API version has passed its sunset date, see the Link header",
+		codeFeatureDisabled: "The feature is turned off for the account",
+		codeAlreadyExists: "Something with the same name already exists",
+		codeIdempotencyKeyReused: "The Idempotency-Key was already used for a different request",
+		codeIdempotencyInProgress: "The first request with the Idempotency-Key has not finished",
+		codeAuthUnauthorized: "The token is missing, invalid, or expired",
+		codeAuthForbidden: "The user lacks the permission the route requires",
+		codeAuthInvalidCredentials: "The username, email, or password is wrong",
+		codeAuthInvalidPassword: "The password given to confirm a change is wrong",
+		codeAuthUserSuspended: "The user is suspended",
+		codeAuthTokenFailed: "A token could not be issued",
+		codeCsrfInvalid: "The X-CSRF-Token header is missing or does not match the cookie",
+		codeAccountKeyInvalid: "The Account-Key header is missing or unknown",
+		codeConsentRequired: "The user must accept the latest required documents",
+		codeAccountNotFound: "The account does not exist",
+		codeUserNotFound: "The user does not exist in the account",
+		codeUserEmailTaken: "Another user in the account has the email",
+		codeUsernameTaken: "The username is in use or recently was",
+		codeGroupNotFound: "The group does not exist in the account",
+		codeRoleNotFound: "The role does not exist in the account",
+		codeInviteNotFound: "The invite does not exist in the account",
+		codeInviteInvalid: "The invite or invite link is invalid, used up, or expired",
+		codePasswordResetInvalid: "The password reset link is invalid, used, or expired",
+		codeNoteNotFound: "The note does not exist",
+		codeConsentDocumentNotFound: "The consent document does not exist",
+		codeWebhookNotFound: "The webhook does not exist in the account",
+		codeWebhookDeliveryNotFound: "The delivery does not exist for the webhook",
+		codeEmailTemplateNotFound: "There is no such kind of email",
+		codeDataExportNotFound: "The user has no data export",
+		codeDataExportInProgress: "The user already has a data export being built",
+		codeErasureNotFound: "The user has no erasure request, or none that can be cancelled",
+		codeErasurePending: "The user's erasure is already scheduled",
+		codeHostedPagesSlugTaken: "Another account's hosted pages already use the slug",
+		codeHostedPagesRedirectInvalid: "The redirect_uri is not one of the account's redirect URLs",
+		codeKeyNotFound: "The key does not exist in the account",
+		codeKeyCertificateTaken: "Another key is already bound to the client certificate",
+		codeKeyCertificateInvalid: "The client certificate is not a PEM certificate or SHA-256 fingerprint, or isn't the one the request was made with",
+		codeQuotaExceeded: "The account has used its monthly requests, see the X-Quota-Reset header",
+		codePlanInvalid: "The plan is not one of QUOTA_PLANS",
+	}
+}
+
+// The code for errors that don't set one
+func defaultErrorCode(status int) string {
+	switch status {
+		case fiber.StatusBadRequest:
+			return codeBadRequest
+		case fiber.StatusUnauthorized:
+			return codeUnauthorized
+		case fiber.StatusForbidden:
+			return codeForbidden
+		case fiber.StatusNotFound:
+			return codeNotFound
+		case fiber.StatusConflict:
+			return codeConflict
+		case fiber.StatusUnprocessableEntity:
+			return codeValidationFailed
+		case fiber.StatusTooManyRequests:
+			return codeRateLimited
+		case fiber.StatusRequestTimeout:
+			return codeRequestTimeout
+		case fiber.StatusRequestEntityTooLarge:
+			return codePayloadTooLarge
+		case fiber.StatusRequestHeaderFieldsTooLarge:
+			return codeHeadersTooLarge
+	}
+	if status >= 500 {
+		return codeInternal
+	}
+	return codeBadRequest
+}
@@ -0,0 +1,184 @@
+package goapi
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+const mimeProblemJSON = "application/problem+json"
+
+// An error with the status and message the client should see. Data is
+// merged into the response body alongside the message.
+type AppError struct {
+	Status int
+	Code string // see error_codes.go, defaults by status
+	Message string
+	Data fiber.Map
+	Err error
+}
+
+func (e *AppError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+func (e *AppError) WithCode(code string) *AppError {
+	e.Code = code
+	return e
+}
+
+// Extra fields for the response body
+func (e *AppError) With(data fiber.Map) *AppError {
+	e.Data = data
+	return e
+}
+
+func badRequest(message string) *AppError {
+	return &AppError{Status: fiber.StatusBadRequest, Message: message}
+}
+
+func unauthorized(message string) *AppError {
+	return &AppError{Status: fiber.StatusUnauthorized, Message: message}
+}
+
+func forbidden(message string) *AppError {
+	return &AppError{Status: fiber.StatusForbidden, Message: message}
+}
+
+func notFound(message string) *AppError {
+	return &AppError{Status: fiber.StatusNotFound, Message: message}
+}
+
+func conflict(message string) *AppError {
+	return &AppError{Status: fiber.StatusConflict, Message: message}
+}
+
+func gone(message string) *AppError {
+	return &AppError{Status: fiber.StatusGone, Message: message}
+}
+
+func unprocessable(message string) *AppError {
+	return &AppError{Status: fiber.StatusUnprocessableEntity, Message: message}
+}
+
+func tooManyRequests(message string) *AppError {
+	return &AppError{Status: fiber.StatusTooManyRequests, Message: message}
+}
+
+func upgradeRequired(message string) *AppError {
+	return &AppError{Status: fiber.StatusUpgradeRequired, Message: message}
+}
+
+// An unexpected failure. The cause is logged and reported but never shown.
+// Running past REQUEST_TIMEOUT_SECONDS or losing the database is reported
+// as unavailable instead.
+func internalError(err error) *AppError {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &AppError{Status: fiber.StatusServiceUnavailable, Code: codeTimedOut, Message: "the request took too long", Err: err}
+	}
+	if isConnectionError(err) {
+		return databaseUnavailable(err)
+	}
+	return &AppError{Status: fiber.StatusInternalServerError, Message: "something went wrong", Err: err}
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Fiber's ErrorHandler. Every error a handler or middleware returns ends up
+// here and leaves as {"code": ..., "message": ..., "request_id": ...} with its status, or
+// as RFC 7807 problem details for clients that accept application/problem+json.
+// Messages are translated into the request's locale where a bundle has them.
+func errorHandler(c *fiber.Ctx, err error) error {
+	// Server errors were already reported by reportErrors
+	appErr := toAppError(err)
+	code := appErr.Code
+	if code == "" {
+		code = defaultErrorCode(appErr.Status)
+	}
+
+	locale := requestLocale(c)
+	message := translate(locale, appErr.Message)
+	c.Set(fiber.HeaderContentLanguage, locale)
+	if code == codeDatabaseUnavailable {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(databaseBreaker.retryAfter()))
+	}
+
+	body := fiber.Map{}
+	for key, value := range appErr.Data {
+		body[key] = translateValue(locale, value)
+	}
+	body["code"] = code
+
+	if c.Accepts(fiber.MIMEApplicationJSON, mimeProblemJSON) == mimeProblemJSON {
+		body["type"] = "about:blank"
+		if base := os.Getenv("ERROR_DOCS_URL"); base != "" {
+			body["type"] = fmt.Sprintf("%s/%s", strings.TrimRight(base, "/"), code)
+		}
+		body["title"] = utils.StatusMessage(appErr.Status)
+		body["status"] = appErr.Status
+		body["detail"] = message
+		body["instance"] = fmt.Sprintf("urn:request:%s", requestId(c))
+
+		c.Status(appErr.Status)
+		c.Set(fiber.HeaderContentType, mimeProblemJSON)
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		return c.Send(raw)
+	}
+
+	body["message"] = message
+	body["request_id"] = requestId(c)
+
+	return c.Status(appErr.Status).JSON(body)
+}
+
+// The status a response will have once err, if any, has been handled
+func responseStatus(c *fiber.Ctx, err error) int {
+	if err == nil {
+		return c.Response().StatusCode()
+	}
+	return toAppError(err).Status
+}
+
+func toAppError(err error) *AppError {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return &AppError{Status: fiberErr.Code, Message: fiberErr.Message, Err: err}
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return &AppError{Status: fiber.StatusNotFound, Message: "not found", Err: err}
+	}
+
+	// Writes that would break a unique index are conflicts wherever they
+	// aren't told apart more specifically
+	if uniqueViolation(err) != "" {
+		return &AppError{Status: fiber.StatusConflict, Code: codeAlreadyExists, Message: "already exists", Err: err}
+	}
+
+	return internalError(err)
+}
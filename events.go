@@ -0,0 +1,505 @@
+package goapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+// Event DB model. Events are written in the same transaction as the
+// change they describe, so the table is also an outbox the dispatcher
+// publishes from.
+type Event struct {
+	bun.BaseModel `bun:"table:events"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Type string
+	Data map[string]interface{} `bun:"type:jsonb"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	DispatchedAt time.Time `bun:",nullzero" json:"-"` // has partial idx while null
+
+	// Relations
+	AccountId uuid.UUID `bun:",type:uuid"` // has idx
+	UserId uuid.UUID `bun:",type:uuid,nullzero"`
+}
+
+// Sending events to webhooks again, e.g. {"From": "2030-01-01T00:00:00Z",
+// "To": "2030-01-02T00:00:00Z"}. Types and WebhookId narrow what's sent.
+type EventReplayInput struct {
+	From time.Time `validate:"required"`
+	To time.Time `validate:"required"`
+	Types []string
+	WebhookId uuid.UUID
+}
+
+// Event types
+const (
+	eventUserCreated = "user.created"
+	eventUserUpdated = "user.updated"
+	eventUserDeleted = "user.deleted"
+	eventUserSuspended = "user.suspended"
+	eventUserUnsuspended = "user.unsuspended"
+	eventUserErased = "user.erased"
+	eventLoginSucceeded = "login.succeeded"
+	eventLoginFailed = "login.failed"
+	eventTokenRevoked = "token.revoked"
+	eventQuotaWarning = "quota.warning"
+	eventUserRoleChanged = "user.role_changed"
+	eventKeyCreated = "key.created"
+	eventKeyRevoked = "key.revoked"
+)
+
+// Events recorded by any instance, fanned out to this instance's live
+// connections as their notifications arrive
+type EventHub struct {
+	mu sync.Mutex
+	subscribers map[chan *Event]uuid.UUID // to the account they follow
+}
+
+const (
+	// Notified with each event once its transaction commits
+	eventsChannel = "events"
+
+	// Postgres caps notification payloads just under 8000 bytes
+	eventNotificationLimit = 7900
+
+	// Live events a slow connection may fall behind by before it misses some
+	eventSubscriberBuffer = 64
+
+	// Events dispatched per transaction
+	eventDispatchBatchSize = 100
+
+	// The most events one replay may send
+	eventReplayLimit = 10000
+
+	// The most missed events a reconnecting stream is sent
+	eventStreamResumeLimit = 100
+
+	// How often an idle stream is sent a comment to keep it open
+	eventStreamHeartbeat = 15 * time.Second
+)
+
+// ====================
+//        Setup
+// ====================
+
+func initEventRoutes(api fiber.Router, db *bun.DB) {
+	routes := api.Group("/events", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	})
+
+	routes.Get("/", permit(db, permissionEventsRead), func(c *fiber.Ctx) error {
+		return getEvents(c, db)
+	})
+
+	routes.Get("/stream", permit(db, permissionEventsRead), func(c *fiber.Ctx) error {
+		return streamEvents(c, db)
+	})
+
+	routes.Post("/replay", permit(db, permissionWebhooksManage), func(c *fiber.Ctx) error {
+		return replayEvents(c, db)
+	})
+}
+
+var liveEvents = &EventHub{subscribers: map[chan *Event]uuid.UUID{}}
+
+// Publishes committed events as soon as their transaction's notification
+// arrives, and every 30 seconds for any a notification was missed for.
+// broker may be nil, in which case events only go to webhooks.
+// Notifications also go to live connections on every instance. Only
+// Postgres notifies, so on other databases events are polled for every
+// second and go to the live connections of the instance dispatching them.
+func startEventDispatcher(db *bun.DB, broker EventBroker) {
+	ctx := context.Background()
+
+	if !isDialect(db, dialect.PG) {
+		go func() {
+			for range time.Tick(time.Second) {
+				dispatchEvents(db, broker)
+			}
+		}()
+		return
+	}
+
+	listener := pgdriver.NewListener(db)
+	if err := listener.Listen(ctx, eventsChannel); err != nil {
+		logger.Error().Err(err).Msg("listening for events failed, polling only")
+	}
+	notifications := listener.Channel()
+
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		for {
+			select {
+				case notification := <-notifications:
+					event := new(Event)
+					if err := json.Unmarshal([]byte(notification.Payload), event); err == nil {
+						liveEvents.publish(event)
+					}
+				case <-ticker.C:
+			}
+			dispatchEvents(db, broker)
+		}
+	}()
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// The account's latest 100 events, optionally of one ?type= and between
+// ?from and ?to (RFC 3339)
+func getEvents(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	events := []Event{}
+	query := db.NewSelect().Model(&events).
+		Where("account_id = ?", currentUser.AccountId).
+		Order("created_at DESC").
+		Limit(100)
+
+	if eventType := c.Query("type"); eventType != "" {
+		query = query.Where("type = ?", eventType)
+	}
+
+	if value := c.Query("from"); value != "" {
+		from, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return badRequest("invalid from")
+		}
+		query = query.Where("created_at >= ?", from)
+	}
+
+	if value := c.Query("to"); value != "" {
+		to, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return badRequest("invalid to")
+		}
+		query = query.Where("created_at < ?", to)
+	}
+
+	if err := query.Scan(ctx); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return an empty array
+	}
+
+	return c.JSON(events)
+}
+
+// Streams the account's events as server-sent events while they happen,
+// optionally only those of ?type=login.failed,user.created. Connections
+// end after WRITE_TIMEOUT_SECONDS, and browsers reconnecting with
+// Last-Event-ID are sent what they missed first.
+func streamEvents(c *fiber.Ctx, db *bun.DB) error {
+	ctx := context.Background()
+	currentUser := c.Locals("user").(*User)
+
+	types := []string{}
+	if value := c.Query("type"); value != "" {
+		normalized, err := normalizeEventTypes(splitList(value))
+		if err != nil {
+			return err
+		}
+		if normalized[0] != "*" {
+			types = normalized
+		}
+	}
+	wanted := func(event *Event) bool {
+		return len(types) == 0 || stringInSlice(event.Type, types)
+	}
+
+	// Follow along before catching up, so nothing falls in between
+	live := liveEvents.subscribe(currentUser.AccountId)
+
+	missed := []Event{}
+	if lastId, err := uuid.Parse(c.Get("Last-Event-ID")); err == nil {
+		query := db.NewSelect().Model(&missed).
+			Where("account_id = ?", currentUser.AccountId).
+			Where("created_at > (SELECT created_at FROM events WHERE id = ?)", lastId).
+			Order("created_at ASC").
+			Limit(eventStreamResumeLimit)
+		if len(types) > 0 {
+			query = query.Where("type IN (?)", bun.In(types))
+		}
+		if err := query.Scan(ctx); err != nil {
+			requestLogger(c).Error().Err(err).Send()
+		}
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set("X-Accel-Buffering", "no")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer liveEvents.unsubscribe(live)
+
+		sent := map[uuid.UUID]bool{}
+		for i := range missed {
+			writeServerSentEvent(w, &missed[i])
+			sent[missed[i].ID] = true
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+
+		ticker := time.NewTicker(eventStreamHeartbeat)
+		defer ticker.Stop()
+
+		for {
+			select {
+				case event := <-live:
+					if !wanted(event) || sent[event.ID] {
+						continue
+					}
+					writeServerSentEvent(w, event)
+				case <-ticker.C:
+					w.WriteString(": heartbeat\n\n")
+			}
+
+			// Fails once the client has gone
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// Queues the account's events from a time range for its webhooks again,
+// as new deliveries, so receivers can catch up on anything they lost.
+// Each goes to the webhooks subscribed to it now.
+func replayEvents(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(EventReplayInput)
+	if err := parseBody(c, input); err != nil {
+		return err
+	}
+	if !input.From.Before(input.To) {
+		return badRequest("from must be before to")
+	}
+
+	query := db.NewSelect().Model((*Event)(nil)).
+		Where("account_id = ?", currentUser.AccountId).
+		Where("created_at >= ?", input.From).
+		Where("created_at < ?", input.To)
+	if len(input.Types) > 0 {
+		query = query.Where("type IN (?)", bun.In(input.Types))
+	}
+
+	count, err := query.Count(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	if count > eventReplayLimit {
+		return badRequest("too many events to replay, narrow the range").With(fiber.Map{"events": count, "limit": eventReplayLimit})
+	}
+
+	if input.WebhookId != uuid.Nil {
+		if _, err := findWebhook(ctx, input.WebhookId.String(), currentUser.AccountId, db); err != nil {
+			return err
+		}
+	}
+
+	events := []Event{}
+	if err := query.Model(&events).Order("created_at ASC").Scan(ctx); err != nil {
+		return internalError(err)
+	}
+
+	deliveries := 0
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		for i := range events {
+			queued, err := queueWebhookDeliveries(ctx, tx, &events[i], input.WebhookId, false)
+			if err != nil {
+				return err
+			}
+			deliveries += len(queued)
+		}
+		return nil
+	})
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"events": len(events),
+		"deliveries": deliveries,
+	})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Every event type, which webhooks may subscribe to
+func eventTypes() []string {
+	return []string{
+		eventUserCreated,
+		eventUserUpdated,
+		eventUserDeleted,
+		eventUserSuspended,
+		eventUserUnsuspended,
+		eventUserErased,
+		eventLoginSucceeded,
+		eventLoginFailed,
+		eventTokenRevoked,
+		eventQuotaWarning,
+		eventUserRoleChanged,
+		eventKeyCreated,
+		eventKeyRevoked,
+	}
+}
+
+// Records a domain event. Pass the transaction making the change it
+// describes, so the event is kept if and only if the change is, and the
+// dispatcher is notified once it commits.
+func recordEvent(ctx context.Context, db bun.IDB, eventType string, accountId uuid.UUID, userId uuid.UUID, data map[string]interface{}) error {
+	event := new(Event)
+	event.ID = newId()
+	event.Type = eventType
+	event.AccountId = accountId
+	event.UserId = userId
+	event.Data = data
+	event.CreatedAt = time.Now()
+
+	if _, err := db.NewInsert().Model(event).Exec(ctx); err != nil {
+		return err
+	}
+
+	// Postgres holds notifications until the transaction commits. Other
+	// databases leave the dispatcher to find the event.
+	if !isDialect(db, dialect.PG) {
+		return nil
+	}
+	_, err := db.NewSelect().ColumnExpr("pg_notify(?, ?)", eventsChannel, eventNotification(event)).Exec(ctx)
+	return err
+}
+
+// The event as its notification carries it, leaving out the data should
+// it not fit
+func eventNotification(event *Event) string {
+	payload, err := json.Marshal(event)
+	if err != nil || len(payload) > eventNotificationLimit {
+		trimmed := *event
+		trimmed.Data = nil
+		payload, _ = json.Marshal(&trimmed)
+	}
+	return string(payload)
+}
+
+func writeServerSentEvent(w *bufio.Writer, event *Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
+
+// Follows the account's live events until unsubscribed
+func (hub *EventHub) subscribe(accountId uuid.UUID) chan *Event {
+	events := make(chan *Event, eventSubscriberBuffer)
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.subscribers[events] = accountId
+
+	return events
+}
+
+func (hub *EventHub) unsubscribe(events chan *Event) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	delete(hub.subscribers, events)
+}
+
+// Hands the event to each subscriber following its account, skipping any
+// that are too far behind rather than holding up the rest
+func (hub *EventHub) publish(event *Event) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for events, accountId := range hub.subscribers {
+		if accountId != event.AccountId {
+			continue
+		}
+		select {
+			case events <- event:
+			default:
+		}
+	}
+}
+
+// Publishes undispatched events, oldest first, until none are left.
+// Each batch is claimed, queued, and marked in one transaction, so an
+// event is queued for webhooks exactly once however many instances are
+// running. Should the broker fail, the batch is left for the next run, so
+// it may see an event more than once; its id tells them apart.
+func dispatchEvents(db *bun.DB, broker EventBroker) {
+	ctx := context.Background()
+
+	for {
+		sent := []WebhookDelivery{}
+		events := []Event{}
+		err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			err := forUpdate(tx.NewSelect().Model(&events).
+				Where("dispatched_at IS NULL").
+				Order("created_at ASC").
+				Limit(eventDispatchBatchSize), true).
+				Scan(ctx)
+			if err != nil || len(events) == 0 {
+				return err
+			}
+
+			ids := []uuid.UUID{}
+			for i := range events {
+				queued, err := queueWebhookDeliveries(ctx, tx, &events[i], uuid.Nil, true)
+				if err != nil {
+					return err
+				}
+				sent = append(sent, queued...)
+				ids = append(ids, events[i].ID)
+			}
+
+			if broker != nil {
+				if err := broker.Publish(ctx, events); err != nil {
+					return err
+				}
+			}
+
+			_, err = tx.NewUpdate().Model((*Event)(nil)).
+				Set("dispatched_at = ?", time.Now()).
+				Where("id IN (?)", bun.In(ids)).
+				Exec(ctx)
+			return err
+		})
+		if err != nil {
+			logger.Error().Err(err).Msg("event dispatch failed")
+			return
+		}
+
+		// Only send once the deliveries are committed
+		for _, delivery := range sent {
+			go attemptWebhookDelivery(db, delivery)
+		}
+		if !isDialect(db, dialect.PG) {
+			for i := range events {
+				liveEvents.publish(&events[i])
+			}
+		}
+
+		if len(events) < eventDispatchBatchSize {
+			return
+		}
+	}
+}
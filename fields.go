@@ -0,0 +1,152 @@
+package goapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/uptrace/bun"
+)
+
+// ====================
+//      Utilities
+// ====================
+
+// Trims a response value, or each value in a slice, to the fields named in
+// ?fields=, e.g. ?fields=id,username,role. Names match the response's keys
+// without regard to case. Without ?fields= the value is returned as is.
+func sparseFields(c *fiber.Ctx, value interface{}) (interface{}, error) {
+	requested := splitList(c.Query("fields"))
+	if len(requested) == 0 {
+		return value, nil
+	}
+
+	names := jsonFieldNames(reflect.TypeOf(value))
+	keep := map[string]bool{}
+	unknown := []string{}
+	for _, name := range requested {
+		if key, ok := names[strings.ToLower(name)]; ok {
+			keep[key] = true
+		} else {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, badRequest(fmt.Sprintf("unknown fields: %s", strings.Join(unknown, ", "))).
+			WithCode(codeInvalidFields).
+			With(fiber.Map{"fields": availableFields(names)})
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return nil, internalError(err)
+	}
+
+	switch decoded := decoded.(type) {
+		case []interface{}:
+			for _, item := range decoded {
+				pickFields(item, keep)
+			}
+		default:
+			pickFields(decoded, keep)
+	}
+
+	return decoded, nil
+}
+
+// The JSON keys a struct, or a slice or pointer to one, is encoded with,
+// by their lowercase form
+func jsonFieldNames(t reflect.Type) map[string]string {
+	for t != nil && (t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice) {
+		t = t.Elem()
+	}
+
+	names := map[string]string{}
+	if t == nil || t.Kind() != reflect.Struct {
+		return names
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() || field.Anonymous {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names[strings.ToLower(name)] = name
+	}
+
+	return names
+}
+
+// Loads the relations named in ?include=, e.g. ?include=account,tokens,
+// along with a read, so clients needn't fetch them one by one. allowed
+// maps each name a client may give to the model's relation.
+func includeRelations(c *fiber.Ctx, allowed map[string]string) (func(*bun.SelectQuery) *bun.SelectQuery, error) {
+	relations := []string{}
+	unknown := []string{}
+	seen := map[string]bool{}
+	for _, name := range splitList(c.Query("include")) {
+		relation, ok := allowed[strings.ToLower(name)]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		if !seen[relation] {
+			seen[relation] = true
+			relations = append(relations, relation)
+		}
+	}
+	if len(unknown) > 0 {
+		names := []string{}
+		for name := range allowed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, badRequest(fmt.Sprintf("unknown includes: %s", strings.Join(unknown, ", "))).
+			WithCode(codeInvalidIncludes).
+			With(fiber.Map{"includes": names})
+	}
+
+	return func(q *bun.SelectQuery) *bun.SelectQuery {
+		for _, relation := range relations {
+			q = q.Relation(relation)
+		}
+		return q
+	}, nil
+}
+
+func availableFields(names map[string]string) []string {
+	fields := []string{}
+	for _, name := range names {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func pickFields(item interface{}, keep map[string]bool) {
+	object, ok := item.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for key := range object {
+		if !keep[key] {
+			delete(object, key)
+		}
+	}
+}
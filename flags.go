@@ -0,0 +1,328 @@
+package goapi
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// Flags the API itself checks, and whether they're on when nobody has defined them
+const (
+	flagAnonymousUsers = "anonymous_users"
+	flagInviteLinks = "invite_links"
+)
+
+func defaultFlags() map[string]bool {
+	return map[string]bool{
+		flagAnonymousUsers: true,
+		flagInviteLinks: true,
+	}
+}
+
+var flagKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+// FeatureFlag DB model. An enabled flag is on for Rollout percent of accounts.
+type FeatureFlag struct {
+	bun.BaseModel `bun:"table:feature_flags"`
+	Key string `bun:",pk"`
+	Description string
+	Enabled bool `bun:",notnull"`
+	Rollout int `bun:",notnull,default:100"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	Overrides []*FlagOverride `bun:"rel:has-many,join:key=flag_key"`
+}
+
+// FlagOverride DB model, turning a flag on or off for one account
+type FlagOverride struct {
+	bun.BaseModel `bun:"table:flag_overrides"`
+	FlagKey string `bun:",pk"`
+	AccountId uuid.UUID `bun:",pk,type:uuid"`
+	Enabled bool `bun:",notnull"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+}
+
+// Flags and overrides are read on every check, so they're kept in memory
+// and reloaded whenever they change
+var (
+	flagsMutex sync.RWMutex
+	flagsLoaded bool
+	flagsByKey map[string]FeatureFlag
+	flagOverrides map[string]map[uuid.UUID]bool
+)
+
+// ====================
+//        Setup
+// ====================
+
+var _ bun.BeforeAppendModelHook = (*FeatureFlag)(nil)
+func (f *FeatureFlag) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+		case *bun.UpdateQuery:
+			f.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func initFlagRoutes(api fiber.Router, db *bun.DB) {
+	api.Get("/flags", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	}, func(c *fiber.Ctx) error {
+		return getMyFlags(c, db)
+	})
+
+	// Flags are defined for the whole deployment, so only operators manage them
+	routes := api.Group("/operator/flags", requireOperator)
+
+	routes.Get("/", func(c *fiber.Ctx) error {
+		return getFlags(c, db)
+	})
+
+	routes.Put("/:key", func(c *fiber.Ctx) error {
+		return saveFlag(c, db)
+	})
+
+	routes.Delete("/:key", func(c *fiber.Ctx) error {
+		return deleteFlag(c, db)
+	})
+
+	routes.Put("/:key/accounts/:accountId", func(c *fiber.Ctx) error {
+		return saveFlagOverride(c, db)
+	})
+
+	routes.Delete("/:key/accounts/:accountId", func(c *fiber.Ctx) error {
+		return deleteFlagOverride(c, db)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Every known flag and whether it's on for the current user's account
+func getMyFlags(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+
+	flags := map[string]bool{}
+	for key := range defaultFlags() {
+		flags[key] = IsEnabled(currentUser.AccountId, key, db)
+	}
+
+	loadFlags(db)
+	flagsMutex.RLock()
+	keys := []string{}
+	for key := range flagsByKey {
+		keys = append(keys, key)
+	}
+	flagsMutex.RUnlock()
+
+	for _, key := range keys {
+		flags[key] = IsEnabled(currentUser.AccountId, key, db)
+	}
+
+	return c.JSON(flags)
+}
+
+func getFlags(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+
+	flags := []FeatureFlag{}
+	err := db.NewSelect().Model(&flags).Relation("Overrides").Order("key ASC").Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return an empty array
+	}
+
+	return c.JSON(flags)
+}
+
+// Creates or replaces a flag definition
+func saveFlag(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+
+	flag := new(FeatureFlag)
+	flag.Rollout = 100
+	if err := c.BodyParser(flag); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	flag.Key = c.Params("key")
+	if !flagKeyPattern.MatchString(flag.Key) {
+		return badRequest("invalid flag key")
+	}
+	if flag.Rollout < 0 || flag.Rollout > 100 {
+		return badRequest("rollout must be between 0 and 100")
+	}
+
+	flag.UpdatedAt = time.Now()
+	q := db.NewInsert().Model(flag)
+	_, err := upsert(q, "key").
+		Set("description = " + insertedValue(q, "description")).
+		Set("enabled = " + insertedValue(q, "enabled")).
+		Set("rollout = " + insertedValue(q, "rollout")).
+		Set("updated_at = " + insertedValue(q, "updated_at")).
+		Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	forgetFlags()
+
+	return c.JSON(flag)
+}
+
+func deleteFlag(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	key := c.Params("key")
+
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().Model((*FlagOverride)(nil)).Where("flag_key = ?", key).Exec(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewDelete().Model((*FeatureFlag)(nil)).Where("? = ?", bun.Ident("key"), key).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return internalError(err)
+	}
+	forgetFlags()
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// Turns a flag on or off for one account, regardless of its rollout
+func saveFlagOverride(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+
+	override := new(FlagOverride)
+	if err := c.BodyParser(override); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	accountId, err := uuid.Parse(c.Params("accountId"))
+	if err != nil {
+		return badRequest("invalid account")
+	}
+	override.AccountId = accountId
+	override.FlagKey = c.Params("key")
+	if !flagKeyPattern.MatchString(override.FlagKey) {
+		return badRequest("invalid flag key")
+	}
+
+	q := db.NewInsert().Model(override)
+	_, err = upsert(q, "flag_key, account_id").
+		Set("enabled = " + insertedValue(q, "enabled")).
+		Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	forgetFlags()
+
+	return c.JSON(override)
+}
+
+func deleteFlagOverride(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+
+	_, err := db.NewDelete().Model((*FlagOverride)(nil)).
+		Where("flag_key = ?", c.Params("key")).
+		Where("account_id = ?", c.Params("accountId")).
+		Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	forgetFlags()
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Whether a flag is on for an account: its override if it has one, otherwise
+// the flag's rollout, otherwise the API's default for flags nobody has defined
+func IsEnabled(accountId uuid.UUID, flag string, db *bun.DB) bool {
+	loadFlags(db)
+
+	flagsMutex.RLock()
+	defer flagsMutex.RUnlock()
+
+	if enabled, ok := flagOverrides[flag][accountId]; ok {
+		return enabled
+	}
+
+	definition, ok := flagsByKey[flag]
+	if !ok {
+		return defaultFlags()[flag]
+	}
+
+	return definition.Enabled && rolloutBucket(flag, accountId) < definition.Rollout
+}
+
+// A stable 0-99 bucket per account and flag, so raising a rollout only adds accounts
+func rolloutBucket(flag string, accountId uuid.UUID) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(fmt.Sprintf("%s:%s", flag, accountId)))
+	return int(hash.Sum32() % 100)
+}
+
+// Loads flags and overrides into memory unless they already are
+func loadFlags(db *bun.DB) {
+	flagsMutex.RLock()
+	loaded := flagsLoaded
+	flagsMutex.RUnlock()
+	if loaded {
+		return
+	}
+
+	ctx := context.Background()
+	flags := []FeatureFlag{}
+	if err := db.NewSelect().Model(&flags).Scan(ctx); err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	overrides := []FlagOverride{}
+	if err := db.NewSelect().Model(&overrides).Scan(ctx); err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	byKey := map[string]FeatureFlag{}
+	for _, flag := range flags {
+		byKey[flag.Key] = flag
+	}
+
+	byFlag := map[string]map[uuid.UUID]bool{}
+	for _, override := range overrides {
+		if byFlag[override.FlagKey] == nil {
+			byFlag[override.FlagKey] = map[uuid.UUID]bool{}
+		}
+		byFlag[override.FlagKey][override.AccountId] = override.Enabled
+	}
+
+	flagsMutex.Lock()
+	flagsByKey = byKey
+	flagOverrides = byFlag
+	flagsLoaded = true
+	flagsMutex.Unlock()
+}
+
+// Drops the in-memory flags so the next check reloads them
+func forgetFlags() {
+	flagsMutex.Lock()
+	flagsLoaded = false
+	flagsMutex.Unlock()
+}
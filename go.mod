@@ -3,36 +3,67 @@ module goapi
 go 1.18
 
 require (
+	github.com/casbin/casbin/v2 v2.70.0
+	github.com/go-playground/validator/v10 v10.11.2
+	github.com/go-sql-driver/mysql v1.7.1
 	github.com/gofiber/fiber/v2 v2.31.0
+	github.com/gofiber/websocket/v2 v2.0.20
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/uuid v1.3.0
+	github.com/graph-gophers/graphql-go v1.5.0
+	github.com/joho/godotenv v1.4.0
 	github.com/lib/pq v1.10.5
+	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/nats-io/nats.go v1.23.0
+	github.com/redis/go-redis/v9 v9.0.5
+	github.com/rs/zerolog v1.29.1
+	github.com/segmentio/kafka-go v0.4.38
 	github.com/uptrace/bun v1.1.3
+	github.com/uptrace/bun/dialect/mysqldialect v1.1.3
 	github.com/uptrace/bun/dialect/pgdialect v1.1.3
+	github.com/uptrace/bun/dialect/sqlitedialect v1.1.3
 	github.com/uptrace/bun/driver/pgdriver v1.1.3
 	github.com/uptrace/bun/extra/bundebug v1.1.3
-	golang.org/x/crypto v0.0.0-20220321153916-2c7772ba3064
+	github.com/valyala/fasthttp v1.34.0
+	golang.org/x/crypto v0.5.0
+	golang.org/x/image v0.5.0
+	google.golang.org/grpc v1.56.3
+	google.golang.org/protobuf v1.30.0
 )
 
 require (
+	github.com/Knetic/govaluate v3.0.1-0.20171022003610-9aa49832a739+incompatible // indirect
 	github.com/andybalholm/brotli v1.0.4 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/cosmtrek/air v1.29.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/fasthttp/websocket v1.5.0 // indirect
 	github.com/fatih/color v1.13.0 // indirect
 	github.com/fsnotify/fsnotify v1.5.1 // indirect
+	github.com/go-playground/locales v0.14.1 // indirect
+	github.com/go-playground/universal-translator v0.18.1 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/imdario/mergo v0.3.12 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
-	github.com/joho/godotenv v1.4.0 // indirect
-	github.com/klauspost/compress v1.15.0 // indirect
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/leodido/go-urn v1.2.1 // indirect
 	github.com/mattn/go-colorable v0.1.12 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
+	github.com/nats-io/nkeys v0.3.0 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/pelletier/go-toml v1.9.4 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/savsgio/gotils v0.0.0-20211223103454-d0aaa54c5899 // indirect
 	github.com/tmthrgd/go-hex v0.0.0-20190904060850-447a3041c3bc // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasthttp v1.34.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
 	github.com/vmihailenco/msgpack/v5 v5.3.5 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
-	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad // indirect
+	golang.org/x/mod v0.8.0 // indirect
+	golang.org/x/net v0.9.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
 	mellium.im/sasl v0.2.1 // indirect
 )
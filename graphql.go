@@ -0,0 +1,785 @@
+package goapi
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/types"
+	"github.com/uptrace/bun"
+)
+
+// A GraphQL request, as a JSON body or, for GET, the query string
+type GraphqlRequest struct {
+	Query string `json:"query"`
+	OperationName string `json:"operationName"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// Fields marked @hasPermission need the signed in user to have that
+// permission, the same as the REST routes over the same data
+const graphqlSchema = `
+	directive @hasPermission(permission: String!) on FIELD_DEFINITION
+
+	scalar Time
+	scalar JSON
+
+	schema {
+		query: Query
+	}
+
+	type Query {
+		me: User!
+		user(id: ID!): User @hasPermission(permission: "users.read")
+		users(first: Int = 20, after: String, role: String, status: String, group: String): UserConnection @hasPermission(permission: "users.read")
+		account: Account @hasPermission(permission: "accounts.manage")
+	}
+
+	type User {
+		id: ID!
+		username: String!
+		email: String!
+		displayName: String!
+		avatarUrl: String!
+		role: String!
+		status: String!
+		isAnonymous: Boolean!
+		metadata: JSON
+		createdAt: Time!
+		updatedAt: Time!
+		lastLoginAt: Time @hasPermission(permission: "users.read")
+		loginCount: Int @hasPermission(permission: "users.read")
+		tags: [String!] @hasPermission(permission: "users.read")
+		account: Account @hasPermission(permission: "accounts.manage")
+		sessions(first: Int = 20, after: String): SessionConnection @hasPermission(permission: "users.read")
+	}
+
+	type Account {
+		id: ID!
+		name: String!
+		locale: String
+		createdAt: Time!
+		updatedAt: Time!
+		users(first: Int = 20, after: String, role: String, status: String, group: String): UserConnection @hasPermission(permission: "users.read")
+		keys: [Key!] @hasPermission(permission: "keys.manage")
+	}
+
+	type Key {
+		id: ID!
+		createdAt: Time!
+		updatedAt: Time!
+	}
+
+	type Session {
+		id: ID!
+		impersonated: Boolean!
+		createdAt: Time!
+		updatedAt: Time!
+	}
+
+	type PageInfo {
+		hasNextPage: Boolean!
+		endCursor: String
+	}
+
+	type UserConnection {
+		edges: [UserEdge!]!
+		pageInfo: PageInfo!
+		totalCount: Int!
+	}
+
+	type UserEdge {
+		cursor: String!
+		node: User!
+	}
+
+	type SessionConnection {
+		edges: [SessionEdge!]!
+		pageInfo: PageInfo!
+		totalCount: Int!
+	}
+
+	type SessionEdge {
+		cursor: String!
+		node: Session!
+	}
+`
+
+// The most a connection returns at once
+const graphqlMaxPageSize = 100
+
+// The most users, sessions and keys one query may ask for across all its
+// connections, so nesting them can't multiply into a full table scan
+const graphqlMaxNodes = 1000
+
+type graphqlViewerKey struct{}
+
+// What one query has used so far, shared by its resolvers
+type graphqlQueryState struct {
+	mutex sync.Mutex
+	nodes int
+	permissions map[string]bool // whether the viewer has each, once checked
+}
+
+type graphqlQueryStateKey struct{}
+
+// ====================
+//        Setup
+// ====================
+
+func initGraphqlRoutes(api fiber.Router, db *bun.DB) {
+	root := &graphqlResolver{db: db}
+	schema := graphql.MustParseSchema(graphqlSchema, root, graphql.MaxDepth(10))
+	root.permissions = schemaPermissions(schema)
+
+	handler := func(c *fiber.Ctx) error {
+		return runGraphql(c, schema)
+	}
+
+	api.Get("/graphql", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	}, handler)
+
+	api.Post("/graphql", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	}, handler)
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Runs a query as the signed in user. Errors are in the body, translated
+// and with their code in extensions, as GraphQL clients expect.
+func runGraphql(c *fiber.Ctx, schema *graphql.Schema) error {
+	request := new(GraphqlRequest)
+	if c.Method() == fiber.MethodGet {
+		request.Query = c.Query("query")
+		request.OperationName = c.Query("operationName")
+		if variables := c.Query("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &request.Variables); err != nil {
+				return badRequest("invalid input").WithCode(codeInvalidInput)
+			}
+		}
+	} else if err := json.Unmarshal(c.Body(), request); err != nil {
+		requestLogger(c).Debug().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	if strings.TrimSpace(request.Query) == "" {
+		return badRequest("no query provided").WithCode(codeInvalidInput)
+	}
+
+	ctx := context.WithValue(c.UserContext(), graphqlViewerKey{}, c.Locals("user").(*User))
+	ctx = context.WithValue(ctx, graphqlQueryStateKey{}, &graphqlQueryState{permissions: map[string]bool{}})
+	response := schema.Exec(ctx, request.Query, request.OperationName, request.Variables)
+
+	locale := requestLocale(c)
+	for _, queryErr := range response.Errors {
+		if queryErr.ResolverError == nil {
+			continue
+		}
+
+		appErr := toAppError(queryErr.ResolverError)
+		if appErr.Status >= fiber.StatusInternalServerError {
+			requestLogger(c).Error().Err(queryErr.ResolverError).Send()
+		}
+
+		code := appErr.Code
+		if code == "" {
+			code = defaultErrorCode(appErr.Status)
+		}
+		queryErr.Message = translate(locale, appErr.Message)
+		queryErr.Extensions = map[string]interface{}{"code": code}
+	}
+
+	return c.JSON(response)
+}
+
+// ====================
+//      Resolvers
+// ====================
+
+type graphqlResolver struct {
+	db *bun.DB
+	permissions map[string]string
+}
+
+type graphqlUser struct {
+	root *graphqlResolver
+	user *User
+}
+
+type graphqlAccount struct {
+	root *graphqlResolver
+	account *Account
+}
+
+type graphqlKey struct {
+	key *Key
+}
+
+type graphqlSession struct {
+	token *Token
+}
+
+type graphqlPageInfo struct {
+	hasNextPage bool
+	endCursor *string
+}
+
+type graphqlUserConnection struct {
+	root *graphqlResolver
+	users []User
+	pageInfo graphqlPageInfo
+	count func() (int, error)
+}
+
+type graphqlUserEdge struct {
+	root *graphqlResolver
+	user *User
+}
+
+type graphqlSessionConnection struct {
+	tokens []Token
+	pageInfo graphqlPageInfo
+	count func() (int, error)
+}
+
+type graphqlSessionEdge struct {
+	token *Token
+}
+
+// Arguments of a paged field. First defaults to 20 in the schema.
+type graphqlPage struct {
+	First int32
+	After *string
+}
+
+// Arguments of a paged list of users
+type graphqlUsersArgs struct {
+	graphqlPage
+	Role *string
+	Status *string
+	Group *string
+}
+
+// Maps and raw JSON, passed through as they are
+type graphqlJSON struct {
+	Value interface{}
+}
+
+func (r *graphqlResolver) Me(ctx context.Context) *graphqlUser {
+	return &graphqlUser{root: r, user: graphqlViewer(ctx)}
+}
+
+func (r *graphqlResolver) User(ctx context.Context, args struct{ ID graphql.ID }) (*graphqlUser, error) {
+	if err := r.authorize(ctx, "Query.user"); err != nil {
+		return nil, err
+	}
+
+	user, err := findAccountUser(ctx, graphqlViewer(ctx).AccountId, string(args.ID), r.db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &graphqlUser{root: r, user: user}, nil
+}
+
+func (r *graphqlResolver) Users(ctx context.Context, args graphqlUsersArgs) (*graphqlUserConnection, error) {
+	if err := r.authorize(ctx, "Query.users"); err != nil {
+		return nil, err
+	}
+	return r.accountUsers(ctx, graphqlViewer(ctx).AccountId, args)
+}
+
+func (r *graphqlResolver) Account(ctx context.Context) (*graphqlAccount, error) {
+	if err := r.authorize(ctx, "Query.account"); err != nil {
+		return nil, err
+	}
+	return r.viewerAccount(ctx)
+}
+
+func (u *graphqlUser) ID() graphql.ID {
+	return graphql.ID(u.user.ID.String())
+}
+
+func (u *graphqlUser) Username() string {
+	return u.user.Username
+}
+
+func (u *graphqlUser) Email() string {
+	return u.user.Email
+}
+
+func (u *graphqlUser) DisplayName() string {
+	return u.user.DisplayName
+}
+
+func (u *graphqlUser) AvatarUrl() string {
+	return u.user.AvatarURL
+}
+
+func (u *graphqlUser) Role() string {
+	return u.user.Role
+}
+
+func (u *graphqlUser) Status() string {
+	return u.user.Status
+}
+
+func (u *graphqlUser) IsAnonymous() bool {
+	return u.user.IsAnonymous
+}
+
+func (u *graphqlUser) Metadata() *graphqlJSON {
+	if u.user.Metadata == nil {
+		return nil
+	}
+	return &graphqlJSON{Value: u.user.Metadata}
+}
+
+func (u *graphqlUser) CreatedAt() graphql.Time {
+	return graphql.Time{Time: u.user.CreatedAt}
+}
+
+func (u *graphqlUser) UpdatedAt() graphql.Time {
+	return graphql.Time{Time: u.user.UpdatedAt}
+}
+
+func (u *graphqlUser) LastLoginAt(ctx context.Context) (*graphql.Time, error) {
+	if err := u.root.authorize(ctx, "User.lastLoginAt"); err != nil {
+		return nil, err
+	}
+	if u.user.LastLoginAt.IsZero() {
+		return nil, nil
+	}
+	return &graphql.Time{Time: u.user.LastLoginAt}, nil
+}
+
+func (u *graphqlUser) LoginCount(ctx context.Context) (*int32, error) {
+	if err := u.root.authorize(ctx, "User.loginCount"); err != nil {
+		return nil, err
+	}
+	count := int32(u.user.LoginCount)
+	return &count, nil
+}
+
+func (u *graphqlUser) Tags(ctx context.Context) (*[]string, error) {
+	if err := u.root.authorize(ctx, "User.tags"); err != nil {
+		return nil, err
+	}
+	tags := u.user.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return &tags, nil
+}
+
+func (u *graphqlUser) Account(ctx context.Context) (*graphqlAccount, error) {
+	if err := u.root.authorize(ctx, "User.account"); err != nil {
+		return nil, err
+	}
+	return u.root.viewerAccount(ctx)
+}
+
+// The user's tokens, oldest first
+func (u *graphqlUser) Sessions(ctx context.Context, args graphqlPage) (*graphqlSessionConnection, error) {
+	if err := u.root.authorize(ctx, "User.sessions"); err != nil {
+		return nil, err
+	}
+
+	db := u.root.db
+	userId := u.user.ID
+	filter := func(query *bun.SelectQuery) *bun.SelectQuery {
+		return query.Where("user_id = ?", userId)
+	}
+
+	tokens := []Token{}
+	query, first, err := paginate(filter(db.NewSelect().Model(&tokens)), args)
+	if err != nil {
+		return nil, err
+	}
+	if err := reserveNodes(ctx, first); err != nil {
+		return nil, err
+	}
+	if err := query.Scan(ctx); err != nil {
+		logger.Error().Err(err).Send()
+		// Continue and simply return an empty page
+	}
+
+	connection := &graphqlSessionConnection{
+		count: func() (int, error) {
+			return filter(db.NewSelect().Model((*Token)(nil))).Count(ctx)
+		},
+	}
+	connection.pageInfo.hasNextPage = len(tokens) > first
+	if connection.pageInfo.hasNextPage {
+		tokens = tokens[:first]
+	}
+	if len(tokens) > 0 {
+		last := tokens[len(tokens)-1]
+		cursor := encodeCursor(last.CreatedAt, last.ID)
+		connection.pageInfo.endCursor = &cursor
+	}
+	connection.tokens = tokens
+
+	return connection, nil
+}
+
+func (a *graphqlAccount) ID() graphql.ID {
+	return graphql.ID(a.account.ID.String())
+}
+
+func (a *graphqlAccount) Name() string {
+	return a.account.Name
+}
+
+func (a *graphqlAccount) Locale() *string {
+	if a.account.Locale == "" {
+		return nil
+	}
+	return &a.account.Locale
+}
+
+func (a *graphqlAccount) CreatedAt() graphql.Time {
+	return graphql.Time{Time: a.account.CreatedAt}
+}
+
+func (a *graphqlAccount) UpdatedAt() graphql.Time {
+	return graphql.Time{Time: a.account.UpdatedAt}
+}
+
+func (a *graphqlAccount) Users(ctx context.Context, args graphqlUsersArgs) (*graphqlUserConnection, error) {
+	if err := a.root.authorize(ctx, "Account.users"); err != nil {
+		return nil, err
+	}
+	return a.root.accountUsers(ctx, a.account.ID, args)
+}
+
+func (a *graphqlAccount) Keys(ctx context.Context) (*[]*graphqlKey, error) {
+	if err := a.root.authorize(ctx, "Account.keys"); err != nil {
+		return nil, err
+	}
+
+	keys := []Key{}
+	err := a.root.db.NewSelect().Model(&keys).
+		Where("account_id = ?", a.account.ID).
+		Order("created_at ASC").
+		Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		// Continue and simply return an empty list
+	}
+	if err := reserveNodes(ctx, len(keys)); err != nil {
+		return nil, err
+	}
+
+	resolvers := []*graphqlKey{}
+	for i := range keys {
+		resolvers = append(resolvers, &graphqlKey{key: &keys[i]})
+	}
+	return &resolvers, nil
+}
+
+func (k *graphqlKey) ID() graphql.ID {
+	return graphql.ID(k.key.ID.String())
+}
+
+func (k *graphqlKey) CreatedAt() graphql.Time {
+	return graphql.Time{Time: k.key.CreatedAt}
+}
+
+func (k *graphqlKey) UpdatedAt() graphql.Time {
+	return graphql.Time{Time: k.key.UpdatedAt}
+}
+
+func (s *graphqlSession) ID() graphql.ID {
+	return graphql.ID(s.token.ID.String())
+}
+
+func (s *graphqlSession) Impersonated() bool {
+	return s.token.ActorId != uuid.Nil
+}
+
+func (s *graphqlSession) CreatedAt() graphql.Time {
+	return graphql.Time{Time: s.token.CreatedAt}
+}
+
+func (s *graphqlSession) UpdatedAt() graphql.Time {
+	return graphql.Time{Time: s.token.UpdatedAt}
+}
+
+func (p graphqlPageInfo) HasNextPage() bool {
+	return p.hasNextPage
+}
+
+func (p graphqlPageInfo) EndCursor() *string {
+	return p.endCursor
+}
+
+func (c *graphqlUserConnection) Edges() []*graphqlUserEdge {
+	edges := []*graphqlUserEdge{}
+	for i := range c.users {
+		edges = append(edges, &graphqlUserEdge{root: c.root, user: &c.users[i]})
+	}
+	return edges
+}
+
+func (c *graphqlUserConnection) PageInfo() graphqlPageInfo {
+	return c.pageInfo
+}
+
+// Counted only when asked for
+func (c *graphqlUserConnection) TotalCount() (int32, error) {
+	count, err := c.count()
+	if err != nil {
+		return 0, internalError(err)
+	}
+	return int32(count), nil
+}
+
+func (e *graphqlUserEdge) Cursor() string {
+	return encodeCursor(e.user.CreatedAt, e.user.ID)
+}
+
+func (e *graphqlUserEdge) Node() *graphqlUser {
+	return &graphqlUser{root: e.root, user: e.user}
+}
+
+func (c *graphqlSessionConnection) Edges() []*graphqlSessionEdge {
+	edges := []*graphqlSessionEdge{}
+	for i := range c.tokens {
+		edges = append(edges, &graphqlSessionEdge{token: &c.tokens[i]})
+	}
+	return edges
+}
+
+func (c *graphqlSessionConnection) PageInfo() graphqlPageInfo {
+	return c.pageInfo
+}
+
+func (c *graphqlSessionConnection) TotalCount() (int32, error) {
+	count, err := c.count()
+	if err != nil {
+		return 0, internalError(err)
+	}
+	return int32(count), nil
+}
+
+func (e *graphqlSessionEdge) Cursor() string {
+	return encodeCursor(e.token.CreatedAt, e.token.ID)
+}
+
+func (e *graphqlSessionEdge) Node() *graphqlSession {
+	return &graphqlSession{token: e.token}
+}
+
+func (graphqlJSON) ImplementsGraphQLType(name string) bool {
+	return name == "JSON"
+}
+
+func (j *graphqlJSON) UnmarshalGraphQL(input interface{}) error {
+	j.Value = input
+	return nil
+}
+
+func (j graphqlJSON) MarshalJSON() ([]byte, error) {
+	return json.Marshal(j.Value)
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// The signed in user running the query
+func graphqlViewer(ctx context.Context) *User {
+	user, _ := ctx.Value(graphqlViewerKey{}).(*User)
+	return user
+}
+
+// Checks the viewer has the permission the schema puts on a field, e.g.
+// "Query.users". Fields without @hasPermission are open to any user. Each
+// permission is looked up once per query, however many nodes ask for it.
+func (r *graphqlResolver) authorize(ctx context.Context, field string) error {
+	permission, ok := r.permissions[field]
+	if !ok {
+		return nil
+	}
+
+	user := graphqlViewer(ctx)
+	if user == nil {
+		return unauthorized("unauthorized").WithCode(codeAuthUnauthorized)
+	}
+
+	state, _ := ctx.Value(graphqlQueryStateKey{}).(*graphqlQueryState)
+	if state == nil {
+		state = &graphqlQueryState{permissions: map[string]bool{}}
+	}
+	state.mutex.Lock()
+	allowed, checked := state.permissions[permission]
+	if !checked {
+		allowed = userHasPermission(ctx, user, permission, r.db)
+		state.permissions[permission] = allowed
+	}
+	state.mutex.Unlock()
+
+	if !allowed {
+		return forbidden("forbidden").WithCode(codeAuthForbidden)
+	}
+	return nil
+}
+
+// Counts nodes a connection is about to fetch against graphqlMaxNodes
+func reserveNodes(ctx context.Context, count int) error {
+	state, _ := ctx.Value(graphqlQueryStateKey{}).(*graphqlQueryState)
+	if state == nil {
+		return nil
+	}
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if state.nodes+count > graphqlMaxNodes {
+		return badRequest("query asks for more than 1000 nodes").WithCode(codeInvalidInput)
+	}
+	state.nodes += count
+	return nil
+}
+
+// The permission of every field marked @hasPermission, by "Type.field"
+func schemaPermissions(schema *graphql.Schema) map[string]string {
+	permissions := map[string]string{}
+	for name, namedType := range schema.ASTSchema().Types {
+		object, ok := namedType.(*types.ObjectTypeDefinition)
+		if !ok {
+			continue
+		}
+
+		for _, field := range object.Fields {
+			directive := field.Directives.Get("hasPermission")
+			if directive == nil {
+				continue
+			}
+			if value, ok := directive.Arguments.Get("permission"); ok {
+				permission, _ := value.Deserialize(nil).(string)
+				permissions[name+"."+field.Name] = permission
+			}
+		}
+	}
+	return permissions
+}
+
+func (r *graphqlResolver) viewerAccount(ctx context.Context) (*graphqlAccount, error) {
+	account := new(Account)
+	err := r.db.NewSelect().Model(account).Where("id = ?", graphqlViewer(ctx).AccountId).Scan(ctx)
+	if err != nil {
+		logger.Debug().Err(err).Send()
+		return nil, notFound("account not found")
+	}
+	return &graphqlAccount{root: r, account: account}, nil
+}
+
+// A page of an account's users, oldest first, filtered like GET /users
+func (r *graphqlResolver) accountUsers(ctx context.Context, accountId uuid.UUID, args graphqlUsersArgs) (*graphqlUserConnection, error) {
+	filter := userFilter{}
+	if args.Role != nil {
+		filter.Role = *args.Role
+	}
+	if args.Status != nil {
+		filter.Status = *args.Status
+	}
+	if args.Group != nil {
+		filter.Group = *args.Group
+	}
+
+	users := []User{}
+	query, first, err := paginate(filter.apply(r.db.NewSelect().Model(&users), accountId), args.graphqlPage)
+	if err != nil {
+		return nil, err
+	}
+	if err := reserveNodes(ctx, first); err != nil {
+		return nil, err
+	}
+	if err := query.Scan(ctx); err != nil {
+		logger.Error().Err(err).Send()
+		// Continue and simply return an empty page
+	}
+
+	connection := &graphqlUserConnection{
+		root: r,
+		count: func() (int, error) {
+			return filter.apply(r.db.NewSelect().Model((*User)(nil)), accountId).Count(ctx)
+		},
+	}
+	connection.pageInfo.hasNextPage = len(users) > first
+	if connection.pageInfo.hasNextPage {
+		users = users[:first]
+	}
+	if len(users) > 0 {
+		last := users[len(users)-1]
+		cursor := encodeCursor(last.CreatedAt, last.ID)
+		connection.pageInfo.endCursor = &cursor
+	}
+	connection.users = users
+
+	return connection, nil
+}
+
+// Orders a query oldest first from after the page's cursor, fetching one
+// more row than the page holds to tell whether there's another page.
+// Returns the page size.
+func paginate(query *bun.SelectQuery, page graphqlPage) (*bun.SelectQuery, int, error) {
+	first := int(page.First)
+	if first < 1 || first > graphqlMaxPageSize {
+		return nil, 0, badRequest("first must be between 1 and 100").WithCode(codeInvalidInput)
+	}
+
+	if page.After != nil {
+		createdAt, id, err := decodeCursor(*page.After)
+		if err != nil {
+			return nil, 0, badRequest("invalid cursor").WithCode(codeInvalidInput)
+		}
+		query = query.Where("(?TableAlias.created_at, ?TableAlias.id) > (?, ?)", createdAt, id)
+	}
+
+	query = query.
+		OrderExpr("?TableAlias.created_at ASC, ?TableAlias.id ASC").
+		Limit(first + 1)
+
+	return query, first, nil
+}
+
+// An opaque position in a list ordered by creation
+func encodeCursor(createdAt time.Time, id uuid.UUID) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt.UTC().Format(time.RFC3339Nano) + "|" + id.String()))
+}
+
+func decodeCursor(cursor string) (time.Time, uuid.UUID, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+
+	parts := strings.SplitN(string(decoded), "|", 2)
+	if len(parts) != 2 {
+		return time.Time{}, uuid.Nil, errors.New("malformed cursor")
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+
+	return createdAt, id, nil
+}
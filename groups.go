@@ -0,0 +1,366 @@
+package goapi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// Group DB model. Members get the group's role and permissions on top of their own.
+type Group struct {
+	bun.BaseModel `bun:"table:groups"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Name string // has unique idx per account
+	Role string `bun:",nullzero"`
+	Permissions []string `bun:",array"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	AccountId uuid.UUID `bun:",type:uuid"`
+}
+
+// GroupMember DB model
+type GroupMember struct {
+	bun.BaseModel `bun:"table:group_members"`
+	GroupId uuid.UUID `bun:",pk,type:uuid"`
+	UserId uuid.UUID `bun:",pk,type:uuid"` // has idx
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+}
+
+// Adding members to a group
+type GroupMembersInput struct {
+	UserIds []uuid.UUID
+}
+
+// ====================
+//        Setup
+// ====================
+
+var _ bun.BeforeAppendModelHook = (*Group)(nil)
+func (g *Group) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+		case *bun.UpdateQuery:
+			g.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func initGroupRoutes(api fiber.Router, db *bun.DB) {
+	routes := api.Group("/groups", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	})
+
+	routes.Get("/", permit(db, permissionGroupsManage), func(c *fiber.Ctx) error {
+		return getGroups(c, db)
+	})
+
+	routes.Post("/", permit(db, permissionGroupsManage), func(c *fiber.Ctx) error {
+		return createGroup(c, db)
+	})
+
+	routes.Put("/:id", permit(db, permissionGroupsManage), func(c *fiber.Ctx) error {
+		return updateGroup(c, db)
+	})
+
+	routes.Delete("/:id", permit(db, permissionGroupsManage), func(c *fiber.Ctx) error {
+		return deleteGroup(c, db)
+	})
+
+	routes.Get("/:id/members", permit(db, permissionGroupsManage), func(c *fiber.Ctx) error {
+		return getGroupMembers(c, db)
+	})
+
+	routes.Post("/:id/members", permit(db, permissionGroupsManage), func(c *fiber.Ctx) error {
+		return addGroupMembers(c, db)
+	})
+
+	routes.Delete("/:id/members/:userId", permit(db, permissionGroupsManage), func(c *fiber.Ctx) error {
+		return removeGroupMember(c, db)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func getGroups(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	groups := []Group{}
+	err := db.NewSelect().Model(&groups).
+		Where("account_id = ?", currentUser.AccountId).
+		Order("name ASC").
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return an empty array
+	}
+
+	return c.JSON(groups)
+}
+
+func createGroup(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	group := new(Group)
+	if err := c.BodyParser(group); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" {
+		return badRequest("no name provided")
+	}
+
+	group.Role = normalizeRoleName(group.Role)
+	if err := validateRoleAssignment(ctx, currentUser, group.Role, db); err != nil {
+		return err
+	}
+
+	group.Permissions = normalizePermissions(group.Permissions)
+	if err := validatePermissionGrant(ctx, currentUser, group.Permissions, db); err != nil {
+		return err
+	}
+
+	group.ID = newId()
+	group.AccountId = currentUser.AccountId
+	_, err := db.NewInsert().Model(group).Exec(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return conflict("group already exists").WithCode(codeAlreadyExists)
+	}
+
+	return created(c, apiPath(c, "/groups/"+group.ID.String()), group)
+}
+
+func updateGroup(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(Group)
+	if err := c.BodyParser(input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	group, err := findGroup(ctx, c.Params("id"), currentUser.AccountId, db)
+	if err != nil {
+		return notFound("group not found").WithCode(codeGroupNotFound)
+	}
+
+	// Only write what was sent
+	columns := []string{"updated_at"}
+	for _, field := range sentFields(c, input) {
+		switch field {
+			case "Name":
+				if name := strings.TrimSpace(input.Name); name != "" {
+					group.Name = name
+					columns = append(columns, "name")
+				}
+			case "Role":
+				group.Role = normalizeRoleName(input.Role)
+				if err := validateRoleAssignment(ctx, currentUser, group.Role, db); err != nil {
+					return err
+				}
+				columns = append(columns, "role")
+			case "Permissions":
+				group.Permissions = normalizePermissions(input.Permissions)
+				if err := validatePermissionGrant(ctx, currentUser, group.Permissions, db); err != nil {
+					return err
+				}
+				columns = append(columns, "permissions")
+		}
+	}
+
+	group.UpdatedAt = time.Now()
+	_, err = db.NewUpdate().Model(group).Column(columns...).WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(group)
+}
+
+func deleteGroup(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	group, err := findGroup(ctx, c.Params("id"), currentUser.AccountId, db)
+	if err != nil {
+		return notFound("group not found").WithCode(codeGroupNotFound)
+	}
+
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().Model((*GroupMember)(nil)).Where("group_id = ?", group.ID).Exec(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewDelete().Model(group).WherePK().Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+func getGroupMembers(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	group, err := findGroup(ctx, c.Params("id"), currentUser.AccountId, db)
+	if err != nil {
+		return notFound("group not found").WithCode(codeGroupNotFound)
+	}
+
+	users := []User{}
+	err = db.NewSelect().Model(&users).
+		Where("account_id = ?", currentUser.AccountId).
+		Where("id IN (SELECT user_id FROM group_members WHERE group_id = ?)", group.ID).
+		Order("username ASC").
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return an empty array
+	}
+
+	publicUsers := []PublicUser{}
+	for _, user := range users {
+		publicUsers = append(publicUsers, *user.ToAdminUser())
+	}
+
+	body, err := sparseFields(c, render(c, publicUsers))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(body)
+}
+
+// Adds users from the group's account, skipping existing members
+func addGroupMembers(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(GroupMembersInput)
+	if err := c.BodyParser(input); err != nil || len(input.UserIds) == 0 {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	group, err := findGroup(ctx, c.Params("id"), currentUser.AccountId, db)
+	if err != nil {
+		return notFound("group not found").WithCode(codeGroupNotFound)
+	}
+
+	// Members get the group's role and permissions, so adding them is handing those out
+	if err := validateRoleAssignment(ctx, currentUser, group.Role, db); err != nil {
+		return err
+	}
+	if err := validatePermissionGrant(ctx, currentUser, group.Permissions, db); err != nil {
+		return err
+	}
+
+	userIds := []uuid.UUID{}
+	err = db.NewSelect().Model((*User)(nil)).
+		Column("id").
+		Where("account_id = ?", currentUser.AccountId).
+		Where("id IN (?)", bun.In(input.UserIds)).
+		Scan(ctx, &userIds)
+	if err != nil || len(userIds) == 0 {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("users not found")
+	}
+
+	members := []GroupMember{}
+	for _, userId := range userIds {
+		members = append(members, GroupMember{GroupId: group.ID, UserId: userId})
+	}
+
+	_, err = db.NewInsert().Model(&members).Ignore().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return getGroupMembers(c, db)
+}
+
+func removeGroupMember(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	group, err := findGroup(ctx, c.Params("id"), currentUser.AccountId, db)
+	if err != nil {
+		return notFound("group not found").WithCode(codeGroupNotFound)
+	}
+
+	_, err = db.NewDelete().Model((*GroupMember)(nil)).
+		Where("group_id = ?", group.ID).
+		Where("user_id = ?", c.Params("userId")).
+		Exec(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func findGroup(ctx context.Context, id string, accountId uuid.UUID, db *bun.DB) (*Group, error) {
+	group := new(Group)
+	err := db.NewSelect().Model(group).
+		Where("id = ?", id).
+		Where("account_id = ?", accountId).
+		Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+
+	return group, nil
+}
+
+// The groups a user belongs to
+func userGroups(ctx context.Context, user *User, db *bun.DB) []Group {
+	groups := []Group{}
+	err := db.NewSelect().Model(&groups).
+		Where("account_id = ?", user.AccountId).
+		Where("id IN (SELECT group_id FROM group_members WHERE user_id = ?)", user.ID).
+		Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+
+	return groups
+}
+
+// Every role that applies to the user: their own and the roles it extends,
+// then for each group a role carrying the group's permissions named
+// "group:<name>" followed by the group's role and the roles it extends
+func userRoles(ctx context.Context, user *User, db *bun.DB) []Role {
+	roles := roleAncestry(ctx, user.Role, user.AccountId, db)
+
+	for _, group := range userGroups(ctx, user, db) {
+		roles = append(roles, Role{
+			Name: fmt.Sprintf("group:%s", group.Name),
+			Permissions: group.Permissions,
+			AccountId: group.AccountId,
+		})
+		roles = append(roles, roleAncestry(ctx, group.Role, user.AccountId, db)...)
+	}
+
+	return roles
+}
@@ -0,0 +1,361 @@
+package goapi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/uptrace/bun"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"goapi/pb"
+)
+
+// The Auth service, sharing its work with the REST routes
+type authServer struct {
+	pb.UnimplementedAuthServer
+	auth *AuthService
+	accounts *AccountService
+}
+
+// The Users service, sharing its work with the REST routes
+type usersServer struct {
+	pb.UnimplementedUsersServer
+	db *bun.DB
+}
+
+// ====================
+//        Setup
+// ====================
+
+// Serves the services in pb/goapi.proto on GRPC_PORT alongside the REST
+// API, when it's set
+func startGrpcServer(db *bun.DB) {
+	port := os.Getenv("GRPC_PORT")
+	if port == "" {
+		return
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
+	if err != nil {
+		logger.Fatal().Err(err).Send()
+	}
+
+	server := grpc.NewServer()
+	pb.RegisterAuthServer(server, &authServer{auth: newAuthService(db), accounts: newAccountService(db)})
+	pb.RegisterUsersServer(server, &usersServer{db: db})
+
+	go func() {
+		logger.Fatal().Err(server.Serve(listener)).Send()
+	}()
+}
+
+// ====================
+//    Auth Service
+// ====================
+
+func (s *authServer) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.Session, error) {
+	accountId, err := accountIdForKey(ctx, incomingMetadata(ctx, "account-key"), "", s.accounts)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	input := &RegisterInput{
+		Username: req.Username,
+		Email: req.Email,
+		Password: req.Password,
+		DisplayName: req.DisplayName,
+		Metadata: req.Metadata.AsMap(),
+	}
+	if err := validateInput(input); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	user, token, err := s.auth.Register(ctx, accountId, input)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	return &pb.Session{User: toProtoUser(user), Token: token}, nil
+}
+
+func (s *authServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.Session, error) {
+	accountId, err := accountIdForKey(ctx, incomingMetadata(ctx, "account-key"), "", s.accounts)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	input := &LoginInput{Username: req.Username, Email: req.Email, Password: req.Password}
+	if err := validateInput(input); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	user, token, err := s.auth.Login(ctx, accountId, input, grpcLoginOrigin(ctx))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	return &pb.Session{User: toProtoUser(user), Token: token}, nil
+}
+
+// Whether a token is live, and whose it is. Dead tokens aren't an error.
+func (s *authServer) Introspect(ctx context.Context, req *pb.IntrospectRequest) (*pb.IntrospectResponse, error) {
+	if req.Token == "" {
+		return &pb.IntrospectResponse{Active: false}, nil
+	}
+
+	user, err := s.auth.Authenticate(ctx, req.Token)
+	if err != nil {
+		logger.Debug().Err(err).Send()
+		return &pb.IntrospectResponse{Active: false}, nil
+	}
+
+	return &pb.IntrospectResponse{Active: true, User: toProtoUser(user)}, nil
+}
+
+// ====================
+//    Users Service
+// ====================
+
+func (s *usersServer) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.User, error) {
+	currentUser, err := grpcUser(ctx, permissionUsersRead, s.db)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	user, err := findAccountUser(ctx, currentUser.AccountId, req.Id, s.db)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	return toProtoUser(user), nil
+}
+
+func (s *usersServer) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	currentUser, err := grpcUser(ctx, permissionUsersRead, s.db)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	users := []User{}
+	filter := userFilter{Role: req.Role, Status: req.Status, Group: req.Group}
+	err = filter.apply(s.db.NewSelect().Model(&users), currentUser.AccountId).Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		// Continue and simply return an empty list
+	}
+
+	response := &pb.ListUsersResponse{Users: []*pb.User{}}
+	for i := range users {
+		response.Users = append(response.Users, toProtoUser(&users[i]))
+	}
+
+	return response, nil
+}
+
+func (s *usersServer) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.User, error) {
+	currentUser, err := grpcUser(ctx, permissionUsersWrite, s.db)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	input := &CreateUserInput{
+		RegisterInput: RegisterInput{
+			Username: req.Username,
+			Email: req.Email,
+			Password: req.Password,
+			DisplayName: req.DisplayName,
+			Metadata: req.Metadata.AsMap(),
+		},
+		Role: req.Role,
+	}
+	if err := validateInput(input); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	user, err := createAccountUser(ctx, currentUser, input, s.db)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	return toProtoUser(user), nil
+}
+
+// Changes only the fields the request sets, like PUT /users/:id
+func (s *usersServer) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.User, error) {
+	currentUser, err := grpcUser(ctx, permissionUsersWrite, s.db)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	input := new(UpdateUserInput)
+	fields := []string{}
+	if req.Username != nil {
+		input.Username = *req.Username
+		fields = append(fields, "Username")
+	}
+	if req.Email != nil {
+		input.Email = *req.Email
+		fields = append(fields, "Email")
+	}
+	if req.Password != nil {
+		input.Password = *req.Password
+		fields = append(fields, "Password")
+	}
+	if req.DisplayName != nil {
+		input.DisplayName = *req.DisplayName
+		fields = append(fields, "DisplayName")
+	}
+	if req.Role != nil {
+		input.Role = *req.Role
+		fields = append(fields, "Role")
+	}
+	if req.Metadata != nil {
+		input.Metadata = req.Metadata.AsMap()
+		fields = append(fields, "Metadata")
+	}
+	if err := validateInput(input); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	user, err := findAccountUser(ctx, currentUser.AccountId, req.Id, s.db)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	if err := user.saveUpdate(ctx, input, fields, currentUser, s.db); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	return toProtoUser(user), nil
+}
+
+// Always succeeds, like DELETE /users/:id, so as not to enumerate users
+func (s *usersServer) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
+	currentUser, err := grpcUser(ctx, permissionUsersWrite, s.db)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	if err := validateUserChange(ctx, currentUser, req.Id, s.db); err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	deleteAccountUser(currentUser.AccountId, req.Id, req.Hard, &logger, s.db)
+
+	return &pb.DeleteUserResponse{Success: true}, nil
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// The first value of a metadata key sent with the call
+func incomingMetadata(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// The user whose bearer token is in the call's authorization metadata,
+// if they have the permission
+func grpcUser(ctx context.Context, permission string, db *bun.DB) (*User, error) {
+	tokenString := strings.TrimSpace(strings.TrimPrefix(incomingMetadata(ctx, "authorization"), "Bearer "))
+	if tokenString == "" {
+		return nil, unauthorized("unauthorized").WithCode(codeAuthUnauthorized)
+	}
+
+	user, err := newAuthService(db).Authenticate(ctx, tokenString)
+	if err != nil {
+		logger.Debug().Err(err).Send()
+		return nil, unauthorized("unauthorized").WithCode(codeAuthUnauthorized)
+	}
+
+	if !userHasPermission(ctx, user, permission, db) {
+		return nil, forbidden("forbidden").WithCode(codeAuthForbidden)
+	}
+
+	return user, nil
+}
+
+// Where a gRPC call's login came from
+func grpcLoginOrigin(ctx context.Context) loginOrigin {
+	origin := loginOrigin{UserAgent: incomingMetadata(ctx, "user-agent"), Log: &logger}
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			origin.IP = host
+		}
+	}
+	return origin
+}
+
+// An app error as a gRPC status, in the locale the call's accept-language
+// metadata asks for
+func grpcError(ctx context.Context, err error) error {
+	appErr := toAppError(err)
+	if appErr.Status >= fiber.StatusInternalServerError {
+		logger.Error().Err(err).Send()
+	}
+
+	locale := acceptedLocale(incomingMetadata(ctx, "accept-language"))
+	if locale == "" {
+		locale = os.Getenv("DEFAULT_LOCALE")
+	}
+	message := translate(locale, appErr.Message)
+
+	code := codes.Internal
+	switch appErr.Status {
+		case fiber.StatusBadRequest, fiber.StatusUnprocessableEntity:
+			code = codes.InvalidArgument
+		case fiber.StatusUnauthorized:
+			code = codes.Unauthenticated
+		case fiber.StatusForbidden:
+			code = codes.PermissionDenied
+		case fiber.StatusNotFound:
+			code = codes.NotFound
+		case fiber.StatusConflict:
+			code = codes.AlreadyExists
+		case fiber.StatusTooManyRequests:
+			code = codes.ResourceExhausted
+	}
+
+	return status.Error(code, message)
+}
+
+func toProtoUser(user *User) *pb.User {
+	protoUser := &pb.User{
+		Id: user.ID.String(),
+		Username: user.Username,
+		Email: user.Email,
+		DisplayName: user.DisplayName,
+		AvatarUrl: user.AvatarURL,
+		Role: user.Role,
+		Status: user.Status,
+		IsAnonymous: user.IsAnonymous,
+		CreatedAt: timestamppb.New(user.CreatedAt),
+		UpdatedAt: timestamppb.New(user.UpdatedAt),
+	}
+
+	if user.Metadata != nil {
+		fields, err := structpb.NewStruct(user.Metadata)
+		if err != nil {
+			logger.Error().Err(err).Send()
+		}
+		protoUser.Metadata = fields
+	}
+
+	return protoUser
+}
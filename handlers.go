@@ -0,0 +1,37 @@
+package goapi
+
+import (
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/uptrace/bun"
+)
+
+// What route handlers are built from. Handler structs are given these by
+// their constructors rather than reaching for globals, so a test can hand
+// them fake repositories or a fixed clock. Routes that aren't yet on a
+// handler struct still close over the database.
+type handlerDeps struct {
+	db *bun.DB
+	auth *AuthService
+	accounts *AccountService
+	quotas *QuotaService
+	log *zerolog.Logger
+	clock func() time.Time
+}
+
+// ====================
+//        Setup
+// ====================
+
+// The dependencies the API runs with
+func newHandlerDeps(db *bun.DB) handlerDeps {
+	return handlerDeps{
+		db: db,
+		auth: newAuthService(db),
+		accounts: newAccountService(db),
+		quotas: newQuotaService(db),
+		log: &logger,
+		clock: time.Now,
+	}
+}
@@ -0,0 +1,526 @@
+package goapi
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/uptrace/bun"
+)
+
+// How an account's hosted login, registration, and reset pages look, and
+// where they send users once they're signed in. Accounts without a
+// frontend of their own link to /t/<slug>/login, optionally with
+// ?redirect_uri= and ?state=, and get the token back in the redirect
+// URL's fragment as #token=...&state=...
+type HostedPages struct {
+	RedirectURLs []string `validate:"required,min=1,max=10,dive,url"` // the first is the default
+	Title string `validate:"max=100"` // the account's name when empty
+	LogoURL string `validate:"omitempty,url"`
+	Color string `validate:"omitempty,hexcolor"` // of buttons and links
+	Registration bool // whether users may register themselves
+}
+
+// An account's hosted pages along with the slug they're served under
+type HostedPagesSettings struct {
+	Slug string `validate:"required"`
+	HostedPages
+}
+
+// What a hosted page template is given
+type hostedPage struct {
+	Name string // login, register, reset, or password
+	Locale string
+	Title string
+	LogoURL string
+	Color string
+	Registration bool
+	CsrfToken string
+	Error string
+	Fields map[string]string // invalid fields, with why
+	Notice string
+	Values map[string]string // what was entered, to fill the form in again
+	Links map[string]string
+}
+
+// Slugs are lowercase letters, digits, and dashes, as they appear in paths
+var hostedPagesSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// ====================
+//        Setup
+// ====================
+
+func initHostedPageRoutes(router fiber.Router, db *bun.DB) {
+	routes := router.Group("/t")
+
+	routes.Get("/:slug/login", func(c *fiber.Ctx) error {
+		return showHostedPage(c, db, "login")
+	})
+
+	routes.Post("/:slug/login", func(c *fiber.Ctx) error {
+		return submitHostedLogin(c, db)
+	})
+
+	routes.Get("/:slug/register", func(c *fiber.Ctx) error {
+		return showHostedPage(c, db, "register")
+	})
+
+	routes.Post("/:slug/register", func(c *fiber.Ctx) error {
+		return submitHostedRegistration(c, db)
+	})
+
+	routes.Get("/:slug/reset", func(c *fiber.Ctx) error {
+		return showHostedPage(c, db, "reset")
+	})
+
+	routes.Post("/:slug/reset", func(c *fiber.Ctx) error {
+		return submitHostedReset(c, db)
+	})
+
+	routes.Get("/:slug/reset/password", func(c *fiber.Ctx) error {
+		return showHostedPage(c, db, "password")
+	})
+
+	routes.Post("/:slug/reset/password", func(c *fiber.Ctx) error {
+		return submitHostedPassword(c, db)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func (h *accountHandlers) getHostedPages(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	account := new(Account)
+	err := h.db.NewSelect().Model(account).Where("id = ?", currentUser.AccountId).Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("account not found").WithCode(codeAccountNotFound)
+	}
+
+	return c.JSON(account.hostedPagesSettings())
+}
+
+// Turns on the account's hosted pages, or changes them. An empty body
+// turns them off.
+func (h *accountHandlers) updateHostedPages(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	account := new(Account)
+	account.ID = currentUser.AccountId
+	if len(c.Body()) > 0 {
+		input := new(HostedPagesSettings)
+		if err := parseBody(c, input); err != nil {
+			return err
+		}
+
+		input.Slug = strings.ToLower(strings.TrimSpace(input.Slug))
+		if !hostedPagesSlugPattern.MatchString(input.Slug) {
+			return unprocessable("validation failed").WithCode(codeValidationFailed).With(fiber.Map{
+				"fields": fiber.Map{"Slug": localize("must be 3 to 63 lowercase letters, digits, or dashes")},
+			})
+		}
+
+		taken, err := h.db.NewSelect().Model((*Account)(nil)).
+			Where("slug = ?", input.Slug).
+			Where("id != ?", account.ID).
+			Exists(ctx)
+		if err != nil {
+			return internalError(err)
+		}
+		if taken {
+			return conflict("slug already taken").WithCode(codeHostedPagesSlugTaken)
+		}
+
+		account.Slug = input.Slug
+		account.HostedPages = &input.HostedPages
+	}
+
+	account.UpdatedAt = h.clock()
+	_, err := h.db.NewUpdate().Model(account).Column("slug", "hosted_pages", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(account.hostedPagesSettings())
+}
+
+func showHostedPage(c *fiber.Ctx, db *bun.DB, name string) error {
+	account, err := findHostedAccount(c, db)
+	if err != nil {
+		return err
+	}
+
+	page := newHostedPage(c, account, name, db)
+	if name == "register" && !page.Registration {
+		return notFound("route not found").WithCode(codeRouteNotFound)
+	}
+	if name == "password" && c.Query("token") == "" {
+		return c.Redirect(page.Links["reset"], fiber.StatusSeeOther)
+	}
+
+	return page.render(c, fiber.StatusOK)
+}
+
+func submitHostedLogin(c *fiber.Ctx, db *bun.DB) error {
+	account, err := findHostedAccount(c, db)
+	if err != nil {
+		return err
+	}
+
+	page := newHostedPage(c, account, "login", db)
+	redirect, err := hostedRedirectURL(c, account)
+	if err != nil {
+		return err
+	}
+	page.Values["Username"] = c.FormValue("Username")
+	if err := checkFormCsrf(c); err != nil {
+		return page.fail(c, err)
+	}
+
+	input := new(LoginInput)
+	if err := parseBody(c, input); err != nil {
+		return page.fail(c, err)
+	}
+
+	// A username that looks like an email is taken to be one
+	if strings.Contains(input.Username, "@") {
+		input.Email, input.Username = input.Username, ""
+	}
+
+	_, token, err := newAuthService(db).Login(c.UserContext(), account.ID, input, requestLoginOrigin(c))
+	if err != nil {
+		return page.fail(c, err)
+	}
+
+	return redirectWithToken(c, redirect, token, page)
+}
+
+func submitHostedRegistration(c *fiber.Ctx, db *bun.DB) error {
+	account, err := findHostedAccount(c, db)
+	if err != nil {
+		return err
+	}
+
+	page := newHostedPage(c, account, "register", db)
+	if !page.Registration {
+		return notFound("route not found").WithCode(codeRouteNotFound)
+	}
+	redirect, err := hostedRedirectURL(c, account)
+	if err != nil {
+		return err
+	}
+	for _, field := range []string{"Username", "Email", "DisplayName"} {
+		page.Values[field] = c.FormValue(field)
+	}
+	if err := checkFormCsrf(c); err != nil {
+		return page.fail(c, err)
+	}
+
+	input := new(RegisterInput)
+	if err := parseBody(c, input); err != nil {
+		return page.fail(c, err)
+	}
+
+	_, token, err := newAuthService(db).Register(c.UserContext(), account.ID, input)
+	if err != nil {
+		return page.fail(c, err)
+	}
+
+	return redirectWithToken(c, redirect, token, page)
+}
+
+// Emails a link back to the password page. Whether or not anyone matched,
+// the same notice is shown.
+func submitHostedReset(c *fiber.Ctx, db *bun.DB) error {
+	account, err := findHostedAccount(c, db)
+	if err != nil {
+		return err
+	}
+
+	page := newHostedPage(c, account, "reset", db)
+	page.Values["Username"] = c.FormValue("Username")
+	if err := checkFormCsrf(c); err != nil {
+		return page.fail(c, err)
+	}
+
+	input := new(PasswordResetInput)
+	if err := parseBody(c, input); err != nil {
+		return page.fail(c, err)
+	}
+	if strings.Contains(input.Username, "@") {
+		input.Email, input.Username = input.Username, ""
+	}
+
+	link := func(token string) string {
+		query := hostedPageQuery(c)
+		query.Set("token", token)
+		return c.BaseURL() + page.Links["password"] + "?" + query.Encode()
+	}
+	if err := sendPasswordReset(c.UserContext(), account.ID, input, link, page.Locale, db); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	page.Values = map[string]string{}
+	page.Notice = translate(page.Locale, "If the account exists, we've emailed it a link to reset the password.")
+	return page.render(c, fiber.StatusOK)
+}
+
+// Sets the new password, then sends the user back to log in with it
+func submitHostedPassword(c *fiber.Ctx, db *bun.DB) error {
+	account, err := findHostedAccount(c, db)
+	if err != nil {
+		return err
+	}
+
+	page := newHostedPage(c, account, "password", db)
+	if err := checkFormCsrf(c); err != nil {
+		return page.fail(c, err)
+	}
+
+	input := &ResetPasswordInput{Token: c.Query("token")}
+	if err := parseBody(c, input); err != nil {
+		return page.fail(c, err)
+	}
+
+	if _, err := resetPassword(c.UserContext(), account.ID, input, db); err != nil {
+		return page.fail(c, err)
+	}
+
+	page = newHostedPage(c, account, "login", db)
+	page.Notice = translate(page.Locale, "Your password has been changed. Log in with the new one.")
+	return page.render(c, fiber.StatusOK)
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// The account whose slug is in the path, if it has hosted pages
+func findHostedAccount(c *fiber.Ctx, db *bun.DB) (*Account, error) {
+	ctx := c.UserContext()
+
+	account := new(Account)
+	err := db.NewSelect().Model(account).
+		Where("slug = ?", strings.ToLower(c.Params("slug"))).
+		Where("hosted_pages IS NOT NULL").
+		Scan(ctx)
+	if err != nil {
+		return nil, notFound("route not found").WithCode(codeRouteNotFound)
+	}
+
+	return account, nil
+}
+
+func (account *Account) hostedPagesSettings() *HostedPagesSettings {
+	if account.HostedPages == nil {
+		return nil
+	}
+	return &HostedPagesSettings{Slug: account.Slug, HostedPages: *account.HostedPages}
+}
+
+// Where to send the user once they're signed in: ?redirect_uri= if it's
+// one of the account's redirect URLs, else the first of them
+func hostedRedirectURL(c *fiber.Ctx, account *Account) (string, error) {
+	redirect := c.Query("redirect_uri")
+	if redirect == "" {
+		return account.HostedPages.RedirectURLs[0], nil
+	}
+	if !stringInSlice(redirect, account.HostedPages.RedirectURLs) {
+		return "", badRequest("redirect_uri not allowed").WithCode(codeHostedPagesRedirectInvalid)
+	}
+	return redirect, nil
+}
+
+// The query the pages pass along to each other
+func hostedPageQuery(c *fiber.Ctx) url.Values {
+	query := url.Values{}
+	for _, name := range []string{"redirect_uri", "state"} {
+		if value := c.Query(name); value != "" {
+			query.Set(name, value)
+		}
+	}
+	return query
+}
+
+// The token goes in the fragment so that it isn't sent on to the
+// redirect URL's server or left in its logs
+func redirectWithToken(c *fiber.Ctx, redirect string, token string, page *hostedPage) error {
+	if token == "" {
+		return page.fail(c, internalError(errors.New("no token was issued")))
+	}
+
+	fragment := url.Values{"token": {token}}
+	if state := c.Query("state"); state != "" {
+		fragment.Set("state", state)
+	}
+
+	return c.Redirect(redirect+"#"+fragment.Encode(), fiber.StatusSeeOther)
+}
+
+// Forms echo the CSRF cookie in a field, since they can't set headers
+func checkFormCsrf(c *fiber.Ctx) error {
+	cookie := c.Cookies(csrfCookieName)
+	if cookie == "" || cookie != c.FormValue(csrfFieldName) {
+		return forbidden("invalid csrf token").WithCode(codeCsrfInvalid)
+	}
+	return nil
+}
+
+func newHostedPage(c *fiber.Ctx, account *Account, name string, db *bun.DB) *hostedPage {
+	locale := acceptedLocale(c.Get(fiber.HeaderAcceptLanguage))
+	if locale == "" {
+		locale = accountLocale(account.ID, db)
+	}
+
+	page := &hostedPage{
+		Name: name,
+		Locale: locale,
+		Title: account.HostedPages.Title,
+		LogoURL: account.HostedPages.LogoURL,
+		Color: account.HostedPages.Color,
+		Registration: account.HostedPages.Registration,
+		Values: map[string]string{},
+		Links: map[string]string{},
+	}
+	if page.Title == "" {
+		page.Title = account.Name
+	}
+
+	base := mountPrefix + "/t/" + account.Slug
+	query := hostedPageQuery(c).Encode()
+	for name, path := range map[string]string{"login": "/login", "register": "/register", "reset": "/reset", "password": "/reset/password"} {
+		page.Links[name] = base + path
+		if query != "" && name != "password" {
+			page.Links[name] += "?" + query
+		}
+	}
+
+	return page
+}
+
+// Shows the page again with what went wrong
+func (page *hostedPage) fail(c *fiber.Ctx, err error) error {
+	appErr := toAppError(err)
+	if appErr.Status >= fiber.StatusInternalServerError {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	page.Error = translate(page.Locale, appErr.Message)
+	if fields, ok := appErr.Data["fields"].(fiber.Map); ok {
+		page.Fields = map[string]string{}
+		for field, problem := range fields {
+			if text, ok := problem.(localizedText); ok {
+				page.Fields[field] = text.in(page.Locale)
+			}
+		}
+	}
+
+	return page.render(c, appErr.Status)
+}
+
+func (page *hostedPage) render(c *fiber.Ctx, status int) error {
+	token, err := setCsrfCookie(c)
+	if err != nil {
+		return internalError(err)
+	}
+	page.CsrfToken = token
+
+	tmpl, err := hostedPageTemplate.Clone()
+	if err != nil {
+		return internalError(err)
+	}
+	tmpl.Funcs(template.FuncMap{
+		"t": func(english string) string {
+			return translate(page.Locale, english)
+		},
+	})
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, page); err != nil {
+		return internalError(err)
+	}
+
+	c.Set(fiber.HeaderContentLanguage, page.Locale)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set(fiber.HeaderXFrameOptions, "DENY")
+	c.Type("html", "utf-8")
+	return c.Status(status).Send(buf.Bytes())
+}
+
+// Every page shares one template, which shows the form the page is for.
+// Text goes through t to be translated.
+var hostedPageTemplate = template.Must(template.New("page").Funcs(template.FuncMap{
+	"t": func(english string) string { return english },
+}).Parse(`<!DOCTYPE html>
+<html lang="{{.Locale}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; background: #f5f5f5; margin: 0; }
+main { max-width: 22rem; margin: 4rem auto; padding: 2rem; background: #fff; border-radius: 8px; box-shadow: 0 1px 3px rgba(0,0,0,.1); }
+h1 { font-size: 1.4rem; margin-top: 0; }
+img { max-height: 3rem; margin-bottom: 1rem; }
+label { display: block; margin-top: 1rem; font-size: .9rem; }
+input { display: block; width: 100%; box-sizing: border-box; padding: .5rem; margin-top: .25rem; font-size: 1rem; }
+button { width: 100%; margin-top: 1.5rem; padding: .6rem; font-size: 1rem; color: #fff; background: {{if .Color}}{{.Color}}{{else}}#2563eb{{end}}; border: 0; border-radius: 4px; cursor: pointer; }
+a { color: {{if .Color}}{{.Color}}{{else}}#2563eb{{end}}; }
+nav { margin-top: 1.5rem; font-size: .9rem; display: flex; justify-content: space-between; }
+.error { color: #b91c1c; }
+.notice { color: #15803d; }
+.field { color: #b91c1c; font-size: .8rem; }
+</style>
+</head>
+<body>
+<main>
+{{if .LogoURL}}<img src="{{.LogoURL}}" alt="{{.Title}}">{{end}}
+<h1>{{.Title}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .Notice}}<p class="notice">{{.Notice}}</p>{{end}}
+<form method="post">
+<input type="hidden" name="csrf_token" value="{{.CsrfToken}}">
+{{if eq .Name "login"}}
+<label>{{t "Username or email"}}<input name="Username" value="{{index .Values "Username"}}" autocomplete="username" required autofocus></label>
+{{with index .Fields "Username"}}<span class="field">{{.}}</span>{{end}}
+<label>{{t "Password"}}<input type="password" name="Password" autocomplete="current-password" required></label>
+{{with index .Fields "Password"}}<span class="field">{{.}}</span>{{end}}
+<button type="submit">{{t "Log in"}}</button>
+{{else if eq .Name "register"}}
+<label>{{t "Username"}}<input name="Username" value="{{index .Values "Username"}}" autocomplete="username" required autofocus></label>
+{{with index .Fields "Username"}}<span class="field">{{.}}</span>{{end}}
+<label>{{t "Email"}}<input type="email" name="Email" value="{{index .Values "Email"}}" autocomplete="email"></label>
+{{with index .Fields "Email"}}<span class="field">{{.}}</span>{{end}}
+<label>{{t "Name"}}<input name="DisplayName" value="{{index .Values "DisplayName"}}" autocomplete="name"></label>
+{{with index .Fields "DisplayName"}}<span class="field">{{.}}</span>{{end}}
+<label>{{t "Password"}}<input type="password" name="Password" autocomplete="new-password" minlength="8" required></label>
+{{with index .Fields "Password"}}<span class="field">{{.}}</span>{{end}}
+<button type="submit">{{t "Create account"}}</button>
+{{else if eq .Name "reset"}}
+<label>{{t "Username or email"}}<input name="Username" value="{{index .Values "Username"}}" autocomplete="username" required autofocus></label>
+{{with index .Fields "Username"}}<span class="field">{{.}}</span>{{end}}
+<button type="submit">{{t "Email me a reset link"}}</button>
+{{else if eq .Name "password"}}
+<label>{{t "New password"}}<input type="password" name="Password" autocomplete="new-password" minlength="8" required autofocus></label>
+{{with index .Fields "Password"}}<span class="field">{{.}}</span>{{end}}
+<button type="submit">{{t "Change password"}}</button>
+{{end}}
+</form>
+<nav>
+{{if ne .Name "login"}}<a href="{{.Links.login}}">{{t "Log in"}}</a>{{end}}
+{{if and .Registration (ne .Name "register")}}<a href="{{.Links.register}}">{{t "Create account"}}</a>{{end}}
+{{if eq .Name "login"}}<a href="{{.Links.reset}}">{{t "Forgot your password?"}}</a>{{end}}
+</nav>
+</main>
+</body>
+</html>
+`))
@@ -0,0 +1,408 @@
+package goapi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// Text shown to clients that's translated once their locale is known.
+// Format is the English text, which is also the key to its translations.
+type localizedText struct {
+	Format string
+	Args []interface{}
+}
+
+// Translations of client-facing text, keyed by locale and then by the
+// English text. English is the source, so its bundle is empty.
+var localeBundles = map[string]map[string]string{
+	"en": {},
+	"es": {
+		// Errors
+		"something went wrong": "algo salió mal",
+		"the request took too long": "la solicitud tardó demasiado",
+		"the database is unavailable": "la base de datos no está disponible",
+		"invalid input": "entrada no válida",
+		"validation failed": "la validación falló",
+		"unauthorized": "no autorizado",
+		"forbidden": "prohibido",
+		"route not found": "ruta no encontrada",
+		"account not found": "cuenta no encontrada",
+		"user not found": "usuario no encontrado",
+		"users not found": "usuarios no encontrados",
+		"group not found": "grupo no encontrado",
+		"role not found": "rol no encontrado",
+		"parent role not found": "rol padre no encontrado",
+		"invite not found": "invitación no encontrada",
+		"note not found": "nota no encontrada",
+		"document not found": "documento no encontrado",
+		"user suspended": "usuario suspendido",
+		"consent required": "se requiere consentimiento",
+		"invalid username or password": "nombre de usuario o contraseña no válidos",
+		"no username or password": "falta el nombre de usuario o la contraseña",
+		"invalid password": "contraseña no válida",
+		"invalid old password": "la contraseña anterior no es válida",
+		"password confirmation required": "se requiere confirmar la contraseña",
+		"username in use": "el nombre de usuario ya está en uso",
+		"username is reserved": "el nombre de usuario está reservado",
+		"username cannot be empty": "el nombre de usuario no puede estar vacío",
+		"email in use": "el correo electrónico ya está en uso",
+		"invalid email": "correo electrónico no válido",
+		"no token provided": "no se proporcionó un token",
+		"unable to create token": "no se pudo crear el token",
+		"no account key provided": "no se proporcionó una clave de cuenta",
+		"invalid account key": "clave de cuenta no válida",
+		"invalid account": "cuenta no válida",
+		"key not found": "clave no encontrada",
+		"invalid client certificate": "certificado de cliente no válido",
+		"present the client certificate to bind it": "presenta el certificado de cliente para vincularlo",
+		"client certificate bound to another key": "el certificado de cliente ya está vinculado a otra clave",
+		"monthly request quota exceeded": "se agotó la cuota mensual de solicitudes",
+		"unknown plan": "plan desconocido",
+		"limit must be between 1 and 100": "el límite debe estar entre 1 y 100",
+		"a user": "un usuario",
+		"someone": "alguien",
+		"%s joined the account": "%s se unió a la cuenta",
+		"%s was removed by %s": "%s fue eliminado por %s",
+		"%s was suspended by %s": "%s fue suspendido por %s",
+		"%s was reinstated by %s": "%s fue reactivado por %s",
+		"%s's personal data was erased": "se borraron los datos personales de %s",
+		"%s's role was changed to %s by %s": "el rol de %s fue cambiado a %s por %s",
+		"An account key was created": "se creó una clave de cuenta",
+		"An account key was revoked": "se revocó una clave de cuenta",
+		"The account is nearing its monthly request quota": "la cuenta se acerca a su cuota mensual de solicitudes",
+		"%d failed logins in an hour": "%d inicios de sesión fallidos en una hora",
+		"invalid csrf token": "token csrf no válido",
+		"invalid or expired invite": "invitación no válida o vencida",
+		"invalid or expired invite link": "enlace de invitación no válido o vencido",
+		"invite links are disabled": "los enlaces de invitación están desactivados",
+		"anonymous users are disabled": "los usuarios anónimos están desactivados",
+		"user is not anonymous": "el usuario no es anónimo",
+		"cannot change your own role": "no puedes cambiar tu propio rol",
+		"cannot change your own status": "no puedes cambiar tu propio estado",
+		"cannot change password while impersonating": "no se puede cambiar la contraseña mientras se suplanta a otro usuario",
+		"cannot impersonate yourself": "no puedes suplantarte a ti mismo",
+		"only owners may impersonate users": "solo los propietarios pueden suplantar a usuarios",
+		"not impersonating": "no se está suplantando a nadie",
+		"only owners may assign owner roles": "solo los propietarios pueden asignar roles de propietario",
+		"cannot grant permissions you don't have": "no puedes otorgar permisos que no tienes",
+		"only owners may change owners": "solo los propietarios pueden modificar a los propietarios",
+		"webhook URL must use https and a public address": "la URL del webhook debe usar https y una dirección pública",
+		"only owners may extend the owner role": "solo los propietarios pueden extender el rol de propietario",
+		"invalid role name": "nombre de rol no válido",
+		"role already exists": "el rol ya existe",
+		"role is assigned to users": "el rol está asignado a usuarios",
+		"role hierarchy is too deep": "la jerarquía de roles es demasiado profunda",
+		"roles cannot extend themselves": "los roles no pueden extenderse a sí mismos",
+		"group already exists": "el grupo ya existe",
+		"cannot revoke the only key": "no se puede revocar la única clave",
+		"avatar must be 2MB or smaller": "el avatar debe pesar 2MB o menos",
+		"avatar must be 16 megapixels or smaller": "el avatar debe tener 16 megapíxeles o menos",
+		"avatar must be a PNG, JPEG, or GIF image": "el avatar debe ser una imagen PNG, JPEG o GIF",
+		"no avatar provided": "no se proporcionó un avatar",
+		"invalid avatar": "avatar no válido",
+		"invalid locale": "configuración regional no válida",
+		"invalid merge patch": "merge patch no válido",
+		"invalid json patch": "json patch no válido",
+		"no query provided": "no se proporcionó una consulta",
+		"webhook not found": "webhook no encontrado",
+		"invalid from": "from no válido",
+		"invalid to": "to no válido",
+		"from must be before to": "from debe ser anterior a to",
+		"too many events to replay, narrow the range": "demasiados eventos para reenviar, acota el intervalo",
+		"websocket upgrade required": "se requiere actualizar a websocket",
+		"origin not allowed": "origen no permitido",
+		"sender domain not allowed": "dominio del remitente no permitido",
+		"email template not found": "plantilla de correo no encontrada",
+		"invalid template": "plantilla no válida",
+		"you have no email address": "no tienes una dirección de correo electrónico",
+		"delivery not found": "entrega no encontrada",
+		"no events provided": "no se proporcionaron eventos",
+		"invalid cursor": "cursor no válido",
+		"already exists": "ya existe",
+		"export not found": "exportación no encontrada",
+		"export already in progress": "ya hay una exportación en curso",
+		"erasure request not found": "solicitud de borrado no encontrada",
+		"erasure already requested": "el borrado ya fue solicitado",
+		"invalid or expired reset link": "enlace de restablecimiento no válido o vencido",
+		"first must be between 1 and 100": "first debe estar entre 1 y 100",
+		"query asks for more than 1000 nodes": "la consulta pide más de 1000 nodos",
+		"a request with this idempotency key is in progress": "hay una solicitud en curso con esta clave de idempotencia",
+		"idempotency key was used for a different request": "la clave de idempotencia se usó para otra solicitud",
+
+		// Validation
+		"is required": "es obligatorio",
+		"is required without %s": "es obligatorio si falta %s",
+		"must be at least %s characters": "debe tener al menos %s caracteres",
+		"must be at most %s characters": "debe tener como máximo %s caracteres",
+		"must be an email address": "debe ser una dirección de correo electrónico",
+		"must be a URL": "debe ser una URL",
+		"must be one of %s": "debe ser uno de %s",
+		"is invalid": "no es válido",
+		"must be 3 to 63 lowercase letters, digits, or dashes": "debe tener de 3 a 63 letras minúsculas, dígitos o guiones",
+
+		// Hosted pages
+		"Username or email": "Nombre de usuario o correo electrónico",
+		"Username": "Nombre de usuario",
+		"Email": "Correo electrónico",
+		"Name": "Nombre",
+		"Password": "Contraseña",
+		"New password": "Contraseña nueva",
+		"Log in": "Iniciar sesión",
+		"Create account": "Crear cuenta",
+		"Forgot your password?": "¿Olvidaste tu contraseña?",
+		"Email me a reset link": "Envíame un enlace para restablecerla",
+		"Change password": "Cambiar contraseña",
+		"If the account exists, we've emailed it a link to reset the password.": "Si la cuenta existe, le enviamos un enlace para restablecer la contraseña.",
+		"Your password has been changed. Log in with the new one.": "Tu contraseña cambió. Inicia sesión con la nueva.",
+
+		// Emails
+		"Confirm your email": "Confirma tu correo electrónico",
+		"Hi {{.Username}},\n\nConfirm your email address for {{.AccountName}} here:\n\n{{.Link}}\n\nThis link expires in {{.ExpiresInHours}} hours.": "Hola {{.Username}}:\n\nConfirma tu dirección de correo electrónico para {{.AccountName}} aquí:\n\n{{.Link}}\n\nEste enlace vence en {{.ExpiresInHours}} horas.",
+		`<p>Hi {{.Username}},</p><p>Confirm your email address for {{.AccountName}}:</p><p><a href="{{.Link}}">Confirm email</a></p><p>This link expires in {{.ExpiresInHours}} hours.</p>`: `<p>Hola {{.Username}}:</p><p>Confirma tu dirección de correo electrónico para {{.AccountName}}:</p><p><a href="{{.Link}}">Confirmar correo</a></p><p>Este enlace vence en {{.ExpiresInHours}} horas.</p>`,
+		"Reset your password": "Restablece tu contraseña",
+		"Hi {{.Username}},\n\nSomeone asked to reset your {{.AccountName}} password. If it was you, choose a new one here:\n\n{{.Link}}\n\nThis link expires in {{.ExpiresInMinutes}} minutes. If it wasn't you, you can ignore this email.": "Hola {{.Username}}:\n\nAlguien pidió restablecer tu contraseña de {{.AccountName}}. Si fuiste tú, elige una nueva aquí:\n\n{{.Link}}\n\nEste enlace vence en {{.ExpiresInMinutes}} minutos. Si no fuiste tú, puedes ignorar este correo.",
+		`<p>Hi {{.Username}},</p><p>Someone asked to reset your {{.AccountName}} password. If it was you, choose a new one:</p><p><a href="{{.Link}}">Reset password</a></p><p>This link expires in {{.ExpiresInMinutes}} minutes. If it wasn't you, you can ignore this email.</p>`: `<p>Hola {{.Username}}:</p><p>Alguien pidió restablecer tu contraseña de {{.AccountName}}. Si fuiste tú, elige una nueva:</p><p><a href="{{.Link}}">Restablecer contraseña</a></p><p>Este enlace vence en {{.ExpiresInMinutes}} minutos. Si no fuiste tú, puedes ignorar este correo.</p>`,
+		"You've been invited": "Has recibido una invitación",
+		"You've been invited to join {{.AccountName}}. Set your password here:\n\n{{.Link}}\n\nThis link expires in {{.ExpiresInDays}} days.": "Te han invitado a unirte a {{.AccountName}}. Establece tu contraseña aquí:\n\n{{.Link}}\n\nEste enlace vence en {{.ExpiresInDays}} días.",
+		`<p>You've been invited to join {{.AccountName}}.</p><p><a href="{{.Link}}">Set your password</a></p><p>This link expires in {{.ExpiresInDays}} days.</p>`: `<p>Te han invitado a unirte a {{.AccountName}}.</p><p><a href="{{.Link}}">Establecer contraseña</a></p><p>Este enlace vence en {{.ExpiresInDays}} días.</p>`,
+		"New sign-in to your account": "Nuevo inicio de sesión en tu cuenta",
+		"Hi {{.Username}},\n\nYour {{.AccountName}} account was signed in to from a new device:\n\n{{.UserAgent}}\n{{.IP}}\n{{.Time}}\n\nIf this wasn't you, change your password right away.": "Hola {{.Username}}:\n\nSe inició sesión en tu cuenta de {{.AccountName}} desde un dispositivo nuevo:\n\n{{.UserAgent}}\n{{.IP}}\n{{.Time}}\n\nSi no fuiste tú, cambia tu contraseña de inmediato.",
+		`<p>Hi {{.Username}},</p><p>Your {{.AccountName}} account was signed in to from a new device:</p><p>{{.UserAgent}}<br>{{.IP}}<br>{{.Time}}</p><p>If this wasn't you, change your password right away.</p>`: `<p>Hola {{.Username}}:</p><p>Se inició sesión en tu cuenta de {{.AccountName}} desde un dispositivo nuevo:</p><p>{{.UserAgent}}<br>{{.IP}}<br>{{.Time}}</p><p>Si no fuiste tú, cambia tu contraseña de inmediato.</p>`,
+	},
+}
+
+// Every account's own default locale, read once and cached
+var (
+	accountLocalesMutex sync.Mutex
+	accountLocalesCache map[uuid.UUID]string
+)
+
+// ====================
+//    Route Handlers
+// ====================
+
+func (h *accountHandlers) getLocale(c *fiber.Ctx) error {
+	currentUser := c.Locals("user").(*User)
+
+	return c.JSON(fiber.Map{
+		"default": os.Getenv("DEFAULT_LOCALE"),
+		"account": accountLocales(h.db)[currentUser.AccountId],
+		"supported": supportedLocales(),
+	})
+}
+
+// Sets the locale the account's users get when their requests don't ask
+// for one, e.g. {"Locale": "es"}. An empty locale uses DEFAULT_LOCALE.
+func (h *accountHandlers) updateLocale(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(Account)
+	if err := c.BodyParser(input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	input.Locale = strings.ToLower(strings.TrimSpace(input.Locale))
+	if _, ok := localeBundles[input.Locale]; input.Locale != "" && !ok {
+		return badRequest("invalid locale").With(fiber.Map{"supported": supportedLocales()})
+	}
+
+	account := new(Account)
+	account.ID = currentUser.AccountId
+	account.Locale = input.Locale
+	account.UpdatedAt = h.clock()
+	_, err := h.db.NewUpdate().Model(account).Column("locale", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	forgetAccountLocales()
+
+	return c.JSON(fiber.Map{
+		"default": os.Getenv("DEFAULT_LOCALE"),
+		"account": account.Locale,
+		"supported": supportedLocales(),
+	})
+}
+
+// ====================
+//      Middleware
+// ====================
+
+// Settles the locale errors are written in once the handlers have run,
+// so the account of whoever signed in is known: the best of
+// Accept-Language, then the account's default, then DEFAULT_LOCALE
+func negotiateLocale(c *fiber.Ctx, db *bun.DB) error {
+	err := c.Next()
+	if err == nil {
+		return nil
+	}
+
+	locale := acceptedLocale(c.Get(fiber.HeaderAcceptLanguage))
+	if locale == "" {
+		locale = accountLocale(requestAccountId(c, db), db)
+	}
+	c.Locals("locale", locale)
+
+	return err
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Wraps English text, formatted with args, to be translated later
+func localize(format string, args ...interface{}) localizedText {
+	return localizedText{Format: format, Args: args}
+}
+
+// The text in a locale, in English where there's no translation
+func (text localizedText) in(locale string) string {
+	format := translate(locale, text.Format)
+	if len(text.Args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, text.Args...)
+}
+
+// Text that escapes without being translated is English
+func (text localizedText) MarshalText() ([]byte, error) {
+	return []byte(text.in("en")), nil
+}
+
+// English text in a locale, or as is where there's no translation
+func translate(locale string, english string) string {
+	if translated, ok := localeBundles[locale][english]; ok {
+		return translated
+	}
+	return english
+}
+
+// Translates text within a response body, looking inside maps
+func translateValue(locale string, value interface{}) interface{} {
+	switch value := value.(type) {
+		case localizedText:
+			return value.in(locale)
+		case fiber.Map:
+			translated := fiber.Map{}
+			for key, inner := range value {
+				translated[key] = translateValue(locale, inner)
+			}
+			return translated
+	}
+	return value
+}
+
+// The locale to answer the request in
+func requestLocale(c *fiber.Ctx) string {
+	if locale, ok := c.Locals("locale").(string); ok {
+		return locale
+	}
+	if locale := acceptedLocale(c.Get(fiber.HeaderAcceptLanguage)); locale != "" {
+		return locale
+	}
+	return os.Getenv("DEFAULT_LOCALE")
+}
+
+// The supported locale the client prefers most, or "" if it accepts none
+// of them, e.g. "es-MX,es;q=0.9,en;q=0.8" is "es"
+func acceptedLocale(header string) string {
+	type preference struct {
+		Locale string
+		Quality float64
+	}
+
+	preferences := []preference{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		locale := strings.ToLower(strings.TrimSpace(fields[0]))
+		if locale == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			preferences = append(preferences, preference{Locale: locale, Quality: quality})
+		}
+	}
+
+	// Ties keep the client's order
+	sort.SliceStable(preferences, func(i, j int) bool {
+		return preferences[i].Quality > preferences[j].Quality
+	})
+
+	for _, preference := range preferences {
+		// Regional variants fall back to the language, e.g. es-MX to es
+		language := strings.SplitN(preference.Locale, "-", 2)[0]
+		if _, ok := localeBundles[language]; ok {
+			return language
+		}
+	}
+	return ""
+}
+
+// The account's default locale, else DEFAULT_LOCALE
+func accountLocale(accountId uuid.UUID, db *bun.DB) string {
+	if locale, ok := accountLocales(db)[accountId]; ok {
+		return locale
+	}
+	return os.Getenv("DEFAULT_LOCALE")
+}
+
+// The default locale of every account that has its own, read once and cached
+func accountLocales(db *bun.DB) map[uuid.UUID]string {
+	accountLocalesMutex.Lock()
+	defer accountLocalesMutex.Unlock()
+
+	if accountLocalesCache != nil {
+		return accountLocalesCache
+	}
+
+	ctx := context.Background()
+	accounts := []Account{}
+	err := db.NewSelect().Model(&accounts).Column("id", "locale").Where("locale IS NOT NULL").Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return map[uuid.UUID]string{}
+	}
+
+	accountLocalesCache = map[uuid.UUID]string{}
+	for _, account := range accounts {
+		accountLocalesCache[account.ID] = account.Locale
+	}
+
+	return accountLocalesCache
+}
+
+// Drops the cached account locales so the next request reads them again
+func forgetAccountLocales() {
+	accountLocalesMutex.Lock()
+	defer accountLocalesMutex.Unlock()
+	accountLocalesCache = nil
+}
+
+func supportedLocales() []string {
+	locales := []string{}
+	for locale := range localeBundles {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
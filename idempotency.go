@@ -0,0 +1,226 @@
+package goapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// IdempotencyKey DB model, the saved response to a request sent with
+// an Idempotency-Key header. Status is 0 while the request is running.
+// Bodies are saved without credentials, see withoutCredentials.
+type IdempotencyKey struct {
+	bun.BaseModel `bun:"table:idempotency_keys"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Key string // has idx
+	Scope string // has idx
+	Fingerprint string
+	Status int `bun:",notnull,default:0"`
+	ContentType string
+	Location string
+	Body []byte
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+}
+
+// How long a key replays its response before it can be used again
+const idempotencyTtl = time.Hour * 24
+
+const idempotencyHeaderName = "Idempotency-Key"
+
+// ====================
+//      Middleware
+// ====================
+
+// Replays the first successful response to a request with the same
+// Idempotency-Key, so clients can retry creations safely. Failed
+// requests give the key back so the retry runs again.
+func idempotent(db *bun.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(idempotencyHeaderName)
+		if key == "" {
+			return c.Next()
+		}
+		if len(key) > 255 {
+			return badRequest("idempotency key must be 255 characters or fewer")
+		}
+
+		ctx := context.Background()
+		record := &IdempotencyKey{
+			ID: newId(),
+			Key: key,
+			Scope: idempotencyScope(c),
+			Fingerprint: idempotencyFingerprint(c),
+		}
+
+		// Claim the key, taking it over if it has expired
+		q := db.NewInsert().Model(record)
+		result, err := upsertWhere(upsert(q, "scope, key"), [][2]string{
+			{"id", insertedValue(q, "id")},
+			{"fingerprint", insertedValue(q, "fingerprint")},
+			{"status", "0"},
+			{"content_type", "NULL"},
+			{"location", "NULL"},
+			{"body", "NULL"},
+			{"created_at", "current_timestamp"},
+		}, existingValue(q, "idempotency_key", "created_at")+" < ?", time.Now().Add(-idempotencyTtl)).
+			Returning("NULL").
+			Exec(ctx)
+		if err != nil {
+			return internalError(err)
+		}
+
+		if claimed, _ := result.RowsAffected(); claimed == 0 {
+			return replayIdempotentResponse(c, record, db)
+		}
+
+		if err := c.Next(); err != nil {
+			db.NewDelete().Model(record).WherePK().Exec(ctx)
+			return err
+		}
+
+		response := c.Response()
+		if response.StatusCode() >= fiber.StatusBadRequest {
+			db.NewDelete().Model(record).WherePK().Exec(ctx)
+			return nil
+		}
+
+		record.Status = response.StatusCode()
+		record.ContentType = string(response.Header.ContentType())
+		record.Location = string(response.Header.Peek(fiber.HeaderLocation))
+		record.Body = withoutCredentials(response.Body())
+		_, err = db.NewUpdate().Model(record).
+			Column("status", "content_type", "location", "body").
+			WherePK().
+			Exec(ctx)
+		if err != nil {
+			requestLogger(c).Error().Err(err).Send()
+		}
+
+		return nil
+	}
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Response fields holding something to sign in or verify with: session
+// tokens, the account key from creating an account, webhook secrets, and
+// invite link URLs, which carry their token. Compared ignoring case, as
+// later API versions name them in snake case.
+var idempotencyCredentialFields = []string{"token", "key", "secret", "url"}
+
+// A JSON body with every credential field left out, so saved responses
+// hold nothing that could be used if replayed or read from the database.
+// Clients that lost the first response sign in again or make new secrets.
+func withoutCredentials(body []byte) []byte {
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil
+	}
+
+	stripped, err := json.Marshal(stripCredentials(document))
+	if err != nil {
+		return nil
+	}
+	return stripped
+}
+
+func stripCredentials(value interface{}) interface{} {
+	switch value := value.(type) {
+		case map[string]interface{}:
+			for field, inner := range value {
+				if isCredentialField(field) {
+					delete(value, field)
+				} else {
+					value[field] = stripCredentials(inner)
+				}
+			}
+		case []interface{}:
+			for i, inner := range value {
+				value[i] = stripCredentials(inner)
+			}
+	}
+	return value
+}
+
+func isCredentialField(field string) bool {
+	for _, credential := range idempotencyCredentialFields {
+		if strings.EqualFold(field, credential) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends the saved response for a key someone already claimed
+func replayIdempotentResponse(c *fiber.Ctx, claim *IdempotencyKey, db *bun.DB) error {
+	ctx := c.UserContext()
+
+	saved := new(IdempotencyKey)
+	err := db.NewSelect().Model(saved).
+		Where("scope = ?", claim.Scope).
+		Where("? = ?", bun.Ident("key"), claim.Key).
+		Scan(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	if saved.Fingerprint != claim.Fingerprint {
+		return unprocessable("idempotency key was used for a different request").WithCode(codeIdempotencyKeyReused)
+	}
+	if saved.Status == 0 {
+		return conflict("a request with this idempotency key is in progress").WithCode(codeIdempotencyInProgress)
+	}
+
+	c.Set("Idempotent-Replayed", "true")
+	if saved.Location != "" {
+		c.Location(saved.Location)
+	}
+	c.Set(fiber.HeaderContentType, saved.ContentType)
+	return c.Status(saved.Status).Send(saved.Body)
+}
+
+// Keys are only unique per caller: the signed in user, else the client's
+// address along with the account key. An account key is shared by every
+// client of the account, so it can't tell them apart on its own.
+func idempotencyScope(c *fiber.Ctx) string {
+	if user, ok := c.Locals("user").(*User); ok {
+		return "user:" + user.ID.String()
+	}
+	scope := "ip:" + c.IP()
+	if key := c.Get("Account-Key"); key != "" {
+		scope = "key:" + hashSecret(key) + "|" + scope
+	}
+	return scope
+}
+
+// A digest of what the request asks for, to catch a key reused for
+// a different request
+func idempotencyFingerprint(c *fiber.Ctx) string {
+	sum := sha256.New()
+	sum.Write([]byte(c.Method()))
+	sum.Write([]byte{0})
+	sum.Write([]byte(c.OriginalURL()))
+	sum.Write([]byte{0})
+	sum.Write(c.Body())
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// Deletes keys that no longer replay
+func purgeIdempotencyKeys(db *bun.DB) {
+	ctx := context.Background()
+	_, err := db.NewDelete().Model((*IdempotencyKey)(nil)).
+		Where("created_at < ?", time.Now().Add(-idempotencyTtl)).
+		Exec(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("purging idempotency keys failed")
+	}
+}
@@ -0,0 +1,41 @@
+package goapi
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ====================
+//      Utilities
+// ====================
+
+// The ID for a new row. With UUID_VERSION=7 it starts with the time it was
+// made, so new rows land together at the end of an index rather than all
+// over it. IDs already stored are left as they are.
+func newId() uuid.UUID {
+	if os.Getenv("UUID_VERSION") == "7" {
+		return newUUIDv7()
+	}
+	return uuid.New()
+}
+
+// A UUIDv7: milliseconds since the epoch in the first 48 bits, then the
+// version, random bits, and the variant
+func newUUIDv7() uuid.UUID {
+	var id uuid.UUID
+	if _, err := rand.Read(id[6:]); err != nil {
+		return uuid.New()
+	}
+
+	var millis [8]byte
+	binary.BigEndian.PutUint64(millis[:], uint64(time.Now().UnixMilli()))
+	copy(id[:6], millis[2:])
+
+	id[6] = id[6]&0x0f | 0x70
+	id[8] = id[8]&0x3f | 0x80
+	return id
+}
@@ -0,0 +1,86 @@
+package goapi
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Lets an owner act as another user in their account with a short-lived token
+func impersonateUser(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	if !userHasRole(ctx, currentUser, roleOwner, db) || currentUser.ImpersonatorId != uuid.Nil {
+		return forbidden("only owners may impersonate users")
+	}
+
+	user := new(User)
+	err := db.NewSelect().Model(user).
+		Where("id = ?", c.Params("id")).
+		Where("account_id = ?", currentUser.AccountId).
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("user not found").WithCode(codeUserNotFound)
+	}
+
+	if user.ID == currentUser.ID {
+		return badRequest("cannot impersonate yourself")
+	}
+
+	token, err := newAuthService(db).SignToken(user.ID, user.AccountId, currentUser.ID, impersonationTtl())
+	if err != nil {
+		return internalError(err).WithCode(codeAuthTokenFailed)
+	}
+	user.Token = token
+
+	return c.JSON(render(c, user.ToPublicUser()))
+}
+
+// Revokes the impersonation token used to make the request
+func (h *authHandlers) endImpersonation(c *fiber.Ctx) error {
+	tokenString := getTokenStringFromHeaders(c)
+	if tokenString == "" {
+		return unauthorized("unauthorized").WithCode(codeAuthUnauthorized)
+	}
+
+	user, err := h.auth.Authenticate(c.UserContext(), tokenString)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return unauthorized("unauthorized").WithCode(codeAuthUnauthorized)
+	}
+
+	if user.ImpersonatorId == uuid.Nil {
+		return badRequest("not impersonating")
+	}
+
+	// Attribute the request to the impersonator in the audit log
+	c.Locals("user", user)
+
+	ctx := c.UserContext()
+	_, err = h.auth.Revoke(ctx, user, tokenString, map[string]interface{}{
+		"reason": "impersonation ended",
+		"impersonator": user.ImpersonatorId,
+	})
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// How long impersonation tokens last, from IMPERSONATION_TTL_MINUTES
+func impersonationTtl() time.Duration {
+	return time.Minute * time.Duration(intSetting("IMPERSONATION_TTL_MINUTES"))
+}
@@ -0,0 +1,317 @@
+//go:build integration
+
+package goapi_test
+
+// End to end tests of the API's main flows, through Fiber's test client
+// against a real database. They run against a throwaway Postgres started
+// in Docker, or the database at INTEGRATION_DATABASE_URI when it's set,
+// with DATABASE_DIALECT naming its dialect. Run them with
+//
+//	go test -tags integration ./...
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/uptrace/bun"
+	"goapi"
+	"goapi/testutil"
+)
+
+// The API the tests run against, mounted once for the whole run
+var (
+	app *fiber.App
+	db *bun.DB
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+// Sets up the database and the API, runs the tests, and cleans up, in a
+// function of its own so the clean up runs before os.Exit
+func run(m *testing.M) int {
+	uri := os.Getenv("INTEGRATION_DATABASE_URI")
+	if uri == "" {
+		container, started, err := startPostgres()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "starting postgres failed:", err)
+			return 1
+		}
+		defer exec.Command("docker", "rm", "-f", container).Run()
+		uri = started
+		os.Setenv("DATABASE_DIALECT", "postgres")
+	}
+	os.Setenv("DATABASE_URI", uri)
+	os.Setenv("JWT_SECRET", "integration")
+
+	if err := goapi.LoadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, "loading config failed:", err)
+		return 1
+	}
+	db = goapi.OpenDB()
+	defer db.Close()
+
+	app = fiber.New(fiber.Config{ErrorHandler: goapi.ErrorHandler})
+	goapi.Mount(app, db, goapi.Config{SkipWorkers: true})
+
+	return m.Run()
+}
+
+// ====================
+//        Tests
+// ====================
+
+func TestCreateAccount(t *testing.T) {
+	f := testutil.New(t, db, app)
+
+	res := f.Client().Post("/api/v1/accounts", fiber.Map{
+		"name": "Integration",
+		"username": "founder",
+		"email": "founder@example.com",
+		"password": testutil.DefaultPassword,
+	})
+	body := res.Object()
+	if res.Status != http.StatusCreated {
+		t.Fatalf("creating an account failed: %d %s", res.Status, res.Body)
+	}
+	owner := &testutil.User{Token: body["user"].(map[string]interface{})["Token"].(string)}
+	waitForSignIn(t, f, owner)
+
+	res = f.As(owner).Get("/api/v1/auth")
+	if res.Status != http.StatusOK || res.Object()["Role"] != "owner" {
+		t.Fatalf("the owner isn't signed in: %d %s", res.Status, res.Body)
+	}
+
+	res = f.As(owner).Get("/api/v1/accounts/keys")
+	if res.Status != http.StatusOK || len(res.List()) != 1 {
+		t.Fatalf("the account should have one key: %d %s", res.Status, res.Body)
+	}
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	f := testutil.New(t, db, app)
+	account := f.Account()
+
+	res := f.WithKey(account).Post("/api/v1/auth", fiber.Map{
+		"username": "newcomer",
+		"email": "newcomer@example.com",
+		"password": testutil.DefaultPassword,
+	})
+	if res.Status != http.StatusCreated || res.Object()["Token"] == "" {
+		t.Fatalf("registering failed: %d %s", res.Status, res.Body)
+	}
+	waitForSignIn(t, f, &testutil.User{Token: res.Object()["Token"].(string)})
+
+	for _, login := range []fiber.Map{
+		{"username": "NEWCOMER", "password": testutil.DefaultPassword},
+		{"email": "newcomer@example.com", "password": testutil.DefaultPassword},
+	} {
+		res = f.WithKey(account).Put("/api/v1/auth", login)
+		if res.Status != http.StatusOK || res.Object()["Username"] != "newcomer" {
+			t.Fatalf("logging in with %v failed: %d %s", login, res.Status, res.Body)
+		}
+	}
+
+	res = f.WithKey(account).Put("/api/v1/auth", fiber.Map{
+		"username": "newcomer",
+		"password": "wrong-password",
+	})
+	if res.Status != http.StatusBadRequest || res.Object()["code"] != "AUTH_INVALID_CREDENTIALS" {
+		t.Fatalf("a wrong password should be refused: %d %s", res.Status, res.Body)
+	}
+
+	res = f.WithKey(f.Account()).Put("/api/v1/auth", fiber.Map{
+		"username": "newcomer",
+		"password": testutil.DefaultPassword,
+	})
+	if res.Status != http.StatusBadRequest {
+		t.Fatalf("users shouldn't log in through another account's key: %d", res.Status)
+	}
+}
+
+func TestAdminUserCrud(t *testing.T) {
+	f := testutil.New(t, db, app)
+	account := f.Account()
+	admin := f.As(f.Admin(account))
+
+	res := admin.Post("/api/v1/users", fiber.Map{
+		"username": "managed",
+		"email": "managed@example.com",
+		"password": testutil.DefaultPassword,
+	})
+	if res.Status != http.StatusCreated {
+		t.Fatalf("creating a user failed: %d %s", res.Status, res.Body)
+	}
+	path := "/api/v1/users/" + res.Object()["ID"].(string)
+
+	res = admin.Get(path)
+	if res.Status != http.StatusOK || res.Object()["Username"] != "managed" {
+		t.Fatalf("reading the user failed: %d %s", res.Status, res.Body)
+	}
+
+	res = admin.Put(path, fiber.Map{"displayName": "Renamed"})
+	if res.Status != http.StatusOK || res.Object()["DisplayName"] != "Renamed" {
+		t.Fatalf("updating the user failed: %d %s", res.Status, res.Body)
+	}
+
+	// The owner, the admin, and the new user
+	res = admin.Get("/api/v1/users")
+	if res.Status != http.StatusOK || len(res.List()) != 3 {
+		t.Fatalf("the account should list three users: %d %s", res.Status, res.Body)
+	}
+
+	res = f.As(f.User(account)).Get("/api/v1/users")
+	if res.Status != http.StatusForbidden {
+		t.Fatalf("users without a role shouldn't list them: %d", res.Status)
+	}
+
+	res = admin.Delete(path)
+	if res.Status != http.StatusOK {
+		t.Fatalf("deleting the user failed: %d", res.Status)
+	}
+	// Users are deleted in the background
+	testutil.Eventually(t, "the deleted user was still found", func() bool {
+		return admin.Get(path).Status == http.StatusNotFound
+	})
+}
+
+// A PUT or PATCH only changes what it sends, so the role, metadata,
+// password, and creation time it leaves out stay as they were
+func TestUpdateKeepsOmittedFields(t *testing.T) {
+	f := testutil.New(t, db, app)
+	account := f.Account()
+	owner := f.As(account.Owner)
+	ctx := context.Background()
+
+	managed := f.User(account, func(user *goapi.User) {
+		user.Role = "admin"
+		user.Metadata = map[string]interface{}{"plan": "pro"}
+	})
+	before := new(goapi.User)
+	if err := db.NewSelect().Model(before).Where("id = ?", managed.ID).Scan(ctx); err != nil {
+		t.Fatalf("reading the user: %v", err)
+	}
+
+	for _, method := range []string{"PUT", "PATCH"} {
+		res := owner.Do(method, "/api/v1/users/"+managed.ID.String(), fiber.Map{"DisplayName": "Renamed by " + method})
+		if res.Status != http.StatusOK {
+			t.Fatalf("%s of the display name failed: %d %s", method, res.Status, res.Body)
+		}
+
+		after := new(goapi.User)
+		if err := db.NewSelect().Model(after).Where("id = ?", managed.ID).Scan(ctx); err != nil {
+			t.Fatalf("reading the user: %v", err)
+		}
+		if after.DisplayName != "Renamed by "+method {
+			t.Errorf("%s didn't change the display name: %q", method, after.DisplayName)
+		}
+		if after.Role != before.Role {
+			t.Errorf("%s changed the role from %q to %q", method, before.Role, after.Role)
+		}
+		if after.Metadata["plan"] != "pro" {
+			t.Errorf("%s changed the metadata to %v", method, after.Metadata)
+		}
+		if after.Password != before.Password {
+			t.Errorf("%s changed the password", method)
+		}
+		if !after.CreatedAt.Equal(before.CreatedAt) {
+			t.Errorf("%s changed the creation time from %v to %v", method, before.CreatedAt, after.CreatedAt)
+		}
+	}
+
+	res := f.WithKey(account).Put("/api/v1/auth", fiber.Map{
+		"username": managed.Username,
+		"password": managed.Password,
+	})
+	if res.Status != http.StatusOK {
+		t.Fatalf("the user's password should still log them in: %d %s", res.Status, res.Body)
+	}
+}
+
+// An account is made with its key and owner or not at all, so an owner
+// that can't be written leaves neither the account nor its key behind
+func TestCreateAccountRollsBack(t *testing.T) {
+	ctx := context.Background()
+
+	account := &goapi.Account{Name: "Rolled back"}
+	owner := &goapi.User{
+		Username: "rolledback",
+		Email: "rolledback@example.com",
+		Password: testutil.DefaultPassword,
+		// Can't be encoded as JSON, so the owner's insert fails
+		Metadata: map[string]interface{}{"unencodable": make(chan int)},
+	}
+	if _, err := goapi.CreateAccount(ctx, db, account, owner); err == nil {
+		t.Fatal("creating an account with an owner that can't be written should fail")
+	}
+
+	accounts, err := db.NewSelect().Model((*goapi.Account)(nil)).Where("id = ?", account.ID).Count(ctx)
+	if err != nil || accounts != 0 {
+		t.Fatalf("the account should have been rolled back: %d %v", accounts, err)
+	}
+	keys, err := db.NewSelect().Model((*goapi.Key)(nil)).Where("account_id = ?", account.ID).Count(ctx)
+	if err != nil || keys != 0 {
+		t.Fatalf("the key should have been rolled back: %d %v", keys, err)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	f := testutil.New(t, db, app)
+	owner := f.As(f.Account().Owner)
+
+	res := owner.Delete("/api/v1/auth")
+	if res.Status != http.StatusOK {
+		t.Fatalf("logging out failed: %d", res.Status)
+	}
+
+	res = owner.Get("/api/v1/users")
+	if res.Status != http.StatusUnauthorized {
+		t.Fatalf("a token should stop working once logged out: %d", res.Status)
+	}
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Tokens from logging in are stored in the background, so a new one may
+// take a moment to sign anyone in
+func waitForSignIn(t *testing.T, f *testutil.Factory, user *testutil.User) {
+	t.Helper()
+	testutil.Eventually(t, "the token never signed anyone in", func() bool {
+		res := f.As(user).Get("/api/v1/auth")
+		return res.Status == http.StatusOK && res.Object()["ID"] != nil
+	})
+}
+
+// Runs Postgres in a container removed once the tests finish, returning
+// the container and a URI for it. The API waits for it to accept
+// connections when it opens the database.
+func startPostgres() (string, string, error) {
+	out, err := exec.Command("docker", "run", "-d", "--rm",
+		"-e", "POSTGRES_PASSWORD=goapi",
+		"-e", "POSTGRES_DB=goapi",
+		"-p", "127.0.0.1::5432",
+		"postgres:15-alpine",
+	).Output()
+	if err != nil {
+		return "", "", err
+	}
+	container := strings.TrimSpace(string(out))
+
+	out, err = exec.Command("docker", "port", container, "5432/tcp").Output()
+	if err != nil {
+		exec.Command("docker", "rm", "-f", container).Run()
+		return "", "", err
+	}
+	address := strings.Fields(string(out))[0]
+
+	return container, fmt.Sprintf("postgres://postgres:goapi@%s/goapi?sslmode=disable", address), nil
+}
@@ -0,0 +1,181 @@
+package goapi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// InviteLink DB model, a reusable registration link with a preset role
+type InviteLink struct {
+	bun.BaseModel `bun:"table:invite_links"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Role string
+	TokenHash string `json:"-"` // has idx
+	MaxUses int `bun:",notnull,default:0"` // 0 is unlimited
+	Uses int `bun:",notnull,default:0"`
+	ExpiresAt time.Time
+	RevokedAt time.Time `bun:",nullzero"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	AccountId uuid.UUID `bun:",type:uuid"`
+	CreatedById uuid.UUID `bun:",type:uuid"`
+
+	// Other
+	URL string `bun:"-" json:",omitempty"` // only returned when created
+	ExpiresInHours int `bun:"-" json:"-"`
+}
+
+// Joining through a link, with the link's token and the new user's details
+type AcceptInviteLinkInput struct {
+	Token string `validate:"required"`
+	RegisterInput
+}
+
+// ====================
+//        Setup
+// ====================
+
+var _ bun.BeforeAppendModelHook = (*InviteLink)(nil)
+func (l *InviteLink) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+		case *bun.UpdateQuery:
+			l.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Mints a link. The URL is only ever shown in this response.
+func createInviteLink(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	if !IsEnabled(currentUser.AccountId, flagInviteLinks, db) {
+		return forbidden("invite links are disabled").WithCode(codeFeatureDisabled)
+	}
+
+	link := new(InviteLink)
+	if err := c.BodyParser(link); err != nil || link.MaxUses < 0 {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	link.Role = normalizeRoleName(link.Role)
+	if err := validateRoleAssignment(ctx, currentUser, link.Role, db); err != nil {
+		return err
+	}
+
+	token, err := generateSecureToken()
+	if err != nil {
+		return internalError(err)
+	}
+
+	if link.ExpiresInHours <= 0 {
+		link.ExpiresInHours = 24 * 7
+	}
+
+	link.ID = newId()
+	link.TokenHash = hashSecret(token)
+	link.Uses = 0
+	link.ExpiresAt = time.Now().Add(time.Hour * time.Duration(link.ExpiresInHours))
+	link.AccountId = currentUser.AccountId
+	link.CreatedById = currentUser.ID
+	_, err = db.NewInsert().Model(link).Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	link.URL = fmt.Sprintf("%s?token=%s", os.Getenv("INVITE_LINK_URL"), token)
+	return created(c, apiPath(c, "/users/invite-links/"+link.ID.String()), link)
+}
+
+func getInviteLinks(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	links := []InviteLink{}
+	err := db.NewSelect().Model(&links).
+		Where("account_id = ?", currentUser.AccountId).
+		Where("revoked_at IS NULL").
+		Order("created_at DESC").
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return an empty array
+	}
+
+	return c.JSON(links)
+}
+
+func revokeInviteLink(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	_, err := db.NewUpdate().Model((*InviteLink)(nil)).
+		Set("revoked_at = ?", time.Now()).
+		Set("updated_at = ?", time.Now()).
+		Where("id = ?", c.Params("linkId")).
+		Where("account_id = ?", currentUser.AccountId).
+		Exec(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// Registers a new user through a link, using up one of its uses
+func acceptInviteLink(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+
+	input := new(AcceptInviteLinkInput)
+	if err := parseBody(c, input); err != nil {
+		return err
+	}
+
+	// Claim a use up front so concurrent registrations can't exceed the limit
+	link := new(InviteLink)
+	err := updateReturning(ctx, db, link, func(q bun.QueryBuilder) bun.QueryBuilder {
+		return q.Where("token_hash = ?", hashSecret(input.Token)).
+			Where("revoked_at IS NULL").
+			Where("expires_at > ?", time.Now()).
+			Where("max_uses = 0 OR uses < max_uses")
+	}, func(q *bun.UpdateQuery) *bun.UpdateQuery {
+		return q.Set("uses = uses + 1").Set("updated_at = ?", time.Now())
+	})
+	if err != nil || link.ID == uuid.Nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid or expired invite link").WithCode(codeInviteInvalid)
+	}
+
+	user := input.ToUser()
+	user.Role = link.Role
+	user.AccountId = link.AccountId
+	if _, err := user.New(ctx, db); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+
+		// Give the use back
+		db.NewUpdate().Model(link).Set("uses = uses - 1").WherePK().Exec(ctx)
+		return err
+	}
+
+	token, err := newAuthService(db).StartSession(user.ID, user.AccountId)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// continue without a token
+	}
+	user.Token = token
+
+	return created(c, apiPath(c, "/me"), render(c, user.ToPublicUser()))
+}
@@ -0,0 +1,291 @@
+package goapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// Invite DB model, a user who has been invited but hasn't set a password yet
+type Invite struct {
+	bun.BaseModel `bun:"table:invites"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Email string
+	Role string
+	TokenHash string `json:"-"` // has idx
+	ExpiresAt time.Time
+	AcceptedAt time.Time `bun:",nullzero"`
+	RevokedAt time.Time `bun:",nullzero"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	AccountId uuid.UUID `bun:",type:uuid"`
+	InvitedById uuid.UUID `bun:",type:uuid"`
+	UserId uuid.UUID `bun:",type:uuid,nullzero"` // set once accepted
+}
+
+// Accepting an invite
+type AcceptInviteInput struct {
+	Token string
+	Username string
+	Password string
+}
+
+// How long an invite link works for
+const inviteTtl = time.Hour * 24 * 7
+
+// ====================
+//        Setup
+// ====================
+
+var _ bun.BeforeAppendModelHook = (*Invite)(nil)
+func (i *Invite) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+		case *bun.UpdateQuery:
+			i.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func initInviteRoutes(api fiber.Router, db *bun.DB) {
+	api.Post("/invites/accept", func(c *fiber.Ctx) error {
+		return acceptInvite(c, db)
+	})
+
+	api.Post("/invite-links/accept", func(c *fiber.Ctx) error {
+		return acceptInviteLink(c, db)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func createInvite(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	invite := new(Invite)
+	if err := c.BodyParser(invite); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	email, err := normalizeEmail(invite.Email)
+	if err != nil {
+		return badRequest("invalid email")
+	}
+
+	invite.Role = normalizeRoleName(invite.Role)
+	if err := validateRoleAssignment(ctx, currentUser, invite.Role, db); err != nil {
+		return err
+	}
+
+	exists, err := db.NewSelect().Model((*User)(nil)).WhereAllWithDeleted().
+		Where("email = ?", email).Where("account_id = ?", currentUser.AccountId).Exists(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	if exists {
+		return conflict("email in use").WithCode(codeUserEmailTaken)
+	}
+
+	invite.ID = newId()
+	invite.Email = email
+	invite.AccountId = currentUser.AccountId
+	invite.InvitedById = currentUser.ID
+	token, err := invite.refreshToken()
+	if err != nil {
+		return internalError(err)
+	}
+
+	_, err = db.NewInsert().Model(invite).Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	invite.send(ctx, token, accountLocale(invite.AccountId, db), db)
+
+	return created(c, apiPath(c, "/users/invites/"+invite.ID.String()), invite)
+}
+
+// Lists invites that haven't been accepted or revoked
+func getInvites(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	invites := []Invite{}
+	err := db.NewSelect().Model(&invites).
+		Where("account_id = ?", currentUser.AccountId).
+		Where("accepted_at IS NULL").
+		Where("revoked_at IS NULL").
+		Order("created_at DESC").
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return an empty array
+	}
+
+	return c.JSON(invites)
+}
+
+func getInvite(c *fiber.Ctx, db *bun.DB) error {
+	invite, err := findPendingInvite(c, db)
+	if err != nil {
+		return notFound("invite not found").WithCode(codeInviteNotFound)
+	}
+
+	return c.JSON(invite)
+}
+
+// Sends a new link, invalidating the old one
+func resendInvite(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+
+	invite, err := findPendingInvite(c, db)
+	if err != nil {
+		return notFound("invite not found").WithCode(codeInviteNotFound)
+	}
+
+	token, err := invite.refreshToken()
+	if err != nil {
+		return internalError(err)
+	}
+
+	_, err = db.NewUpdate().Model(invite).Column("token_hash", "expires_at", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	invite.send(ctx, token, accountLocale(invite.AccountId, db), db)
+
+	return c.JSON(invite)
+}
+
+func revokeInvite(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+
+	invite, err := findPendingInvite(c, db)
+	if err != nil {
+		return notFound("invite not found").WithCode(codeInviteNotFound)
+	}
+
+	invite.RevokedAt = time.Now()
+	_, err = db.NewUpdate().Model(invite).Column("revoked_at", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// Creates the invited user with the username and password they chose
+func acceptInvite(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+
+	input := new(AcceptInviteInput)
+	if err := c.BodyParser(input); err != nil || input.Token == "" {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	// Claim the invite up front so concurrent accepts can't both use it
+	invite := new(Invite)
+	err := updateReturning(ctx, db, invite, func(q bun.QueryBuilder) bun.QueryBuilder {
+		return q.Where("token_hash = ?", hashSecret(input.Token)).
+			Where("accepted_at IS NULL").
+			Where("revoked_at IS NULL").
+			Where("expires_at > ?", time.Now())
+	}, func(q *bun.UpdateQuery) *bun.UpdateQuery {
+		return q.Set("accepted_at = ?", time.Now()).Set("updated_at = ?", time.Now())
+	})
+	if err != nil || invite.ID == uuid.Nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid or expired invite").WithCode(codeInviteInvalid)
+	}
+
+	user := new(User)
+	user.Username = input.Username
+	user.Password = input.Password
+	user.Email = invite.Email
+	user.Role = invite.Role
+	user.AccountId = invite.AccountId
+	if _, err := user.New(ctx, db); err != nil {
+		// Give the invite back
+		db.NewUpdate().Model(invite).Set("accepted_at = NULL").WherePK().Exec(ctx)
+		return err
+	}
+
+	invite.UserId = user.ID
+	_, err = db.NewUpdate().Model(invite).Column("user_id", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	token, err := newAuthService(db).StartSession(user.ID, user.AccountId)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// continue without a token
+	}
+	user.Token = token
+
+	return created(c, apiPath(c, "/me"), render(c, user.ToPublicUser()))
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func findPendingInvite(c *fiber.Ctx, db *bun.DB) (*Invite, error) {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	invite := new(Invite)
+	err := db.NewSelect().Model(invite).
+		Where("id = ?", c.Params("inviteId")).
+		Where("account_id = ?", currentUser.AccountId).
+		Where("accepted_at IS NULL").
+		Where("revoked_at IS NULL").
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return nil, errors.New("invite not found")
+	}
+
+	return invite, nil
+}
+
+// Generates a new single-use token, returning it and storing only its digest
+func (invite *Invite) refreshToken() (string, error) {
+	token, err := generateSecureToken()
+	if err != nil {
+		return "", err
+	}
+
+	invite.TokenHash = hashSecret(token)
+	invite.ExpiresAt = time.Now().Add(inviteTtl)
+	return token, nil
+}
+
+// Queues an email with the acceptance link, built from INVITE_URL
+func (invite *Invite) send(ctx context.Context, token string, locale string, db *bun.DB) {
+	content, err := renderEmail(ctx, emailTemplateInvite, invite.AccountId, locale, map[string]interface{}{
+		"Link": fmt.Sprintf("%s?token=%s", os.Getenv("INVITE_URL"), token),
+		"ExpiresInDays": int(inviteTtl.Hours() / 24),
+	}, db)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	if err := queueEmail(ctx, db, invite.AccountId, invite.Email, content); err != nil {
+		logger.Error().Err(err).Send()
+	}
+}
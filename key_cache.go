@@ -0,0 +1,141 @@
+package goapi
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The accounts of recently used keys, by the hash of their secret or the
+// fingerprint of their client certificate, so requests carrying either
+// needn't read the key from the database. The least recently used key is
+// dropped once KEY_CACHE_SIZE are held, and every key after
+// KEY_CACHE_TTL_SECONDS. A key revoked through another instance keeps
+// working there until then. A size of 0 turns the cache off.
+type keyCache struct {
+	mutex sync.Mutex
+	size int
+	ttl time.Duration
+	order *list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+type keyCacheEntry struct {
+	hash string
+	keyId uuid.UUID
+	accountId uuid.UUID
+	certificate string // the client certificate the key is bound to
+	expiresAt time.Time
+}
+
+// Lookups, by whether the cache had the key, and the share it had
+var (
+	keyCacheResults = expvar.NewMap("key_cache")
+	keyCacheHits = new(expvar.Int)
+	keyCacheMisses = new(expvar.Int)
+)
+
+var accountKeys = &keyCache{order: list.New(), entries: map[string]*list.Element{}}
+
+func init() {
+	keyCacheResults.Set("hits", keyCacheHits)
+	keyCacheResults.Set("misses", keyCacheMisses)
+	keyCacheResults.Set("hit_rate", expvar.Func(func() interface{} {
+		hits, misses := keyCacheHits.Value(), keyCacheMisses.Value()
+		if hits+misses == 0 {
+			return 0.0
+		}
+		return float64(hits) / float64(hits+misses)
+	}))
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Drops a revoked or rebound key so the change takes hold on this
+// instance at once
+func forgetKey(keyId uuid.UUID) {
+	accountKeys.mutex.Lock()
+	defer accountKeys.mutex.Unlock()
+
+	for hash, element := range accountKeys.entries {
+		if element.Value.(*keyCacheEntry).keyId == keyId {
+			accountKeys.order.Remove(element)
+			delete(accountKeys.entries, hash)
+		}
+	}
+}
+
+func (cache *keyCache) get(hash string) (*keyCacheEntry, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[hash]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*keyCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		cache.order.Remove(element)
+		delete(cache.entries, hash)
+		return nil, false
+	}
+
+	cache.order.MoveToFront(element)
+	return entry, true
+}
+
+func (cache *keyCache) set(hash string, key *Key) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	// Read each time, so a reload can resize or turn off the cache
+	cache.size = intSetting("KEY_CACHE_SIZE")
+	cache.ttl = time.Duration(intSetting("KEY_CACHE_TTL_SECONDS")) * time.Second
+	if cache.size == 0 {
+		return
+	}
+
+	entry := &keyCacheEntry{
+		hash: hash,
+		keyId: key.ID,
+		accountId: key.AccountId,
+		certificate: key.ClientCertificate,
+		expiresAt: time.Now().Add(cache.ttl),
+	}
+	if element, ok := cache.entries[hash]; ok {
+		element.Value = entry
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[hash] = cache.order.PushFront(entry)
+
+	for cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*keyCacheEntry).hash)
+	}
+}
+
+// The cached key under the name, or the one find returns, cached under it
+// when found
+func cachedKey(name string, find func() (*Key, error)) (*keyCacheEntry, error) {
+	if entry, ok := accountKeys.get(name); ok {
+		keyCacheHits.Add(1)
+		return entry, nil
+	}
+	keyCacheMisses.Add(1)
+
+	key, err := find()
+	if err != nil {
+		return nil, err
+	}
+
+	accountKeys.set(name, key)
+	return &keyCacheEntry{keyId: key.ID, accountId: key.AccountId, certificate: key.ClientCertificate}, nil
+}
@@ -0,0 +1,54 @@
+package goapi
+
+import (
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// The application logger, configured by initLogger
+var logger = zerolog.New(os.Stdout).With().Timestamp().Logger()
+
+// ====================
+//        Setup
+// ====================
+
+// Configures the logger from LOG_LEVEL (default info) and LOG_FORMAT, which
+// is JSON unless set to "console" for human-readable output
+func initLogger() {
+	level, err := zerolog.ParseLevel(strings.ToLower(os.Getenv("LOG_LEVEL")))
+	if err != nil || level == zerolog.NoLevel {
+		level = zerolog.InfoLevel
+	}
+
+	// Everything logged goes through redaction, see redact.go
+	out := zerolog.New(newRedactingWriter(os.Stdout))
+	if os.Getenv("LOG_FORMAT") == "console" {
+		out = zerolog.New(zerolog.ConsoleWriter{Out: newRedactingWriter(os.Stdout)})
+	}
+
+	logger = out.Level(level).With().Timestamp().Caller().Logger()
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// A logger carrying the request's id and route and, once known, its account and user
+func requestLogger(c *fiber.Ctx) *zerolog.Logger {
+	fields := logger.With().
+		Str("request_id", requestId(c)).
+		Str("method", c.Method()).
+		Str("route", c.Route().Path)
+
+	if user, ok := c.Locals("user").(*User); ok {
+		fields = fields.
+			Str("account_id", user.AccountId.String()).
+			Str("user_id", user.ID.String())
+	}
+
+	l := fields.Logger()
+	return &l
+}
@@ -0,0 +1,118 @@
+package goapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/uptrace/bun"
+)
+
+// LoginAttempt DB model
+type LoginAttempt struct {
+	bun.BaseModel `bun:"table:login_attempts"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Identifier string
+	Success bool `bun:",notnull"`
+	Reason string `bun:",nullzero"`
+	IP string
+	UserAgent string
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	UserId uuid.UUID `bun:",type:uuid,nullzero"` // has idx
+	AccountId uuid.UUID `bun:",type:uuid"`
+}
+
+// Where a login came from, over whichever transport
+type loginOrigin struct {
+	IP string
+	UserAgent string
+	Log *zerolog.Logger
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func getMyLogins(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+	return c.JSON(findLoginAttempts(c.UserContext(), currentUser.ID, currentUser.AccountId, db))
+}
+
+func getUserLogins(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+
+	userId, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return notFound("user not found").WithCode(codeUserNotFound)
+	}
+
+	return c.JSON(findLoginAttempts(c.UserContext(), userId, currentUser.AccountId, db))
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Records a login attempt in the background. userId may be uuid.Nil
+// when the identifier didn't match anyone.
+func recordLoginAttempt(origin loginOrigin, db *bun.DB, accountId uuid.UUID, userId uuid.UUID, identifier string, success bool, reason string) {
+	attempt := new(LoginAttempt)
+	attempt.ID = newId()
+	attempt.AccountId = accountId
+	attempt.UserId = userId
+	attempt.Identifier = identifier
+	attempt.Success = success
+	attempt.Reason = reason
+	attempt.IP = origin.IP
+	attempt.UserAgent = origin.UserAgent
+
+	eventType := eventLoginSucceeded
+	data := map[string]interface{}{"identifier": identifier, "ip": origin.IP}
+	if !success {
+		eventType = eventLoginFailed
+		data["reason"] = reason
+	}
+
+	go func() {
+		ctx := context.Background()
+		err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			if _, err := tx.NewInsert().Model(attempt).Exec(ctx); err != nil {
+				return err
+			}
+			return recordEvent(ctx, tx, eventType, accountId, userId, data)
+		})
+		if err != nil {
+			origin.Log.Error().Err(err).Send()
+		}
+	}()
+}
+
+// Where an HTTP request's login came from
+func requestLoginOrigin(c *fiber.Ctx) loginOrigin {
+	return loginOrigin{
+		IP: c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		Log: requestLogger(c),
+	}
+}
+
+// The most recent login attempts for a user
+func findLoginAttempts(ctx context.Context, userId uuid.UUID, accountId uuid.UUID, db *bun.DB) []LoginAttempt {
+	attempts := []LoginAttempt{}
+	err := db.NewSelect().Model(&attempts).
+		Where("user_id = ?", userId).
+		Where("account_id = ?", accountId).
+		Order("created_at DESC").
+		Limit(100).
+		Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		// Continue and simply return an empty array
+	}
+
+	return attempts
+}
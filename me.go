@@ -0,0 +1,192 @@
+package goapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/uptrace/bun"
+)
+
+// Fields a user may change on their own record
+type MeInput struct {
+	DisplayName *string
+	Metadata map[string]interface{}
+}
+
+// ====================
+//        Setup
+// ====================
+
+func initMeRoutes(api fiber.Router, db *bun.DB, store Storage) {
+	routes := api.Group("/me", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	})
+
+	routes.Get("/", func(c *fiber.Ctx) error {
+		return getMe(c, db)
+	})
+
+	routes.Delete("/", func(c *fiber.Ctx) error {
+		return deleteMe(c, db)
+	})
+
+	routes.Get("/consents", func(c *fiber.Ctx) error {
+		return getMyConsents(c, db)
+	})
+
+	routes.Post("/consents", func(c *fiber.Ctx) error {
+		return acceptConsent(c, db)
+	})
+
+	routes.Get("/export", func(c *fiber.Ctx) error {
+		return getMyDataExport(c, db)
+	})
+
+	routes.Post("/export", func(c *fiber.Ctx) error {
+		return createMyDataExport(c, db, store)
+	})
+
+	routes.Get("/export/download", func(c *fiber.Ctx) error {
+		return downloadMyDataExport(c, db, store)
+	})
+
+	routes.Get("/erasure", func(c *fiber.Ctx) error {
+		return getMyErasure(c, db)
+	})
+
+	routes.Post("/erasure", func(c *fiber.Ctx) error {
+		return requestMyErasure(c, db)
+	})
+
+	routes.Delete("/erasure", func(c *fiber.Ctx) error {
+		return cancelMyErasure(c, db)
+	})
+
+	// Everything below needs the latest required documents accepted
+	routes.Use(func(c *fiber.Ctx) error {
+		return requireConsent(c, db)
+	})
+
+	routes.Patch("/", func(c *fiber.Ctx) error {
+		return updateMe(c, db)
+	})
+
+	routes.Get("/logins", func(c *fiber.Ctx) error {
+		return getMyLogins(c, db)
+	})
+
+	routes.Post("/upgrade", func(c *fiber.Ctx) error {
+		return upgradeAnonymous(c, db)
+	})
+
+	routes.Put("/username", func(c *fiber.Ctx) error {
+		return changeMyUsername(c, db)
+	})
+
+	routes.Put("/avatar", func(c *fiber.Ctx) error {
+		return uploadAvatar(c, db, store)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func getMe(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	include, err := includeRelations(c, userIncludes)
+	if err != nil {
+		return err
+	}
+
+	// The signed in user was read without relations, so they're read now
+	if c.Query("include") != "" {
+		loaded := &User{ID: currentUser.ID}
+		if err := db.NewSelect().Model(loaded).WherePK().Apply(include).Scan(ctx); err != nil {
+			return internalError(err)
+		}
+		currentUser.Account = loaded.Account
+		currentUser.Tokens = loaded.Tokens
+	}
+
+	publicUser := currentUser.ToPublicUser()
+	publicUser.PendingConsents = pendingConsents(ctx, currentUser, db)
+
+	body, err := sparseFields(c, render(c, publicUser))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(body)
+}
+
+// Updates only the self-service fields the user sent
+func updateMe(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(MeInput)
+	if err := c.BodyParser(input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	columns := []string{"updated_at"}
+	if input.DisplayName != nil {
+		currentUser.DisplayName = *input.DisplayName
+		columns = append(columns, "display_name")
+	}
+	if input.Metadata != nil {
+		currentUser.Metadata = input.Metadata
+		columns = append(columns, "metadata")
+	}
+
+	currentUser.UpdatedAt = time.Now()
+	_, err := db.NewUpdate().Model(currentUser).Column(columns...).WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	forgetUserTokens(currentUser.ID)
+
+	return c.JSON(render(c, currentUser.ToPublicUser()))
+}
+
+// Soft deletes the current user after confirming their password
+// and revokes every token they hold
+func deleteMe(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(User)
+	if err := c.BodyParser(input); err != nil || input.Password == "" {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("password confirmation required")
+	}
+
+	if !checkPasswordHash(input.Password, currentUser.Password) {
+		return badRequest("invalid password").WithCode(codeAuthInvalidPassword)
+	}
+
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewDelete().Model(currentUser).WherePK().Exec(ctx); err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, eventUserDeleted, currentUser.AccountId, currentUser.ID, map[string]interface{}{
+			"self": true,
+		})
+	})
+	if err != nil {
+		return internalError(err)
+	}
+	forgetUserTokens(currentUser.ID)
+
+	_, err = db.NewDelete().Model(new(Token)).Where("user_id = ?", currentUser.ID).Exec(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
@@ -0,0 +1,174 @@
+package goapi
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/migrate"
+)
+
+// Schema changes are SQL files in migrations/<dialect>/, named
+// <YYYYMMDDHHMMSS>_<name>.tx.up.sql with a matching .tx.down.sql that
+// undoes it. Each runs in a transaction, so one that fails leaves nothing
+// behind and is tried again on the next start. Statements are separated
+// by --bun:split lines. Every dialect has a migration of each name, and
+// MySQL's leave out .tx since it can't change the schema in one.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// A migration and whether it has been applied
+type MigrationStatus struct {
+	Name string
+	Applied bool
+	Group int64 `json:",omitempty"` // migrations applied together share a group
+	MigratedAt *time.Time `json:",omitempty"`
+}
+
+// How long to wait for another instance that's migrating to finish. A
+// lock left by one that died partway has to be deleted from
+// bun_migration_locks by hand.
+const migrationLockTimeout = 5 * time.Minute
+
+// ====================
+//        Setup
+// ====================
+
+func initMigrationRoutes(api fiber.Router, db *bun.DB) {
+	api.Get("/operator/migrations", requireOperator, func(c *fiber.Ctx) error {
+		return getMigrations(c, db)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func getMigrations(c *fiber.Ctx, db *bun.DB) error {
+	statuses, err := MigrationStatuses(db)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(statuses)
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Applies every migration not yet applied. Instances starting together
+// take turns, so only one of them changes the schema.
+func Migrate(db *bun.DB) error {
+	ctx := context.Background()
+
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(migrationLockTimeout)
+	for {
+		group, err := migrator.Migrate(ctx)
+		if err != nil && isMigrationLocked(err) && time.Now().Before(deadline) {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if err != nil {
+			// bun records a migration as applied before running it, but a
+			// failed one was rolled back with its transaction
+			if group != nil && len(group.Migrations) > 0 {
+				failed := group.Migrations[len(group.Migrations)-1]
+				if unmarkErr := migrator.MarkUnapplied(ctx, &failed); unmarkErr != nil {
+					logger.Error().Err(unmarkErr).Send()
+				}
+			}
+			return err
+		}
+
+		if !group.IsZero() {
+			logger.Info().Str("migrations", group.Migrations.String()).Msg("database migrated")
+		}
+		return nil
+	}
+}
+
+// Undoes the last group of migrations applied
+func Rollback(db *bun.DB) error {
+	ctx := context.Background()
+
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	group, err := migrator.Rollback(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !group.IsZero() {
+		logger.Info().Str("migrations", group.Migrations.String()).Msg("database rolled back")
+	}
+	return nil
+}
+
+// Every migration, oldest first, with whether it's been applied
+func MigrationStatuses(db *bun.DB) ([]MigrationStatus, error) {
+	ctx := context.Background()
+
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations, err := migrator.MigrationsWithStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	for _, migration := range migrations {
+		status := MigrationStatus{Name: migration.Name, Applied: migration.IsApplied(), Group: migration.GroupID}
+		if status.Applied {
+			migratedAt := migration.MigratedAt
+			status.MigratedAt = &migratedAt
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// A migrator for the embedded migrations of DATABASE_DIALECT, with its
+// tables created
+func newMigrator(db *bun.DB) (*migrate.Migrator, error) {
+	files, err := fs.Sub(migrationFiles, path.Join("migrations", databaseDialect()))
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := migrate.NewMigrations()
+	if err := migrations.Discover(files); err != nil {
+		return nil, err
+	}
+
+	migrator := migrate.NewMigrator(db, migrations)
+	if err := migrator.Init(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return migrator, nil
+}
+
+// bun doesn't wait for the lock, it fails
+func isMigrationLocked(err error) bool {
+	return strings.Contains(err.Error(), "already locked")
+}
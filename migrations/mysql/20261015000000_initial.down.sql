@@ -0,0 +1,121 @@
+DROP TABLE IF EXISTS `password_resets`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `erasure_requests`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `data_exports`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `email_templates`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `emails`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `webhook_deliveries`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `webhooks`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `idempotency_keys`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `flag_overrides`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `feature_flags`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `daily_metrics`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `audit_exports`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `group_members`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `groups`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `account_policies`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `roles`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `consents`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `consent_documents`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `user_activities`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `daily_signups`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `invite_links`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `invites`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `audit_logs`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `user_notes`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `login_attempts`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `username_histories`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `events`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `keys`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `accounts`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `tokens`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `users`;
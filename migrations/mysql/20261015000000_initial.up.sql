@@ -0,0 +1,247 @@
+-- The schema as of the Postgres migration of the same name. Ids are
+-- generated by the app, arrays are kept as JSON, and the Postgres search
+-- indexes are left out. MySQL has no partial indexes, so pending erasures
+-- are kept unique through a generated column. It commits each change to
+-- the schema as it's made, so this doesn't run in a transaction.
+
+CREATE TABLE IF NOT EXISTS `users` (`id` CHAR(36) NOT NULL, `username` VARCHAR(255), `email` VARCHAR(255), `display_name` TEXT, `avatar_url` TEXT, `password` TEXT, `role` TEXT, `status` VARCHAR(255) NOT NULL DEFAULT 'active', `metadata` JSON, `last_login_at` DATETIME(6), `login_count` BIGINT NOT NULL DEFAULT 0, `tags` JSON, `is_anonymous` BOOLEAN NOT NULL DEFAULT false, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `deleted_at` DATETIME(6), `account_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `username_idx` ON `users` (`username`);
+
+--bun:split
+
+CREATE INDEX `account_id_idx` ON `users` (`account_id`);
+
+--bun:split
+
+CREATE UNIQUE INDEX `account_id_lower_username_idx` ON `users` ((lower(`username`)), `account_id`);
+
+--bun:split
+
+CREATE UNIQUE INDEX `account_id_email_idx` ON `users` (`account_id`, `email`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `tokens` (`id` CHAR(36) NOT NULL, `value` VARCHAR(2048) CHARACTER SET ascii, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `user_id` CHAR(36), `actor_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `value_idx` ON `tokens` (`value`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `accounts` (`id` CHAR(36) NOT NULL, `name` TEXT, `reserved_usernames` JSON, `route_permissions` JSON, `retention` JSON, `cors` JSON, `locale` TEXT, `email_sender` JSON, `email_variables` JSON, `slug` VARCHAR(255), `hosted_pages` JSON, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE UNIQUE INDEX `accounts_slug_idx` ON `accounts` (`slug`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `keys` (`id` CHAR(36) NOT NULL, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `account_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `events` (`id` CHAR(36) NOT NULL, `type` TEXT, `data` JSON, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `dispatched_at` DATETIME(6), `account_id` CHAR(36), `user_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `events_account_id_created_at_idx` ON `events` (`account_id`, `created_at`);
+
+--bun:split
+
+CREATE INDEX `events_undispatched_idx` ON `events` (`dispatched_at`, `created_at`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `username_histories` (`id` CHAR(36) NOT NULL, `username` VARCHAR(255), `reserved_until` DATETIME(6), `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `user_id` CHAR(36), `account_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `username_histories_account_id_username_idx` ON `username_histories` (`account_id`, `username`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `login_attempts` (`id` CHAR(36) NOT NULL, `identifier` TEXT, `success` BOOLEAN NOT NULL, `reason` TEXT, `ip` TEXT, `user_agent` TEXT, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `user_id` CHAR(36), `account_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `login_attempts_user_id_created_at_idx` ON `login_attempts` (`user_id`, `created_at`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `user_notes` (`id` CHAR(36) NOT NULL, `body` TEXT, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `user_id` CHAR(36), `author_id` CHAR(36), `account_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `user_notes_user_id_idx` ON `user_notes` (`user_id`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `audit_logs` (`id` CHAR(36) NOT NULL, `method` TEXT, `path` TEXT, `status` BIGINT, `ip` TEXT, `request_id` TEXT, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `account_id` CHAR(36), `actor_id` CHAR(36), `user_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `audit_logs_account_id_created_at_idx` ON `audit_logs` (`account_id`, `created_at`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `invites` (`id` CHAR(36) NOT NULL, `email` TEXT, `role` TEXT, `token_hash` VARCHAR(255), `expires_at` DATETIME(6), `accepted_at` DATETIME(6), `revoked_at` DATETIME(6), `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `account_id` CHAR(36), `invited_by_id` CHAR(36), `user_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `invites_token_hash_idx` ON `invites` (`token_hash`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `invite_links` (`id` CHAR(36) NOT NULL, `role` TEXT, `token_hash` VARCHAR(255), `max_uses` BIGINT NOT NULL DEFAULT 0, `uses` BIGINT NOT NULL DEFAULT 0, `expires_at` DATETIME(6), `revoked_at` DATETIME(6), `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `account_id` CHAR(36), `created_by_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `invite_links_token_hash_idx` ON `invite_links` (`token_hash`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `daily_signups` (`account_id` CHAR(36) NOT NULL, `day` DATE NOT NULL, `count` BIGINT NOT NULL DEFAULT 0, PRIMARY KEY (`account_id`, `day`));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `user_activities` (`account_id` CHAR(36) NOT NULL, `day` DATE NOT NULL, `user_id` CHAR(36) NOT NULL, PRIMARY KEY (`account_id`, `day`, `user_id`));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `consent_documents` (`id` CHAR(36) NOT NULL, `slug` VARCHAR(255), `version` BIGINT NOT NULL, `title` TEXT, `url` TEXT, `body` TEXT, `required` BOOLEAN NOT NULL DEFAULT false, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `account_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE UNIQUE INDEX `consent_documents_account_id_slug_version_idx` ON `consent_documents` (`account_id`, `slug`, `version`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `consents` (`id` CHAR(36) NOT NULL, `slug` TEXT, `version` BIGINT NOT NULL, `ip` TEXT, `accepted_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `user_id` CHAR(36), `account_id` CHAR(36), `document_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `consents_user_id_idx` ON `consents` (`user_id`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `roles` (`id` CHAR(36) NOT NULL, `name` VARCHAR(255), `parent` TEXT, `permissions` JSON, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `account_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE UNIQUE INDEX `roles_account_id_name_idx` ON `roles` (`account_id`, `name`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `account_policies` (`account_id` CHAR(36) NOT NULL, `model` TEXT, `policy` TEXT, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), PRIMARY KEY (`account_id`));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `groups` (`id` CHAR(36) NOT NULL, `name` VARCHAR(255), `role` TEXT, `permissions` JSON, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `account_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE UNIQUE INDEX `groups_account_id_name_idx` ON `groups` (`account_id`, `name`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `group_members` (`group_id` CHAR(36) NOT NULL, `user_id` CHAR(36) NOT NULL, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), PRIMARY KEY (`group_id`, `user_id`));
+
+--bun:split
+
+CREATE INDEX `group_members_user_id_idx` ON `group_members` (`user_id`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `audit_exports` (`id` CHAR(36) NOT NULL, `key` TEXT, `url` TEXT, `from` DATETIME(6), `to` DATETIME(6), `count` BIGINT, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `account_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `audit_exports_account_id_to_idx` ON `audit_exports` (`account_id`, `to`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `daily_metrics` (`account_id` CHAR(36) NOT NULL, `day` DATE NOT NULL, `metric` VARCHAR(255) NOT NULL, `value` BIGINT NOT NULL DEFAULT 0, PRIMARY KEY (`account_id`, `day`, `metric`));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `feature_flags` (`key` VARCHAR(255) NOT NULL, `description` TEXT, `enabled` BOOLEAN NOT NULL, `rollout` BIGINT NOT NULL DEFAULT 100, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), PRIMARY KEY (`key`));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `flag_overrides` (`flag_key` VARCHAR(255) NOT NULL, `account_id` CHAR(36) NOT NULL, `enabled` BOOLEAN NOT NULL, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), PRIMARY KEY (`flag_key`, `account_id`));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `idempotency_keys` (`id` CHAR(36) NOT NULL, `key` VARCHAR(255), `scope` VARCHAR(255), `fingerprint` TEXT, `status` BIGINT NOT NULL DEFAULT 0, `content_type` TEXT, `location` TEXT, `body` LONGBLOB, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE UNIQUE INDEX `idempotency_keys_scope_key_idx` ON `idempotency_keys` (`scope`, `key`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `webhooks` (`id` CHAR(36) NOT NULL, `url` TEXT, `events` JSON, `description` TEXT, `active` BOOLEAN NOT NULL DEFAULT true, `secret` TEXT, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `account_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `webhooks_account_id_idx` ON `webhooks` (`account_id`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `webhook_deliveries` (`id` CHAR(36) NOT NULL, `event_type` TEXT, `payload` JSON, `status` VARCHAR(255) NOT NULL DEFAULT 'pending', `attempts` BIGINT NOT NULL DEFAULT 0, `response_status` BIGINT, `response_body` TEXT, `error` TEXT, `next_attempt_at` DATETIME(6), `delivered_at` DATETIME(6), `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `webhook_id` CHAR(36), `account_id` CHAR(36), `event_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `webhook_deliveries_webhook_id_created_at_idx` ON `webhook_deliveries` (`webhook_id`, `created_at`);
+
+--bun:split
+
+CREATE INDEX `webhook_deliveries_status_next_attempt_at_idx` ON `webhook_deliveries` (`status`, `next_attempt_at`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `emails` (`id` CHAR(36) NOT NULL, `to` TEXT, `from` TEXT, `reply_to` TEXT, `subject` TEXT, `body` TEXT, `html` TEXT, `status` VARCHAR(255) NOT NULL DEFAULT 'pending', `attempts` BIGINT NOT NULL DEFAULT 0, `error` TEXT, `next_attempt_at` DATETIME(6), `sent_at` DATETIME(6), `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `account_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `emails_status_next_attempt_at_idx` ON `emails` (`status`, `next_attempt_at`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `email_templates` (`id` CHAR(36) NOT NULL, `kind` VARCHAR(255), `locale` VARCHAR(255) NOT NULL DEFAULT '', `subject` TEXT, `text` TEXT, `html` TEXT, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `account_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE UNIQUE INDEX `email_templates_account_id_kind_locale_idx` ON `email_templates` (`account_id`, `kind`, `locale`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `data_exports` (`id` CHAR(36) NOT NULL, `status` TEXT NOT NULL, `key` TEXT, `url` TEXT, `expires_at` DATETIME(6), `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `user_id` CHAR(36), `account_id` CHAR(36), `requested_by` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `data_exports_user_id_created_at_idx` ON `data_exports` (`user_id`, `created_at`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `erasure_requests` (`id` CHAR(36) NOT NULL, `status` VARCHAR(255) NOT NULL, `scheduled_for` DATETIME(6) NOT NULL, `completed_at` DATETIME(6), `confirmation` JSON, `signature` TEXT, `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `user_id` CHAR(36), `account_id` CHAR(36), `requested_by` CHAR(36), `pending_user_id` CHAR(36) AS (CASE WHEN `status` = 'pending' THEN `user_id` END) VIRTUAL, PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE UNIQUE INDEX `erasure_requests_pending_user_id_idx` ON `erasure_requests` (`pending_user_id`);
+
+--bun:split
+
+CREATE INDEX `erasure_requests_status_scheduled_for_idx` ON `erasure_requests` (`status`, `scheduled_for`);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `password_resets` (`id` CHAR(36) NOT NULL, `token_hash` VARCHAR(255), `expires_at` DATETIME(6), `used_at` DATETIME(6), `created_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `updated_at` DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6), `user_id` CHAR(36), `account_id` CHAR(36), PRIMARY KEY (`id`));
+
+--bun:split
+
+CREATE INDEX `password_resets_token_hash_idx` ON `password_resets` (`token_hash`);
@@ -0,0 +1,5 @@
+DROP INDEX `tokens_value_idx` ON `tokens`;
+
+--bun:split
+
+CREATE INDEX `value_idx` ON `tokens` (`value`);
@@ -0,0 +1,7 @@
+-- Every MySQL database was made after tokens stopped repeating, so there
+-- are no duplicates to drop before the index is made unique
+DROP INDEX `value_idx` ON `tokens`;
+
+--bun:split
+
+CREATE UNIQUE INDEX `tokens_value_idx` ON `tokens` (`value`);
@@ -0,0 +1,2 @@
+-- Row level security is Postgres's alone, so there's nothing to change
+SELECT 1;
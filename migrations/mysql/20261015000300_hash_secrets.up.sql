@@ -0,0 +1,16 @@
+-- Keys were sent as their id, so that's what existing keys' hashes are
+-- made from, and each is given a new id that isn't a secret
+ALTER TABLE `keys` ADD COLUMN `hash` VARCHAR(64) CHARACTER SET ascii;
+
+--bun:split
+
+UPDATE `keys` SET `hash` = SHA2(`id`, 256), `id` = UUID() WHERE `hash` IS NULL;
+
+--bun:split
+
+CREATE UNIQUE INDEX `keys_hash_idx` ON `keys` (`hash`);
+
+--bun:split
+
+-- Tokens are looked up by the digest of their unsigned value
+UPDATE `tokens` SET `value` = SHA2(`value`, 256) WHERE `value` IS NOT NULL;
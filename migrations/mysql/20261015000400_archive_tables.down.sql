@@ -0,0 +1,34 @@
+-- Archived rows go back where they came from
+INSERT INTO `tokens` SELECT * FROM `tokens_archive`;
+
+--bun:split
+
+INSERT INTO `login_attempts` SELECT * FROM `login_attempts_archive`;
+
+--bun:split
+
+INSERT INTO `audit_logs` SELECT * FROM `audit_logs_archive`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `tokens_archive`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `login_attempts_archive`;
+
+--bun:split
+
+DROP TABLE IF EXISTS `audit_logs_archive`;
+
+--bun:split
+
+DROP INDEX `tokens_created_at_idx` ON `tokens`;
+
+--bun:split
+
+DROP INDEX `login_attempts_created_at_idx` ON `login_attempts`;
+
+--bun:split
+
+DROP INDEX `audit_logs_created_at_idx` ON `audit_logs`;
@@ -0,0 +1,29 @@
+-- The archival worker picks the oldest rows out of each table
+CREATE INDEX `tokens_created_at_idx` ON `tokens` (`created_at`);
+
+--bun:split
+
+CREATE INDEX `login_attempts_created_at_idx` ON `login_attempts` (`created_at`);
+
+--bun:split
+
+CREATE INDEX `audit_logs_created_at_idx` ON `audit_logs` (`created_at`);
+
+--bun:split
+
+-- Archives take the tables' columns in the same order, so rows can be
+-- moved with SELECT *, and their indexes
+CREATE TABLE IF NOT EXISTS `tokens_archive` LIKE `tokens`;
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `login_attempts_archive` LIKE `login_attempts`;
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `audit_logs_archive` LIKE `audit_logs`;
+
+--bun:split
+
+-- Erasure finds a user's archived tokens
+CREATE INDEX `tokens_archive_user_id_idx` ON `tokens_archive` (`user_id`);
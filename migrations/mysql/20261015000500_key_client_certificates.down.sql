@@ -0,0 +1,5 @@
+DROP INDEX `keys_client_certificate_idx` ON `keys`;
+
+--bun:split
+
+ALTER TABLE `keys` DROP COLUMN `client_certificate`;
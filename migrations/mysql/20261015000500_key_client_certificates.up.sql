@@ -0,0 +1,6 @@
+-- The SHA-256 fingerprint of the client certificate a key is bound to
+ALTER TABLE `keys` ADD COLUMN `client_certificate` VARCHAR(64) CHARACTER SET ascii;
+
+--bun:split
+
+CREATE UNIQUE INDEX `keys_client_certificate_idx` ON `keys` (`client_certificate`);
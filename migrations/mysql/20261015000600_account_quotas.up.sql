@@ -0,0 +1,11 @@
+-- The plan in QUOTA_PLANS setting the account's monthly request quota
+ALTER TABLE `accounts` ADD COLUMN `plan` VARCHAR(255);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS `account_quotas` (`account_id` CHAR(36) NOT NULL, `period_start` DATETIME(6) NOT NULL, `period_end` DATETIME(6) NOT NULL, `used` BIGINT NOT NULL DEFAULT 0, `warned_at` DATETIME(6), PRIMARY KEY (`account_id`));
+
+--bun:split
+
+-- The reset job finds periods that have ended
+CREATE INDEX `account_quotas_period_end_idx` ON `account_quotas` (`period_end`);
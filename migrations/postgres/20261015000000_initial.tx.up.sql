@@ -0,0 +1,265 @@
+-- The schema as it stood before migrations, when tables were created at
+-- startup. Everything is IF NOT EXISTS so databases made that way are
+-- taken as already migrated.
+
+CREATE TABLE IF NOT EXISTS "users" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "username" VARCHAR, "email" VARCHAR, "display_name" VARCHAR, "avatar_url" VARCHAR, "password" VARCHAR, "role" VARCHAR, "status" VARCHAR NOT NULL DEFAULT 'active', "metadata" jsonb, "last_login_at" TIMESTAMPTZ, "login_count" BIGINT NOT NULL DEFAULT 0, "tags" VARCHAR[], "is_anonymous" BOOLEAN NOT NULL DEFAULT false, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "deleted_at" TIMESTAMPTZ, "account_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "username_idx" ON "users" ("username");
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "account_id_idx" ON "users" ("account_id");
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "account_id_lower_username_idx" ON "users" (lower(username), "account_id");
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "account_id_email_idx" ON "users" ("account_id", "email");
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "tags_gin_idx" ON "users" USING gin ("tags");
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "metadata_gin_idx" ON "users" USING gin ("metadata");
+
+--bun:split
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "username_trgm_idx" ON "users" USING gin (username gin_trgm_ops);
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "email_trgm_idx" ON "users" USING gin (email gin_trgm_ops);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "tokens" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "value" VARCHAR, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "user_id" uuid, "actor_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "value_idx" ON "tokens" ("value");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "accounts" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "name" VARCHAR, "reserved_usernames" VARCHAR[], "route_permissions" jsonb, "retention" jsonb, "cors" jsonb, "locale" VARCHAR, "email_sender" jsonb, "email_variables" jsonb, "slug" VARCHAR, "hosted_pages" jsonb, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "accounts_slug_idx" ON "accounts" ("slug");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "keys" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "account_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "events" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "type" VARCHAR, "data" jsonb, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "dispatched_at" TIMESTAMPTZ, "account_id" uuid, "user_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "events_account_id_created_at_idx" ON "events" ("account_id", "created_at");
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "events_undispatched_idx" ON "events" ("created_at") WHERE (dispatched_at IS NULL);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "username_histories" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "username" VARCHAR, "reserved_until" TIMESTAMPTZ, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "user_id" uuid, "account_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "username_histories_account_id_username_idx" ON "username_histories" ("account_id", "username");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "login_attempts" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "identifier" VARCHAR, "success" BOOLEAN NOT NULL, "reason" VARCHAR, "ip" VARCHAR, "user_agent" VARCHAR, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "user_id" uuid, "account_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "login_attempts_user_id_created_at_idx" ON "login_attempts" ("user_id", "created_at");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "user_notes" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "body" VARCHAR, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "user_id" uuid, "author_id" uuid, "account_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "user_notes_user_id_idx" ON "user_notes" ("user_id");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "audit_logs" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "method" VARCHAR, "path" VARCHAR, "status" BIGINT, "ip" VARCHAR, "request_id" VARCHAR, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "account_id" uuid, "actor_id" uuid, "user_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "audit_logs_account_id_created_at_idx" ON "audit_logs" ("account_id", "created_at");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "invites" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "email" VARCHAR, "role" VARCHAR, "token_hash" VARCHAR, "expires_at" TIMESTAMPTZ, "accepted_at" TIMESTAMPTZ, "revoked_at" TIMESTAMPTZ, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "account_id" uuid, "invited_by_id" uuid, "user_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "invites_token_hash_idx" ON "invites" ("token_hash");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "invite_links" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "role" VARCHAR, "token_hash" VARCHAR, "max_uses" BIGINT NOT NULL DEFAULT 0, "uses" BIGINT NOT NULL DEFAULT 0, "expires_at" TIMESTAMPTZ, "revoked_at" TIMESTAMPTZ, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "account_id" uuid, "created_by_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "invite_links_token_hash_idx" ON "invite_links" ("token_hash");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "daily_signups" ("account_id" uuid NOT NULL, "day" date NOT NULL, "count" BIGINT NOT NULL DEFAULT 0, PRIMARY KEY ("account_id", "day"));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "user_activities" ("account_id" uuid NOT NULL, "day" date NOT NULL, "user_id" uuid NOT NULL, PRIMARY KEY ("account_id", "day", "user_id"));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "consent_documents" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "slug" VARCHAR, "version" BIGINT NOT NULL, "title" VARCHAR, "url" VARCHAR, "body" VARCHAR, "required" BOOLEAN NOT NULL DEFAULT false, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "account_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "consent_documents_account_id_slug_version_idx" ON "consent_documents" ("account_id", "slug", "version");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "consents" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "slug" VARCHAR, "version" BIGINT NOT NULL, "ip" VARCHAR, "accepted_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "user_id" uuid, "account_id" uuid, "document_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "consents_user_id_idx" ON "consents" ("user_id");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "roles" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "name" VARCHAR, "parent" VARCHAR, "permissions" VARCHAR[], "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "account_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "roles_account_id_name_idx" ON "roles" ("account_id", "name");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "account_policies" ("account_id" uuid NOT NULL, "model" VARCHAR, "policy" VARCHAR, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, PRIMARY KEY ("account_id"));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "groups" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "name" VARCHAR, "role" VARCHAR, "permissions" VARCHAR[], "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "account_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "groups_account_id_name_idx" ON "groups" ("account_id", "name");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "group_members" ("group_id" uuid NOT NULL, "user_id" uuid NOT NULL, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, PRIMARY KEY ("group_id", "user_id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "group_members_user_id_idx" ON "group_members" ("user_id");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "audit_exports" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "key" VARCHAR, "url" VARCHAR, "from" TIMESTAMPTZ, "to" TIMESTAMPTZ, "count" BIGINT, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "account_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "audit_exports_account_id_to_idx" ON "audit_exports" ("account_id", "to");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "daily_metrics" ("account_id" uuid NOT NULL, "day" date NOT NULL, "metric" VARCHAR NOT NULL, "value" BIGINT NOT NULL DEFAULT 0, PRIMARY KEY ("account_id", "day", "metric"));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "feature_flags" ("key" VARCHAR NOT NULL, "description" VARCHAR, "enabled" BOOLEAN NOT NULL, "rollout" BIGINT NOT NULL DEFAULT 100, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, PRIMARY KEY ("key"));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "flag_overrides" ("flag_key" VARCHAR NOT NULL, "account_id" uuid NOT NULL, "enabled" BOOLEAN NOT NULL, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, PRIMARY KEY ("flag_key", "account_id"));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "idempotency_keys" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "key" VARCHAR, "scope" VARCHAR, "fingerprint" VARCHAR, "status" BIGINT NOT NULL DEFAULT 0, "content_type" VARCHAR, "location" VARCHAR, "body" BYTEA, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "idempotency_keys_scope_key_idx" ON "idempotency_keys" ("scope", "key");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "webhooks" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "url" VARCHAR, "events" VARCHAR[], "description" VARCHAR, "active" BOOLEAN NOT NULL DEFAULT true, "secret" VARCHAR, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "account_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "webhooks_account_id_idx" ON "webhooks" ("account_id");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "webhook_deliveries" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "event_type" VARCHAR, "payload" jsonb, "status" VARCHAR NOT NULL DEFAULT 'pending', "attempts" BIGINT NOT NULL DEFAULT 0, "response_status" BIGINT, "response_body" VARCHAR, "error" VARCHAR, "next_attempt_at" TIMESTAMPTZ, "delivered_at" TIMESTAMPTZ, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "webhook_id" uuid, "account_id" uuid, "event_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "webhook_deliveries_webhook_id_created_at_idx" ON "webhook_deliveries" ("webhook_id", "created_at");
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "webhook_deliveries_status_next_attempt_at_idx" ON "webhook_deliveries" ("status", "next_attempt_at");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "emails" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "to" VARCHAR, "from" VARCHAR, "reply_to" VARCHAR, "subject" VARCHAR, "body" VARCHAR, "html" VARCHAR, "status" VARCHAR NOT NULL DEFAULT 'pending', "attempts" BIGINT NOT NULL DEFAULT 0, "error" VARCHAR, "next_attempt_at" TIMESTAMPTZ, "sent_at" TIMESTAMPTZ, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "account_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "emails_status_next_attempt_at_idx" ON "emails" ("status", "next_attempt_at");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "email_templates" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "kind" VARCHAR, "locale" VARCHAR NOT NULL DEFAULT '', "subject" VARCHAR, "text" VARCHAR, "html" VARCHAR, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "account_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "email_templates_account_id_kind_locale_idx" ON "email_templates" ("account_id", "kind", "locale");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "data_exports" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "status" VARCHAR NOT NULL, "key" VARCHAR, "url" VARCHAR, "expires_at" TIMESTAMPTZ, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "user_id" uuid, "account_id" uuid, "requested_by" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "data_exports_user_id_created_at_idx" ON "data_exports" ("user_id", "created_at");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "erasure_requests" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "status" VARCHAR NOT NULL, "scheduled_for" TIMESTAMPTZ NOT NULL, "completed_at" TIMESTAMPTZ, "confirmation" jsonb, "signature" VARCHAR, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "user_id" uuid, "account_id" uuid, "requested_by" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "erasure_requests_pending_user_id_idx" ON "erasure_requests" ("user_id") WHERE (status = 'pending');
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "erasure_requests_status_scheduled_for_idx" ON "erasure_requests" ("status", "scheduled_for");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "password_resets" ("id" uuid NOT NULL DEFAULT gen_random_uuid(), "token_hash" VARCHAR, "expires_at" TIMESTAMPTZ, "used_at" TIMESTAMPTZ, "created_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMPTZ NOT NULL DEFAULT current_timestamp, "user_id" uuid, "account_id" uuid, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "password_resets_token_hash_idx" ON "password_resets" ("token_hash");
@@ -0,0 +1,17 @@
+-- Tokens signed for a user in the same second used to come out the same,
+-- so duplicates are dropped before the index can be unique
+DELETE FROM "tokens" AS "a" USING "tokens" AS "b"
+WHERE "a"."value" = "b"."value" AND "a"."created_at" > "b"."created_at";
+
+--bun:split
+
+DELETE FROM "tokens" AS "a" USING "tokens" AS "b"
+WHERE "a"."value" = "b"."value" AND "a"."created_at" = "b"."created_at" AND "a"."id" > "b"."id";
+
+--bun:split
+
+DROP INDEX IF EXISTS "value_idx";
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "tokens_value_idx" ON "tokens" ("value");
@@ -0,0 +1,21 @@
+DROP POLICY IF EXISTS "tokens_account_isolation" ON "tokens";
+
+--bun:split
+
+ALTER TABLE "tokens" NO FORCE ROW LEVEL SECURITY;
+
+--bun:split
+
+ALTER TABLE "tokens" DISABLE ROW LEVEL SECURITY;
+
+--bun:split
+
+DROP POLICY IF EXISTS "users_account_isolation" ON "users";
+
+--bun:split
+
+ALTER TABLE "users" NO FORCE ROW LEVEL SECURITY;
+
+--bun:split
+
+ALTER TABLE "users" DISABLE ROW LEVEL SECURITY;
@@ -0,0 +1,29 @@
+-- Users and tokens are only visible within the account app.account_id
+-- names. Connections that haven't set it, like the background workers',
+-- still see every row, so this only narrows anything once
+-- DATABASE_ROW_LEVEL_SECURITY is on. Forced, so it applies to the app
+-- even when it owns the tables.
+ALTER TABLE "users" ENABLE ROW LEVEL SECURITY;
+
+--bun:split
+
+ALTER TABLE "users" FORCE ROW LEVEL SECURITY;
+
+--bun:split
+
+CREATE POLICY "users_account_isolation" ON "users"
+USING (nullif(current_setting('app.account_id', true), '') IS NULL OR "account_id" = nullif(current_setting('app.account_id', true), '')::uuid);
+
+--bun:split
+
+-- Tokens have no account of their own, so they go with their user's
+ALTER TABLE "tokens" ENABLE ROW LEVEL SECURITY;
+
+--bun:split
+
+ALTER TABLE "tokens" FORCE ROW LEVEL SECURITY;
+
+--bun:split
+
+CREATE POLICY "tokens_account_isolation" ON "tokens"
+USING (nullif(current_setting('app.account_id', true), '') IS NULL OR "user_id" IN (SELECT "id" FROM "users"));
@@ -0,0 +1,17 @@
+-- Keys were sent as their id, so that's what existing keys' hashes are
+-- made from, and each is given a new id that isn't a secret
+ALTER TABLE "keys" ADD COLUMN IF NOT EXISTS "hash" VARCHAR;
+
+--bun:split
+
+UPDATE "keys" SET "hash" = encode(sha256("id"::text::bytea), 'hex'), "id" = gen_random_uuid()
+WHERE "hash" IS NULL;
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "keys_hash_idx" ON "keys" ("hash");
+
+--bun:split
+
+-- Tokens are looked up by the digest of their unsigned value
+UPDATE "tokens" SET "value" = encode(sha256("value"::bytea), 'hex') WHERE "value" IS NOT NULL;
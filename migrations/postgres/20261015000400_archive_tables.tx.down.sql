@@ -0,0 +1,34 @@
+-- Archived rows go back where they came from
+INSERT INTO "tokens" SELECT * FROM "tokens_archive";
+
+--bun:split
+
+INSERT INTO "login_attempts" SELECT * FROM "login_attempts_archive";
+
+--bun:split
+
+INSERT INTO "audit_logs" SELECT * FROM "audit_logs_archive";
+
+--bun:split
+
+DROP TABLE IF EXISTS "tokens_archive";
+
+--bun:split
+
+DROP TABLE IF EXISTS "login_attempts_archive";
+
+--bun:split
+
+DROP TABLE IF EXISTS "audit_logs_archive";
+
+--bun:split
+
+DROP INDEX IF EXISTS "tokens_created_at_idx";
+
+--bun:split
+
+DROP INDEX IF EXISTS "login_attempts_created_at_idx";
+
+--bun:split
+
+DROP INDEX IF EXISTS "audit_logs_created_at_idx";
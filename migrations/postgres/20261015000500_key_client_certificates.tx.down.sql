@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS "keys_client_certificate_idx";
+
+--bun:split
+
+ALTER TABLE "keys" DROP COLUMN "client_certificate";
@@ -0,0 +1,6 @@
+-- The SHA-256 fingerprint of the client certificate a key is bound to
+ALTER TABLE "keys" ADD COLUMN IF NOT EXISTS "client_certificate" VARCHAR;
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "keys_client_certificate_idx" ON "keys" ("client_certificate");
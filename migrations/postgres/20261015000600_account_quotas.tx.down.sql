@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS "account_quotas";
+
+--bun:split
+
+ALTER TABLE "accounts" DROP COLUMN "plan";
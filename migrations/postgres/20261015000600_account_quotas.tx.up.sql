@@ -0,0 +1,11 @@
+-- The plan in QUOTA_PLANS setting the account's monthly request quota
+ALTER TABLE "accounts" ADD COLUMN IF NOT EXISTS "plan" VARCHAR;
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "account_quotas" ("account_id" uuid NOT NULL, "period_start" TIMESTAMPTZ NOT NULL, "period_end" TIMESTAMPTZ NOT NULL, "used" BIGINT NOT NULL DEFAULT 0, "warned_at" TIMESTAMPTZ, PRIMARY KEY ("account_id"));
+
+--bun:split
+
+-- The reset job finds periods that have ended
+CREATE INDEX IF NOT EXISTS "account_quotas_period_end_idx" ON "account_quotas" ("period_end");
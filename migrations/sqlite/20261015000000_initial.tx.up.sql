@@ -0,0 +1,245 @@
+-- The schema as of the Postgres migration of the same name. Ids are
+-- generated by the app, arrays and JSON are kept as JSON text, and the
+-- Postgres search indexes are left out.
+
+CREATE TABLE IF NOT EXISTS "users" ("id" TEXT NOT NULL, "username" VARCHAR, "email" VARCHAR, "display_name" VARCHAR, "avatar_url" VARCHAR, "password" VARCHAR, "role" VARCHAR, "status" VARCHAR NOT NULL DEFAULT 'active', "metadata" TEXT, "last_login_at" TIMESTAMP, "login_count" BIGINT NOT NULL DEFAULT 0, "tags" TEXT, "is_anonymous" BOOLEAN NOT NULL DEFAULT false, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "deleted_at" TIMESTAMP, "account_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "username_idx" ON "users" ("username");
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "account_id_idx" ON "users" ("account_id");
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "account_id_lower_username_idx" ON "users" (lower(username), "account_id");
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "account_id_email_idx" ON "users" ("account_id", "email");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "tokens" ("id" TEXT NOT NULL, "value" VARCHAR, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "user_id" TEXT, "actor_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "value_idx" ON "tokens" ("value");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "accounts" ("id" TEXT NOT NULL, "name" VARCHAR, "reserved_usernames" TEXT, "route_permissions" TEXT, "retention" TEXT, "cors" TEXT, "locale" VARCHAR, "email_sender" TEXT, "email_variables" TEXT, "slug" VARCHAR, "hosted_pages" TEXT, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "accounts_slug_idx" ON "accounts" ("slug");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "keys" ("id" TEXT NOT NULL, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "account_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "events" ("id" TEXT NOT NULL, "type" VARCHAR, "data" TEXT, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "dispatched_at" TIMESTAMP, "account_id" TEXT, "user_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "events_account_id_created_at_idx" ON "events" ("account_id", "created_at");
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "events_undispatched_idx" ON "events" ("created_at") WHERE (dispatched_at IS NULL);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "username_histories" ("id" TEXT NOT NULL, "username" VARCHAR, "reserved_until" TIMESTAMP, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "user_id" TEXT, "account_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "username_histories_account_id_username_idx" ON "username_histories" ("account_id", "username");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "login_attempts" ("id" TEXT NOT NULL, "identifier" VARCHAR, "success" BOOLEAN NOT NULL, "reason" VARCHAR, "ip" VARCHAR, "user_agent" VARCHAR, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "user_id" TEXT, "account_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "login_attempts_user_id_created_at_idx" ON "login_attempts" ("user_id", "created_at");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "user_notes" ("id" TEXT NOT NULL, "body" VARCHAR, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "user_id" TEXT, "author_id" TEXT, "account_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "user_notes_user_id_idx" ON "user_notes" ("user_id");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "audit_logs" ("id" TEXT NOT NULL, "method" VARCHAR, "path" VARCHAR, "status" BIGINT, "ip" VARCHAR, "request_id" VARCHAR, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "account_id" TEXT, "actor_id" TEXT, "user_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "audit_logs_account_id_created_at_idx" ON "audit_logs" ("account_id", "created_at");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "invites" ("id" TEXT NOT NULL, "email" VARCHAR, "role" VARCHAR, "token_hash" VARCHAR, "expires_at" TIMESTAMP, "accepted_at" TIMESTAMP, "revoked_at" TIMESTAMP, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "account_id" TEXT, "invited_by_id" TEXT, "user_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "invites_token_hash_idx" ON "invites" ("token_hash");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "invite_links" ("id" TEXT NOT NULL, "role" VARCHAR, "token_hash" VARCHAR, "max_uses" BIGINT NOT NULL DEFAULT 0, "uses" BIGINT NOT NULL DEFAULT 0, "expires_at" TIMESTAMP, "revoked_at" TIMESTAMP, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "account_id" TEXT, "created_by_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "invite_links_token_hash_idx" ON "invite_links" ("token_hash");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "daily_signups" ("account_id" TEXT NOT NULL, "day" DATE NOT NULL, "count" BIGINT NOT NULL DEFAULT 0, PRIMARY KEY ("account_id", "day"));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "user_activities" ("account_id" TEXT NOT NULL, "day" DATE NOT NULL, "user_id" TEXT NOT NULL, PRIMARY KEY ("account_id", "day", "user_id"));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "consent_documents" ("id" TEXT NOT NULL, "slug" VARCHAR, "version" BIGINT NOT NULL, "title" VARCHAR, "url" VARCHAR, "body" VARCHAR, "required" BOOLEAN NOT NULL DEFAULT false, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "account_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "consent_documents_account_id_slug_version_idx" ON "consent_documents" ("account_id", "slug", "version");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "consents" ("id" TEXT NOT NULL, "slug" VARCHAR, "version" BIGINT NOT NULL, "ip" VARCHAR, "accepted_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "user_id" TEXT, "account_id" TEXT, "document_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "consents_user_id_idx" ON "consents" ("user_id");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "roles" ("id" TEXT NOT NULL, "name" VARCHAR, "parent" VARCHAR, "permissions" TEXT, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "account_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "roles_account_id_name_idx" ON "roles" ("account_id", "name");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "account_policies" ("account_id" TEXT NOT NULL, "model" VARCHAR, "policy" VARCHAR, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, PRIMARY KEY ("account_id"));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "groups" ("id" TEXT NOT NULL, "name" VARCHAR, "role" VARCHAR, "permissions" TEXT, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "account_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "groups_account_id_name_idx" ON "groups" ("account_id", "name");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "group_members" ("group_id" TEXT NOT NULL, "user_id" TEXT NOT NULL, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, PRIMARY KEY ("group_id", "user_id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "group_members_user_id_idx" ON "group_members" ("user_id");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "audit_exports" ("id" TEXT NOT NULL, "key" VARCHAR, "url" VARCHAR, "from" TIMESTAMP, "to" TIMESTAMP, "count" BIGINT, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "account_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "audit_exports_account_id_to_idx" ON "audit_exports" ("account_id", "to");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "daily_metrics" ("account_id" TEXT NOT NULL, "day" DATE NOT NULL, "metric" VARCHAR NOT NULL, "value" BIGINT NOT NULL DEFAULT 0, PRIMARY KEY ("account_id", "day", "metric"));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "feature_flags" ("key" VARCHAR NOT NULL, "description" VARCHAR, "enabled" BOOLEAN NOT NULL, "rollout" BIGINT NOT NULL DEFAULT 100, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, PRIMARY KEY ("key"));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "flag_overrides" ("flag_key" VARCHAR NOT NULL, "account_id" TEXT NOT NULL, "enabled" BOOLEAN NOT NULL, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, PRIMARY KEY ("flag_key", "account_id"));
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "idempotency_keys" ("id" TEXT NOT NULL, "key" VARCHAR, "scope" VARCHAR, "fingerprint" VARCHAR, "status" BIGINT NOT NULL DEFAULT 0, "content_type" VARCHAR, "location" VARCHAR, "body" BLOB, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "idempotency_keys_scope_key_idx" ON "idempotency_keys" ("scope", "key");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "webhooks" ("id" TEXT NOT NULL, "url" VARCHAR, "events" TEXT, "description" VARCHAR, "active" BOOLEAN NOT NULL DEFAULT true, "secret" VARCHAR, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "account_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "webhooks_account_id_idx" ON "webhooks" ("account_id");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "webhook_deliveries" ("id" TEXT NOT NULL, "event_type" VARCHAR, "payload" TEXT, "status" VARCHAR NOT NULL DEFAULT 'pending', "attempts" BIGINT NOT NULL DEFAULT 0, "response_status" BIGINT, "response_body" VARCHAR, "error" VARCHAR, "next_attempt_at" TIMESTAMP, "delivered_at" TIMESTAMP, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "webhook_id" TEXT, "account_id" TEXT, "event_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "webhook_deliveries_webhook_id_created_at_idx" ON "webhook_deliveries" ("webhook_id", "created_at");
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "webhook_deliveries_status_next_attempt_at_idx" ON "webhook_deliveries" ("status", "next_attempt_at");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "emails" ("id" TEXT NOT NULL, "to" VARCHAR, "from" VARCHAR, "reply_to" VARCHAR, "subject" VARCHAR, "body" VARCHAR, "html" VARCHAR, "status" VARCHAR NOT NULL DEFAULT 'pending', "attempts" BIGINT NOT NULL DEFAULT 0, "error" VARCHAR, "next_attempt_at" TIMESTAMP, "sent_at" TIMESTAMP, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "account_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "emails_status_next_attempt_at_idx" ON "emails" ("status", "next_attempt_at");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "email_templates" ("id" TEXT NOT NULL, "kind" VARCHAR, "locale" VARCHAR NOT NULL DEFAULT '', "subject" VARCHAR, "text" VARCHAR, "html" VARCHAR, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "account_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "email_templates_account_id_kind_locale_idx" ON "email_templates" ("account_id", "kind", "locale");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "data_exports" ("id" TEXT NOT NULL, "status" VARCHAR NOT NULL, "key" VARCHAR, "url" VARCHAR, "expires_at" TIMESTAMP, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "user_id" TEXT, "account_id" TEXT, "requested_by" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "data_exports_user_id_created_at_idx" ON "data_exports" ("user_id", "created_at");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "erasure_requests" ("id" TEXT NOT NULL, "status" VARCHAR NOT NULL, "scheduled_for" TIMESTAMP NOT NULL, "completed_at" TIMESTAMP, "confirmation" TEXT, "signature" VARCHAR, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "user_id" TEXT, "account_id" TEXT, "requested_by" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "erasure_requests_pending_user_id_idx" ON "erasure_requests" ("user_id") WHERE (status = 'pending');
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "erasure_requests_status_scheduled_for_idx" ON "erasure_requests" ("status", "scheduled_for");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "password_resets" ("id" TEXT NOT NULL, "token_hash" VARCHAR, "expires_at" TIMESTAMP, "used_at" TIMESTAMP, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "user_id" TEXT, "account_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "password_resets_token_hash_idx" ON "password_resets" ("token_hash");
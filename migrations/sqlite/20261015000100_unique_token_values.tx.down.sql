@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS "tokens_value_idx";
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "value_idx" ON "tokens" ("value");
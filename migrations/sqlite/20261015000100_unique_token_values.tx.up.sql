@@ -0,0 +1,7 @@
+-- Every SQLite database was made after tokens stopped repeating, so there
+-- are no duplicates to drop before the index is made unique
+DROP INDEX IF EXISTS "value_idx";
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "tokens_value_idx" ON "tokens" ("value");
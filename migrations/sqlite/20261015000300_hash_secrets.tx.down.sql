@@ -0,0 +1,11 @@
+-- Digests can't be turned back into what they were made from, so every
+-- token is dropped, signing everyone out, and every key stops working
+DELETE FROM "tokens";
+
+--bun:split
+
+DROP INDEX IF EXISTS "keys_hash_idx";
+
+--bun:split
+
+ALTER TABLE "keys" DROP COLUMN "hash";
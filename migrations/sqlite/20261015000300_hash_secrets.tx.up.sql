@@ -0,0 +1,17 @@
+-- Keys were sent as their id, so that's what existing keys' hashes are
+-- made from, and each is given a new id that isn't a secret.
+-- sha256_hex and new_id are registered by the app.
+ALTER TABLE "keys" ADD COLUMN "hash" VARCHAR;
+
+--bun:split
+
+UPDATE "keys" SET "hash" = sha256_hex("id"), "id" = new_id() WHERE "hash" IS NULL;
+
+--bun:split
+
+CREATE UNIQUE INDEX IF NOT EXISTS "keys_hash_idx" ON "keys" ("hash");
+
+--bun:split
+
+-- Tokens are looked up by the digest of their unsigned value
+UPDATE "tokens" SET "value" = sha256_hex("value") WHERE "value" IS NOT NULL;
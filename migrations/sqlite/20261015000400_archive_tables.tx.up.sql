@@ -0,0 +1,40 @@
+-- The archival worker picks the oldest rows out of each table
+CREATE INDEX IF NOT EXISTS "tokens_created_at_idx" ON "tokens" ("created_at");
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "login_attempts_created_at_idx" ON "login_attempts" ("created_at");
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "audit_logs_created_at_idx" ON "audit_logs" ("created_at");
+
+--bun:split
+
+-- Archives have the tables' columns in the same order, so rows can be
+-- moved with SELECT *
+CREATE TABLE IF NOT EXISTS "tokens_archive" ("id" TEXT NOT NULL, "value" VARCHAR, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "updated_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "user_id" TEXT, "actor_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "tokens_archive_user_id_idx" ON "tokens_archive" ("user_id");
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "tokens_archive_created_at_idx" ON "tokens_archive" ("created_at");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "login_attempts_archive" ("id" TEXT NOT NULL, "identifier" VARCHAR, "success" BOOLEAN NOT NULL, "reason" VARCHAR, "ip" VARCHAR, "user_agent" VARCHAR, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "user_id" TEXT, "account_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "login_attempts_archive_user_id_created_at_idx" ON "login_attempts_archive" ("user_id", "created_at");
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS "audit_logs_archive" ("id" TEXT NOT NULL, "method" VARCHAR, "path" VARCHAR, "status" BIGINT, "ip" VARCHAR, "request_id" VARCHAR, "created_at" TIMESTAMP NOT NULL DEFAULT current_timestamp, "account_id" TEXT, "actor_id" TEXT, "user_id" TEXT, PRIMARY KEY ("id"));
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS "audit_logs_archive_account_id_created_at_idx" ON "audit_logs_archive" ("account_id", "created_at");
@@ -0,0 +1,2 @@
+-- Nothing to restore
+SELECT 1;
@@ -0,0 +1,4 @@
+-- Saved responses used to include session tokens and secrets, which are
+-- now left out. Those saved before can't be told apart, so they all go,
+-- and retries within the day they'd have replayed for run again.
+DELETE FROM "idempotency_keys";
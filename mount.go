@@ -0,0 +1,207 @@
+package goapi
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/uptrace/bun"
+)
+
+// How the API is mounted into an app. The zero value mounts it the way
+// the standalone server runs it.
+type Config struct {
+	// Path everything is served under, e.g. "/auth" for /auth/api/v1/me.
+	// Without one the API's middleware and its catch-all 404 apply to the
+	// whole app, so register the host's own routes first.
+	Prefix string
+
+	// Where uploads and exports are kept, instead of STORAGE_DRIVER's choice
+	Storage Storage
+
+	// Leaves the background workers, like webhook and email delivery, to
+	// another process mounting the API
+	SkipWorkers bool
+
+	// Leaves the schema alone, for deployments that migrate as a separate
+	// step, e.g. with goapi migrate
+	SkipMigrations bool
+}
+
+// The path the API was mounted under, see Config.Prefix
+var mountPrefix string
+
+// ====================
+//        Setup
+// ====================
+
+// Reads the settings, from the secrets manager when one is configured
+// and otherwise from the environment, and sets up logging, email, and
+// the token cache. Call once before Mount.
+func LoadConfig() error {
+	if err := initSecrets(); err != nil {
+		return err
+	}
+	if err := loadConfig(); err != nil {
+		return err
+	}
+	initLogger()
+	initMailer()
+	initAccessLog()
+	initTokenCache()
+	return nil
+}
+
+// Fiber's settings for an app that serves only the API
+func ServerConfig() fiber.Config {
+	return serverConfig()
+}
+
+// Connects to DATABASE_URI, with the DATABASE_DIALECT driver, waiting up
+// to DATABASE_CONNECT_TIMEOUT_SECONDS for it to answer. User lists and
+// token lookups read from DATABASE_REPLICA_URIS when they're set.
+func OpenDB() *bun.DB {
+	return initDb()
+}
+
+// Migrates the database, registers the API's middleware and routes on
+// the app, and starts its background workers. On Postgres the DB must use
+// the pgdriver, which events are listened for through.
+func Mount(app *fiber.App, db *bun.DB, cfg Config) {
+	mountPrefix = cfg.Prefix
+	if !cfg.SkipMigrations {
+		if err := Migrate(db); err != nil {
+			logger.Fatal().Err(err).Msg("migrating the database failed")
+		}
+	}
+
+	router := app.Group(mountPrefix)
+	router.Use(assignRequestId)
+	router.Use(logAccess)
+	router.Use(limitRequestTime)
+	initReadinessRoutes(router, db)
+	router.Use(checkDatabaseBreaker)
+	router.Use(func(c *fiber.Ctx) error {
+		return negotiateLocale(c, db)
+	})
+	router.Use(func(c *fiber.Ctx) error {
+		return handleCors(c, db)
+	})
+	router.Use(compressResponses)
+
+	reporter := initReporter()
+	router.Use(func(c *fiber.Ctx) error {
+		return reportErrors(c, reporter)
+	})
+
+	router.Use(countRequests)
+	router.Use(func(c *fiber.Ctx) error {
+		return auditRequests(c, db)
+	})
+	router.Use(verifyCsrf)
+
+	initDebugRoutes(router)
+	initDocsRoutes(router, app)
+	store := cfg.Storage
+	if store == nil {
+		store = initStorage(router)
+	}
+
+	initHostedPageRoutes(router, db)
+	initVersionedRoutes(router, app, db, store)
+
+	// Anything unmatched gets the same JSON error as everything else
+	router.Use(func(c *fiber.Ctx) error {
+		return notFound("route not found").WithCode(codeRouteNotFound)
+	})
+
+	startQuotaSync(db)
+
+	if cfg.SkipWorkers {
+		return
+	}
+	startAuditExports(db, store)
+	startRetentionPurge(db)
+	startArchival(db)
+	startMetricsRollup(db)
+	startQuotaResets(db)
+	startConfigReload()
+	startWebhookDeliveries(db)
+	startEmailDeliveries(db)
+	startDataExportPurge(db, store)
+	startErasures(db, store)
+	startEventDispatcher(db, initBroker())
+	startSecretsRefresh()
+}
+
+// Serves the app on PORT, over HTTPS when TLS_CERT_FILE or
+// TLS_AUTOCERT_DOMAINS is set
+func Listen(app *fiber.App) error {
+	return listen(app)
+}
+
+// Serves the gRPC API on GRPC_PORT, if it's set
+func ServeGrpc(db *bun.DB) {
+	startGrpcServer(db)
+}
+
+// ====================
+//     Middleware
+// ====================
+
+// Requires a valid token, as the API's own routes do. The user is then
+// available from CurrentUser.
+func RequireUser(db *bun.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	}
+}
+
+// Requires a permission, e.g. "users.read", for use after RequireUser
+func Permit(db *bun.DB, permission string) fiber.Handler {
+	return permit(db, permission)
+}
+
+// Answers errors with the API's JSON error bodies, for fiber.Config
+func ErrorHandler(c *fiber.Ctx, err error) error {
+	return errorHandler(c, err)
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// The user RequireUser signed in, or nil
+func CurrentUser(c *fiber.Ctx) *User {
+	user, _ := c.Locals("user").(*User)
+	return user
+}
+
+// The API's logger, configured by LoadConfig
+func Logger() *zerolog.Logger {
+	return &logger
+}
+
+// Creates an account with a key and its owner, as POST /accounts does,
+// returning the key with its secret. The owner's password is hashed.
+func CreateAccount(ctx context.Context, db *bun.DB, account *Account, owner *User) (*Key, error) {
+	if account.ID == uuid.Nil {
+		account.ID = newId()
+	}
+	return newAccountService(db).Create(ctx, account, owner)
+}
+
+// Makes another key for the account, returning it with its secret
+func CreateKey(ctx context.Context, db *bun.DB, accountId uuid.UUID) (*Key, error) {
+	return newAccountService(db).CreateKey(ctx, accountId)
+}
+
+// Signs the user in as logging in does, returning their token. Unlike a
+// login's, the token is stored before it's returned, so it can be used
+// at once.
+func SignIn(db *bun.DB, user *User) (string, error) {
+	auth := newAuthService(db)
+	auth.tokens = storedTokenRepository{bunTokenRepository{db: db}}
+	return auth.StartSession(user.ID, user.AccountId)
+}
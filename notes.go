@@ -0,0 +1,133 @@
+package goapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// UserNote DB model. Notes are for admins only and never part of PublicUser.
+type UserNote struct {
+	bun.BaseModel `bun:"table:user_notes"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Body string
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	UserId uuid.UUID `bun:",type:uuid"` // has idx
+	AuthorId uuid.UUID `bun:",type:uuid"`
+	AccountId uuid.UUID `bun:",type:uuid"`
+}
+
+// ====================
+//        Setup
+// ====================
+
+var _ bun.BeforeAppendModelHook = (*UserNote)(nil)
+func (n *UserNote) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+		case *bun.UpdateQuery:
+			n.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func getUserNotes(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	notes := []UserNote{}
+	err := db.NewSelect().Model(&notes).
+		Where("user_id = ?", c.Params("id")).
+		Where("account_id = ?", currentUser.AccountId).
+		Order("created_at DESC").
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return an empty array
+	}
+
+	return c.JSON(notes)
+}
+
+func createUserNote(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	note := new(UserNote)
+	if err := c.BodyParser(note); err != nil || note.Body == "" {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	// Make sure the user is in the admin's account
+	exists, err := db.NewSelect().Model((*User)(nil)).
+		Where("id = ?", c.Params("id")).
+		Where("account_id = ?", currentUser.AccountId).
+		Exists(ctx)
+	if err != nil || !exists {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("user not found").WithCode(codeUserNotFound)
+	}
+
+	note.ID = newId()
+	note.UserId, _ = uuid.Parse(c.Params("id"))
+	note.AuthorId = currentUser.ID
+	note.AccountId = currentUser.AccountId
+	_, err = db.NewInsert().Model(note).Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return created(c, apiPath(c, "/users/")+note.UserId.String()+"/notes/"+note.ID.String(), note)
+}
+
+func updateUserNote(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(UserNote)
+	if err := c.BodyParser(input); err != nil || input.Body == "" {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	note := new(UserNote)
+	err := updateReturning(ctx, db, note, func(q bun.QueryBuilder) bun.QueryBuilder {
+		return q.Where("id = ?", c.Params("noteId")).
+			Where("user_id = ?", c.Params("id")).
+			Where("account_id = ?", currentUser.AccountId)
+	}, func(q *bun.UpdateQuery) *bun.UpdateQuery {
+		return q.Set("body = ?", input.Body).Set("updated_at = ?", time.Now())
+	})
+	if err != nil || note.ID == uuid.Nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("note not found").WithCode(codeNoteNotFound)
+	}
+
+	return c.JSON(note)
+}
+
+func deleteUserNote(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	_, err := db.NewDelete().Model((*UserNote)(nil)).
+		Where("id = ?", c.Params("noteId")).
+		Where("user_id = ?", c.Params("id")).
+		Where("account_id = ?", currentUser.AccountId).
+		Exec(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
@@ -0,0 +1,588 @@
+package goapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/google/uuid"
+)
+
+// What the spec says about a route beyond what the router knows. Paths,
+// methods, and path parameters come from the router itself, and schemas
+// from the body and response types, so the spec follows the code.
+type operationDoc struct {
+	Summary string
+	Auth string // one of the auth constants below, a signed in user by default
+	Query []string
+	Body interface{} // a value of the request body's type
+	Response interface{} // a value of the success response's type
+	Status int // of a success, 200 by default
+}
+
+// Who may call a route
+const (
+	authUser = ""
+	authNone = "none"
+	authAccountKey = "account-key"
+	authOperator = "operator"
+)
+
+// The body of routes that only report that they worked
+type SuccessResponse struct {
+	Success bool `json:"success"`
+}
+
+// The body of every error. See errorHandler.
+type ErrorResponse struct {
+	Code string `json:"code"`
+	Message string `json:"message"`
+	RequestId string `json:"request_id"`
+}
+
+// Account settings routes answer with the deployment's and the account's
+type SettingsResponse struct {
+	Defaults interface{} `json:"defaults"`
+	Account interface{} `json:"account"`
+}
+
+// Docs for each route, keyed by method and path under a version
+var operationDocs = map[string]operationDoc{
+	// Accounts
+	"POST /accounts": {Summary: "Create an account with its first key and owner", Auth: authNone, Body: CreateAccountInput{}, Response: struct {
+		Key uuid.UUID `json:"key"`
+		User PublicUser `json:"user"`
+	}{}, Status: fiber.StatusCreated},
+	"GET /accounts": {Summary: "Get the account and its settings", Query: []string{"fields", "include"}, Response: Account{}},
+	"GET /accounts/reserved-usernames": {Summary: "List reserved usernames", Response: SettingsResponse{}},
+	"PUT /accounts/reserved-usernames": {Summary: "Replace the account's reserved usernames", Body: struct{ ReservedUsernames []string }{}, Response: SettingsResponse{}},
+	"GET /accounts/route-permissions": {Summary: "List the permissions routes require", Response: SettingsResponse{}},
+	"PUT /accounts/route-permissions": {Summary: "Replace the permissions routes require", Body: map[string]string{}, Response: SettingsResponse{}},
+	"GET /accounts/retention": {Summary: "Get how many days rows are kept", Response: SettingsResponse{}},
+	"PUT /accounts/retention": {Summary: "Set how many days rows are kept", Body: map[string]int{}, Response: SettingsResponse{}},
+	"GET /accounts/cors": {Summary: "Get the account's CORS rules", Response: SettingsResponse{}},
+	"PUT /accounts/cors": {Summary: "Replace the account's CORS rules", Body: CorsConfig{}, Response: SettingsResponse{}},
+	"GET /accounts/locale": {Summary: "Get the account's default locale", Response: fiber.Map{}},
+	"GET /accounts/email-sender": {Summary: "Get who the account's emails come from", Response: fiber.Map{}},
+	"PUT /accounts/email-sender": {Summary: "Set who the account's emails come from", Body: EmailSender{}, Response: fiber.Map{}},
+	"GET /accounts/quota": {Summary: "Get the account's plan and what's left of its monthly requests", Response: QuotaStatus{}},
+	"GET /accounts/activity": {Summary: "List notable recent events on the account, newest first", Query: []string{"limit", "cursor"}, Response: ActivityPage{}},
+	"GET /accounts/hosted-pages": {Summary: "Get the account's hosted login pages", Response: HostedPagesSettings{}},
+	"PUT /accounts/hosted-pages": {Summary: "Set up the account's hosted login pages, or turn them off with an empty body", Body: HostedPagesSettings{}, Response: HostedPagesSettings{}},
+	"PUT /accounts/locale": {Summary: "Set the account's default locale", Body: struct{ Locale string }{}, Response: fiber.Map{}},
+	"GET /accounts/keys": {Summary: "List account keys", Query: []string{"fields"}, Response: []Key{}},
+	"POST /accounts/keys": {Summary: "Create an account key", Response: Key{}, Status: fiber.StatusCreated},
+	"DELETE /accounts/keys/:id": {Summary: "Revoke an account key", Response: SuccessResponse{}},
+	"PUT /accounts/keys/:id/client-certificate": {Summary: "Bind an account key to the client certificate the request is made with", Body: KeyCertificateInput{}, Response: SuccessResponse{}},
+	"DELETE /accounts/keys/:id/client-certificate": {Summary: "Unbind an account key from its client certificate", Response: SuccessResponse{}},
+
+	// Auth
+	"GET /auth": {Summary: "Get the user a token belongs to", Auth: authNone, Response: PublicUser{}},
+	"POST /auth": {Summary: "Register a user", Auth: authAccountKey, Query: []string{"session"}, Body: RegisterInput{}, Response: PublicUser{}, Status: fiber.StatusCreated},
+	"PUT /auth": {Summary: "Log in", Auth: authAccountKey, Query: []string{"session"}, Body: struct {
+		Username string
+		Password string
+	}{}, Response: PublicUser{}},
+	"PATCH /auth": {Summary: "Change the signed in user's password", Body: struct {
+		Password string
+		NewPassword string
+	}{}, Response: SuccessResponse{}},
+	"DELETE /auth": {Summary: "Log out", Auth: authNone, Response: SuccessResponse{}},
+	"POST /auth/anonymous": {Summary: "Register an anonymous user", Auth: authAccountKey, Query: []string{"session"}, Response: PublicUser{}, Status: fiber.StatusCreated},
+	"POST /auth/reset": {Summary: "Email a password reset link to a user by username or email", Auth: authAccountKey, Body: PasswordResetInput{}, Response: SuccessResponse{}, Status: fiber.StatusAccepted},
+	"PUT /auth/reset": {Summary: "Choose a new password with a reset link's token", Auth: authAccountKey, Body: ResetPasswordInput{}, Response: SuccessResponse{}},
+	"GET /auth/csrf": {Summary: "Issue a CSRF token for cookie sessions", Auth: authNone, Response: struct {
+		Token string `json:"token"`
+	}{}},
+	"DELETE /auth/impersonation": {Summary: "End an impersonation", Response: SuccessResponse{}},
+	"POST /authz/check": {Summary: "Check whether a user may take an action", Body: AuthzCheckInput{}, Response: AuthzDecision{}},
+	"POST /batch": {Summary: "Run many requests in one", Body: []BatchRequest{}, Response: []BatchResult{}},
+	"GET /graphql": {Summary: "Run a GraphQL query", Query: []string{"query", "operationName", "variables"}, Response: map[string]interface{}{}},
+	"POST /graphql": {Summary: "Run a GraphQL query", Body: GraphqlRequest{}, Response: map[string]interface{}{}},
+	"GET /errors": {Summary: "List error codes", Auth: authNone, Response: map[string]string{}},
+
+	// Me
+	"GET /me": {Summary: "Get the signed in user", Query: []string{"fields", "include"}, Response: PublicUser{}},
+	"PATCH /me": {Summary: "Update the signed in user", Body: MeInput{}, Response: PublicUser{}},
+	"DELETE /me": {Summary: "Delete the signed in user", Body: struct{ Password string }{}, Response: SuccessResponse{}},
+	"GET /me/consents": {Summary: "List the signed in user's consents", Response: []ConsentStatus{}},
+	"POST /me/consents": {Summary: "Accept a consent document", Body: struct{ Slug string }{}, Response: []ConsentStatus{}},
+	"GET /me/logins": {Summary: "List the signed in user's logins", Response: []LoginAttempt{}},
+	"POST /me/export": {Summary: "Start an export of everything stored about the signed in user", Response: DataExport{}, Status: fiber.StatusAccepted},
+	"GET /me/export": {Summary: "Get the signed in user's latest data export and its download link", Response: DataExport{}},
+	"GET /me/export/download": {Summary: "Download the signed in user's latest data export until it expires"},
+	"POST /me/erasure": {Summary: "Ask for everything stored about the signed in user to be erased after a grace period", Body: struct{ Password string }{}, Response: ErasureRequest{}, Status: fiber.StatusAccepted},
+	"GET /me/erasure": {Summary: "Get the signed in user's erasure request", Response: ErasureRequest{}},
+	"DELETE /me/erasure": {Summary: "Cancel the signed in user's pending erasure", Response: SuccessResponse{}},
+	"POST /me/upgrade": {Summary: "Give an anonymous user credentials", Body: struct {
+		Username string
+		Password string
+		Email string
+	}{}, Response: PublicUser{}},
+	"PUT /me/username": {Summary: "Change the signed in user's username", Body: struct{ Username string }{}, Response: PublicUser{}},
+	"PUT /me/avatar": {Summary: "Upload an avatar as the multipart field avatar", Response: PublicUser{}},
+
+	// Users
+	"GET /users": {Summary: "List users", Query: []string{"role", "status", "group", "fields", "include"}, Response: []PublicUser{}},
+	"POST /users": {Summary: "Create a user", Body: CreateUserInput{}, Response: PublicUser{}, Status: fiber.StatusCreated},
+	"PATCH /users": {Summary: "Replace the signed in user's metadata", Body: struct{ Metadata map[string]interface{} }{}, Response: PublicUser{}},
+	"GET /users/search": {Summary: "Search users", Query: []string{"q", "role", "status", "group", "fields", "include"}, Response: []PublicUser{}},
+	"GET /users/export": {Summary: "Export users as CSV", Query: []string{"columns", "role", "status", "group"}},
+	"GET /users/stats": {Summary: "Get signup and activity counts", Query: []string{"days"}, Response: fiber.Map{}},
+	"POST /users/bulk": {Summary: "Apply one action to many users", Body: BulkUserInput{}, Response: []BulkUserResult{}},
+	"POST /users/import": {Summary: "Import users with their password hashes from another provider", Body: ImportUsersInput{}, Response: []ImportUserResult{}},
+	"GET /users/:id": {Summary: "Get a user", Query: []string{"fields", "include"}, Response: PublicUser{}},
+	"PUT /users/:id": {Summary: "Update the fields sent on a user", Body: UpdateUserInput{}, Response: PublicUser{}},
+	"PATCH /users/:id": {Summary: "Patch a user with a merge or JSON patch", Body: UpdateUserInput{}, Response: PublicUser{}},
+	"DELETE /users/:id": {Summary: "Delete a user", Query: []string{"hard"}, Response: SuccessResponse{}},
+	"POST /users/:id/restore": {Summary: "Restore a deleted user", Response: PublicUser{}},
+	"POST /users/:id/suspend": {Summary: "Suspend a user", Response: PublicUser{}},
+	"POST /users/:id/unsuspend": {Summary: "Unsuspend a user", Response: PublicUser{}},
+	"PUT /users/:id/role": {Summary: "Assign a user's role", Body: struct{ Role string }{}, Response: PublicUser{}},
+	"PUT /users/:id/username": {Summary: "Change a user's username", Body: struct{ Username string }{}, Response: PublicUser{}},
+	"GET /users/:id/usernames": {Summary: "List a user's past usernames", Response: []UsernameHistory{}},
+	"GET /users/:id/logins": {Summary: "List a user's logins", Response: []LoginAttempt{}},
+	"POST /users/:id/export": {Summary: "Start an export of everything stored about a user", Response: DataExport{}, Status: fiber.StatusAccepted},
+	"GET /users/:id/export": {Summary: "Get a user's latest data export and its download link", Response: DataExport{}},
+	"GET /users/:id/export/download": {Summary: "Download a user's latest data export until it expires"},
+	"POST /users/:id/erasure": {Summary: "Schedule a user's erasure after the grace period", Response: ErasureRequest{}, Status: fiber.StatusAccepted},
+	"GET /users/:id/erasure": {Summary: "Get a user's latest erasure request and its signed confirmation", Response: ErasureRequest{}},
+	"DELETE /users/:id/erasure": {Summary: "Cancel a user's pending erasure", Response: SuccessResponse{}},
+	"POST /users/:id/tags": {Summary: "Tag a user", Body: struct{ Tags []string }{}, Response: PublicUser{}},
+	"DELETE /users/:id/tags/:tag": {Summary: "Untag a user", Response: PublicUser{}},
+	"GET /users/:id/notes": {Summary: "List notes on a user", Response: []UserNote{}},
+	"POST /users/:id/notes": {Summary: "Add a note to a user", Body: struct{ Body string }{}, Response: UserNote{}, Status: fiber.StatusCreated},
+	"PUT /users/:id/notes/:noteId": {Summary: "Edit a note", Body: struct{ Body string }{}, Response: UserNote{}},
+	"DELETE /users/:id/notes/:noteId": {Summary: "Delete a note", Response: SuccessResponse{}},
+	"POST /users/:id/impersonate": {Summary: "Get a token acting as a user", Response: PublicUser{}},
+
+	// Invites
+	"POST /users/invite": {Summary: "Invite someone by email", Body: struct {
+		Email string
+		Role string
+	}{}, Response: Invite{}, Status: fiber.StatusCreated},
+	"GET /users/invites": {Summary: "List pending invites", Response: []Invite{}},
+	"GET /users/invites/:inviteId": {Summary: "Get a pending invite", Response: Invite{}},
+	"POST /users/invites/:inviteId/resend": {Summary: "Resend an invite", Response: Invite{}},
+	"DELETE /users/invites/:inviteId": {Summary: "Revoke an invite", Response: SuccessResponse{}},
+	"POST /users/invite-links": {Summary: "Create a shareable invite link", Body: InviteLink{}, Response: InviteLink{}, Status: fiber.StatusCreated},
+	"GET /users/invite-links": {Summary: "List invite links", Response: []InviteLink{}},
+	"DELETE /users/invite-links/:linkId": {Summary: "Revoke an invite link", Response: SuccessResponse{}},
+	"POST /invites/accept": {Summary: "Accept an invite", Auth: authNone, Body: AcceptInviteInput{}, Response: PublicUser{}, Status: fiber.StatusCreated},
+	"POST /invite-links/accept": {Summary: "Join through an invite link", Auth: authNone, Body: AcceptInviteLinkInput{}, Response: PublicUser{}, Status: fiber.StatusCreated},
+
+	// Roles and groups
+	"GET /roles": {Summary: "List roles", Response: []Role{}},
+	"POST /roles": {Summary: "Create a role", Body: Role{}, Response: Role{}, Status: fiber.StatusCreated},
+	"PUT /roles/:id": {Summary: "Update the fields sent on a role", Body: Role{}, Response: Role{}},
+	"DELETE /roles/:id": {Summary: "Delete a role nobody is assigned", Response: SuccessResponse{}},
+	"GET /roles/permissions": {Summary: "List permissions", Response: []string{}},
+	"GET /groups": {Summary: "List groups", Response: []Group{}},
+	"POST /groups": {Summary: "Create a group", Body: Group{}, Response: Group{}, Status: fiber.StatusCreated},
+	"PUT /groups/:id": {Summary: "Update the fields sent on a group", Body: Group{}, Response: Group{}},
+	"DELETE /groups/:id": {Summary: "Delete a group", Response: SuccessResponse{}},
+	"GET /groups/:id/members": {Summary: "List a group's members", Query: []string{"fields"}, Response: []PublicUser{}},
+	"POST /groups/:id/members": {Summary: "Add users to a group", Body: GroupMembersInput{}, Response: []PublicUser{}},
+	"DELETE /groups/:id/members/:userId": {Summary: "Remove a user from a group", Response: SuccessResponse{}},
+	"GET /policies": {Summary: "Get the account's policy", Response: AccountPolicy{}},
+	"PUT /policies": {Summary: "Replace the account's policy", Body: AccountPolicy{}, Response: AccountPolicy{}},
+	"DELETE /policies": {Summary: "Delete the account's policy", Response: SuccessResponse{}},
+	"POST /policies/test": {Summary: "Try a policy without saving it", Body: PolicyTestInput{}, Response: AuthzDecision{}},
+
+	// Consents
+	"GET /consents/documents": {Summary: "List the latest consent documents", Response: []ConsentDocument{}},
+	"POST /consents/documents": {Summary: "Publish a consent document", Body: ConsentDocument{}, Response: ConsentDocument{}, Status: fiber.StatusCreated},
+
+	// Audit and analytics
+	"GET /audit-logs/exports": {Summary: "List audit log exports", Response: []AuditExport{}},
+	"POST /audit-logs/exports": {Summary: "Export audit logs", Query: []string{"from", "to"}, Response: AuditExport{}, Status: fiber.StatusCreated},
+	"GET /audit-logs/exports/:exportId/download": {Summary: "Download an audit log export"},
+	"GET /metrics": {Summary: "Get the account's daily metrics", Query: []string{"days"}, Response: fiber.Map{}},
+	"GET /flags": {Summary: "Get the flags on for the signed in user", Response: map[string]bool{}},
+
+	// Webhooks
+	"GET /webhooks/events": {Summary: "List the event types webhooks may subscribe to", Response: []string{}},
+	"GET /webhooks": {Summary: "List webhooks", Response: []Webhook{}},
+	"POST /webhooks": {Summary: "Create a webhook", Body: WebhookInput{}, Response: WebhookWithSecret{}, Status: fiber.StatusCreated},
+	"GET /webhooks/:id": {Summary: "Get a webhook", Response: Webhook{}},
+	"PUT /webhooks/:id": {Summary: "Update the fields sent on a webhook", Body: UpdateWebhookInput{}, Response: Webhook{}},
+	"DELETE /webhooks/:id": {Summary: "Delete a webhook and its deliveries", Response: SuccessResponse{}},
+	"POST /webhooks/:id/secret": {Summary: "Rotate a webhook's signing secret", Response: WebhookWithSecret{}},
+	"GET /webhooks/:id/deliveries": {Summary: "List a webhook's latest deliveries", Query: []string{"status"}, Response: []WebhookDelivery{}},
+	"POST /webhooks/:id/deliveries/:deliveryId/redeliver": {Summary: "Send a delivery's event again", Response: WebhookDelivery{}, Status: fiber.StatusAccepted},
+
+	// Email templates
+	"GET /email-templates": {Summary: "List the kinds of email and the account's templates", Response: fiber.Map{}},
+	"GET /email-templates/variables": {Summary: "Get the account's own template variables", Response: map[string]string{}},
+	"PUT /email-templates/variables": {Summary: "Replace the account's own template variables", Body: map[string]string{}, Response: map[string]string{}},
+	"GET /email-templates/:kind": {Summary: "Get a kind of email and the account's templates for it", Response: fiber.Map{}},
+	"PUT /email-templates/:kind": {Summary: "Save the account's template for a kind of email", Query: []string{"locale"}, Body: EmailTemplateInput{}, Response: EmailTemplate{}},
+	"DELETE /email-templates/:kind": {Summary: "Go back to the default template for a kind of email", Query: []string{"locale"}, Response: SuccessResponse{}},
+	"POST /email-templates/:kind/preview": {Summary: "Render a kind of email with sample values", Query: []string{"locale"}, Body: EmailTemplateInput{}, Response: EmailContent{}},
+	"POST /email-templates/:kind/test": {Summary: "Send a kind of email with sample values to yourself", Query: []string{"locale"}, Body: EmailTemplateInput{}, Response: fiber.Map{}, Status: fiber.StatusAccepted},
+
+	// Events
+	"GET /events": {Summary: "List the account's latest events", Query: []string{"type", "from", "to"}, Response: []Event{}},
+	"GET /sessions/ws": {Summary: "Receive session revoked and user suspended notifications over a WebSocket", Response: SessionNotification{}, Status: fiber.StatusSwitchingProtocols},
+	"GET /events/stream": {Summary: "Stream the account's events as server-sent events", Query: []string{"type"}, Response: Event{}},
+	"POST /events/replay": {Summary: "Send a time range's events to webhooks again", Body: EventReplayInput{}, Response: fiber.Map{}, Status: fiber.StatusAccepted},
+
+	// Operator
+	"PUT /operator/accounts/:id/plan": {Summary: "Put an account on a plan", Auth: authOperator, Body: AccountPlanInput{}, Response: QuotaStatus{}},
+	"GET /operator/metrics": {Summary: "Get daily metrics across accounts", Auth: authOperator, Query: []string{"days", "account"}, Response: fiber.Map{}},
+	"POST /operator/reload": {Summary: "Reload the configuration", Auth: authOperator, Response: SuccessResponse{}},
+	"GET /operator/migrations": {Summary: "List the schema migrations and whether each has been applied", Auth: authOperator, Response: []MigrationStatus{}},
+	"POST /operator/seed": {Summary: "Create a demo account with fake users, in development only", Auth: authOperator, Body: SeedOptions{}, Response: SeedResult{}, Status: fiber.StatusCreated},
+	"GET /operator/flags": {Summary: "List feature flags", Auth: authOperator, Response: []FeatureFlag{}},
+	"PUT /operator/flags/:key": {Summary: "Save a feature flag", Auth: authOperator, Body: FeatureFlag{}, Response: FeatureFlag{}},
+	"DELETE /operator/flags/:key": {Summary: "Delete a feature flag", Auth: authOperator, Response: SuccessResponse{}},
+	"PUT /operator/flags/:key/accounts/:accountId": {Summary: "Override a flag for an account", Auth: authOperator, Body: FlagOverride{}, Response: FlagOverride{}},
+	"DELETE /operator/flags/:key/accounts/:accountId": {Summary: "Remove an account's flag override", Auth: authOperator, Response: SuccessResponse{}},
+}
+
+// Specs are built once per version, after every route is registered
+var (
+	openApiSpecsMutex sync.Mutex
+	openApiSpecs = map[string][]byte{}
+)
+
+// Fiber path parameters, e.g. :id
+var pathParamPattern = regexp.MustCompile(`:([A-Za-z0-9_]+)`)
+
+// Loads Swagger UI from a CDN, pointed at the openapi.json beside it
+const swaggerUiHtml = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>API docs</title>
+	<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@4/swagger-ui.css">
+</head>
+<body>
+	<div id="docs"></div>
+	<script src="https://unpkg.com/swagger-ui-dist@4/swagger-ui-bundle.js"></script>
+	<script>
+		SwaggerUIBundle({ url: "openapi.json" + window.location.search, dom_id: "#docs" })
+	</script>
+</body>
+</html>`
+
+// ====================
+//        Setup
+// ====================
+
+func initDocsRoutes(router fiber.Router, app *fiber.App) {
+	router.Get("/openapi.json", func(c *fiber.Ctx) error {
+		return getOpenApiSpec(c, app)
+	})
+
+	router.Get("/docs", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+		return c.SendString(swaggerUiHtml)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// The OpenAPI 3 spec of the latest version, or of ?version=
+func getOpenApiSpec(c *fiber.Ctx, app *fiber.App) error {
+	versions := apiVersions()
+	version := versions[len(versions)-1]
+	if name := c.Query("version"); name != "" {
+		found := false
+		for _, v := range versions {
+			if v.Name == name {
+				version, found = v, true
+			}
+		}
+		if !found {
+			return notFound(fmt.Sprintf("no api version %s", name)).WithCode(codeRouteNotFound)
+		}
+	}
+
+	openApiSpecsMutex.Lock()
+	defer openApiSpecsMutex.Unlock()
+
+	spec, ok := openApiSpecs[version.Name]
+	if !ok {
+		var err error
+		spec, err = json.Marshal(buildOpenApiSpec(app, version))
+		if err != nil {
+			return internalError(err)
+		}
+		openApiSpecs[version.Name] = spec
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+	return c.Send(spec)
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Describes every route the app serves under the version
+func buildOpenApiSpec(app *fiber.App, version apiVersion) fiber.Map {
+	prefix := versionPrefix(version)
+	schemas := fiber.Map{}
+	builder := &schemaBuilder{Version: version, Schemas: schemas}
+	errorSchema := builder.schemaFor(reflect.TypeOf(ErrorResponse{}))
+
+	paths := fiber.Map{}
+	for _, route := range apiRoutes(app, prefix) {
+		path := strings.TrimPrefix(route.Path, prefix)
+		doc, documented := operationDocs[route.Method+" "+path]
+		if !documented {
+			doc.Summary = route.Method + " " + path
+		}
+
+		operation := fiber.Map{
+			"summary": doc.Summary,
+			"tags": []string{strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]},
+			"security": operationSecurity(doc.Auth),
+		}
+
+		parameters := []fiber.Map{}
+		for _, param := range route.Params {
+			parameters = append(parameters, fiber.Map{
+				"name": param,
+				"in": "path",
+				"required": true,
+				"schema": fiber.Map{"type": "string"},
+			})
+		}
+		for _, name := range doc.Query {
+			parameters = append(parameters, fiber.Map{
+				"name": name,
+				"in": "query",
+				"schema": fiber.Map{"type": "string"},
+			})
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+
+		if doc.Body != nil {
+			operation["requestBody"] = fiber.Map{
+				"required": true,
+				"content": fiber.Map{
+					fiber.MIMEApplicationJSON: fiber.Map{"schema": builder.schemaFor(reflect.TypeOf(doc.Body))},
+				},
+			}
+		}
+
+		status := doc.Status
+		if status == 0 {
+			status = fiber.StatusOK
+		}
+		success := fiber.Map{"description": utils.StatusMessage(status)}
+		if doc.Response != nil {
+			success["content"] = fiber.Map{
+				fiber.MIMEApplicationJSON: fiber.Map{"schema": builder.schemaFor(reflect.TypeOf(doc.Response))},
+			}
+		}
+		operation["responses"] = fiber.Map{
+			strconv.Itoa(status): success,
+			"default": fiber.Map{
+				"description": "An error",
+				"content": fiber.Map{
+					fiber.MIMEApplicationJSON: fiber.Map{"schema": errorSchema},
+				},
+			},
+		}
+
+		specPath := pathParamPattern.ReplaceAllString(route.Path, "{$1}")
+		operations, ok := paths[specPath].(fiber.Map)
+		if !ok {
+			operations = fiber.Map{}
+			paths[specPath] = operations
+		}
+		operations[strings.ToLower(route.Method)] = operation
+	}
+
+	return fiber.Map{
+		"openapi": "3.0.3",
+		"info": fiber.Map{
+			"title": "goapi",
+			"version": version.Name,
+		},
+		"paths": paths,
+		"components": fiber.Map{
+			"schemas": schemas,
+			"securitySchemes": fiber.Map{
+				"bearer": fiber.Map{"type": "http", "scheme": "bearer"},
+				"session": fiber.Map{"type": "apiKey", "in": "cookie", "name": sessionCookieName},
+				"accountKey": fiber.Map{"type": "apiKey", "in": "header", "name": "Account-Key"},
+				"operator": fiber.Map{"type": "http", "scheme": "bearer", "description": "The deployment's OPERATOR_TOKEN"},
+			},
+		},
+	}
+}
+
+// The routes registered under the prefix, leaving out middleware and
+// the methods Fiber adds on its own, sorted by path
+func apiRoutes(app *fiber.App, prefix string) []*fiber.Route {
+	methods := []string{fiber.MethodGet, fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete}
+
+	routes := []*fiber.Route{}
+	for _, stack := range app.Stack() {
+		for _, route := range stack {
+			if !stringInSlice(route.Method, methods) || !strings.HasPrefix(route.Path, prefix+"/") {
+				continue
+			}
+			// Fiber doesn't export whether a route came from Use
+			if reflect.ValueOf(route).Elem().FieldByName("use").Bool() {
+				continue
+			}
+			routes = append(routes, route)
+		}
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Path < routes[j].Path
+	})
+	return routes
+}
+
+func operationSecurity(auth string) []fiber.Map {
+	switch auth {
+		case authNone:
+			return []fiber.Map{}
+		case authAccountKey:
+			return []fiber.Map{{"accountKey": []string{}}}
+		case authOperator:
+			return []fiber.Map{{"operator": []string{}}}
+	}
+	return []fiber.Map{{"bearer": []string{}}, {"session": []string{}}}
+}
+
+// Builds JSON schemas from Go types, the way encoding/json would write
+// them, collecting named structs as shared components
+type schemaBuilder struct {
+	Version apiVersion
+	Schemas fiber.Map
+}
+
+func (builder *schemaBuilder) schemaFor(t reflect.Type) fiber.Map {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	// Versions may render a type as another
+	if serialize, ok := builder.Version.Serializers[t]; ok {
+		t = reflect.TypeOf(serialize(reflect.Zero(t).Interface()))
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+	}
+
+	switch t {
+		case reflect.TypeOf(time.Time{}):
+			return fiber.Map{"type": "string", "format": "date-time"}
+		case reflect.TypeOf(uuid.UUID{}):
+			return fiber.Map{"type": "string", "format": "uuid"}
+		case reflect.TypeOf(json.RawMessage{}):
+			return fiber.Map{}
+	}
+
+	switch t.Kind() {
+		case reflect.String:
+			return fiber.Map{"type": "string"}
+		case reflect.Bool:
+			return fiber.Map{"type": "boolean"}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return fiber.Map{"type": "integer"}
+		case reflect.Float32, reflect.Float64:
+			return fiber.Map{"type": "number"}
+		case reflect.Slice, reflect.Array:
+			if t.Elem().Kind() == reflect.Uint8 {
+				return fiber.Map{"type": "string", "format": "byte"}
+			}
+			return fiber.Map{"type": "array", "items": builder.schemaFor(t.Elem())}
+		case reflect.Map:
+			return fiber.Map{"type": "object", "additionalProperties": builder.schemaFor(t.Elem())}
+		case reflect.Struct:
+			if t.Name() == "" {
+				return builder.structSchema(t)
+			}
+			ref := fiber.Map{"$ref": "#/components/schemas/" + t.Name()}
+			if _, ok := builder.Schemas[t.Name()]; !ok {
+				// Claim the name first so types that refer to themselves end
+				builder.Schemas[t.Name()] = fiber.Map{}
+				builder.Schemas[t.Name()] = builder.structSchema(t)
+			}
+			return ref
+	}
+	return fiber.Map{}
+}
+
+func (builder *schemaBuilder) structSchema(t reflect.Type) fiber.Map {
+	properties := fiber.Map{}
+	required := []string{}
+	builder.addFields(t, properties, &required)
+
+	schema := fiber.Map{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (builder *schemaBuilder) addFields(t reflect.Type, properties fiber.Map, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		// Untagged embedded structs have their fields inlined
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			builder.addFields(field.Type, properties, required)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := fiber.Map{}
+		for key, value := range builder.schemaFor(field.Type) {
+			schema[key] = value
+		}
+		for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+			parts := strings.SplitN(rule, "=", 2)
+			switch parts[0] {
+				case "required":
+					*required = append(*required, name)
+				case "email":
+					schema["format"] = "email"
+				case "url":
+					schema["format"] = "uri"
+				case "oneof":
+					schema["enum"] = strings.Fields(parts[1])
+				case "min", "max":
+					limit, err := strconv.Atoi(parts[1])
+					if err != nil || schema["type"] != "string" {
+						continue
+					}
+					schema[parts[0]+"Length"] = limit
+			}
+		}
+		properties[name] = schema
+	}
+}
@@ -0,0 +1,24 @@
+package goapi
+
+import (
+	"crypto/subtle"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ====================
+//     Middleware
+// ====================
+
+// Requires the deployment's OPERATOR_TOKEN as a bearer token. Operator
+// routes are closed entirely when it isn't set.
+func requireOperator(c *fiber.Ctx) error {
+	token := getTokenStringFromHeaders(c)
+	expected := os.Getenv("OPERATOR_TOKEN")
+	if token == "" || expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return unauthorized("unauthorized").WithCode(codeAuthUnauthorized)
+	}
+
+	return c.Next()
+}
@@ -0,0 +1,206 @@
+package goapi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// PasswordReset DB model, a single-use link emailed to a user who forgot
+// their password
+type PasswordReset struct {
+	bun.BaseModel `bun:"table:password_resets"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	TokenHash string `json:"-"` // has idx
+	ExpiresAt time.Time
+	UsedAt time.Time `bun:",nullzero"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	UserId uuid.UUID `bun:",type:uuid"`
+	AccountId uuid.UUID `bun:",type:uuid"`
+}
+
+// Asking for a reset link, by username or email
+type PasswordResetInput struct {
+	Username string `validate:"required_without=Email,max=254"`
+	Email string `validate:"omitempty,email,max=254"`
+}
+
+// Choosing a new password with the token from the link
+type ResetPasswordInput struct {
+	Token string `validate:"required"`
+	Password string `validate:"required,min=8,max=72"`
+}
+
+// How long a reset link works for
+const passwordResetTtl = 30 * time.Minute
+
+// ====================
+//        Setup
+// ====================
+
+var _ bun.BeforeAppendModelHook = (*PasswordReset)(nil)
+func (r *PasswordReset) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+		case *bun.UpdateQuery:
+			r.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Emails a reset link, built from RESET_URL, to the user with the username
+// or email. So as not to enumerate, it always succeeds.
+func (h *authHandlers) createPasswordReset(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	input := new(PasswordResetInput)
+	if err := parseBody(c, input); err != nil {
+		return err
+	}
+
+	accountId, err := accountIdForRequest(c, h.accounts)
+	if err != nil {
+		return err
+	}
+
+	link := func(token string) string {
+		return fmt.Sprintf("%s?token=%s", os.Getenv("RESET_URL"), token)
+	}
+	if err := sendPasswordReset(ctx, accountId, input, link, requestLocale(c), h.db); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"success": true})
+}
+
+// Sets the new password and signs the user out everywhere
+func (h *authHandlers) completePasswordReset(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	input := new(ResetPasswordInput)
+	if err := parseBody(c, input); err != nil {
+		return err
+	}
+
+	accountId, err := accountIdForRequest(c, h.accounts)
+	if err != nil {
+		return err
+	}
+
+	if _, err := resetPassword(ctx, accountId, input, h.db); err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Emails the user a link to choose a new password, made from a token by
+// link. Nothing is sent when there's no such active user with an email.
+func sendPasswordReset(ctx context.Context, accountId uuid.UUID, input *PasswordResetInput, link func(token string) string, locale string, db *bun.DB) error {
+	user := new(User)
+	query := db.NewSelect().Model(user).Where("account_id = ?", accountId)
+	if input.Username == "" && input.Email != "" {
+		email, _ := normalizeEmail(input.Email)
+		query.Where("email = ?", email)
+	} else {
+		query.Where("lower(username) = ?", normalizeUsername(input.Username))
+	}
+	if err := query.Scan(ctx); err != nil || user.Email == "" || !user.IsActive() {
+		return nil
+	}
+
+	token, err := generateSecureToken()
+	if err != nil {
+		return err
+	}
+
+	reset := new(PasswordReset)
+	reset.ID = newId()
+	reset.TokenHash = hashSecret(token)
+	reset.ExpiresAt = time.Now().Add(passwordResetTtl)
+	reset.UserId = user.ID
+	reset.AccountId = accountId
+	if _, err := db.NewInsert().Model(reset).Exec(ctx); err != nil {
+		return err
+	}
+
+	content, err := renderEmail(ctx, emailTemplateReset, accountId, locale, map[string]interface{}{
+		"Username": user.Username,
+		"Link": link(token),
+		"ExpiresInMinutes": int(passwordResetTtl.Minutes()),
+	}, db)
+	if err != nil {
+		return err
+	}
+
+	return queueEmail(ctx, db, accountId, user.Email, content)
+}
+
+// Uses up a reset link, replacing the user's password and revoking their
+// tokens, and returns the user
+func resetPassword(ctx context.Context, accountId uuid.UUID, input *ResetPasswordInput, db *bun.DB) (*User, error) {
+	hash, err := hashPassword(input.Password)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	user := new(User)
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		reset := new(PasswordReset)
+		err := forUpdate(tx.NewSelect().Model(reset).
+			Where("token_hash = ?", hashSecret(input.Token)).
+			Where("account_id = ?", accountId).
+			Where("used_at IS NULL").
+			Where("expires_at > ?", time.Now()), false).
+			Scan(ctx)
+		if err != nil {
+			return badRequest("invalid or expired reset link").WithCode(codePasswordResetInvalid)
+		}
+
+		err = tx.NewSelect().Model(user).Where("id = ?", reset.UserId).Scan(ctx)
+		if err != nil || !user.IsActive() {
+			return badRequest("invalid or expired reset link").WithCode(codePasswordResetInvalid)
+		}
+
+		user.Password = hash
+		user.UpdatedAt = time.Now()
+		if _, err := tx.NewUpdate().Model(user).Column("password", "updated_at").WherePK().Exec(ctx); err != nil {
+			return err
+		}
+
+		reset.UsedAt = time.Now()
+		if _, err := tx.NewUpdate().Model(reset).Column("used_at", "updated_at").WherePK().Exec(ctx); err != nil {
+			return err
+		}
+
+		// Whoever knew the old password is signed out too
+		if _, err := tx.NewDelete().Model((*Token)(nil)).Where("user_id = ?", user.ID).Exec(ctx); err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, eventTokenRevoked, user.AccountId, user.ID, map[string]interface{}{
+			"reason": "password reset",
+		})
+	})
+	if err != nil {
+		if _, ok := err.(*AppError); ok {
+			return nil, err
+		}
+		return nil, internalError(err)
+	}
+	forgetUserTokens(user.ID)
+
+	return user, nil
+}
@@ -0,0 +1,383 @@
+package goapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// One RFC 6902 operation
+type patchOperation struct {
+	Op string `json:"op"`
+	Path string `json:"path"`
+	From string `json:"from"`
+	Value interface{} `json:"value"`
+}
+
+const mimeJsonPatch = "application/json-patch+json"
+
+// ====================
+//      Utilities
+// ====================
+
+// Patches a JSON document with the request body: an RFC 6902 JSON Patch
+// when sent as application/json-patch+json, otherwise an RFC 7386 merge
+// patch. Top level keys match the document's without regard to case.
+func patchDocument(c *fiber.Ctx, document map[string]interface{}) (map[string]interface{}, error) {
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), mimeJsonPatch) {
+		operations := []patchOperation{}
+		if err := json.Unmarshal(c.Body(), &operations); err != nil {
+			return nil, badRequest("invalid json patch").WithCode(codeInvalidInput)
+		}
+
+		var patched interface{} = document
+		for i, operation := range operations {
+			operation.Path = canonicalPointer(operation.Path, document)
+			operation.From = canonicalPointer(operation.From, document)
+
+			var err error
+			patched, err = applyPatchOperation(patched, operation)
+			if err != nil {
+				return nil, unprocessable(fmt.Sprintf("operation %d: %s", i, err)).WithCode(codePatchFailed)
+			}
+		}
+
+		result, ok := patched.(map[string]interface{})
+		if !ok {
+			return nil, unprocessable("patch must leave an object").WithCode(codePatchFailed)
+		}
+		return result, nil
+	}
+
+	var patch interface{}
+	if err := json.Unmarshal(c.Body(), &patch); err != nil {
+		return nil, badRequest("invalid merge patch").WithCode(codeInvalidInput)
+	}
+
+	object, ok := patch.(map[string]interface{})
+	if !ok {
+		return nil, unprocessable("merge patch must be an object").WithCode(codePatchFailed)
+	}
+
+	canonical := map[string]interface{}{}
+	for key, value := range object {
+		canonical[canonicalKey(key, document)] = value
+	}
+
+	return mergePatch(document, canonical).(map[string]interface{}), nil
+}
+
+// RFC 7386: objects merge key by key, null removes a key, and anything
+// else replaces the target
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+
+	return targetObject
+}
+
+// The document's keys that differ after patching
+func changedKeys(before map[string]interface{}, after map[string]interface{}) []string {
+	changed := []string{}
+	for key, value := range after {
+		if !reflect.DeepEqual(before[key], value) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+// A copy of a struct as a generic JSON document
+func toDocument(value interface{}) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	document := map[string]interface{}{}
+	err = json.Unmarshal(encoded, &document)
+	return document, err
+}
+
+// Decodes a JSON document into a struct, rejecting unknown keys
+func decodeDocument(document map[string]interface{}, out interface{}) error {
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(out)
+}
+
+// The document's spelling of a top level key
+func canonicalKey(key string, document map[string]interface{}) string {
+	for existing := range document {
+		if strings.EqualFold(existing, key) {
+			return existing
+		}
+	}
+	return key
+}
+
+func canonicalPointer(pointer string, document map[string]interface{}) string {
+	tokens := strings.SplitN(pointer, "/", 3)
+	if len(tokens) < 2 || tokens[0] != "" {
+		return pointer
+	}
+	tokens[1] = escapePointerToken(canonicalKey(unescapePointerToken(tokens[1]), document))
+	return strings.Join(tokens, "/")
+}
+
+// ====================
+//   RFC 6902 Patches
+// ====================
+
+func applyPatchOperation(document interface{}, operation patchOperation) (interface{}, error) {
+	switch operation.Op {
+		case "add":
+			return patchAdd(document, operation.Path, operation.Value)
+		case "remove":
+			document, _, err := patchRemove(document, operation.Path)
+			return document, err
+		case "replace":
+			document, _, err := patchRemove(document, operation.Path)
+			if err != nil {
+				return nil, err
+			}
+			return patchAdd(document, operation.Path, operation.Value)
+		case "move":
+			if strings.HasPrefix(operation.Path, operation.From+"/") {
+				return nil, fmt.Errorf("cannot move %s into itself", operation.From)
+			}
+			document, value, err := patchRemove(document, operation.From)
+			if err != nil {
+				return nil, err
+			}
+			return patchAdd(document, operation.Path, value)
+		case "copy":
+			value, err := patchGet(document, operation.From)
+			if err != nil {
+				return nil, err
+			}
+			return patchAdd(document, operation.Path, deepCopy(value))
+		case "test":
+			value, err := patchGet(document, operation.Path)
+			if err != nil {
+				return nil, err
+			}
+			if !reflect.DeepEqual(normalizeJson(value), normalizeJson(operation.Value)) {
+				return nil, fmt.Errorf("test failed at %s", operation.Path)
+			}
+			return document, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", operation.Op)
+}
+
+func patchGet(document interface{}, pointer string) (interface{}, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	current := document
+	for _, token := range tokens {
+		switch node := current.(type) {
+			case map[string]interface{}:
+				value, ok := node[token]
+				if !ok {
+					return nil, fmt.Errorf("%s does not exist", pointer)
+				}
+				current = value
+			case []interface{}:
+				index, err := arrayIndex(token, len(node), false)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s", pointer, err)
+				}
+				current = node[index]
+			default:
+				return nil, fmt.Errorf("%s does not exist", pointer)
+		}
+	}
+
+	return current, nil
+}
+
+func patchAdd(document interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parent, err := patchGet(document, joinPointer(tokens[:len(tokens)-1]))
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch node := parent.(type) {
+		case map[string]interface{}:
+			node[last] = value
+			return document, nil
+		case []interface{}:
+			index, err := arrayIndex(last, len(node), true)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", pointer, err)
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return setPointer(document, tokens[:len(tokens)-1], node)
+	}
+	return nil, fmt.Errorf("%s does not exist", pointer)
+}
+
+// Removes the value at the pointer, returning the document and the value
+func patchRemove(document interface{}, pointer string) (interface{}, interface{}, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, document, nil
+	}
+
+	parent, err := patchGet(document, joinPointer(tokens[:len(tokens)-1]))
+	if err != nil {
+		return nil, nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch node := parent.(type) {
+		case map[string]interface{}:
+			value, ok := node[last]
+			if !ok {
+				return nil, nil, fmt.Errorf("%s does not exist", pointer)
+			}
+			delete(node, last)
+			return document, value, nil
+		case []interface{}:
+			index, err := arrayIndex(last, len(node), false)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %s", pointer, err)
+			}
+			value := node[index]
+			node = append(node[:index:index], node[index+1:]...)
+			document, err := setPointer(document, tokens[:len(tokens)-1], node)
+			return document, value, err
+	}
+	return nil, nil, fmt.Errorf("%s does not exist", pointer)
+}
+
+// Replaces the value at the tokens, for arrays that changed length
+func setPointer(document interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parent, err := patchGet(document, joinPointer(tokens[:len(tokens)-1]))
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+
+	switch node := parent.(type) {
+		case map[string]interface{}:
+			node[last] = value
+		case []interface{}:
+			index, err := arrayIndex(last, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			node[index] = value
+	}
+	return document, nil
+}
+
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid path %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = unescapePointerToken(token)
+	}
+	return tokens, nil
+}
+
+func joinPointer(tokens []string) string {
+	pointer := ""
+	for _, token := range tokens {
+		pointer += "/" + escapePointerToken(token)
+	}
+	return pointer
+}
+
+func escapePointerToken(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+func unescapePointerToken(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+}
+
+// An array position from a pointer token. "-" is the end, for adds only.
+func arrayIndex(token string, length int, adding bool) (int, error) {
+	if token == "-" && adding {
+		return length, nil
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if index > length || (index == length && !adding) {
+		return 0, fmt.Errorf("array index %d out of range", index)
+	}
+	return index, nil
+}
+
+func deepCopy(value interface{}) interface{} {
+	encoded, _ := json.Marshal(value)
+	var copied interface{}
+	json.Unmarshal(encoded, &copied)
+	return copied
+}
+
+// Values decoded from JSON so numbers compare the same however they were built
+func normalizeJson(value interface{}) interface{} {
+	return deepCopy(value)
+}
@@ -0,0 +1,289 @@
+package goapi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	stringadapter "github.com/casbin/casbin/v2/persist/string-adapter"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// AccountPolicy DB model, a Casbin model and policy evaluated before role permissions
+type AccountPolicy struct {
+	bun.BaseModel `bun:"table:account_policies"`
+	AccountId uuid.UUID `bun:",pk,type:uuid"`
+	Model string // defaults to defaultPolicyModel
+	Policy string // CSV policy lines
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+}
+
+// Testing a policy, either the stored one or one supplied inline
+type PolicyTestInput struct {
+	Model string
+	Policy string
+	AuthzCheckInput
+}
+
+// Requests are (subject, action, resource) where the subject is "user:<id>",
+// "role:<name>", or "group:<name>". Policy lines look like "p, role:support, users.read, *, allow".
+const defaultPolicyModel = `
+[request_definition]
+r = sub, act, obj
+
+[policy_definition]
+p = sub, act, obj, eft
+
+[policy_effect]
+e = some(where (p.eft == allow)) && !some(where (p.eft == deny))
+
+[matchers]
+m = r.sub == p.sub && keyMatch(r.act, p.act) && keyMatch(r.obj, p.obj)
+`
+
+// Enforcers by account, nil for accounts without a policy. Each is kept
+// for POLICY_CACHE_TTL_SECONDS, so a policy changed through another
+// instance takes hold here once it expires.
+var (
+	policyMutex sync.RWMutex
+	policyEnforcers = map[uuid.UUID]cachedPolicyEnforcer{}
+)
+
+type cachedPolicyEnforcer struct {
+	enforcer *casbin.SyncedEnforcer
+	expiresAt time.Time
+}
+
+// ====================
+//        Setup
+// ====================
+
+func initPolicyRoutes(api fiber.Router, db *bun.DB) {
+	routes := api.Group("/policies", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	})
+
+	routes.Get("/", permit(db, permissionPoliciesManage), func(c *fiber.Ctx) error {
+		return getPolicy(c, db)
+	})
+
+	routes.Put("/", permit(db, permissionPoliciesManage), func(c *fiber.Ctx) error {
+		return updatePolicy(c, db)
+	})
+
+	routes.Delete("/", permit(db, permissionPoliciesManage), func(c *fiber.Ctx) error {
+		return deletePolicy(c, db)
+	})
+
+	routes.Post("/test", permit(db, permissionPoliciesManage), func(c *fiber.Ctx) error {
+		return testPolicy(c, db)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func getPolicy(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	policy := new(AccountPolicy)
+	err := db.NewSelect().Model(policy).Where("account_id = ?", currentUser.AccountId).Scan(ctx)
+	if err != nil {
+		return c.JSON(fiber.Map{"Model": defaultPolicyModel, "Policy": ""})
+	}
+
+	return c.JSON(policy)
+}
+
+// Validates and stores the account's policy, taking effect immediately
+func updatePolicy(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	policy := new(AccountPolicy)
+	if err := c.BodyParser(policy); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	if _, err := newPolicyEnforcer(policy.Model, policy.Policy); err != nil {
+		return badRequest(fmt.Sprintf("invalid policy: %v", err))
+	}
+
+	policy.AccountId = currentUser.AccountId
+	policy.UpdatedAt = time.Now()
+	q := db.NewInsert().Model(policy)
+	_, err := upsert(q, "account_id").
+		Set("model = " + insertedValue(q, "model")).
+		Set("policy = " + insertedValue(q, "policy")).
+		Set("updated_at = " + insertedValue(q, "updated_at")).
+		Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	forgetPolicyEnforcer(currentUser.AccountId)
+	return c.JSON(policy)
+}
+
+func deletePolicy(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	_, err := db.NewDelete().Model((*AccountPolicy)(nil)).Where("account_id = ?", currentUser.AccountId).Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	forgetPolicyEnforcer(currentUser.AccountId)
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// Evaluates a request against a draft policy, or the stored one if none is given
+func testPolicy(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(PolicyTestInput)
+	if err := c.BodyParser(input); err != nil || input.Action == "" {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	subject := currentUser
+	if input.Subject != uuid.Nil {
+		subject = new(User)
+		err := db.NewSelect().Model(subject).
+			Where("id = ?", input.Subject).
+			Where("account_id = ?", currentUser.AccountId).
+			Scan(ctx)
+		if err != nil {
+			requestLogger(c).Error().Err(err).Send()
+			return notFound("user not found").WithCode(codeUserNotFound)
+		}
+	}
+
+	var enforcer *casbin.SyncedEnforcer
+	if input.Policy != "" || input.Model != "" {
+		var err error
+		enforcer, err = newPolicyEnforcer(input.Model, input.Policy)
+		if err != nil {
+			return badRequest(fmt.Sprintf("invalid policy: %v", err))
+		}
+	} else {
+		enforcer = policyEnforcer(subject.AccountId, db)
+	}
+
+	if decision, ok := enforcePolicy(ctx, enforcer, subject, input.Action, input.Resource, db); ok {
+		return c.JSON(decision)
+	}
+
+	// Nothing in the policy matched, so role permissions decide
+	return c.JSON(authorizeByRole(ctx, subject, input.Action, input.Resource, db))
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func newPolicyEnforcer(modelText string, policy string) (*casbin.SyncedEnforcer, error) {
+	if strings.TrimSpace(modelText) == "" {
+		modelText = defaultPolicyModel
+	}
+
+	m, err := model.NewModelFromString(modelText)
+	if err != nil {
+		return nil, err
+	}
+
+	return casbin.NewSyncedEnforcer(m, stringadapter.NewAdapter(policy))
+}
+
+// The account's enforcer, cached until the policy changes or it expires
+func policyEnforcer(accountId uuid.UUID, db *bun.DB) *casbin.SyncedEnforcer {
+	policyMutex.RLock()
+	cached, ok := policyEnforcers[accountId]
+	policyMutex.RUnlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.enforcer
+	}
+
+	var enforcer *casbin.SyncedEnforcer
+	ctx := context.Background()
+	policy := new(AccountPolicy)
+	err := db.NewSelect().Model(policy).Where("account_id = ?", accountId).Scan(ctx)
+	if err == nil {
+		enforcer, err = newPolicyEnforcer(policy.Model, policy.Policy)
+		if err != nil {
+			logger.Error().Err(err).Send()
+		}
+	}
+
+	ttl := time.Duration(intSetting("POLICY_CACHE_TTL_SECONDS")) * time.Second
+	policyMutex.Lock()
+	policyEnforcers[accountId] = cachedPolicyEnforcer{enforcer: enforcer, expiresAt: time.Now().Add(ttl)}
+	policyMutex.Unlock()
+
+	return enforcer
+}
+
+func forgetPolicyEnforcer(accountId uuid.UUID) {
+	policyMutex.Lock()
+	delete(policyEnforcers, accountId)
+	policyMutex.Unlock()
+}
+
+// Drops every cached enforcer so the next check reloads its policy
+func forgetPolicyEnforcers() {
+	policyMutex.Lock()
+	policyEnforcers = map[uuid.UUID]cachedPolicyEnforcer{}
+	policyMutex.Unlock()
+}
+
+// Checks the user and then each of their roles and groups against the policy. The
+// second return is false when no policy line matched and roles should decide.
+func enforcePolicy(ctx context.Context, enforcer *casbin.SyncedEnforcer, user *User, action string, resource string, db *bun.DB) (AuthzDecision, bool) {
+	if enforcer == nil {
+		return AuthzDecision{}, false
+	}
+
+	subjects := []string{fmt.Sprintf("user:%s", user.ID)}
+	for _, role := range userRoles(ctx, user, db) {
+		if strings.HasPrefix(role.Name, "group:") {
+			subjects = append(subjects, role.Name)
+		} else {
+			subjects = append(subjects, fmt.Sprintf("role:%s", role.Name))
+		}
+	}
+
+	if resource == "" {
+		resource = "*"
+	}
+
+	for _, subject := range subjects {
+		allow, explain, err := enforcer.EnforceEx(subject, action, resource)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return AuthzDecision{}, false
+		}
+
+		if len(explain) > 0 {
+			return AuthzDecision{
+				Allow: allow,
+				Role: subject,
+				Rule: fmt.Sprintf("policy: %s", strings.Join(explain, ", ")),
+			}, true
+		}
+	}
+
+	return AuthzDecision{}, false
+}
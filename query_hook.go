@@ -0,0 +1,78 @@
+package goapi
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// Queries slower than SLOW_QUERY_MS, in total and per operation
+var (
+	slowQueries = expvar.NewInt("slow_queries")
+	slowQueriesByOperation = expvar.NewMap("slow_queries_by_operation")
+)
+
+// Logs queries slower than a threshold, with the request they ran for
+type SlowQueryHook struct {
+	Threshold time.Duration
+}
+
+var _ bun.QueryHook = (*SlowQueryHook)(nil)
+
+// ====================
+//        Setup
+// ====================
+
+// The threshold comes from SLOW_QUERY_MS, defaulting to 200ms. 0 turns logging off.
+func newSlowQueryHook() *SlowQueryHook {
+	ms, err := strconv.Atoi(os.Getenv("SLOW_QUERY_MS"))
+	if err != nil || ms < 0 {
+		ms = 200
+	}
+	return &SlowQueryHook{Threshold: time.Duration(ms) * time.Millisecond}
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func (h *SlowQueryHook) BeforeQuery(ctx context.Context, event *bun.QueryEvent) context.Context {
+	return ctx
+}
+
+func (h *SlowQueryHook) AfterQuery(ctx context.Context, event *bun.QueryEvent) {
+	if h.Threshold == 0 {
+		return
+	}
+
+	duration := time.Since(event.StartTime)
+	if duration < h.Threshold {
+		return
+	}
+
+	operation := event.Operation()
+	slowQueries.Add(1)
+	slowQueriesByOperation.Add(operation, 1)
+
+	entry := logger.Warn().
+		Dur("duration", duration).
+		Str("operation", operation).
+		Str("query", event.Query).
+		Err(event.Err)
+
+	// Only queries run with the request's context know which request they're for
+	if info := requestInfoFromContext(ctx); info != nil {
+		entry = entry.
+			Str("request_id", info.RequestId).
+			Str("method", info.Method).
+			Str("path", info.Path).
+			Str("account_id", info.AccountId).
+			Str("user_id", info.UserId)
+	}
+
+	entry.Msg("slow query")
+}
@@ -0,0 +1,545 @@
+package goapi
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/uptrace/bun"
+)
+
+// AccountQuota DB model, the requests an account has made in its current
+// billing period. Periods are a month long and begin on the day of the
+// month the account was created.
+type AccountQuota struct {
+	bun.BaseModel `bun:"table:account_quotas"`
+	AccountId uuid.UUID `bun:",pk,type:uuid"`
+	PeriodStart time.Time `bun:",notnull"`
+	PeriodEnd time.Time `bun:",notnull"` // has idx
+	Used int64 `bun:",notnull,default:0"`
+	WarnedAt time.Time `bun:",nullzero"` // when quota.warning was sent for the period
+}
+
+// An account's quota for the period, as its owners and the X-Quota-*
+// headers see it
+type QuotaStatus struct {
+	Plan string `json:",omitempty"`
+	Limit int64 // 0 for no quota
+	Used int64
+	Remaining int64
+	PeriodStart time.Time
+	PeriodEnd time.Time
+}
+
+// Putting an account on a plan, e.g. {"Plan": "pro"}. "" puts it back on
+// DEFAULT_PLAN.
+type AccountPlanInput struct {
+	Plan string
+}
+
+// Meters requests against the monthly quota of each account's plan in
+// QUOTA_PLANS. Usage is counted in memory and synced with the database
+// every QUOTA_SYNC_SECONDS, so instances between them may let an account
+// run that far past its quota.
+type QuotaService struct {
+	db *bun.DB
+	log *zerolog.Logger
+	clock func() time.Time
+}
+
+// This instance's view of an account's quota: its usage as of the last
+// sync and the requests counted here since
+type quotaState struct {
+	plan string
+	limit int64
+	used int64
+	pending int64
+	periodStart time.Time
+	periodEnd time.Time
+}
+
+// Lets one instance at a time reset periods and send warnings
+const quotaResetLockId = 7312
+
+var (
+	quotasMutex sync.Mutex
+	quotaStates = map[uuid.UUID]*quotaState{}
+)
+
+// ====================
+//        Setup
+// ====================
+
+func newQuotaService(db *bun.DB) *QuotaService {
+	return &QuotaService{db: db, log: &logger, clock: time.Now}
+}
+
+func initQuotaRoutes(api fiber.Router, db *bun.DB) {
+	// Plans are what accounts pay for, so only operators change them
+	operator := api.Group("/operator/accounts", requireOperator)
+
+	operator.Put("/:id/plan", func(c *fiber.Ctx) error {
+		return updateAccountPlan(c, db)
+	})
+}
+
+// Syncs this process's counts with the database every QUOTA_SYNC_SECONDS.
+// Every process serving requests runs it, prefork's children included.
+func startQuotaSync(db *bun.DB) {
+	go func() {
+		ticker := time.NewTicker(time.Duration(intSetting("QUOTA_SYNC_SECONDS")) * time.Second)
+		for range ticker.C {
+			syncQuotas(db)
+		}
+	}()
+}
+
+// Starts accounts' new periods as their old ones end, and warns those
+// nearing their quota, every QUOTA_SYNC_SECONDS
+func startQuotaResets(db *bun.DB) {
+	go func() {
+		ticker := time.NewTicker(time.Duration(intSetting("QUOTA_SYNC_SECONDS")) * time.Second)
+		for range ticker.C {
+			ctx := context.Background()
+			err := withAdvisoryLock(ctx, db, quotaResetLockId, func() error {
+				resetQuotaPeriods(ctx, db)
+				sendQuotaWarnings(ctx, db)
+				return nil
+			})
+			if err != nil {
+				logger.Error().Err(err).Msg("resetting quotas failed")
+			}
+		}
+	}()
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// The account's plan and how much of its quota is left this period
+func (h *accountHandlers) getQuota(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	status, err := newQuotaService(h.db).Status(ctx, currentUser.AccountId)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(status)
+}
+
+func updateAccountPlan(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+
+	input := new(AccountPlanInput)
+	if err := c.BodyParser(input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+	if input.Plan != "" && !isQuotaPlan(input.Plan) {
+		return badRequest("unknown plan").WithCode(codePlanInvalid)
+	}
+
+	accountId, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return badRequest("invalid account")
+	}
+
+	account := &Account{ID: accountId, Plan: input.Plan, UpdatedAt: time.Now()}
+	res, err := db.NewUpdate().Model(account).Column("plan", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	if count, err := res.RowsAffected(); err == nil && count == 0 {
+		return notFound("account not found").WithCode(codeAccountNotFound)
+	}
+
+	// This instance reads the new quota at once, others at their next sync
+	quotasMutex.Lock()
+	delete(quotaStates, accountId)
+	quotasMutex.Unlock()
+
+	status, err := newQuotaService(db).Status(ctx, accountId)
+	if err != nil {
+		return internalError(err)
+	}
+	return c.JSON(status)
+}
+
+// ====================
+//     Middleware
+// ====================
+
+// Counts the request against its account's quota, refusing it once the
+// quota is used up. Responses say what's left in X-Quota-Limit,
+// X-Quota-Remaining, and X-Quota-Reset, when the period ends in Unix time.
+func meterRequest(c *fiber.Ctx, quotas *QuotaService, accountId uuid.UUID) error {
+	status, err := quotas.Meter(c.UserContext(), accountId)
+	if status == nil {
+		return err
+	}
+
+	c.Set("X-Quota-Limit", strconv.FormatInt(status.Limit, 10))
+	c.Set("X-Quota-Remaining", strconv.FormatInt(status.Remaining, 10))
+	c.Set("X-Quota-Reset", strconv.FormatInt(status.PeriodEnd.Unix(), 10))
+	if err != nil {
+		seconds := int(status.PeriodEnd.Sub(quotas.clock()).Seconds()) + 1
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+	}
+	return err
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Counts a request against the account's quota, returning what's left of
+// it, or nil for an account without one. Once the quota is used up the
+// request is refused and not counted. Usage that can't be read doesn't
+// stop requests.
+func (s *QuotaService) Meter(ctx context.Context, accountId uuid.UUID) (*QuotaStatus, error) {
+	if os.Getenv("QUOTA_PLANS") == "" {
+		return nil, nil
+	}
+
+	state, err := s.state(ctx, accountId)
+	if err != nil {
+		s.log.Error().Err(err).Msg("reading the account's quota failed")
+		return nil, nil
+	}
+
+	quotasMutex.Lock()
+	defer quotasMutex.Unlock()
+
+	if state.limit == 0 {
+		return nil, nil
+	}
+	used := state.used + state.pending
+	// The period ended since the last sync, which will start the next
+	if !s.clock().Before(state.periodEnd) {
+		used = state.pending
+	}
+
+	status := state.status(used)
+	if used >= state.limit {
+		return status, tooManyRequests("monthly request quota exceeded").WithCode(codeQuotaExceeded)
+	}
+
+	state.pending++
+	return state.status(used + 1), nil
+}
+
+// The account's plan and its usage this period, as this instance counts it
+func (s *QuotaService) Status(ctx context.Context, accountId uuid.UUID) (*QuotaStatus, error) {
+	state, err := s.state(ctx, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	quotasMutex.Lock()
+	defer quotasMutex.Unlock()
+	return state.status(state.used + state.pending), nil
+}
+
+// This instance's view of the account's quota, read from the database
+// the first time the account is seen
+func (s *QuotaService) state(ctx context.Context, accountId uuid.UUID) (*quotaState, error) {
+	quotasMutex.Lock()
+	state, ok := quotaStates[accountId]
+	quotasMutex.Unlock()
+	if ok {
+		return state, nil
+	}
+
+	account := new(Account)
+	err := s.db.NewSelect().Model(account).Column("id", "created_at").Where("id = ?", accountId).Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The account's first metered request begins its quota
+	start, end := quotaPeriod(account.CreatedAt, s.clock())
+	quota := &AccountQuota{AccountId: accountId, PeriodStart: start, PeriodEnd: end}
+	q := s.db.NewInsert().Model(quota)
+	_, err = upsert(q, "account_id").Set("used = " + existingValue(q, "account_quota", "used")).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := readQuotaStates(ctx, s.db, []uuid.UUID{accountId})
+	if err != nil {
+		return nil, err
+	}
+	if states[accountId] == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	quotasMutex.Lock()
+	defer quotasMutex.Unlock()
+	// Another request may have read it first
+	if state, ok := quotaStates[accountId]; ok {
+		return state, nil
+	}
+	quotaStates[accountId] = states[accountId]
+	return states[accountId], nil
+}
+
+func (state *quotaState) status(used int64) *QuotaStatus {
+	remaining := state.limit - used
+	if remaining < 0 || state.limit == 0 {
+		remaining = 0
+	}
+	return &QuotaStatus{
+		Plan: state.plan,
+		Limit: state.limit,
+		Used: used,
+		Remaining: remaining,
+		PeriodStart: state.periodStart,
+		PeriodEnd: state.periodEnd,
+	}
+}
+
+// Adds the requests this process counted since the last sync to the
+// database, then reads back every account's usage, which takes in other
+// instances' requests, new periods, and changes of plan
+func syncQuotas(db *bun.DB) {
+	ctx := context.Background()
+
+	quotasMutex.Lock()
+	pending := map[uuid.UUID]int64{}
+	accountIds := []uuid.UUID{}
+	for accountId, state := range quotaStates {
+		if state.pending > 0 {
+			pending[accountId] = state.pending
+			state.used += state.pending
+			state.pending = 0
+		}
+		accountIds = append(accountIds, accountId)
+	}
+	quotasMutex.Unlock()
+
+	for accountId, count := range pending {
+		_, err := db.NewUpdate().Model((*AccountQuota)(nil)).
+			Set("used = used + ?", count).
+			Where("account_id = ?", accountId).
+			Exec(ctx)
+		if err != nil {
+			logger.Error().Err(err).Str("account", accountId.String()).Msg("syncing quota usage failed")
+		}
+	}
+	if len(accountIds) == 0 {
+		return
+	}
+
+	states, err := readQuotaStates(ctx, db, accountIds)
+	if err != nil {
+		logger.Error().Err(err).Msg("reading quota usage failed")
+		return
+	}
+
+	quotasMutex.Lock()
+	defer quotasMutex.Unlock()
+	for accountId, read := range states {
+		if state, ok := quotaStates[accountId]; ok {
+			// Requests counted while reading are kept for the next sync
+			read.pending = state.pending
+			*state = *read
+		}
+	}
+}
+
+// The accounts' quotas as the database has them
+func readQuotaStates(ctx context.Context, db *bun.DB, accountIds []uuid.UUID) (map[uuid.UUID]*quotaState, error) {
+	quotas := []AccountQuota{}
+	err := db.NewSelect().Model(&quotas).Where("account_id IN (?)", bun.In(accountIds)).Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := []Account{}
+	err = db.NewSelect().Model(&accounts).Column("id", "plan").Where("id IN (?)", bun.In(accountIds)).Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plans := map[uuid.UUID]string{}
+	for _, account := range accounts {
+		plans[account.ID] = account.Plan
+	}
+
+	limits := quotaPlans()
+	states := map[uuid.UUID]*quotaState{}
+	for _, quota := range quotas {
+		plan := accountPlan(plans[quota.AccountId])
+		states[quota.AccountId] = &quotaState{
+			plan: plan,
+			limit: limits[plan],
+			used: quota.Used,
+			periodStart: quota.PeriodStart,
+			periodEnd: quota.PeriodEnd,
+		}
+	}
+	return states, nil
+}
+
+// Starts a new period, with nothing used, for each account whose period
+// has ended
+func resetQuotaPeriods(ctx context.Context, db *bun.DB) {
+	now := time.Now()
+
+	ended := []AccountQuota{}
+	err := db.NewSelect().Model(&ended).Where("period_end <= ?", now).Scan(ctx)
+	if err != nil || len(ended) == 0 {
+		if err != nil {
+			logger.Error().Err(err).Msg("finding ended quota periods failed")
+		}
+		return
+	}
+
+	accountIds := []uuid.UUID{}
+	for _, quota := range ended {
+		accountIds = append(accountIds, quota.AccountId)
+	}
+	accounts := []Account{}
+	err = db.NewSelect().Model(&accounts).Column("id", "created_at").Where("id IN (?)", bun.In(accountIds)).Scan(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("finding ended quota periods failed")
+		return
+	}
+	created := map[uuid.UUID]time.Time{}
+	for _, account := range accounts {
+		created[account.ID] = account.CreatedAt
+	}
+
+	for _, quota := range ended {
+		start, end := quotaPeriod(created[quota.AccountId], now)
+		_, err := db.NewUpdate().Model((*AccountQuota)(nil)).
+			Set("used = 0").
+			Set("warned_at = NULL").
+			Set("period_start = ?", start).
+			Set("period_end = ?", end).
+			Where("account_id = ?", quota.AccountId).
+			// Left alone if it was reset in the meantime
+			Where("period_end = ?", quota.PeriodEnd).
+			Exec(ctx)
+		if err != nil {
+			logger.Error().Err(err).Str("account", quota.AccountId.String()).Msg("resetting quota failed")
+		}
+	}
+}
+
+// Records a quota.warning event, which webhooks are sent, for each account
+// that has used QUOTA_WARNING_PERCENT of its quota this period, once a
+// period
+func sendQuotaWarnings(ctx context.Context, db *bun.DB) {
+	quotas := []AccountQuota{}
+	err := db.NewSelect().Model(&quotas).
+		Where("warned_at IS NULL").
+		Where("used > 0").
+		Where("period_end > ?", time.Now()).
+		Scan(ctx)
+	if err != nil || len(quotas) == 0 {
+		if err != nil {
+			logger.Error().Err(err).Msg("finding quotas to warn failed")
+		}
+		return
+	}
+
+	accountIds := []uuid.UUID{}
+	for _, quota := range quotas {
+		accountIds = append(accountIds, quota.AccountId)
+	}
+	states, err := readQuotaStates(ctx, db, accountIds)
+	if err != nil {
+		logger.Error().Err(err).Msg("finding quotas to warn failed")
+		return
+	}
+
+	percent := int64(intSetting("QUOTA_WARNING_PERCENT"))
+	for _, quota := range quotas {
+		state := states[quota.AccountId]
+		if state == nil || state.limit == 0 || state.used*100 < state.limit*percent {
+			continue
+		}
+
+		err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			res, err := tx.NewUpdate().Model((*AccountQuota)(nil)).
+				Set("warned_at = ?", time.Now()).
+				Where("account_id = ?", quota.AccountId).
+				Where("warned_at IS NULL").
+				Exec(ctx)
+			if err != nil {
+				return err
+			}
+			if count, err := res.RowsAffected(); err != nil || count == 0 {
+				return err
+			}
+
+			return recordEvent(ctx, tx, eventQuotaWarning, quota.AccountId, uuid.Nil, map[string]interface{}{
+				"plan": state.plan,
+				"limit": state.limit,
+				"used": state.used,
+				"periodEnd": state.periodEnd,
+			})
+		})
+		if err != nil {
+			logger.Error().Err(err).Str("account", quota.AccountId.String()).Msg("sending quota warning failed")
+		}
+	}
+}
+
+// The billing period holding now, a month from the day of the month the
+// account was created
+func quotaPeriod(created time.Time, now time.Time) (time.Time, time.Time) {
+	created = created.UTC()
+	now = now.UTC()
+
+	months := (now.Year()-created.Year())*12 + int(now.Month()-created.Month())
+	start := addMonths(created, months)
+	if start.After(now) {
+		months--
+		start = addMonths(created, months)
+	}
+	return start, addMonths(created, months+1)
+}
+
+// The same day and time months later, or the month's last day for days it
+// doesn't have, so an account created on the 31st renews on April 30th
+func addMonths(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	day := t.Day()
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// Monthly requests per plan, from QUOTA_PLANS
+func quotaPlans() map[string]int64 {
+	plans := map[string]int64{}
+	if err := json.Unmarshal([]byte(os.Getenv("QUOTA_PLANS")), &plans); err != nil {
+		return map[string]int64{}
+	}
+	return plans
+}
+
+func isQuotaPlan(plan string) bool {
+	_, ok := quotaPlans()[plan]
+	return ok
+}
+
+// The plan an account is on, DEFAULT_PLAN when it hasn't been given one
+func accountPlan(plan string) string {
+	if plan == "" {
+		return os.Getenv("DEFAULT_PLAN")
+	}
+	return plan
+}
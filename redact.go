@@ -0,0 +1,90 @@
+package goapi
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// Values that are secret or personal wherever they turn up
+var redactedValuePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), // emails
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`), // JWTs
+	regexp.MustCompile(`\$2[aby]?\$\d{2}\$[./A-Za-z0-9]{53}`), // bcrypt hashes
+}
+
+// Removes secrets and personal data from text before it is written out
+type Redactor struct {
+	quotedFieldPatterns []*regexp.Regexp
+	plainFieldPatterns []*regexp.Regexp
+}
+
+// Redacts everything written through it, one write at a time
+type RedactingWriter struct {
+	Out io.Writer
+	Redactor *Redactor
+}
+
+// ====================
+//        Setup
+// ====================
+
+// Fields whose values are always redacted, extended by REDACT_FIELDS
+func redactedFields() []string {
+	fields := []string{"password", "new_password", "newpassword", "token", "token_hash", "secret", "email", "authorization"}
+	for _, field := range strings.Split(os.Getenv("REDACT_FIELDS"), ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func newRedactor() *Redactor {
+	redactor := &Redactor{}
+	for _, field := range redactedFields() {
+		name := regexp.QuoteMeta(field)
+		// "field":"value" in JSON and "field" = 'value' in SQL
+		redactor.quotedFieldPatterns = append(redactor.quotedFieldPatterns,
+			regexp.MustCompile(fmt.Sprintf(`(?i)("%s"\s*[:=]\s*)("(?:[^"\\]|\\.)*"|'(?:[^']|'')*')`, name)),
+		)
+		// field=value in console logs and query strings
+		redactor.plainFieldPatterns = append(redactor.plainFieldPatterns,
+			regexp.MustCompile(fmt.Sprintf(`(?i)(\b%s=)([^&\s"]+)`, name)),
+		)
+	}
+	return redactor
+}
+
+func newRedactingWriter(out io.Writer) *RedactingWriter {
+	return &RedactingWriter{Out: out, Redactor: newRedactor()}
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func (r *Redactor) Redact(text string) string {
+	for _, pattern := range r.quotedFieldPatterns {
+		text = pattern.ReplaceAllString(text, fmt.Sprintf(`${1}"%s"`, redacted))
+	}
+	for _, pattern := range r.plainFieldPatterns {
+		text = pattern.ReplaceAllString(text, fmt.Sprintf(`${1}%s`, redacted))
+	}
+	for _, pattern := range redactedValuePatterns {
+		text = pattern.ReplaceAllString(text, redacted)
+	}
+	return text
+}
+
+func (w *RedactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.Out.Write([]byte(w.Redactor.Redact(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,87 @@
+package goapi
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/joho/godotenv"
+)
+
+// What to re-read when the configuration is reloaded
+var (
+	reloadersMutex sync.Mutex
+	reloaders = []func(){
+		initLogger,
+		forgetFlags,
+		forgetRouteRules,
+		forgetCorsConfigs,
+		forgetAccountLocales,
+		forgetPolicyEnforcers,
+		initMailer,
+		initAccessLog,
+	}
+)
+
+// ====================
+//        Setup
+// ====================
+
+// Reloads the configuration on SIGHUP
+func startConfigReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			reloadConfig()
+		}
+	}()
+}
+
+func initReloadRoutes(api fiber.Router) {
+	api.Post("/operator/reload", requireOperator, func(c *fiber.Ctx) error {
+		if err := reloadConfig(); err != nil {
+			requestLogger(c).Error().Err(err).Send()
+			return badRequest(err.Error())
+		}
+		return c.JSON(fiber.Map{"success": true})
+	})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Registers something to re-read on reload
+func onReload(reloader func()) {
+	reloadersMutex.Lock()
+	reloaders = append(reloaders, reloader)
+	reloadersMutex.Unlock()
+}
+
+// Re-reads .env, if there is one, over the environment and refreshes the settings that can
+// change at runtime: log level and format, the access log, feature flags,
+// route rules, and email credentials. Other caches, like the authorization policies, are left alone.
+func reloadConfig() error {
+	// Deployments configured without a .env only reload what's derived from the environment
+	if err := godotenv.Overload(); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	applySecrets()
+
+	if err := loadConfig(); err != nil {
+		return err
+	}
+
+	reloadersMutex.Lock()
+	defer reloadersMutex.Unlock()
+	for _, reloader := range reloaders {
+		reloader()
+	}
+
+	logger.Info().Msg("configuration reloaded")
+	return nil
+}
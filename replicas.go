@@ -0,0 +1,181 @@
+package goapi
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// A read-only copy of the database, set in DATABASE_REPLICA_URIS, and
+// whether it last answered. Reads that can stand to be a moment behind go
+// to the replicas in turn, and to the primary when none is up.
+type replica struct {
+	db *bun.DB
+	sqldb *sql.DB
+	healthy int32
+}
+
+// How often replicas that are down are tried again
+const replicaCheckInterval = 5 * time.Second
+
+var (
+	replicasMutex sync.RWMutex
+	replicas []*replica
+	nextReplica uint32
+	startReplicaChecks sync.Once
+)
+
+// ====================
+//        Setup
+// ====================
+
+// Opens a pool for each replica, replacing any opened before. Replicas
+// that can't be reached yet are left down rather than holding up startup.
+func initReplicas() {
+	opened := []*replica{}
+	for i := range replicaURIs() {
+		index := i
+		sqldb := openPool(func() string {
+			uris := replicaURIs()
+			if index >= len(uris) {
+				return ""
+			}
+			return uris[index]
+		})
+
+		db := newBunDb(sqldb)
+		initHooks(db)
+		r := &replica{db: db, sqldb: sqldb}
+		r.check()
+		opened = append(opened, r)
+	}
+
+	replicasMutex.Lock()
+	previous := replicas
+	replicas = opened
+	replicasMutex.Unlock()
+
+	for _, r := range previous {
+		r.sqldb.Close()
+	}
+
+	startReplicaChecks.Do(func() {
+		expvar.Publish("database_replicas", expvar.Func(replicaStats))
+		go func() {
+			for range time.Tick(replicaCheckInterval) {
+				for _, r := range currentReplicas() {
+					r.check()
+				}
+			}
+		}()
+	})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Runs read against a replica, or the primary when none is up. A read
+// that fails on a replica is run again on the primary, which also covers
+// rows the replica hasn't caught up on yet.
+func onReplica(primary *bun.DB, read func(db *bun.DB) error) error {
+	r := pickReplica()
+	if r == nil {
+		return read(primary)
+	}
+
+	err := read(r.db)
+	if err == nil {
+		return nil
+	}
+	if isConnectionError(err) {
+		atomic.StoreInt32(&r.healthy, 0)
+		logger.Warn().Err(err).Msg("database replica down, reading from the primary")
+	}
+	return read(primary)
+}
+
+// The next healthy replica in turn, or nil when there's none
+func pickReplica() *replica {
+	all := currentReplicas()
+	for range all {
+		r := all[atomic.AddUint32(&nextReplica, 1)%uint32(len(all))]
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			return r
+		}
+	}
+	return nil
+}
+
+func currentReplicas() []*replica {
+	replicasMutex.RLock()
+	defer replicasMutex.RUnlock()
+	return replicas
+}
+
+// Pings the replica, marking whether it answered
+func (r *replica) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err := r.sqldb.PingContext(ctx)
+	if err == nil {
+		if atomic.SwapInt32(&r.healthy, 1) == 0 {
+			logger.Info().Msg("database replica up")
+		}
+		return
+	}
+	if atomic.SwapInt32(&r.healthy, 0) == 1 {
+		logger.Warn().Err(err).Msg("database replica down")
+	}
+}
+
+// The replicas' URIs, from the comma separated DATABASE_REPLICA_URIS
+func replicaURIs() []string {
+	uris := []string{}
+	for _, uri := range strings.Split(os.Getenv("DATABASE_REPLICA_URIS"), ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+func validateReplicaURIs(value string) error {
+	for _, uri := range strings.Split(value, ",") {
+		if err := validateDatabaseURI(strings.TrimSpace(uri)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether the error is the connection failing rather than the query
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// Each replica's health and pool, for /debug/vars
+func replicaStats() interface{} {
+	stats := []map[string]interface{}{}
+	for _, r := range currentReplicas() {
+		stats = append(stats, map[string]interface{}{
+			"healthy": atomic.LoadInt32(&r.healthy) == 1,
+			"pool": r.sqldb.Stats(),
+		})
+	}
+	return stats
+}
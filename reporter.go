@@ -0,0 +1,219 @@
+package goapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Where errors worth a human's attention are sent
+type ErrorReporter interface {
+	Report(report *ErrorReport)
+}
+
+// An error along with the request it happened in. Only ids and the route
+// pattern are kept so no personal data leaves the app.
+type ErrorReport struct {
+	Err error
+	Stack string
+	RequestId string
+	Method string
+	Route string
+	Status int
+	AccountId string
+	UserId string
+	Time time.Time
+}
+
+// Writes reports to the log, used when no DSN is configured
+type LogReporter struct{}
+
+// Sends reports to Sentry, or anything speaking its store API like GlitchTip
+type SentryReporter struct {
+	StoreURL string
+	Key string
+	Environment string
+	Release string
+	client *http.Client
+	redactor *Redactor
+}
+
+// ====================
+//        Setup
+// ====================
+
+// Reports to the Sentry-compatible SENTRY_DSN when set, or to the log otherwise
+func initReporter() ErrorReporter {
+	dsn := os.Getenv("SENTRY_DSN")
+	if dsn == "" {
+		return &LogReporter{}
+	}
+
+	reporter, err := newSentryReporter(dsn)
+	if err != nil {
+		logger.Error().Err(err).Msg("invalid SENTRY_DSN, reporting errors to the log")
+		return &LogReporter{}
+	}
+
+	return reporter
+}
+
+// Parses a DSN like https://<key>@<host>/<project>
+func newSentryReporter(dsn string) (*SentryReporter, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	project := strings.Trim(parsed.Path, "/")
+	if parsed.User == nil || parsed.User.Username() == "" || project == "" {
+		return nil, errors.New("dsn needs a key and a project")
+	}
+
+	return &SentryReporter{
+		StoreURL: fmt.Sprintf("%s://%s/api/%s/store/", parsed.Scheme, parsed.Host, project),
+		Key: parsed.User.Username(),
+		Environment: os.Getenv("SENTRY_ENVIRONMENT"),
+		Release: os.Getenv("SENTRY_RELEASE"),
+		client: &http.Client{Timeout: 5 * time.Second},
+		redactor: newRedactor(),
+	}, nil
+}
+
+// ====================
+//     Middleware
+// ====================
+
+// Recovers panics into a 500 and reports them, along with returned errors
+// and any other server error response
+func reportErrors(c *fiber.Ctx, reporter ErrorReporter) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			report := newErrorReport(c, fmt.Errorf("panic: %v", recovered))
+			report.Stack = string(debug.Stack())
+			report.Status = fiber.StatusInternalServerError
+			reporter.Report(report)
+
+			err = internalError(report.Err)
+		}
+	}()
+
+	err = c.Next()
+
+	status := responseStatus(c, err)
+	if status >= 500 {
+		reported := err
+		if reported == nil {
+			reported = fmt.Errorf("%d response", status)
+		}
+		report := newErrorReport(c, reported)
+		report.Status = status
+		reporter.Report(report)
+	}
+
+	return err
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func newErrorReport(c *fiber.Ctx, err error) *ErrorReport {
+	report := &ErrorReport{
+		Err: err,
+		RequestId: requestId(c),
+		Method: c.Method(),
+		Route: c.Route().Path,
+		Time: time.Now().UTC(),
+	}
+
+	if user, ok := c.Locals("user").(*User); ok {
+		report.AccountId = user.AccountId.String()
+		report.UserId = user.ID.String()
+	}
+
+	return report
+}
+
+func (r *LogReporter) Report(report *ErrorReport) {
+	logger.Error().
+		Err(report.Err).
+		Str("request_id", report.RequestId).
+		Str("method", report.Method).
+		Str("route", report.Route).
+		Int("status", report.Status).
+		Str("account_id", report.AccountId).
+		Str("user_id", report.UserId).
+		Str("stack", report.Stack).
+		Msg("reported error")
+}
+
+// Sends the report in the background so requests never wait on Sentry
+func (r *SentryReporter) Report(report *ErrorReport) {
+	event := fiber.Map{
+		"event_id": strings.ReplaceAll(uuid.New().String(), "-", ""),
+		"timestamp": report.Time.Format(time.RFC3339),
+		"level": "error",
+		"platform": "go",
+		"logger": "goapi",
+		"environment": r.Environment,
+		"release": r.Release,
+		"transaction": fmt.Sprintf("%s %s", report.Method, report.Route),
+		"exception": fiber.Map{
+			"values": []fiber.Map{{
+				"type": fmt.Sprintf("%T", report.Err),
+				"value": r.redactor.Redact(report.Err.Error()),
+			}},
+		},
+		"tags": fiber.Map{
+			"request_id": report.RequestId,
+			"route": report.Route,
+			"status": report.Status,
+			"account_id": report.AccountId,
+		},
+		"user": fiber.Map{"id": report.UserId},
+		"extra": fiber.Map{"stack": report.Stack},
+	}
+
+	go func() {
+		if err := r.send(event); err != nil {
+			logger.Error().Err(err).Str("request_id", report.RequestId).Msg("error reporting failed")
+		}
+	}()
+}
+
+func (r *SentryReporter) send(event fiber.Map) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.StoreURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=goapi/1.0, sentry_key=%s", r.Key))
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("sentry responded %d", res.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,305 @@
+package goapi
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// Data access for users, tokens, and accounts, behind interfaces so the
+// services in services.go can be given fakes. The bun repositories are
+// what the API runs on. Features not yet moved behind a repository still
+// query the database themselves.
+
+// Users, for the auth and account flows
+type UserRepository interface {
+	// Checks the user's username and email are free and allowed, hashes
+	// their password, and inserts them
+	Create(ctx context.Context, user *User) error
+	// The account's user, or sql.ErrNoRows. May read from a replica.
+	FindInAccount(ctx context.Context, accountId uuid.UUID, id uuid.UUID) (*User, error)
+	// The account's user with the normalized username or email, or sql.ErrNoRows
+	FindByLogin(ctx context.Context, accountId uuid.UUID, username string, email string) (*User, error)
+	// Checks a new user's username and email are free and allowed
+	CheckCredentials(ctx context.Context, user *User) error
+	// Stores a new password hash for the user
+	UpdatePassword(ctx context.Context, user *User, hash string) error
+	// Replaces the hash, unless the password changed since it was read
+	ReplacePasswordHash(ctx context.Context, userId uuid.UUID, old string, hash string) error
+	// Counts a sign in towards the user's logins, in the background
+	RecordLogin(userId uuid.UUID)
+	// Records a login attempt, in the background
+	RecordLoginAttempt(origin loginOrigin, accountId uuid.UUID, userId uuid.UUID, identifier string, success bool, reason string)
+	// Marks the user as active today, in the background
+	RecordActivity(user *User)
+}
+
+// Tokens, which are stored by digest
+type TokenRepository interface {
+	// Stores the token, in the background, so signing in needn't wait on it
+	Insert(token *Token)
+	// The token with the digest, or sql.ErrNoRows. A token just signed may
+	// not have reached a replica, so it's read from the primary when it's
+	// not found there.
+	FindByDigest(ctx context.Context, digest string) (*Token, error)
+	// Deletes the user's token with the digest and records its revocation
+	// with data and the token's id as the session, returning the id, or
+	// uuid.Nil if there was no such token
+	Revoke(ctx context.Context, user *User, digest string, data map[string]interface{}) (uuid.UUID, error)
+}
+
+// Accounts and their keys, which are stored by the hash of their secret
+type AccountRepository interface {
+	// Inserts the account with its first key and owner, all or none of
+	// them. The owner's credentials must be checked and password hashed.
+	Create(ctx context.Context, account *Account, key *Key, owner *User) error
+	// The key with the hash, or sql.ErrNoRows
+	FindKey(ctx context.Context, hash string) (*Key, error)
+	// The key bound to the client certificate's fingerprint, or sql.ErrNoRows
+	FindKeyByCertificate(ctx context.Context, fingerprint string) (*Key, error)
+	// The account's keys, oldest first
+	Keys(ctx context.Context, accountId uuid.UUID) ([]Key, error)
+	InsertKey(ctx context.Context, key *Key) error
+	CountKeys(ctx context.Context, accountId uuid.UUID) (int, error)
+	DeleteKey(ctx context.Context, accountId uuid.UUID, id string) error
+	// Binds the account's key to the client certificate's fingerprint, or
+	// unbinds it given "". sql.ErrNoRows when the account has no such key.
+	BindKey(ctx context.Context, accountId uuid.UUID, id uuid.UUID, fingerprint string) error
+}
+
+type bunUserRepository struct {
+	db *bun.DB
+}
+
+type bunTokenRepository struct {
+	db *bun.DB
+}
+
+// bunTokenRepository, storing tokens before Insert returns
+type storedTokenRepository struct {
+	bunTokenRepository
+}
+
+type bunAccountRepository struct {
+	db *bun.DB
+}
+
+var (
+	_ UserRepository = bunUserRepository{}
+	_ TokenRepository = bunTokenRepository{}
+	_ TokenRepository = storedTokenRepository{}
+	_ AccountRepository = bunAccountRepository{}
+)
+
+// ====================
+//      Utilities
+// ====================
+
+func (r bunUserRepository) Create(ctx context.Context, user *User) error {
+	_, err := user.New(ctx, r.db)
+	return err
+}
+
+func (r bunUserRepository) FindInAccount(ctx context.Context, accountId uuid.UUID, id uuid.UUID) (*User, error) {
+	user := new(User)
+	err := onReplica(r.db, func(db *bun.DB) error {
+		return db.NewSelect().Model(user).Where("id = ?", id).Where("account_id = ?", accountId).Scan(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r bunUserRepository) FindByLogin(ctx context.Context, accountId uuid.UUID, username string, email string) (*User, error) {
+	user := new(User)
+	query := r.db.NewSelect().Model(user).Where("account_id = ?", accountId)
+	if username == "" {
+		query.Where("email = ?", email)
+	} else {
+		query.Where("lower(username) = ?", username)
+	}
+	if err := query.Scan(ctx); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r bunUserRepository) CheckCredentials(ctx context.Context, user *User) error {
+	return user.checkCredentials(ctx, r.db)
+}
+
+func (r bunUserRepository) UpdatePassword(ctx context.Context, user *User, hash string) error {
+	user.Password = hash
+	_, err := r.db.NewUpdate().Model(user).Column("password", "updated_at").WherePK().Exec(ctx)
+	return err
+}
+
+func (r bunUserRepository) ReplacePasswordHash(ctx context.Context, userId uuid.UUID, old string, hash string) error {
+	_, err := r.db.NewUpdate().Model((*User)(nil)).
+		Set("password = ?", hash).
+		Where("id = ?", userId).
+		Where("password = ?", old).
+		Exec(ctx)
+	return err
+}
+
+func (r bunUserRepository) RecordLogin(userId uuid.UUID) {
+	// Track logins so admins can find dormant users
+	ctx := context.Background()
+	go r.db.NewUpdate().Model((*User)(nil)).
+		Set("last_login_at = current_timestamp").
+		Set("login_count = login_count + 1").
+		Where("id = ?", userId).
+		Exec(ctx)
+}
+
+func (r bunUserRepository) RecordLoginAttempt(origin loginOrigin, accountId uuid.UUID, userId uuid.UUID, identifier string, success bool, reason string) {
+	recordLoginAttempt(origin, r.db, accountId, userId, identifier, success, reason)
+}
+
+func (r bunUserRepository) RecordActivity(user *User) {
+	recordActivity(r.db, user)
+}
+
+func (r bunTokenRepository) Insert(token *Token) {
+	ctx := context.Background()
+	go r.db.NewInsert().Model(token).Exec(ctx)
+}
+
+func (r storedTokenRepository) Insert(token *Token) {
+	ctx := context.Background()
+	if _, err := r.db.NewInsert().Model(token).Exec(ctx); err != nil {
+		logger.Error().Err(err).Send()
+	}
+}
+
+func (r bunTokenRepository) FindByDigest(ctx context.Context, digest string) (*Token, error) {
+	token := new(Token)
+	err := onReplica(r.db, func(db *bun.DB) error {
+		return db.NewSelect().Model(token).Where("value = ?", digest).Scan(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (r bunTokenRepository) Revoke(ctx context.Context, user *User, digest string, data map[string]interface{}) (uuid.UUID, error) {
+	session := uuid.Nil
+	err := r.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		token := new(Token)
+		err := forUpdate(tx.NewSelect().Model(token).Column("id"), false).Where("value = ?", digest).Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.NewDelete().Model(token).WherePK().Exec(ctx); err != nil {
+			return err
+		}
+		session = token.ID
+
+		data["session"] = session
+		return recordEvent(ctx, tx, eventTokenRevoked, user.AccountId, user.ID, data)
+	})
+	return session, err
+}
+
+func (r bunAccountRepository) Create(ctx context.Context, account *Account, key *Key, owner *User) error {
+	err := r.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewInsert().Model(account).Exec(ctx); err != nil {
+			return err
+		}
+		if _, err := tx.NewInsert().Model(key).Exec(ctx); err != nil {
+			return err
+		}
+		_, err := owner.insertTx(ctx, tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	recordSignup(r.db, account.ID)
+	return nil
+}
+
+func (r bunAccountRepository) FindKey(ctx context.Context, hash string) (*Key, error) {
+	key := new(Key)
+	if err := r.db.NewSelect().Model(key).Where("hash = ?", hash).Scan(ctx); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (r bunAccountRepository) FindKeyByCertificate(ctx context.Context, fingerprint string) (*Key, error) {
+	key := new(Key)
+	if err := r.db.NewSelect().Model(key).Where("client_certificate = ?", fingerprint).Scan(ctx); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (r bunAccountRepository) Keys(ctx context.Context, accountId uuid.UUID) ([]Key, error) {
+	keys := []Key{}
+	err := r.db.NewSelect().Model(&keys).
+		Where("account_id = ?", accountId).
+		Order("created_at ASC").
+		Scan(ctx)
+	return keys, err
+}
+
+func (r bunAccountRepository) InsertKey(ctx context.Context, key *Key) error {
+	return r.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewInsert().Model(key).Exec(ctx); err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, eventKeyCreated, key.AccountId, uuid.Nil, map[string]interface{}{
+			"key": key.ID,
+		})
+	})
+}
+
+func (r bunAccountRepository) CountKeys(ctx context.Context, accountId uuid.UUID) (int, error) {
+	return r.db.NewSelect().Model((*Key)(nil)).Where("account_id = ?", accountId).Count(ctx)
+}
+
+func (r bunAccountRepository) DeleteKey(ctx context.Context, accountId uuid.UUID, id string) error {
+	return r.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		res, err := tx.NewDelete().Model((*Key)(nil)).
+			Where("id = ?", id).
+			Where("account_id = ?", accountId).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if count, err := res.RowsAffected(); err != nil || count == 0 {
+			return err
+		}
+		return recordEvent(ctx, tx, eventKeyRevoked, accountId, uuid.Nil, map[string]interface{}{
+			"key": id,
+		})
+	})
+}
+
+func (r bunAccountRepository) BindKey(ctx context.Context, accountId uuid.UUID, id uuid.UUID, fingerprint string) error {
+	key := &Key{ID: id, ClientCertificate: fingerprint}
+	res, err := r.db.NewUpdate().Model(key).
+		Column("client_certificate", "updated_at").
+		WherePK().
+		Where("account_id = ?", accountId).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err == nil && count == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package goapi
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/google/uuid"
+)
+
+type requestInfoKey struct{}
+
+// What queries and background work need to know about the request they're for
+type requestInfo struct {
+	RequestId string
+	Method string
+	Path string
+	AccountId string
+	UserId string
+}
+
+// Incoming ids are trusted only if they look like an id and not like an injection
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// ====================
+//     Middleware
+// ====================
+
+// Propagates the caller's X-Request-Id, or generates one, onto the request
+// and the response. errorHandler adds it to error bodies.
+func assignRequestId(c *fiber.Ctx) error {
+	id := c.Get(fiber.HeaderXRequestID)
+	if !requestIdPattern.MatchString(id) {
+		id = uuid.New().String()
+	}
+
+	c.Locals("requestId", id)
+	info := &requestInfo{
+		RequestId: id,
+		Method: c.Method(),
+		Path: utils.CopyString(c.Path()),
+	}
+	c.SetUserContext(context.WithValue(c.UserContext(), requestInfoKey{}, info))
+	c.Set(fiber.HeaderXRequestID, id)
+
+	return c.Next()
+}
+
+// Gives the request's context a deadline of REQUEST_TIMEOUT_SECONDS, or
+// none when it's 0, so the queries it runs are canceled once it's over.
+// Work that outlives the handler, like streams, uses its own context.
+func limitRequestTime(c *fiber.Ctx) error {
+	seconds := intSetting("REQUEST_TIMEOUT_SECONDS")
+	if seconds == 0 {
+		return c.Next()
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), time.Duration(seconds)*time.Second)
+	defer cancel()
+	c.SetUserContext(ctx)
+
+	return c.Next()
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// Records who the request is for once they're known, and scopes what it
+// reads to their account
+func setRequestUser(c *fiber.Ctx, user *User) {
+	c.Locals("user", user)
+	scopeRequestToAccount(c, user.AccountId)
+	if info := requestInfoFromContext(c.UserContext()); info != nil {
+		info.AccountId = user.AccountId.String()
+		info.UserId = user.ID.String()
+	}
+}
+
+func requestId(c *fiber.Ctx) string {
+	id, _ := c.Locals("requestId").(string)
+	return id
+}
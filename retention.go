@@ -0,0 +1,169 @@
+package goapi
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/uptrace/bun"
+)
+
+// Rows deleted by the purge worker, per table
+var purgedRows = expvar.NewMap("retention_purged_rows")
+
+// A table the purge worker cleans up, with the SQL finding each row's account
+type retentionTable struct {
+	Name string
+	AccountId string
+}
+
+// ====================
+//        Setup
+// ====================
+
+func retentionTables() []retentionTable {
+	return []retentionTable{
+		{Name: "tokens", AccountId: "(SELECT u.account_id FROM users AS u WHERE u.id = tokens.user_id)"},
+		{Name: "login_attempts", AccountId: "login_attempts.account_id"},
+		{Name: "audit_logs", AccountId: "audit_logs.account_id"},
+		{Name: "webhook_deliveries", AccountId: "webhook_deliveries.account_id"},
+		{Name: "emails", AccountId: "emails.account_id"},
+	}
+}
+
+// Purges expired rows every RETENTION_PURGE_INTERVAL_MINUTES (default 60)
+func startRetentionPurge(db *bun.DB) {
+	minutes, err := strconv.Atoi(os.Getenv("RETENTION_PURGE_INTERVAL_MINUTES"))
+	if err != nil || minutes <= 0 {
+		minutes = 60
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(minutes) * time.Minute)
+		for range ticker.C {
+			purgeExpiredRows(db)
+			purgeIdempotencyKeys(db)
+		}
+	}()
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func (h *accountHandlers) getRetention(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	account := new(Account)
+	err := h.db.NewSelect().Model(account).Where("id = ?", currentUser.AccountId).Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("account not found").WithCode(codeAccountNotFound)
+	}
+
+	return c.JSON(fiber.Map{
+		"defaults": defaultRetention(),
+		"account": account.Retention,
+	})
+}
+
+// Replaces the account's retention days per table. 0 keeps rows forever.
+func (h *accountHandlers) updateRetention(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := map[string]int{}
+	if err := c.BodyParser(&input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	for table, days := range input {
+		if _, ok := defaultRetention()[table]; !ok {
+			return badRequest(fmt.Sprintf("unknown table: %s", table))
+		}
+		if days < 0 {
+			return badRequest("days cannot be negative")
+		}
+	}
+
+	account := new(Account)
+	account.ID = currentUser.AccountId
+	account.Retention = input
+	account.UpdatedAt = h.clock()
+	_, err := h.db.NewUpdate().Model(account).Column("retention", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(fiber.Map{
+		"defaults": defaultRetention(),
+		"account": account.Retention,
+	})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// The deployment's retention days per table from RETENTION_<TABLE>_DAYS,
+// e.g. RETENTION_AUDIT_LOGS_DAYS. 0 keeps rows forever.
+func defaultRetention() map[string]int {
+	retention := map[string]int{}
+	for _, table := range retentionTables() {
+		days, err := strconv.Atoi(os.Getenv(fmt.Sprintf("RETENTION_%s_DAYS", strings.ToUpper(table.Name))))
+		if err != nil || days < 0 {
+			days = 0
+		}
+		retention[table.Name] = days
+	}
+	return retention
+}
+
+// Deletes rows older than their account's retention, or the deployment's
+// where the account hasn't set one, from the table and any archive of it
+func purgeExpiredRows(db *bun.DB) {
+	ctx := context.Background()
+	defaults := defaultRetention()
+
+	for _, table := range retentionTables() {
+		purgeExpiredRowsFrom(ctx, db, table, table.Name, defaults[table.Name])
+		if isArchived(table.Name) {
+			purgeExpiredRowsFrom(ctx, db, table, table.Name+"_archive", defaults[table.Name])
+		}
+	}
+}
+
+// from is the table's name or its archive's, which is given the table's
+// name as an alias so its AccountId SQL applies
+func purgeExpiredRowsFrom(ctx context.Context, db *bun.DB, table retentionTable, from string, defaultDays int) {
+	days := fmt.Sprintf(
+		"COALESCE((SELECT %s FROM accounts AS a WHERE a.id = %s), ?)",
+		jsonInt(db, "a.retention", table.Name), table.AccountId,
+	)
+
+	query := db.NewDelete().TableExpr(table.Name)
+	if from != table.Name {
+		query = db.NewDelete().TableExpr("? AS ?", bun.Ident(from), bun.Ident(table.Name))
+	}
+	res, err := query.
+		Where(fmt.Sprintf("%s > 0", days), defaultDays).
+		Where(fmt.Sprintf("%s.created_at < %s", table.Name, daysAgo(db, days)), defaultDays).
+		Exec(ctx)
+	if err != nil {
+		logger.Error().Err(err).Str("table", from).Msg("retention purge failed")
+		return
+	}
+
+	count, _ := res.RowsAffected()
+	purgedRows.Add(from, count)
+	if count > 0 {
+		logger.Info().Str("table", from).Int64("rows", count).Msg("purged expired rows")
+	}
+}
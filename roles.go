@@ -0,0 +1,511 @@
+package goapi
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// Role DB model, an account-defined role and what it's allowed to do
+type Role struct {
+	bun.BaseModel `bun:"table:roles"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Name string // has unique idx per account
+	Parent string `bun:",nullzero"` // the role this one extends
+	Permissions []string `bun:",array"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	AccountId uuid.UUID `bun:",type:uuid"`
+
+	// Other
+	BuiltIn bool `bun:"-"`
+}
+
+// Built-in roles every account has
+const (
+	roleOwner = "owner"
+	roleAdmin = "admin"
+)
+
+// Permissions
+const (
+	permissionAll = "*"
+	permissionUsersRead = "users.read"
+	permissionUsersWrite = "users.write"
+	permissionUsersInvite = "users.invite"
+	permissionUsersNotes = "users.notes"
+	permissionUsersImpersonate = "users.impersonate"
+	permissionRolesAssign = "roles.assign"
+	permissionRolesManage = "roles.manage"
+	permissionKeysManage = "keys.manage"
+	permissionAccountsManage = "accounts.manage"
+	permissionConsentsManage = "consents.manage"
+	permissionAuthzCheck = "authz.check"
+	permissionPoliciesManage = "policies.manage"
+	permissionGroupsManage = "groups.manage"
+	permissionAuditExport = "audit.export"
+	permissionMetricsRead = "metrics.read"
+	permissionWebhooksManage = "webhooks.manage"
+	permissionEventsRead = "events.read"
+	permissionEmailsManage = "emails.manage"
+)
+
+// Roles can't extend each other deeper than this, which also stops cycles
+const maxRoleDepth = 10
+
+// ====================
+//        Setup
+// ====================
+
+var _ bun.BeforeAppendModelHook = (*Role)(nil)
+func (r *Role) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+		case *bun.UpdateQuery:
+			r.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func initRoleRoutes(api fiber.Router, db *bun.DB) {
+	routes := api.Group("/roles", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	})
+
+	routes.Get("/", permit(db, permissionRolesManage), func(c *fiber.Ctx) error {
+		return getRoles(c, db)
+	})
+
+	routes.Get("/permissions", func(c *fiber.Ctx) error {
+		return c.JSON(allPermissions())
+	})
+
+	routes.Post("/", permit(db, permissionRolesManage), func(c *fiber.Ctx) error {
+		return createRole(c, db)
+	})
+
+	routes.Put("/:id", permit(db, permissionRolesManage), func(c *fiber.Ctx) error {
+		return updateRole(c, db)
+	})
+
+	routes.Delete("/:id", permit(db, permissionRolesManage), func(c *fiber.Ctx) error {
+		return deleteRole(c, db)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Lists the built-in roles followed by the account's own
+func getRoles(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	roles := []Role{}
+	err := db.NewSelect().Model(&roles).
+		Where("account_id = ?", currentUser.AccountId).
+		Order("name ASC").
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue with just the built-in roles
+	}
+
+	return c.JSON(append(builtInRoles(), roles...))
+}
+
+func createRole(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	role := new(Role)
+	if err := c.BodyParser(role); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	role.Name = normalizeRoleName(role.Name)
+	if role.Name == "" || isBuiltInRole(role.Name) {
+		return badRequest("invalid role name")
+	}
+
+	role.Parent = normalizeRoleName(role.Parent)
+	if err := validateRoleParent(ctx, role, currentUser, db); err != nil {
+		return err
+	}
+
+	role.ID = newId()
+	role.AccountId = currentUser.AccountId
+	role.Permissions = normalizePermissions(role.Permissions)
+	_, err := db.NewInsert().Model(role).Exec(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return conflict("role already exists").WithCode(codeAlreadyExists)
+	}
+
+	return created(c, apiPath(c, "/roles/"+role.ID.String()), role)
+}
+
+// Replaces a role's parent and permissions. Renaming is not supported since users reference roles by name.
+func updateRole(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(Role)
+	if err := c.BodyParser(input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	role := new(Role)
+	err := db.NewSelect().Model(role).
+		Where("id = ?", c.Params("id")).
+		Where("account_id = ?", currentUser.AccountId).
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("role not found").WithCode(codeRoleNotFound)
+	}
+
+	// Only write what was sent
+	columns := []string{"updated_at"}
+	for _, field := range sentFields(c, input) {
+		switch field {
+			case "Parent":
+				role.Parent = normalizeRoleName(input.Parent)
+				if err := validateRoleParent(ctx, role, currentUser, db); err != nil {
+					return err
+				}
+				columns = append(columns, "parent")
+			case "Permissions":
+				role.Permissions = normalizePermissions(input.Permissions)
+				columns = append(columns, "permissions")
+		}
+	}
+
+	role.UpdatedAt = time.Now()
+	_, err = db.NewUpdate().Model(role).Column(columns...).WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(role)
+}
+
+// Deletes a role that nobody is assigned to
+func deleteRole(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	role := new(Role)
+	err := db.NewSelect().Model(role).
+		Where("id = ?", c.Params("id")).
+		Where("account_id = ?", currentUser.AccountId).
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("role not found").WithCode(codeRoleNotFound)
+	}
+
+	inUse, err := db.NewSelect().Model((*User)(nil)).
+		Where("account_id = ?", currentUser.AccountId).
+		Where("role = ?", role.Name).
+		Exists(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	if inUse {
+		return conflict("role is assigned to users")
+	}
+
+	_, err = db.NewDelete().Model(role).WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// Assigns a role, or no role with "", to a user in the admin's account
+func assignUserRole(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(User)
+	if err := c.BodyParser(input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	input.Role = normalizeRoleName(input.Role)
+	if err := validateRoleAssignment(ctx, currentUser, input.Role, db); err != nil {
+		return err
+	}
+
+	if c.Params("id") == currentUser.ID.String() {
+		return badRequest("cannot change your own role")
+	}
+	if err := validateUserChange(ctx, currentUser, c.Params("id"), db); err != nil {
+		return err
+	}
+
+	user := new(User)
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := updateReturning(ctx, tx, user, func(q bun.QueryBuilder) bun.QueryBuilder {
+			return q.Where("id = ?", c.Params("id")).Where("account_id = ?", currentUser.AccountId)
+		}, func(q *bun.UpdateQuery) *bun.UpdateQuery {
+			return q.Set("role = ?", input.Role).Set("updated_at = ?", time.Now())
+		})
+		if err != nil || user.ID == uuid.Nil {
+			return err
+		}
+		return recordEvent(ctx, tx, eventUserRoleChanged, user.AccountId, user.ID, map[string]interface{}{
+			"role": user.Role,
+			"by": currentUser.ID,
+		})
+	})
+	if err != nil || user.ID == uuid.Nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("user not found").WithCode(codeUserNotFound)
+	}
+	forgetUserTokens(user.ID)
+
+	return c.JSON(render(c, user.ToAdminUser()))
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Every permission the API itself checks. Roles may also carry
+// other permissions for tenants' own use.
+func allPermissions() []string {
+	return []string{
+		permissionUsersRead,
+		permissionUsersWrite,
+		permissionUsersInvite,
+		permissionUsersNotes,
+		permissionUsersImpersonate,
+		permissionRolesAssign,
+		permissionRolesManage,
+		permissionKeysManage,
+		permissionAccountsManage,
+		permissionConsentsManage,
+		permissionAuthzCheck,
+		permissionPoliciesManage,
+		permissionGroupsManage,
+		permissionAuditExport,
+		permissionMetricsRead,
+		permissionWebhooksManage,
+		permissionEventsRead,
+		permissionEmailsManage,
+	}
+}
+
+// Roles every account has without defining them. ROLE_HIERARCHY lists them
+// lowest to highest (default "admin,owner"), each extending the one before it.
+// Only admin and owner are granted every permission.
+func builtInRoles() []Role {
+	names := parseRoleHierarchy(os.Getenv("ROLE_HIERARCHY"))
+	if validateRoleHierarchy(os.Getenv("ROLE_HIERARCHY")) != nil {
+		names = []string{roleAdmin, roleOwner}
+	}
+
+	roles := []Role{}
+	for i, name := range names {
+		role := Role{Name: name, Permissions: []string{}, BuiltIn: true}
+		if i > 0 {
+			role.Parent = names[i-1]
+		}
+		if name == roleAdmin || name == roleOwner {
+			role.Permissions = []string{permissionAll}
+		}
+		roles = append(roles, role)
+	}
+	return roles
+}
+
+func isBuiltInRole(name string) bool {
+	for _, role := range builtInRoles() {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds a built-in or account role by name
+func findRole(ctx context.Context, name string, accountId uuid.UUID, db *bun.DB) (*Role, error) {
+	for _, role := range builtInRoles() {
+		if role.Name == name {
+			return &role, nil
+		}
+	}
+
+	role := new(Role)
+	err := db.NewSelect().Model(role).
+		Where("account_id = ?", accountId).
+		Where("name = ?", name).
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return role, nil
+}
+
+// The role followed by the chain of roles it extends
+func roleAncestry(ctx context.Context, name string, accountId uuid.UUID, db *bun.DB) []Role {
+	ancestry := []Role{}
+	for name != "" && len(ancestry) < maxRoleDepth {
+		role, err := findRole(ctx, name, accountId, db)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			break
+		}
+		ancestry = append(ancestry, *role)
+		name = role.Parent
+	}
+	return ancestry
+}
+
+func userHasPermission(ctx context.Context, user *User, permission string, db *bun.DB) bool {
+	return authorize(ctx, user, permission, "", db).Allow
+}
+
+// Whether the user's role, or one they get from a group, is minRole or extends it
+func userHasRole(ctx context.Context, user *User, minRole string, db *bun.DB) bool {
+	for _, role := range userRoles(ctx, user, db) {
+		if role.Name == minRole {
+			return true
+		}
+	}
+	return false
+}
+
+func roleExtends(ctx context.Context, name string, minRole string, accountId uuid.UUID, db *bun.DB) bool {
+	for _, role := range roleAncestry(ctx, name, accountId, db) {
+		if role.Name == minRole {
+			return true
+		}
+	}
+	return false
+}
+
+// Makes sure a role's parent exists, doesn't lead back to the role,
+// and doesn't rank the role above the user defining it
+func validateRoleParent(ctx context.Context, role *Role, definer *User, db *bun.DB) error {
+	if role.Parent == "" {
+		return nil
+	}
+
+	ancestry := roleAncestry(ctx, role.Parent, definer.AccountId, db)
+	if len(ancestry) == 0 {
+		return badRequest("parent role not found").WithCode(codeRoleNotFound)
+	}
+
+	for _, ancestor := range ancestry {
+		if ancestor.Name == role.Name {
+			return badRequest("roles cannot extend themselves")
+		}
+	}
+
+	if len(ancestry) >= maxRoleDepth {
+		return badRequest("role hierarchy is too deep")
+	}
+
+	if roleExtends(ctx, role.Parent, roleOwner, definer.AccountId, db) && !userHasRole(ctx, definer, roleOwner, db) {
+		return forbidden("only owners may extend the owner role").WithCode(codeAuthForbidden)
+	}
+
+	return nil
+}
+
+// Makes sure the role exists and that the assigner may hand it out
+func validateRoleAssignment(ctx context.Context, assigner *User, role string, db *bun.DB) error {
+	if role == "" {
+		return nil
+	}
+
+	if _, err := findRole(ctx, role, assigner.AccountId, db); err != nil {
+		return badRequest("role not found").WithCode(codeRoleNotFound)
+	}
+
+	if roleExtends(ctx, role, roleOwner, assigner.AccountId, db) && !userHasRole(ctx, assigner, roleOwner, db) {
+		return forbidden("only owners may assign owner roles").WithCode(codeAuthForbidden)
+	}
+
+	return nil
+}
+
+// Makes sure the actor may change, suspend, or delete the user with the
+// id: only owners act on owners. Users that aren't found are left to the
+// caller to report, or not.
+func validateUserChange(ctx context.Context, actor *User, id string, db *bun.DB) error {
+	if id == actor.ID.String() {
+		return nil
+	}
+
+	target := new(User)
+	err := db.NewSelect().Model(target).
+		WhereAllWithDeleted().
+		Where("id = ?", id).
+		Where("account_id = ?", actor.AccountId).
+		Scan(ctx)
+	if err != nil {
+		return nil
+	}
+
+	if userHasRole(ctx, target, roleOwner, db) && !userHasRole(ctx, actor, roleOwner, db) {
+		return forbidden("only owners may change owners").WithCode(codeAuthForbidden)
+	}
+	return nil
+}
+
+// Makes sure the granter holds every permission they hand out, themselves
+// or through a broader one like "users.*"
+func validatePermissionGrant(ctx context.Context, granter *User, permissions []string, db *bun.DB) error {
+	for _, permission := range permissions {
+		action, resource := permission, "*"
+		if i := strings.Index(permission, ":"); i >= 0 {
+			action, resource = permission[:i], permission[i+1:]
+		}
+		if !authorizeByRole(ctx, granter, action, resource, db).Allow {
+			return forbidden("cannot grant permissions you don't have").WithCode(codeAuthForbidden)
+		}
+	}
+	return nil
+}
+
+// The role names in a hierarchy like "member,admin,owner", in order
+func parseRoleHierarchy(value string) []string {
+	names := []string{}
+	for _, name := range strings.Split(value, ",") {
+		if name = normalizeRoleName(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func normalizeRoleName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func normalizePermissions(permissions []string) []string {
+	normalized := []string{}
+	for _, permission := range permissions {
+		permission = strings.TrimSpace(permission)
+		if permission != "" && !stringInSlice(permission, normalized) {
+			normalized = append(normalized, permission)
+		}
+	}
+	return normalized
+}
@@ -0,0 +1,202 @@
+package goapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/uptrace/bun"
+)
+
+// Route rules are keyed by method and route path, e.g. "GET /api/v1/users/:id",
+// and hold a permission, "role:<name>" for a minimum role, or "user" to allow
+// any signed in user. Account rules win over ROUTE_PERMISSIONS, which wins over
+// the defaults passed to permit.
+const routeRuleAnyUser = "user"
+
+var (
+	routeRulesMutex sync.Mutex
+	routeRules map[string]string // nil until read
+)
+
+// ====================
+//    Route Handlers
+// ====================
+
+func (h *accountHandlers) getRoutePermissions(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	account := new(Account)
+	err := h.db.NewSelect().Model(account).Where("id = ?", currentUser.AccountId).Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("account not found").WithCode(codeAccountNotFound)
+	}
+
+	return c.JSON(fiber.Map{
+		"defaults": configuredRouteRules(),
+		"account": account.RoutePermissions,
+	})
+}
+
+// Replaces the account's route rules
+func (h *accountHandlers) updateRoutePermissions(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := map[string]string{}
+	if err := c.BodyParser(&input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	rules, err := normalizeRouteRules(input)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+
+	// Don't let an account lock itself out of its own rules
+	for key := range rules {
+		if strings.HasSuffix(key, " /api/"+apiV1+"/accounts/route-permissions") {
+			return badRequest("cannot change the rules for this route")
+		}
+	}
+
+	account := new(Account)
+	account.ID = currentUser.AccountId
+	account.RoutePermissions = rules
+	account.UpdatedAt = h.clock()
+	_, err = h.db.NewUpdate().Model(account).Column("route_permissions", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(fiber.Map{
+		"defaults": configuredRouteRules(),
+		"account": account.RoutePermissions,
+	})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// The rule for the matched route, falling back to the given permission
+func routeRule(c *fiber.Ctx, user *User, permission string, db *bun.DB) string {
+	key := routeKey(c.Method(), strings.TrimPrefix(c.Route().Path, mountPrefix))
+
+	// Rules are written against v1 paths, without the mount prefix, and
+	// apply to every version
+	key = strings.Replace(key, " /api/"+requestApiVersion(c).Name+"/", " /api/"+apiV1+"/", 1)
+
+	ctx := c.UserContext()
+	account := new(Account)
+	err := db.NewSelect().Model(account).
+		Column("route_permissions").
+		Where("id = ?", user.AccountId).
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+	if rule, ok := account.RoutePermissions[key]; ok {
+		return rule
+	}
+
+	if rule, ok := configuredRouteRules()[key]; ok {
+		return rule
+	}
+
+	return permission
+}
+
+// Whether the user satisfies a route rule
+func userSatisfiesRule(ctx context.Context, user *User, rule string, db *bun.DB) bool {
+	if rule == routeRuleAnyUser {
+		return true
+	}
+
+	if strings.HasPrefix(rule, "role:") {
+		return userHasRole(ctx, user, strings.TrimPrefix(rule, "role:"), db)
+	}
+
+	return userHasPermission(ctx, user, rule, db)
+}
+
+// Deployment rules from the ROUTE_PERMISSIONS JSON object or the file at
+// ROUTE_PERMISSIONS_FILE, read once and again after a config reload
+func configuredRouteRules() map[string]string {
+	routeRulesMutex.Lock()
+	defer routeRulesMutex.Unlock()
+
+	if routeRules == nil {
+		routeRules = readRouteRules()
+	}
+	return routeRules
+}
+
+func readRouteRules() map[string]string {
+	raw := []byte(os.Getenv("ROUTE_PERMISSIONS"))
+	if path := os.Getenv("ROUTE_PERMISSIONS_FILE"); path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			logger.Error().Err(err).Send()
+			return map[string]string{}
+		}
+		raw = contents
+	}
+	if len(raw) == 0 {
+		return map[string]string{}
+	}
+
+	input := map[string]string{}
+	if err := json.Unmarshal(raw, &input); err != nil {
+		logger.Error().Err(err).Send()
+		return map[string]string{}
+	}
+
+	rules, err := normalizeRouteRules(input)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return map[string]string{}
+	}
+	return rules
+}
+
+// Drops the deployment rules so they're read again
+func forgetRouteRules() {
+	routeRulesMutex.Lock()
+	routeRules = nil
+	routeRulesMutex.Unlock()
+}
+
+// Normalizes rule keys and checks each rule is something permit understands
+func normalizeRouteRules(input map[string]string) (map[string]string, error) {
+	rules := map[string]string{}
+	for key, rule := range input {
+		parts := strings.Fields(key)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid route %q, expected \"METHOD /path\"", key)
+		}
+
+		rule = strings.TrimSpace(rule)
+		if rule != routeRuleAnyUser && !strings.HasPrefix(rule, "role:") && !strings.HasSuffix(rule, "*") && !stringInSlice(rule, allPermissions()) {
+			return nil, fmt.Errorf("invalid rule %q for %s", rule, key)
+		}
+
+		rules[routeKey(parts[0], parts[1])] = rule
+	}
+
+	return rules, nil
+}
+
+func routeKey(method string, path string) string {
+	if len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+	}
+	return fmt.Sprintf("%s %s", strings.ToUpper(method), path)
+}
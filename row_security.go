@@ -0,0 +1,113 @@
+package goapi
+
+import (
+	"context"
+	"database/sql/driver"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+// With DATABASE_ROW_LEVEL_SECURITY=true on Postgres, each statement runs
+// with app.account_id set to the account of the request it's for, and
+// the policies on users and tokens hide every other account's rows. It's
+// a backstop for a query that's missing its account_id filter, not a
+// replacement for one. Statements outside a request, like the background
+// workers', see every row.
+type accountScopeKey struct{}
+
+// A Postgres connection that sets app.account_id to the account in each
+// statement's context before running it. SET LOCAL would only last a
+// transaction, and most reads don't run in one, so it's set for the
+// connection whenever the next statement is for another account, or for
+// none. A transaction keeps the account it began with.
+type accountScopedConn struct {
+	*pgdriver.Conn
+	accountId string
+	inTx bool
+}
+
+type accountScopedTx struct {
+	driver.Tx
+	conn *accountScopedConn
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func rowLevelSecurity() bool {
+	return databaseDialect() == dialectPostgres && os.Getenv("DATABASE_ROW_LEVEL_SECURITY") == "true"
+}
+
+// Scopes the statements the request runs to the account
+func scopeRequestToAccount(c *fiber.Ctx, accountId uuid.UUID) {
+	c.SetUserContext(context.WithValue(c.UserContext(), accountScopeKey{}, accountId.String()))
+}
+
+// The account the context's statements are scoped to, or "" for none
+func scopedAccountId(ctx context.Context) string {
+	accountId, _ := ctx.Value(accountScopeKey{}).(string)
+	return accountId
+}
+
+// Wraps a new connection so it's scoped, when row level security is on
+func scopeConnection(conn driver.Conn) driver.Conn {
+	if pgConn, ok := conn.(*pgdriver.Conn); ok && rowLevelSecurity() {
+		return &accountScopedConn{Conn: pgConn}
+	}
+	return conn
+}
+
+func (cn *accountScopedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := cn.scope(ctx); err != nil {
+		return nil, err
+	}
+	return cn.Conn.ExecContext(ctx, query, args)
+}
+
+func (cn *accountScopedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := cn.scope(ctx); err != nil {
+		return nil, err
+	}
+	return cn.Conn.QueryContext(ctx, query, args)
+}
+
+func (cn *accountScopedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := cn.scope(ctx); err != nil {
+		return nil, err
+	}
+	tx, err := cn.Conn.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	cn.inTx = true
+	return accountScopedTx{Tx: tx, conn: cn}, nil
+}
+
+// Sets app.account_id for the statement about to run, if it's changed
+func (cn *accountScopedConn) scope(ctx context.Context) error {
+	accountId := scopedAccountId(ctx)
+	if cn.inTx || accountId == cn.accountId {
+		return nil
+	}
+
+	args := []driver.NamedValue{{Ordinal: 1, Value: accountId}}
+	if _, err := cn.Conn.ExecContext(ctx, "SELECT set_config('app.account_id', $1, false)", args); err != nil {
+		return err
+	}
+	cn.accountId = accountId
+	return nil
+}
+
+func (tx accountScopedTx) Commit() error {
+	tx.conn.inTx = false
+	return tx.Tx.Commit()
+}
+
+func (tx accountScopedTx) Rollback() error {
+	tx.conn.inTx = false
+	return tx.Tx.Rollback()
+}
@@ -0,0 +1,281 @@
+package goapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Where secrets like JWT_SECRET, DATABASE_URI, and provider credentials
+// come from when they aren't kept in the environment. A secret holds any
+// number of them, named as the settings they replace.
+type SecretSource interface {
+	Fetch(ctx context.Context) (map[string]string, error)
+}
+
+// Reads a KV secret from HashiCorp Vault. Path is the secret's API path,
+// e.g. secret/data/goapi for version 2 of the engine.
+type VaultSecretSource struct {
+	Addr string
+	Token string
+	Namespace string
+	Path string
+	client *http.Client
+}
+
+// Reads a secret whose value is a JSON object from AWS Secrets Manager
+type AwsSecretSource struct {
+	Region string
+	AccessKeyId string
+	SecretAccessKey string
+	SecretId string
+	client *http.Client
+}
+
+// The secrets last fetched, applied over the environment on every reload
+var (
+	secretsMutex sync.Mutex
+	secretSource SecretSource
+	secretValues = map[string]string{}
+	previousJwtSecret string
+)
+
+// ====================
+//        Setup
+// ====================
+
+// Picks the source from SECRETS_PROVIDER ("vault" or "aws"), or none when
+// it's unset, and applies its secrets to the environment. Runs before
+// loadConfig, since the settings it checks may be among them.
+func initSecrets() error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	path := os.Getenv("SECRETS_PATH")
+
+	switch os.Getenv("SECRETS_PROVIDER") {
+		case "":
+			return nil
+		case "vault":
+			if err := requireSettings("SECRETS_PROVIDER is vault", "VAULT_ADDR", "VAULT_TOKEN", "SECRETS_PATH"); err != nil {
+				return err
+			}
+			secretSource = &VaultSecretSource{
+				Addr: strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/"),
+				Token: os.Getenv("VAULT_TOKEN"),
+				Namespace: os.Getenv("VAULT_NAMESPACE"),
+				Path: strings.Trim(path, "/"),
+				client: client,
+			}
+		case "aws":
+			if err := requireSettings("SECRETS_PROVIDER is aws", "AWS_REGION", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "SECRETS_PATH"); err != nil {
+				return err
+			}
+			secretSource = &AwsSecretSource{
+				Region: os.Getenv("AWS_REGION"),
+				AccessKeyId: os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				SecretId: path,
+				client: client,
+			}
+		default:
+			return fmt.Errorf("invalid configuration:\n  SECRETS_PROVIDER must be one of vault, aws")
+	}
+
+	_, err := refreshSecrets()
+	return err
+}
+
+// Fetches the secrets again every SECRETS_REFRESH_MINUTES and reloads the
+// configuration when they've been rotated. A failed fetch keeps the
+// secrets already in use.
+func startSecretsRefresh() {
+	if secretSource == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(intSetting("SECRETS_REFRESH_MINUTES")) * time.Minute)
+		for range ticker.C {
+			changed, err := refreshSecrets()
+			if err != nil {
+				logger.Error().Err(err).Msg("fetching secrets failed")
+				continue
+			}
+			if !changed {
+				continue
+			}
+
+			logger.Info().Msg("secrets rotated")
+			if err := reloadConfig(); err != nil {
+				logger.Error().Err(err).Send()
+			}
+		}
+	}()
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Fetches the secrets and applies them, reporting whether any changed
+func refreshSecrets() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	values, err := secretSource.Fetch(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	secretsMutex.Lock()
+	changed := len(values) != len(secretValues)
+	for name, value := range values {
+		if secretValues[name] != value {
+			changed = true
+		}
+	}
+
+	// Tokens signed before a rotation stay valid until they expire
+	if previous := secretValues["JWT_SECRET"]; previous != "" && previous != values["JWT_SECRET"] {
+		previousJwtSecret = previous
+	}
+
+	secretValues = values
+	secretsMutex.Unlock()
+
+	applySecrets()
+	return changed, nil
+}
+
+// Writes the fetched secrets over the environment, so they win over .env
+func applySecrets() {
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+
+	for name, value := range secretValues {
+		os.Setenv(name, value)
+	}
+	if previousJwtSecret != "" {
+		os.Setenv("JWT_PREVIOUS_SECRET", previousJwtSecret)
+	}
+}
+
+// Reports which of the settings are missing, which the condition requires
+func requireSettings(condition string, names ...string) error {
+	problems := []string{}
+	for _, name := range names {
+		if os.Getenv(name) == "" {
+			problems = append(problems, fmt.Sprintf("%s is required when %s", name, condition))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Reads either version of the KV engine; version 2 nests the values
+// alongside the secret's metadata
+func (s *VaultSecretSource) Fetch(ctx context.Context) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Addr+"/v1/"+s.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", s.Token)
+	if s.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.Namespace)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("vault read of %s failed with %d: %s", s.Path, res.StatusCode, message)
+	}
+
+	var body struct {
+		Data map[string]interface{}
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	return secretStrings(data)
+}
+
+func (s *AwsSecretSource) Fetch(ctx context.Context) (map[string]string, error) {
+	body, err := json.Marshal(fiber.Map{"SecretId": s.SecretId})
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("https://secretsmanager.%s.amazonaws.com/", s.Region)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{
+		"Content-Type": "application/x-amz-json-1.1",
+		"X-Amz-Target": "secretsmanager.GetSecretValue",
+	}
+	signAwsRequest(req, headers, body, s.Region, "secretsmanager", s.AccessKeyId, s.SecretAccessKey)
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("secrets manager read of %s failed with %d: %s", s.SecretId, res.StatusCode, message)
+	}
+
+	var secret struct {
+		SecretString string
+	}
+	if err := json.NewDecoder(res.Body).Decode(&secret); err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(secret.SecretString), &data); err != nil {
+		return nil, errors.New("secret is not a JSON object")
+	}
+
+	return secretStrings(data)
+}
+
+// Secrets are settings, so every value must be a string
+func secretStrings(data map[string]interface{}) (map[string]string, error) {
+	values := map[string]string{}
+	for name, value := range data {
+		text, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("secret %s is not a string", name)
+		}
+		values[name] = text
+	}
+	return values, nil
+}
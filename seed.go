@@ -0,0 +1,170 @@
+package goapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// What to seed. The same RandomSeed always makes the same users.
+type SeedOptions struct {
+	AccountName string `validate:"max=100"`
+	Users int `validate:"min=0,max=1000"`
+	Password string `validate:"omitempty,min=8,max=72"` // every seeded user's
+	RandomSeed int64
+}
+
+// What was seeded, with everything needed to start making requests
+type SeedResult struct {
+	AccountId uuid.UUID
+	Key string
+	Owner *PublicUser // with a token
+	Password string
+	Users int
+}
+
+// Seeding is refused outside development
+var errSeedNotDevelopment = errors.New("seeding is only available when APP_ENV is development")
+
+var (
+	seedFirstNames = []string{"Ada", "Alan", "Grace", "Linus", "Margaret", "Dennis", "Barbara", "Ken", "Frances", "Edsger", "Radia", "Guido"}
+	seedLastNames = []string{"Lovelace", "Turing", "Hopper", "Torvalds", "Hamilton", "Ritchie", "Liskov", "Thompson", "Allen", "Dijkstra", "Perlman", "Rossum"}
+	seedPlans = []string{"free", "pro", "team"}
+	seedCompanies = []string{"Acme", "Globex", "Initech", "Umbrella", "Hooli", "Stark"}
+)
+
+// ====================
+//        Setup
+// ====================
+
+func initSeedRoutes(api fiber.Router, db *bun.DB) {
+	api.Post("/operator/seed", requireOperator, func(c *fiber.Ctx) error {
+		return seedDemoData(c, db)
+	})
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func seedDemoData(c *fiber.Ctx, db *bun.DB) error {
+	if !isDevelopment() {
+		return notFound("route not found").WithCode(codeRouteNotFound)
+	}
+
+	input := &SeedOptions{Users: 25}
+	if len(c.Body()) > 0 {
+		if err := parseBody(c, input); err != nil {
+			return err
+		}
+	}
+
+	result, err := Seed(db, *input)
+	if err != nil {
+		return err
+	}
+
+	return created(c, "", result)
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Creates a demo account with a key, an owner, and options.Users fake
+// users with metadata, for local development and demos. Users are named
+// from RandomSeed, 1 by default, and all have the password "password"
+// unless another is given.
+func Seed(db *bun.DB, options SeedOptions) (*SeedResult, error) {
+	if !isDevelopment() {
+		return nil, errSeedNotDevelopment
+	}
+	if err := validateInput(&options); err != nil {
+		return nil, err
+	}
+	if options.AccountName == "" {
+		options.AccountName = "Demo"
+	}
+	if options.Password == "" {
+		options.Password = "password"
+	}
+	if options.RandomSeed == 0 {
+		options.RandomSeed = 1
+	}
+
+	if err := Migrate(db); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+
+	account := new(Account)
+	account.ID = newId()
+	account.Name = options.AccountName
+
+	owner := &User{Username: "owner", Email: "owner@example.com", DisplayName: "Demo Owner", Password: options.Password}
+	key, err := newAccountService(db).Create(ctx, account, owner)
+	if err != nil {
+		return nil, err
+	}
+	owner.Token, err = newAuthService(db).StartSession(owner.ID, owner.AccountId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hashing is slow on purpose, so every other user shares one hash
+	hash, err := hashPassword(options.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	random := rand.New(rand.NewSource(options.RandomSeed))
+	for i := 1; i <= options.Users; i++ {
+		first := seedFirstNames[random.Intn(len(seedFirstNames))]
+		last := seedLastNames[random.Intn(len(seedLastNames))]
+		username := strings.ToLower(fmt.Sprintf("%s.%s%d", first, last, i))
+
+		user := &User{
+			Username: username,
+			Email: username + "@example.com",
+			DisplayName: first + " " + last,
+			Metadata: map[string]interface{}{
+				"plan": seedPlans[random.Intn(len(seedPlans))],
+				"company": seedCompanies[random.Intn(len(seedCompanies))],
+				"seeded": true,
+			},
+		}
+		if err := seedUser(ctx, user, account.ID, hash, db); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SeedResult{
+		AccountId: account.ID,
+		Key: key.Secret,
+		Owner: owner.ToPublicUser(),
+		Password: options.Password,
+		Users: options.Users,
+	}, nil
+}
+
+func seedUser(ctx context.Context, user *User, accountId uuid.UUID, hash string, db *bun.DB) error {
+	user.AccountId = accountId
+	user.Password = hash
+	if err := user.checkCredentials(ctx, db); err != nil {
+		return err
+	}
+	_, err := user.insert(ctx, db)
+	return err
+}
+
+func isDevelopment() bool {
+	return os.Getenv("APP_ENV") == "development"
+}
@@ -0,0 +1,374 @@
+package goapi
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/uptrace/bun"
+)
+
+// Registering, logging in, and the tokens that sign users in. Handlers
+// parse the request and shape the response; the rules are here.
+type AuthService struct {
+	users UserRepository
+	tokens TokenRepository
+	log *zerolog.Logger
+	clock func() time.Time
+}
+
+// Accounts and the keys that identify them
+type AccountService struct {
+	accounts AccountRepository
+	users UserRepository
+	log *zerolog.Logger
+}
+
+// ====================
+//        Setup
+// ====================
+
+func newAuthService(db *bun.DB) *AuthService {
+	return &AuthService{users: bunUserRepository{db: db}, tokens: bunTokenRepository{db: db}, log: &logger, clock: time.Now}
+}
+
+func newAccountService(db *bun.DB) *AccountService {
+	return &AccountService{accounts: bunAccountRepository{db: db}, users: bunUserRepository{db: db}, log: &logger}
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Creates a user in the account from a validated registration and signs
+// them in, returning the user and their token. A token that can't be
+// made is logged and left empty rather than failing the registration.
+func (s *AuthService) Register(ctx context.Context, accountId uuid.UUID, input *RegisterInput) (*User, string, error) {
+	user := input.ToUser()
+	user.AccountId = accountId
+	if err := s.users.Create(ctx, user); err != nil {
+		return nil, "", err
+	}
+
+	token, err := s.StartSession(user.ID, user.AccountId)
+	if err != nil {
+		s.log.Error().Err(err).Send()
+	}
+
+	return user, token, nil
+}
+
+// Checks a validated login against the account's users, by username or
+// email, recording the attempt, and returns the user and a new token
+func (s *AuthService) Login(ctx context.Context, accountId uuid.UUID, input *LoginInput, origin loginOrigin) (*User, string, error) {
+	// Users may log in with either their username or their email
+	identifier := normalizeUsername(input.Username)
+	username, email := identifier, ""
+	if input.Username == "" && input.Email != "" {
+		identifier, _ = normalizeEmail(input.Email)
+		username, email = "", identifier
+	}
+
+	found, err := s.users.FindByLogin(ctx, accountId, username, email)
+	if err != nil {
+		found = new(User)
+	}
+
+	match := checkPasswordHash(input.Password, found.Password)
+	if !match || found.Password == "" {
+		s.users.RecordLoginAttempt(origin, accountId, found.ID, identifier, false, "invalid credentials")
+		return nil, "", badRequest("invalid username or password").WithCode(codeAuthInvalidCredentials)
+	}
+
+	if !found.IsActive() {
+		s.users.RecordLoginAttempt(origin, accountId, found.ID, identifier, false, "suspended")
+		return nil, "", forbidden("user suspended").WithCode(codeAuthUserSuspended)
+	}
+
+	s.users.RecordLoginAttempt(origin, accountId, found.ID, identifier, true, "")
+
+	if passwordNeedsRehash(found.Password) {
+		go s.rehashPassword(found, input.Password)
+	}
+
+	token, err := s.StartSession(found.ID, found.AccountId)
+	if err != nil {
+		origin.Log.Error().Err(err).Send()
+	}
+
+	return found, token, nil
+}
+
+// Signs a session token for the user, counting it as a login
+func (s *AuthService) StartSession(userId uuid.UUID, accountId uuid.UUID) (string, error) {
+	tokenString, err := s.SignToken(userId, accountId, uuid.Nil, sessionTtl)
+	if err != nil {
+		return "", err
+	}
+
+	s.users.RecordLogin(userId)
+	return tokenString, nil
+}
+
+// Signs a token for the user and stores its digest. actorId is set when
+// someone else is acting as the user, and uuid.Nil otherwise.
+func (s *AuthService) SignToken(userId uuid.UUID, accountId uuid.UUID, actorId uuid.UUID, ttl time.Duration) (string, error) {
+	// The id keeps tokens signed in the same second distinct, as their
+	// stored values must be
+	tokenId := newId()
+	claims := jwt.MapClaims{
+		"jti": tokenId,
+		"uid": userId,
+		"aid": accountId,
+		"iss": s.clock().Unix(),
+		"exp": s.clock().Add(ttl).Unix(),
+	}
+	if actorId != uuid.Nil {
+		claims["act"] = actorId
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	hmacSampleSecret := []byte(os.Getenv("JWT_SECRET"))
+
+	// Sign and get the complete encoded token as a string using the secret
+	tokenString, err := token.SignedString(hmacSampleSecret)
+	if err != nil {
+		return "", err
+	}
+
+	tokenRecord := new(Token)
+	tokenRecord.Value = tokenDigest(tokenString)
+	tokenRecord.ID = tokenId
+	tokenRecord.UserId = userId
+	tokenRecord.ActorId = actorId
+	s.tokens.Insert(tokenRecord)
+
+	return tokenString, nil
+}
+
+// The active user a token signs in, if it's valid and hasn't been revoked
+func (s *AuthService) Authenticate(ctx context.Context, tokenString string) (*User, error) {
+	hmacSampleSecret := []byte(os.Getenv("JWT_SECRET"))
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return hmacSampleSecret, nil
+	}
+
+	token, err := jwt.Parse(tokenString, keyFunc)
+
+	// Tokens signed before the secret was rotated are still good
+	if previous := os.Getenv("JWT_PREVIOUS_SECRET"); err != nil && previous != "" {
+		hmacSampleSecret = []byte(previous)
+		token, err = jwt.Parse(tokenString, keyFunc)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	// The token is still checked above, so an expired one isn't let in
+	value := tokenDigest(tokenString)
+	user, cached := cachedTokenUser(ctx, value)
+	if !cached {
+		tokenObj, err := s.tokens.FindByDigest(ctx, value)
+		if err != nil {
+			s.log.Error().Err(err).Send()
+			return nil, err
+		}
+
+		userId, err := uuid.Parse(fmt.Sprint(claims["uid"]))
+		if err != nil {
+			return nil, err
+		}
+		accountId, err := uuid.Parse(fmt.Sprint(claims["aid"]))
+		if err != nil {
+			return nil, err
+		}
+
+		user, err = s.users.FindInAccount(ctx, accountId, userId)
+		if err != nil {
+			return nil, err
+		}
+		user.ImpersonatorId = tokenObj.ActorId
+	}
+
+	if !user.IsActive() {
+		return nil, errors.New("user suspended")
+	}
+	if !cached {
+		cacheTokenUser(ctx, value, user)
+	}
+
+	user.Token = tokenString
+	if user.ImpersonatorId == uuid.Nil {
+		s.users.RecordActivity(user)
+	}
+	return user, nil
+}
+
+// Changes the user's password, given the one they have now
+func (s *AuthService) ChangePassword(ctx context.Context, user *User, password string, newPassword string) error {
+	if !checkPasswordHash(password, user.Password) {
+		return badRequest("invalid old password").WithCode(codeAuthInvalidPassword)
+	}
+
+	hash, _ := hashPassword(newPassword)
+	user.UpdatedAt = s.clock()
+	if err := s.users.UpdatePassword(ctx, user, hash); err != nil {
+		return internalError(err)
+	}
+	forgetUserTokens(user.ID)
+	return nil
+}
+
+// Revokes the token the user signed in with, recording why in data,
+// and returns the token's id, or uuid.Nil if it was already gone
+func (s *AuthService) Revoke(ctx context.Context, user *User, tokenString string, data map[string]interface{}) (uuid.UUID, error) {
+	digest := tokenDigest(tokenString)
+	session, err := s.tokens.Revoke(ctx, user, digest, data)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	forgetToken(digest)
+	return session, nil
+}
+
+// Replaces an imported or outdated hash now that the password is known
+func (s *AuthService) rehashPassword(user *User, password string) {
+	ctx := context.Background()
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		s.log.Error().Err(err).Send()
+		return
+	}
+
+	// Leave it alone if the password changed in the meantime
+	if err := s.users.ReplacePasswordHash(ctx, user.ID, user.Password, hash); err != nil {
+		s.log.Error().Err(err).Send()
+	}
+}
+
+// Creates an account with its first key and owner, all or none of them,
+// returning the key. The owner's credentials are checked here and their
+// password hashed.
+func (s *AccountService) Create(ctx context.Context, account *Account, owner *User) (*Key, error) {
+	owner.AccountId = account.ID
+	owner.Role = roleOwner
+	if err := s.users.CheckCredentials(ctx, owner); err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(owner.Password)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	owner.Password = hash
+
+	key := newKey(account.ID)
+	if err := s.accounts.Create(ctx, account, key, owner); err != nil {
+		return nil, userWriteError(err)
+	}
+	return key, nil
+}
+
+// The account the key's secret belongs to, from the cache when it's
+// there. Keys that aren't found aren't cached, so a new one works right
+// away. A key bound to a client certificate only works for requests made
+// with it, so certificate is the fingerprint of the request's verified
+// certificate, or "" without one.
+func (s *AccountService) AccountForKey(ctx context.Context, secret uuid.UUID, certificate string) (uuid.UUID, error) {
+	hash := hashSecret(secret.String())
+	entry, err := cachedKey(hash, func() (*Key, error) {
+		return s.accounts.FindKey(ctx, hash)
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if entry.certificate != "" && entry.certificate != certificate {
+		return uuid.Nil, errors.New("the key is bound to another client certificate")
+	}
+	return entry.accountId, nil
+}
+
+// The account of the key bound to the client certificate's fingerprint,
+// so service clients can authenticate with the certificate alone
+func (s *AccountService) AccountForCertificate(ctx context.Context, fingerprint string) (uuid.UUID, error) {
+	entry, err := cachedKey("certificate:"+fingerprint, func() (*Key, error) {
+		return s.accounts.FindKeyByCertificate(ctx, fingerprint)
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return entry.accountId, nil
+}
+
+// The account's keys, oldest first
+func (s *AccountService) Keys(ctx context.Context, accountId uuid.UUID) ([]Key, error) {
+	return s.accounts.Keys(ctx, accountId)
+}
+
+// Makes a key for the account. Its secret is only on the key returned.
+func (s *AccountService) CreateKey(ctx context.Context, accountId uuid.UUID) (*Key, error) {
+	key := newKey(accountId)
+	if err := s.accounts.InsertKey(ctx, key); err != nil {
+		return nil, internalError(err)
+	}
+	return key, nil
+}
+
+// Deletes a key, refusing to remove the account's last one
+func (s *AccountService) RevokeKey(ctx context.Context, accountId uuid.UUID, id string) error {
+	count, err := s.accounts.CountKeys(ctx, accountId)
+	if err != nil || count <= 1 {
+		if err != nil {
+			s.log.Error().Err(err).Send()
+		}
+		return conflict("cannot revoke the only key")
+	}
+
+	if err := s.accounts.DeleteKey(ctx, accountId, id); err != nil {
+		return internalError(err)
+	}
+	if keyId, err := uuid.Parse(id); err == nil {
+		forgetKey(keyId)
+	}
+	return nil
+}
+
+// Binds the account's key to the client certificate's fingerprint, after
+// which the key only works with the certificate and the certificate works
+// without the key. A fingerprint of "" unbinds it.
+func (s *AccountService) BindKey(ctx context.Context, accountId uuid.UUID, id string, fingerprint string) error {
+	keyId, err := uuid.Parse(id)
+	if err != nil {
+		return notFound("key not found").WithCode(codeKeyNotFound)
+	}
+
+	err = s.accounts.BindKey(ctx, accountId, keyId, fingerprint)
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound("key not found").WithCode(codeKeyNotFound)
+	}
+	if uniqueViolation(err) != "" {
+		return conflict("client certificate bound to another key").WithCode(codeKeyCertificateTaken)
+	}
+	if err != nil {
+		return internalError(err)
+	}
+
+	forgetKey(keyId)
+	return nil
+}
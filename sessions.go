@@ -0,0 +1,63 @@
+package goapi
+
+import (
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Browser apps can keep the session in an HttpOnly cookie instead of
+// holding the token themselves by logging in or registering with
+// ?session=cookie. The token is then left out of the response body.
+const (
+	sessionCookieName = "session"
+	sessionTtl = time.Hour * 24 * 14
+)
+
+// ====================
+//      Utilities
+// ====================
+
+func wantsSessionCookie(c *fiber.Ctx) bool {
+	return c.Query("session") == "cookie"
+}
+
+// Hands the user's token to the client, in a cookie along with a CSRF
+// token if they asked for one, otherwise in the body
+func issueSession(c *fiber.Ctx, user *User, token string) error {
+	if token == "" || !wantsSessionCookie(c) {
+		user.Token = token
+		return nil
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name: sessionCookieName,
+		Value: token,
+		Path: "/",
+		Domain: os.Getenv("COOKIE_DOMAIN"),
+		Expires: time.Now().Add(sessionTtl),
+		Secure: os.Getenv("COOKIE_SECURE") != "false",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	_, err := setCsrfCookie(c)
+	return err
+}
+
+func clearSessionCookie(c *fiber.Ctx) {
+	if c.Cookies(sessionCookieName) == "" {
+		return
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name: sessionCookieName,
+		Path: "/",
+		Domain: os.Getenv("COOKIE_DOMAIN"),
+		Expires: time.Unix(0, 0),
+		Secure: os.Getenv("COOKIE_SECURE") != "false",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
@@ -0,0 +1,178 @@
+package goapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// Pushed to live connections when access ends before a token expires.
+// A nil SessionId means every session of the user.
+type SessionNotification struct {
+	Type string // "session.revoked" or "user.suspended"
+	UserId uuid.UUID
+	SessionId uuid.UUID
+	Reason string
+	At time.Time
+}
+
+// Notification types
+const (
+	notificationSessionRevoked = "session.revoked"
+	notificationUserSuspended = "user.suspended"
+)
+
+const (
+	// How often idle connections are pinged to keep proxies from closing them
+	socketPingInterval = 30 * time.Second
+
+	// How long a ping or close frame may take to send
+	socketWriteTimeout = 10 * time.Second
+)
+
+// ====================
+//        Setup
+// ====================
+
+func initSocketRoutes(api fiber.Router, db *bun.DB) {
+	api.Get("/sessions/ws", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	}, func(c *fiber.Ctx) error {
+		return upgradeSessionSocket(c, db)
+	}, websocket.New(streamSessionNotifications))
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Pushes notifications that end the user's access as they happen. Users
+// who may read the account's users, like resource servers, are sent those
+// of every user in the account. The connection closes once its own
+// session ends.
+func streamSessionNotifications(conn *websocket.Conn) {
+	user := conn.Locals("user").(*User)
+	sessionId := conn.Locals("sessionId").(uuid.UUID)
+	watchAccount := conn.Locals("watchAccount").(bool)
+
+	events := liveEvents.subscribe(user.AccountId)
+	defer liveEvents.unsubscribe(events)
+
+	// Clients don't send anything, reading only notices them leave
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(socketPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+			case <-closed:
+				return
+
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteTimeout)); err != nil {
+					return
+				}
+
+			case event := <-events:
+				notification := newSessionNotification(event)
+				if notification == nil || (!watchAccount && notification.UserId != user.ID) {
+					continue
+				}
+				if err := conn.WriteJSON(notification); err != nil {
+					return
+				}
+
+				if notification.ends(user.ID, sessionId) {
+					message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, notification.Type)
+					conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(socketWriteTimeout))
+					return
+				}
+		}
+	}
+}
+
+// ====================
+//     Middleware
+// ====================
+
+// Checks the request can be upgraded and notes what the connection needs.
+// Browsers send the session cookie along from any site, so cookie sessions
+// may only connect from origins allowed to send credentials.
+func upgradeSessionSocket(c *fiber.Ctx, db *bun.DB) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return upgradeRequired("websocket upgrade required")
+	}
+
+	origin := c.Get(fiber.HeaderOrigin)
+	if origin != "" && c.Get(fiber.HeaderAuthorization) == "" && !requestCorsConfig(c, db).allowsCredentials(origin) {
+		return forbidden("origin not allowed")
+	}
+
+	ctx := context.Background()
+	user := c.Locals("user").(*User)
+
+	token := new(Token)
+	err := db.NewSelect().Model(token).
+		Column("id").
+		Where("value = ?", tokenDigest(getTokenStringFromHeaders(c))).
+		Scan(ctx)
+	if err != nil {
+		return unauthorized("unauthorized").WithCode(codeAuthUnauthorized)
+	}
+
+	c.Locals("sessionId", token.ID)
+	c.Locals("watchAccount", userHasPermission(ctx, user, permissionUsersRead, db))
+	return c.Next()
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// The notification an event calls for, or nil if it doesn't end anyone's
+// access
+func newSessionNotification(event *Event) *SessionNotification {
+	notification := &SessionNotification{UserId: event.UserId, At: event.CreatedAt}
+
+	switch event.Type {
+		case eventTokenRevoked:
+			notification.Type = notificationSessionRevoked
+			notification.Reason, _ = event.Data["reason"].(string)
+			if session, ok := event.Data["session"].(string); ok {
+				notification.SessionId, _ = uuid.Parse(session)
+			}
+		case eventUserDeleted:
+			notification.Type = notificationSessionRevoked
+			notification.Reason = "user deleted"
+		case eventUserErased:
+			notification.Type = notificationSessionRevoked
+			notification.Reason = "user erased"
+		case eventUserSuspended:
+			notification.Type = notificationUserSuspended
+		default:
+			return nil
+	}
+
+	return notification
+}
+
+// Whether the notification ends the given session of the user
+func (notification *SessionNotification) ends(userId uuid.UUID, sessionId uuid.UUID) bool {
+	if notification.UserId != userId {
+		return false
+	}
+	return notification.SessionId == uuid.Nil || notification.SessionId == sessionId
+}
@@ -0,0 +1,157 @@
+package goapi
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// DailySignups DB model, a running count of new users per account per day
+type DailySignups struct {
+	bun.BaseModel `bun:"table:daily_signups"`
+	AccountId uuid.UUID `bun:",pk,type:uuid"`
+	Day time.Time `bun:",pk,type:date"`
+	Count int `bun:",notnull,default:0"`
+}
+
+// UserActivity DB model, one row per user per day they used a token
+type UserActivity struct {
+	bun.BaseModel `bun:"table:user_activities"`
+	AccountId uuid.UUID `bun:",pk,type:uuid"`
+	Day time.Time `bun:",pk,type:date"`
+	UserId uuid.UUID `bun:",pk,type:uuid"`
+}
+
+// A count for a single day
+type DayCount struct {
+	Day time.Time `bun:"day"`
+	Count int `bun:"count"`
+}
+
+// Users already recorded as active today, to avoid a write per request
+var (
+	activityMutex sync.Mutex
+	activityDay time.Time
+	activitySeen = map[uuid.UUID]bool{}
+)
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Total users plus signups and active users per day over the last ?days= (default 30)
+func getUserStats(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	days, err := strconv.Atoi(c.Query("days", "30"))
+	if err != nil || days < 1 || days > 365 {
+		return badRequest("days must be between 1 and 365")
+	}
+	since := time.Now().UTC().AddDate(0, 0, -days+1).Truncate(time.Hour * 24)
+
+	total, err := db.NewSelect().Model((*User)(nil)).Where("account_id = ?", currentUser.AccountId).Count(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	signups := []DayCount{}
+	err = db.NewSelect().Model((*DailySignups)(nil)).
+		Column("day", "count").
+		Where("account_id = ?", currentUser.AccountId).
+		Where("day >= ?", since).
+		Order("day ASC").
+		Scan(ctx, &signups)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	dailyActive := []DayCount{}
+	err = db.NewSelect().Model((*UserActivity)(nil)).
+		ColumnExpr("day, count(*) AS count").
+		Where("account_id = ?", currentUser.AccountId).
+		Where("day >= ?", since).
+		Group("day").
+		Order("day ASC").
+		Scan(ctx, &dailyActive)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	activeUsers, err := db.NewSelect().Model((*UserActivity)(nil)).
+		ColumnExpr("DISTINCT user_id").
+		Where("account_id = ?", currentUser.AccountId).
+		Where("day >= ?", since).
+		Count(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	return c.JSON(fiber.Map{
+		"total": total,
+		"since": since,
+		"signups": signups,
+		"dailyActive": dailyActive,
+		"activeUsers": activeUsers,
+	})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Counts a new user towards today's signups in the background
+func recordSignup(db *bun.DB, accountId uuid.UUID) {
+	signups := new(DailySignups)
+	signups.AccountId = accountId
+	signups.Day = time.Now().UTC().Truncate(time.Hour * 24)
+	signups.Count = 1
+
+	go func() {
+		ctx := context.Background()
+		q := db.NewInsert().Model(signups)
+		_, err := upsert(q, "account_id, day").
+			Set(fmt.Sprintf("count = %s + 1", existingValue(q, "daily_signups", "count"))).
+			Exec(ctx)
+		if err != nil {
+			logger.Error().Err(err).Send()
+		}
+	}()
+}
+
+// Marks the user as active today in the background
+func recordActivity(db *bun.DB, user *User) {
+	day := time.Now().UTC().Truncate(time.Hour * 24)
+
+	activityMutex.Lock()
+	if !day.Equal(activityDay) {
+		activityDay = day
+		activitySeen = map[uuid.UUID]bool{}
+	}
+	seen := activitySeen[user.ID]
+	activitySeen[user.ID] = true
+	activityMutex.Unlock()
+
+	if seen {
+		return
+	}
+
+	activity := new(UserActivity)
+	activity.AccountId = user.AccountId
+	activity.Day = day
+	activity.UserId = user.ID
+
+	go func() {
+		ctx := context.Background()
+		_, err := db.NewInsert().Model(activity).Ignore().Exec(ctx)
+		if err != nil {
+			logger.Error().Err(err).Send()
+		}
+	}()
+}
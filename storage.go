@@ -0,0 +1,347 @@
+package goapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Where uploaded files live
+type Storage interface {
+	// Stores the data under key and returns the URL it can be fetched from
+	Put(key string, contentType string, data []byte) (string, error)
+	// The data stored under key, for files only handed out through the API
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	// The key a URL returned by Put was stored under, or "" if it isn't one
+	KeyFromURL(url string) string
+}
+
+// Storage that can link straight to a file for a while, so downloads
+// needn't pass through the API
+type presigner interface {
+	PresignedURL(key string, ttl time.Duration) (string, error)
+}
+
+// How long a presigned download link works
+const downloadLinkTtl = 5 * time.Minute
+
+// Stores files in a directory served by this app
+type LocalStorage struct {
+	Dir string
+	BaseURL string
+}
+
+// Stores files in an S3-compatible bucket
+type S3Storage struct {
+	Bucket string
+	Region string
+	Endpoint string
+	AccessKeyId string
+	SecretAccessKey string
+	BaseURL string
+}
+
+// ====================
+//        Setup
+// ====================
+
+// Picks the storage backend from STORAGE_DRIVER ("local" by default or "s3")
+func initStorage(router fiber.Router) Storage {
+	switch os.Getenv("STORAGE_DRIVER") {
+		case "s3":
+			store := &S3Storage{
+				Bucket: os.Getenv("S3_BUCKET"),
+				Region: os.Getenv("S3_REGION"),
+				Endpoint: os.Getenv("S3_ENDPOINT"),
+				AccessKeyId: os.Getenv("S3_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+				BaseURL: os.Getenv("S3_PUBLIC_URL"),
+			}
+			if store.Region == "" {
+				store.Region = "us-east-1"
+			}
+			if store.Endpoint == "" {
+				store.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", store.Region)
+			}
+			if store.BaseURL == "" {
+				store.BaseURL = fmt.Sprintf("%s/%s", store.Endpoint, store.Bucket)
+			}
+			return store
+
+		default:
+			store := &LocalStorage{
+				Dir: os.Getenv("STORAGE_LOCAL_DIR"),
+				BaseURL: mountPrefix + "/uploads",
+			}
+			if store.Dir == "" {
+				store.Dir = "./uploads"
+			}
+			// Only avatars are public. Exports are downloaded through the API.
+			router.Static("/uploads/avatars", filepath.Join(store.Dir, "avatars"))
+			return store
+	}
+}
+
+// ====================
+//     Local Disk
+// ====================
+
+func (s *LocalStorage) Put(key string, contentType string, data []byte) (string, error) {
+	if !validStorageKey(key) {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+
+	path := filepath.Join(s.Dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/%s", s.BaseURL, key), nil
+}
+
+func (s *LocalStorage) Get(key string) ([]byte, error) {
+	if !validStorageKey(key) {
+		return nil, fmt.Errorf("invalid storage key %q", key)
+	}
+	return ioutil.ReadFile(filepath.Join(s.Dir, filepath.FromSlash(key)))
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	if !validStorageKey(key) {
+		return fmt.Errorf("invalid storage key %q", key)
+	}
+	return os.Remove(filepath.Join(s.Dir, filepath.FromSlash(key)))
+}
+
+func (s *LocalStorage) KeyFromURL(url string) string {
+	return keyFromURL(s.BaseURL, url)
+}
+
+// ====================
+//         S3
+// ====================
+
+func (s *S3Storage) Put(key string, contentType string, data []byte) (string, error) {
+	headers := map[string]string{"Content-Type": contentType}
+	if _, err := s.do(http.MethodPut, key, headers, data); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/%s", s.BaseURL, key), nil
+}
+
+func (s *S3Storage) Get(key string) ([]byte, error) {
+	return s.do(http.MethodGet, key, map[string]string{}, []byte{})
+}
+
+func (s *S3Storage) Delete(key string) error {
+	_, err := s.do(http.MethodDelete, key, map[string]string{}, []byte{})
+	return err
+}
+
+// A link to GET the object that works for ttl without credentials, signed
+// with AWS Signature Version 4 in its query string
+func (s *S3Storage) PresignedURL(key string, ttl time.Duration) (string, error) {
+	if !validStorageKey(key) {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+
+	object, err := url.Parse(fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(s.Endpoint, "/"), s.Bucket, key))
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.Region)
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.AccessKeyId+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int(ttl.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	// AWS wants spaces as %20, which Encode writes as +
+	canonicalQuery := strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		object.EscapedPath(),
+		canonicalQuery,
+		"host:" + object.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	signature := hex.EncodeToString(hmacSha256(awsSigningKey(s.SecretAccessKey, date, s.Region, "s3"), stringToSign))
+
+	object.RawQuery = canonicalQuery + "&X-Amz-Signature=" + signature
+	return object.String(), nil
+}
+
+func (s *S3Storage) KeyFromURL(url string) string {
+	return keyFromURL(s.BaseURL, url)
+}
+
+// Sends a path-style request signed with AWS Signature Version 4,
+// returning the response body
+func (s *S3Storage) do(method string, key string, headers map[string]string, body []byte) ([]byte, error) {
+	if !validStorageKey(key) {
+		return nil, fmt.Errorf("invalid storage key %q", key)
+	}
+
+	url := fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(s.Endpoint, "/"), s.Bucket, key)
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	signAwsRequest(req, headers, body, s.Region, "s3", s.AccessKeyId, s.SecretAccessKey)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		return nil, fmt.Errorf("s3 %s %s failed with %d: %s", method, key, res.StatusCode, data)
+	}
+
+	return data, nil
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Sets the headers on the request and signs them along with the body
+// using AWS Signature Version 4. The request mustn't have a query string.
+func signAwsRequest(req *http.Request, headers map[string]string, body []byte, region string, service string, accessKeyId string, secretAccessKey string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	headers["Host"] = req.URL.Host
+	headers["X-Amz-Date"] = amzDate
+	headers["X-Amz-Content-Sha256"] = payloadHash
+
+	names := []string{}
+	canonicalHeaders := ""
+	for _, name := range sortedKeys(headers) {
+		lower := strings.ToLower(name)
+		names = append(names, lower)
+		canonicalHeaders += fmt.Sprintf("%s:%s\n", lower, strings.TrimSpace(headers[name]))
+		if name != "Host" {
+			req.Header.Set(name, headers[name])
+		}
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signature := hex.EncodeToString(hmacSha256(awsSigningKey(secretAccessKey, date, region, service), stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyId, scope, signedHeaders, signature,
+	))
+}
+
+// The key Signature Version 4 signs with for the day, region and service
+func awsSigningKey(secretAccessKey string, date string, region string, service string) []byte {
+	signingKey := hmacSha256([]byte("AWS4"+secretAccessKey), date)
+	signingKey = hmacSha256(signingKey, region)
+	signingKey = hmacSha256(signingKey, service)
+	return hmacSha256(signingKey, "aws4_request")
+}
+
+// Sends the private file under key as a download named filename, or
+// redirects to a short-lived link where the storage can presign one
+func sendStoredFile(c *fiber.Ctx, store Storage, key string, contentType string, filename string) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	if signer, ok := store.(presigner); ok {
+		link, err := signer.PresignedURL(key, downloadLinkTtl)
+		if err != nil {
+			return internalError(err)
+		}
+		return c.Redirect(link, fiber.StatusFound)
+	}
+
+	data, err := store.Get(key)
+	if err != nil {
+		return internalError(err)
+	}
+	c.Attachment(filename)
+	c.Set(fiber.HeaderContentType, contentType)
+	return c.Send(data)
+}
+
+func keyFromURL(baseURL string, url string) string {
+	prefix := baseURL + "/"
+	if !strings.HasPrefix(url, prefix) {
+		return ""
+	}
+	if key := strings.TrimPrefix(url, prefix); validStorageKey(key) {
+		return key
+	}
+	return ""
+}
+
+// Keys are relative slash separated paths that stay inside the storage,
+// e.g. "avatars/<id>.png" but not "../.env", "/etc/passwd" or "a//b"
+func validStorageKey(key string) bool {
+	if key == "" || strings.ContainsAny(key, "\\%?#") {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,106 @@
+package goapi
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Adds tags to a user, ignoring ones they already have
+func addUserTags(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+
+	input := new(User)
+	if err := c.BodyParser(input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	tags := []string{}
+	for _, tag := range input.Tags {
+		if tag = normalizeTag(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		return badRequest("no tags provided")
+	}
+
+	return updateUserTags(c, db, currentUser.AccountId, func(current []string) []string {
+		for _, tag := range tags {
+			if !containsString(current, tag) {
+				current = append(current, tag)
+			}
+		}
+		return current
+	})
+}
+
+func removeUserTag(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+	removed := normalizeTag(c.Params("tag"))
+	return updateUserTags(c, db, currentUser.AccountId, func(current []string) []string {
+		tags := []string{}
+		for _, tag := range current {
+			if tag != removed {
+				tags = append(tags, tag)
+			}
+		}
+		return tags
+	})
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Changes a user's tags with change, holding the user's row so concurrent
+// changes apply one after another
+func updateUserTags(c *fiber.Ctx, db *bun.DB, accountId uuid.UUID, change func([]string) []string) error {
+	ctx := c.UserContext()
+
+	user := new(User)
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := forUpdate(tx.NewSelect().Model(user), false).
+			Where("id = ?", c.Params("id")).
+			Where("account_id = ?", accountId).
+			Scan(ctx)
+		if err != nil {
+			return err
+		}
+
+		user.Tags = change(user.Tags)
+		user.UpdatedAt = time.Now()
+		_, err = tx.NewUpdate().Model(user).Column("tags", "updated_at").WherePK().Exec(ctx)
+		return err
+	})
+	if err != nil || user.ID == uuid.Nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("user not found").WithCode(codeUserNotFound)
+	}
+	forgetUserTokens(user.ID)
+
+	return c.JSON(render(c, user.ToAdminUser()))
+}
+
+// Tags are compared case-insensitively
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
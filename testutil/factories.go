@@ -0,0 +1,138 @@
+// Factories and request helpers for tests of the API and of apps mounting
+// it. Factories write straight to the database, so a test can set up the
+// accounts and users it needs without going through the routes it isn't
+// testing.
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/uptrace/bun"
+	"goapi"
+)
+
+// The password factory users are given unless overridden
+const DefaultPassword = "password123"
+
+// Builds accounts, keys, users, and tokens for a test. Everything it
+// makes has a unique name, so tests can share a database.
+type Factory struct {
+	t testing.TB
+	db *bun.DB
+	app *fiber.App
+}
+
+// An account, the secret of its first key, and its owner, signed in
+type Account struct {
+	*goapi.Account
+	Key string
+	Owner *User
+}
+
+// A user with the password they were made with and a token signing them in
+type User struct {
+	*goapi.User
+	Password string
+	Token string
+}
+
+// Makes names unique across factories
+var sequence int64
+
+// ====================
+//        Setup
+// ====================
+
+// A factory for the database, and for requests to the app the API is
+// mounted on
+func New(t testing.TB, db *bun.DB, app *fiber.App) *Factory {
+	return &Factory{t: t, db: db, app: app}
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Makes an account with a key and a signed in owner. Overrides may change
+// the account or the owner, e.g. the owner's Password, before they're made.
+func (f *Factory) Account(overrides ...func(account *goapi.Account, owner *goapi.User)) *Account {
+	f.t.Helper()
+	name := uniqueName()
+
+	account := &goapi.Account{Name: "Account " + name}
+	owner := &goapi.User{Username: name, Email: name + "@example.com", Password: DefaultPassword}
+	for _, override := range overrides {
+		override(account, owner)
+	}
+	password := owner.Password
+
+	key, err := goapi.CreateAccount(context.Background(), f.db, account, owner)
+	if err != nil {
+		f.t.Fatalf("making an account: %v", err)
+	}
+
+	return &Account{Account: account, Key: key.Secret, Owner: f.signIn(owner, password)}
+}
+
+// Makes another key for the account, returning its secret
+func (f *Factory) Key(account *Account) string {
+	f.t.Helper()
+	key, err := goapi.CreateKey(context.Background(), f.db, account.ID)
+	if err != nil {
+		f.t.Fatalf("making a key: %v", err)
+	}
+	return key.Secret
+}
+
+// Makes a signed in user in the account, with no role unless an override
+// gives them one
+func (f *Factory) User(account *Account, overrides ...func(user *goapi.User)) *User {
+	f.t.Helper()
+	name := uniqueName()
+
+	user := &goapi.User{Username: name, Email: name + "@example.com", Password: DefaultPassword}
+	for _, override := range overrides {
+		override(user)
+	}
+	user.AccountId = account.ID
+	password := user.Password
+
+	if _, err := user.New(context.Background(), f.db); err != nil {
+		f.t.Fatalf("making a user: %v", err)
+	}
+	return f.signIn(user, password)
+}
+
+// Makes a user with the admin role
+func (f *Factory) Admin(account *Account) *User {
+	f.t.Helper()
+	return f.User(account, func(user *goapi.User) {
+		user.Role = "admin"
+	})
+}
+
+// Signs the user in again, returning the new token
+func (f *Factory) Token(user *User) string {
+	f.t.Helper()
+	token, err := goapi.SignIn(f.db, user.User)
+	if err != nil {
+		f.t.Fatalf("signing a user in: %v", err)
+	}
+	return token
+}
+
+func (f *Factory) signIn(user *goapi.User, password string) *User {
+	f.t.Helper()
+	made := &User{User: user, Password: password}
+	made.Token = f.Token(made)
+	return made
+}
+
+// A username, also used for emails and names, no other factory has made
+func uniqueName() string {
+	return fmt.Sprintf("user%d", atomic.AddInt64(&sequence, 1))
+}
@@ -0,0 +1,138 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Sends requests to the app through Fiber's test client, with the same
+// headers on each
+type Client struct {
+	t testing.TB
+	app *fiber.App
+	headers map[string]string
+}
+
+// What a request got back
+type Response struct {
+	Status int
+	Body []byte
+}
+
+// ====================
+//        Setup
+// ====================
+
+// A client sending no credentials
+func (f *Factory) Client() *Client {
+	return &Client{t: f.t, app: f.app, headers: map[string]string{}}
+}
+
+// A client signed in as the user
+func (f *Factory) As(user *User) *Client {
+	return f.Client().With("Authorization", "Bearer "+user.Token)
+}
+
+// A client sending the account's key, as registering and logging in need
+func (f *Factory) WithKey(account *Account) *Client {
+	return f.Client().With("Account-Key", account.Key)
+}
+
+// A copy of the client that also sends the header
+func (c *Client) With(name string, value string) *Client {
+	headers := map[string]string{name: value}
+	for existing, value := range c.headers {
+		if _, ok := headers[existing]; !ok {
+			headers[existing] = value
+		}
+	}
+	return &Client{t: c.t, app: c.app, headers: headers}
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func (c *Client) Get(path string) *Response {
+	return c.Do("GET", path, nil)
+}
+
+func (c *Client) Post(path string, body interface{}) *Response {
+	return c.Do("POST", path, body)
+}
+
+func (c *Client) Put(path string, body interface{}) *Response {
+	return c.Do("PUT", path, body)
+}
+
+func (c *Client) Patch(path string, body interface{}) *Response {
+	return c.Do("PATCH", path, body)
+}
+
+func (c *Client) Delete(path string) *Response {
+	return c.Do("DELETE", path, nil)
+}
+
+// Sends a request with body encoded as JSON, or none if it's nil
+func (c *Client) Do(method string, path string, body interface{}) *Response {
+	c.t.Helper()
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatalf("encoding a request body: %v", err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range c.headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := c.app.Test(req, -1)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.t.Fatalf("%s %s: reading the response: %v", method, path, err)
+	}
+	return &Response{Status: res.StatusCode, Body: raw}
+}
+
+// The body as a JSON object, or an empty map if it isn't one
+func (r *Response) Object() map[string]interface{} {
+	decoded := map[string]interface{}{}
+	json.Unmarshal(r.Body, &decoded)
+	return decoded
+}
+
+// The body as a JSON array, or an empty slice if it isn't one
+func (r *Response) List() []interface{} {
+	decoded := []interface{}{}
+	json.Unmarshal(r.Body, &decoded)
+	return decoded
+}
+
+// Fails the test unless check passes within a couple of seconds, for
+// work the API finishes in the background, like deleting users
+func Eventually(t testing.TB, failure string, check func() bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if check() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(failure)
+}
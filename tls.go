@@ -0,0 +1,147 @@
+package goapi
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ====================
+//        Setup
+// ====================
+
+// Serves the app on PORT: over HTTPS with TLS_CERT_FILE and TLS_KEY_FILE,
+// or with certificates from Let's Encrypt for TLS_AUTOCERT_DOMAINS, and
+// over plain HTTP otherwise, for deployments behind a proxy that ends TLS.
+// HTTPS is served from one process, as loadConfig won't allow SERVER_PREFORK.
+func listen(app *fiber.App) error {
+	address := fmt.Sprintf(":%v", os.Getenv("PORT"))
+
+	config, err := serverTlsConfig()
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		return app.Listen(address)
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return app.Listener(tls.NewListener(listener, config))
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// The TLS settings for serving HTTPS, or nil to serve HTTP
+func serverTlsConfig() (*tls.Config, error) {
+	config, err := serverCertificates()
+	if err != nil || config == nil {
+		return config, err
+	}
+	config.MinVersion = tls.VersionTLS12
+
+	// Service clients may prove who they are with a certificate signed by
+	// TLS_CLIENT_CA_FILE, which stands in for the key it's bound to. Others
+	// go without one unless TLS_CLIENT_CERT_REQUIRED.
+	if caFile := os.Getenv("TLS_CLIENT_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS_CLIENT_CA_FILE: %w", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE has no PEM certificates")
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if os.Getenv("TLS_CLIENT_CERT_REQUIRED") == "true" {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return config, nil
+}
+
+// The certificates to serve: from TLS_CERT_FILE and TLS_KEY_FILE, or from
+// Let's Encrypt for TLS_AUTOCERT_DOMAINS, or nil for neither
+func serverCertificates() (*tls.Config, error) {
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, os.Getenv("TLS_KEY_FILE"))
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS_CERT_FILE and TLS_KEY_FILE: %w", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+
+	domains := splitList(os.Getenv("TLS_AUTOCERT_DOMAINS"))
+	if len(domains) == 0 {
+		return nil, nil
+	}
+
+	// Certificates are kept in the cache so restarts don't ask for new ones,
+	// which Let's Encrypt limits.
+	manager := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache: autocert.DirCache(os.Getenv("TLS_AUTOCERT_CACHE_DIR")),
+		Email: os.Getenv("TLS_AUTOCERT_EMAIL"),
+	}
+
+	// Answers HTTP-01 challenges and sends everyone else to HTTPS. Without
+	// it certificates are still issued, through TLS-ALPN-01 on PORT, which
+	// must then be 443.
+	if port := os.Getenv("TLS_REDIRECT_PORT"); port != "" && !fiber.IsChild() {
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf(":%v", port), manager.HTTPHandler(nil))
+			logger.Error().Err(err).Msg("serving acme challenges failed")
+		}()
+	}
+
+	return manager.TLSConfig(), nil
+}
+
+// The SHA-256 fingerprint of the client certificate the request came
+// with, in hex, or "" if it had none that TLS_CLIENT_CA_FILE verified
+func clientCertificate(c *fiber.Ctx) string {
+	state := c.Context().TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+	return certificateFingerprint(state.VerifiedChains[0][0])
+}
+
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// A fingerprint from a PEM certificate or one already taken, which may be
+// in upper case or separated by colons as tools print them
+func parseCertificateFingerprint(input string) (string, bool) {
+	if block, _ := pem.Decode([]byte(input)); block != nil {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", false
+		}
+		return certificateFingerprint(cert), true
+	}
+
+	fingerprint := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(input), ":", ""))
+	if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) != sha256.Size*2 {
+		return "", false
+	}
+	return fingerprint, true
+}
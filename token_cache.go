@@ -0,0 +1,274 @@
+package goapi
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Where signed in users are kept by their token's digest, so a request
+// needn't read its token and user from the database. Entries are dropped when the token is
+// revoked or the user changes, and expire after TOKEN_CACHE_TTL_SECONDS
+// regardless.
+type TokenCache interface {
+	// The user the token signs in, if it's cached
+	Get(ctx context.Context, token string) (*User, bool)
+	Set(ctx context.Context, token string, user *User)
+	// Drops the token, once it's revoked
+	Forget(ctx context.Context, token string)
+	// Drops every token of the user, once they've changed
+	ForgetUser(ctx context.Context, userId uuid.UUID)
+}
+
+// Caches in this process, for a single instance
+type MemoryTokenCache struct {
+	ttl time.Duration
+	mutex sync.Mutex
+	entries map[string]memoryTokenEntry
+	byUser map[uuid.UUID]map[string]bool
+}
+
+// Users are kept encoded, so nothing a request changes on its copy is cached
+type memoryTokenEntry struct {
+	userId uuid.UUID
+	user []byte
+	expiresAt time.Time
+}
+
+// Caches in Redis, shared by every instance. Each user has a set of their
+// cached tokens so they can be dropped together.
+type RedisTokenCache struct {
+	client *redis.Client
+	ttl time.Duration
+}
+
+// Lookups, by whether the cache had the token
+var tokenCacheResults = expvar.NewMap("token_cache")
+
+// Set once at startup, nil when tokens aren't cached
+var tokenCache TokenCache
+
+// ====================
+//        Setup
+// ====================
+
+// Picks the cache from TOKEN_CACHE ("memory" or "redis"), or none when
+// it's unset. Redis is reached at REDIS_URL.
+func initTokenCache() {
+	ttl := time.Duration(intSetting("TOKEN_CACHE_TTL_SECONDS")) * time.Second
+
+	switch os.Getenv("TOKEN_CACHE") {
+		case "memory":
+			tokenCache = newMemoryTokenCache(ttl)
+
+		case "redis":
+			options, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+			if err != nil {
+				logger.Fatal().Err(err).Msg("parsing REDIS_URL failed")
+			}
+			tokenCache = &RedisTokenCache{client: redis.NewClient(options), ttl: ttl}
+	}
+}
+
+func newMemoryTokenCache(ttl time.Duration) *MemoryTokenCache {
+	cache := &MemoryTokenCache{
+		ttl: ttl,
+		entries: map[string]memoryTokenEntry{},
+		byUser: map[uuid.UUID]map[string]bool{},
+	}
+
+	// Expired entries are dropped now and then rather than on every read
+	go func() {
+		for range time.Tick(ttl) {
+			cache.purgeExpired()
+		}
+	}()
+
+	return cache
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func (cache *MemoryTokenCache) Get(ctx context.Context, token string) (*User, bool) {
+	cache.mutex.Lock()
+	entry, ok := cache.entries[token]
+	cache.mutex.Unlock()
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+
+	user := new(User)
+	if err := json.Unmarshal(entry.user, user); err != nil {
+		logger.Error().Err(err).Send()
+		return nil, false
+	}
+	return user, true
+}
+
+func (cache *MemoryTokenCache) Set(ctx context.Context, token string, user *User) {
+	data, err := json.Marshal(user)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.entries[token] = memoryTokenEntry{userId: user.ID, user: data, expiresAt: time.Now().Add(cache.ttl)}
+	if cache.byUser[user.ID] == nil {
+		cache.byUser[user.ID] = map[string]bool{}
+	}
+	cache.byUser[user.ID][token] = true
+}
+
+func (cache *MemoryTokenCache) Forget(ctx context.Context, token string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.forget(token)
+}
+
+func (cache *MemoryTokenCache) ForgetUser(ctx context.Context, userId uuid.UUID) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for token := range cache.byUser[userId] {
+		cache.forget(token)
+	}
+}
+
+// Call with the mutex held
+func (cache *MemoryTokenCache) forget(token string) {
+	entry, ok := cache.entries[token]
+	if !ok {
+		return
+	}
+
+	delete(cache.entries, token)
+	delete(cache.byUser[entry.userId], token)
+	if len(cache.byUser[entry.userId]) == 0 {
+		delete(cache.byUser, entry.userId)
+	}
+}
+
+func (cache *MemoryTokenCache) purgeExpired() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	now := time.Now()
+	for token, entry := range cache.entries {
+		if now.After(entry.expiresAt) {
+			cache.forget(token)
+		}
+	}
+}
+
+// Tokens are keyed by their digest, so Redis never holds one that works
+func (cache *RedisTokenCache) Get(ctx context.Context, token string) (*User, bool) {
+	data, err := cache.client.Get(ctx, redisTokenKey(token)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			logger.Error().Err(err).Msg("reading the token cache failed")
+		}
+		return nil, false
+	}
+
+	user := new(User)
+	if err := json.Unmarshal(data, user); err != nil {
+		logger.Error().Err(err).Send()
+		return nil, false
+	}
+	return user, true
+}
+
+func (cache *RedisTokenCache) Set(ctx context.Context, token string, user *User) {
+	data, err := json.Marshal(user)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return
+	}
+
+	key := redisTokenKey(token)
+	userKey := redisUserTokensKey(user.ID)
+	_, err = cache.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, data, cache.ttl)
+		pipe.SAdd(ctx, userKey, key)
+		pipe.Expire(ctx, userKey, cache.ttl)
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("writing the token cache failed")
+	}
+}
+
+func (cache *RedisTokenCache) Forget(ctx context.Context, token string) {
+	if err := cache.client.Del(ctx, redisTokenKey(token)).Err(); err != nil {
+		logger.Error().Err(err).Msg("clearing the token cache failed")
+	}
+}
+
+func (cache *RedisTokenCache) ForgetUser(ctx context.Context, userId uuid.UUID) {
+	userKey := redisUserTokensKey(userId)
+	keys, err := cache.client.SMembers(ctx, userKey).Result()
+	if err == nil {
+		err = cache.client.Del(ctx, append(keys, userKey)...).Err()
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("clearing the token cache failed")
+	}
+}
+
+func redisTokenKey(token string) string {
+	return "goapi:token:" + token
+}
+
+func redisUserTokensKey(userId uuid.UUID) string {
+	return "goapi:user-tokens:" + userId.String()
+}
+
+// The cached user for the token, counting whether it was there
+func cachedTokenUser(ctx context.Context, token string) (*User, bool) {
+	if tokenCache == nil {
+		return nil, false
+	}
+
+	user, ok := tokenCache.Get(ctx, token)
+	if ok {
+		tokenCacheResults.Add("hits", 1)
+	} else {
+		tokenCacheResults.Add("misses", 1)
+	}
+	return user, ok
+}
+
+func cacheTokenUser(ctx context.Context, token string, user *User) {
+	if tokenCache != nil {
+		tokenCache.Set(ctx, token, user)
+	}
+}
+
+// Drops a revoked token from the cache
+func forgetToken(token string) {
+	if tokenCache != nil {
+		tokenCache.Forget(context.Background(), token)
+	}
+}
+
+// Drops a changed user's tokens from the cache, so their next request
+// reads them again
+func forgetUserTokens(userIds ...uuid.UUID) {
+	if tokenCache == nil {
+		return
+	}
+	for _, userId := range userIds {
+		tokenCache.ForgetUser(context.Background(), userId)
+	}
+}
@@ -1,27 +1,42 @@
-package main
+package goapi
 
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+	"github.com/rs/zerolog"
 	"github.com/uptrace/bun"
 )
 
 // User DB model
 type User struct {
 	bun.BaseModel `bun:"table:users"`
-	ID uuid.UUID `bun:",pk,type:uuid,default:gen_random_uuid()"`
-	Username string // has idx
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Username string // has idx, stored lowercased
+	Email string `bun:",nullzero"` // has unique idx per account
+	DisplayName string
+	AvatarURL string
 	Password string
 	Role string
+	Status string `bun:",nullzero,notnull,default:'active'"`
 	Metadata map[string]interface{} `bun:"type:jsonb"`
+	LastLoginAt time.Time `bun:",nullzero"`
+	LoginCount int `bun:",notnull,default:0"`
+	Tags []string `bun:",array"` // has idx
+	IsAnonymous bool `bun:",notnull,default:false"`
 	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	DeletedAt time.Time `bun:",soft_delete,nullzero"`
 
 	// Relationships
 	AccountId uuid.UUID `bun:",type:uuid"` // has idx
@@ -30,29 +45,78 @@ type User struct {
 
 	// Other
 	Token string `bun:"-"`
+	ImpersonatorId uuid.UUID `bun:"-"`
 	NewPassword string `bun:"-"`
 }
 
+// User statuses
+const (
+	userStatusActive = "active"
+	userStatusSuspended = "suspended"
+)
+
+// Fields an admin creates a user with
+type CreateUserInput struct {
+	RegisterInput
+	Role string `validate:"max=64"`
+}
+
+// Fields an admin may change on a user. Only the fields sent are
+// written, and an empty password is left as it is.
+type UpdateUserInput struct {
+	Username string `validate:"omitempty,min=3,max=32"`
+	Email string `validate:"omitempty,email,max=254"`
+	Password string `validate:"omitempty,min=8,max=72"`
+	DisplayName string `validate:"max=100"`
+	Role string `validate:"max=64"`
+	Metadata map[string]interface{}
+}
+
+// What user lists can be narrowed by
+type userFilter struct {
+	Role string
+	Status string
+	Group string
+}
+
 // Client-facing User model
 type PublicUser struct {
 	ID uuid.UUID
 	Token string
 	Username string
+	Email string
+	DisplayName string
+	AvatarURL string
 	Role string
+	Status string
+	IsAnonymous bool
 	Metadata map[string]interface{}
 	CreatedAt time.Time
 	UpdatedAt time.Time
+
+	// Only populated for admins
+	LastLoginAt *time.Time `json:",omitempty"`
+	LoginCount int `json:",omitempty"`
+	Tags []string `json:",omitempty"`
+
+	// Only populated on single-user reads
+	TokenCount int `json:",omitempty"`
+
+	// Only populated for the user themselves
+	PendingConsents []string `json:",omitempty"`
+
+	// Only populated when asked for with ?include=
+	Account *PublicAccount `json:",omitempty"`
+	Tokens []PublicToken `json:",omitempty"`
 }
 
+// The relations user reads can ?include=
+var userIncludes = map[string]string{"account": "Account", "tokens": "Tokens"}
+
 // ====================
 //        Setup
 // ====================
 
-func initUserTable(db *bun.DB) {
-	ctx := context.Background()
-	db.NewCreateTable().IfNotExists().Model((*User)(nil)).Exec(ctx)
-}
-
 var _ bun.BeforeAppendModelHook = (*User)(nil)
 func (u *User) BeforeAppendModel(ctx context.Context, query bun.Query) error {
 	switch query.(type) {
@@ -62,57 +126,170 @@ func (u *User) BeforeAppendModel(ctx context.Context, query bun.Query) error {
 	return nil
 }
 
-var _ bun.AfterCreateTableHook = (*User)(nil)
-func (*User) AfterCreateTable(ctx context.Context, query *bun.CreateTableQuery) error {
-	_, err := query.DB().NewCreateIndex().
-		Model((*User)(nil)).
-		Index("username_idx").
-		IfNotExists().
-		Column("username").
-		Exec(ctx)
+func initUserRoutes(api fiber.Router, db *bun.DB, store Storage) {
+	api.Patch("/users", func(c *fiber.Ctx) error {
+		return updateUserMetadata(c, db)
+	})
 
-	if err != nil {
-		return err
-	}
+	routes := api.Group("/users", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	})
 
-	_, err = query.DB().NewCreateIndex().
-		Model((*User)(nil)).
-		Index("account_id_idx").
-		IfNotExists().
-		Column("account_id").
-		Exec(ctx)
+	routes.Get("/", permit(db, permissionUsersRead), func(c *fiber.Ctx) error {
+		return getUsers(c, db)
+	})
 
-	return err
-}
+	routes.Post("/", permit(db, permissionUsersWrite), idempotent(db), func(c *fiber.Ctx) error {
+		return createUser(c, db)
+	})
 
-func initUserRoutes(app *fiber.App, db *bun.DB) {
-	app.Patch("/api/v1/users", func(c *fiber.Ctx) error {
-		return updateUserMetadata(c, db)
+	routes.Post("/bulk", permit(db, permissionUsersWrite), func(c *fiber.Ctx) error {
+		return bulkUpdateUsers(c, db)
 	})
 
-	routes := app.Group("/api/v1/users", func(c *fiber.Ctx) error {
-		return requireAdmin(c, db)
+	routes.Post("/import", permit(db, permissionUsersWrite), idempotent(db), func(c *fiber.Ctx) error {
+		return importUsers(c, db)
 	})
 
-	routes.Get("/", func(c *fiber.Ctx) error {
-		return getUsers(c, db)
+	routes.Get("/export", permit(db, permissionUsersRead), func(c *fiber.Ctx) error {
+		return exportUsers(c, db)
 	})
 
-	routes.Post("/", func(c *fiber.Ctx) error {
-		return createUser(c, db)
+	routes.Get("/stats", permit(db, permissionUsersRead), func(c *fiber.Ctx) error {
+		return getUserStats(c, db)
+	})
+
+	routes.Get("/search", permit(db, permissionUsersRead), func(c *fiber.Ctx) error {
+		return searchUsers(c, db)
+	})
+
+	routes.Post("/invite", permit(db, permissionUsersInvite), idempotent(db), func(c *fiber.Ctx) error {
+		return createInvite(c, db)
+	})
+
+	routes.Get("/invites", permit(db, permissionUsersInvite), func(c *fiber.Ctx) error {
+		return getInvites(c, db)
+	})
+
+	routes.Get("/invites/:inviteId", permit(db, permissionUsersInvite), func(c *fiber.Ctx) error {
+		return getInvite(c, db)
+	})
+
+	routes.Post("/invites/:inviteId/resend", permit(db, permissionUsersInvite), func(c *fiber.Ctx) error {
+		return resendInvite(c, db)
 	})
 
-	routes.Get("/:id", func(c *fiber.Ctx) error {
+	routes.Delete("/invites/:inviteId", permit(db, permissionUsersInvite), func(c *fiber.Ctx) error {
+		return revokeInvite(c, db)
+	})
+
+	routes.Post("/invite-links", permit(db, permissionUsersInvite), idempotent(db), func(c *fiber.Ctx) error {
+		return createInviteLink(c, db)
+	})
+
+	routes.Get("/invite-links", permit(db, permissionUsersInvite), func(c *fiber.Ctx) error {
+		return getInviteLinks(c, db)
+	})
+
+	routes.Delete("/invite-links/:linkId", permit(db, permissionUsersInvite), func(c *fiber.Ctx) error {
+		return revokeInviteLink(c, db)
+	})
+
+	routes.Get("/:id", permit(db, permissionUsersRead), func(c *fiber.Ctx) error {
 		return getUser(c, db)
 	})
 
-	routes.Put("/:id", func(c *fiber.Ctx) error {
+	routes.Put("/:id", permit(db, permissionUsersWrite), func(c *fiber.Ctx) error {
 		return updateUser(c, db)
 	})
 
-	routes.Delete("/:id", func(c *fiber.Ctx) error {
+	routes.Patch("/:id", permit(db, permissionUsersWrite), func(c *fiber.Ctx) error {
+		return patchUser(c, db)
+	})
+
+	routes.Delete("/:id", permit(db, permissionUsersWrite), func(c *fiber.Ctx) error {
 		return deleteUser(c, db)
 	})
+
+	routes.Post("/:id/restore", permit(db, permissionUsersWrite), func(c *fiber.Ctx) error {
+		return restoreUser(c, db)
+	})
+
+	routes.Get("/:id/logins", permit(db, permissionUsersRead), func(c *fiber.Ctx) error {
+		return getUserLogins(c, db)
+	})
+
+	routes.Get("/:id/export", permit(db, permissionUsersRead), func(c *fiber.Ctx) error {
+		return getUserDataExport(c, db)
+	})
+
+	routes.Post("/:id/export", permit(db, permissionUsersRead), func(c *fiber.Ctx) error {
+		return createUserDataExport(c, db, store)
+	})
+
+	routes.Get("/:id/export/download", permit(db, permissionUsersRead), func(c *fiber.Ctx) error {
+		return downloadUserDataExport(c, db, store)
+	})
+
+	routes.Get("/:id/erasure", permit(db, permissionUsersRead), func(c *fiber.Ctx) error {
+		return getUserErasure(c, db)
+	})
+
+	routes.Post("/:id/erasure", permit(db, permissionUsersWrite), func(c *fiber.Ctx) error {
+		return requestUserErasure(c, db)
+	})
+
+	routes.Delete("/:id/erasure", permit(db, permissionUsersWrite), func(c *fiber.Ctx) error {
+		return cancelUserErasure(c, db)
+	})
+
+	routes.Post("/:id/tags", permit(db, permissionUsersWrite), func(c *fiber.Ctx) error {
+		return addUserTags(c, db)
+	})
+
+	routes.Delete("/:id/tags/:tag", permit(db, permissionUsersWrite), func(c *fiber.Ctx) error {
+		return removeUserTag(c, db)
+	})
+
+	routes.Get("/:id/notes", permit(db, permissionUsersNotes), func(c *fiber.Ctx) error {
+		return getUserNotes(c, db)
+	})
+
+	routes.Post("/:id/notes", permit(db, permissionUsersNotes), func(c *fiber.Ctx) error {
+		return createUserNote(c, db)
+	})
+
+	routes.Put("/:id/notes/:noteId", permit(db, permissionUsersNotes), func(c *fiber.Ctx) error {
+		return updateUserNote(c, db)
+	})
+
+	routes.Delete("/:id/notes/:noteId", permit(db, permissionUsersNotes), func(c *fiber.Ctx) error {
+		return deleteUserNote(c, db)
+	})
+
+	routes.Post("/:id/impersonate", permit(db, permissionUsersImpersonate), func(c *fiber.Ctx) error {
+		return impersonateUser(c, db)
+	})
+
+	routes.Put("/:id/role", permit(db, permissionRolesAssign), func(c *fiber.Ctx) error {
+		return assignUserRole(c, db)
+	})
+
+	routes.Put("/:id/username", permit(db, permissionUsersWrite), func(c *fiber.Ctx) error {
+		return changeUsername(c, db)
+	})
+
+	routes.Get("/:id/usernames", permit(db, permissionUsersRead), func(c *fiber.Ctx) error {
+		return getUsernameHistory(c, db)
+	})
+
+	routes.Post("/:id/suspend", permit(db, permissionUsersWrite), func(c *fiber.Ctx) error {
+		return setUserStatus(c, db, userStatusSuspended)
+	})
+
+	routes.Post("/:id/unsuspend", permit(db, permissionUsersWrite), func(c *fiber.Ctx) error {
+		return setUserStatus(c, db, userStatusActive)
+	})
 }
 
 // ====================
@@ -120,138 +297,747 @@ func initUserRoutes(app *fiber.App, db *bun.DB) {
 // ====================
 
 func getUsers(c *fiber.Ctx, db *bun.DB) error {
-	ctx := context.Background()
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+	include, err := includeRelations(c, userIncludes)
+	if err != nil {
+		return err
+	}
+
 	users := []User{}
-	err := db.NewSelect().Model(&users).Scan(ctx)
+	err = onReplica(db, func(db *bun.DB) error {
+		return filterUsers(c, db.NewSelect().Model(&users), currentUser.AccountId).Apply(include).Scan(ctx)
+	})
 	if err != nil {
-		fmt.Println(err)
+		requestLogger(c).Error().Err(err).Send()
 		// Continue and simply return an empty array
 	}
 
 	publicUsers := []PublicUser{}
 	for _, user := range users {
-		publicUsers = append(publicUsers, *user.ToPublicUser())
+		publicUsers = append(publicUsers, *user.ToAdminUser())
+	}
+
+	body, err := sparseFields(c, render(c, publicUsers))
+	if err != nil {
+		return err
 	}
 
-	return c.JSON(publicUsers)
+	return c.JSON(body)
+}
+
+// Searches the admin's account for users by username, email, and selected metadata fields
+func searchUsers(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	term := strings.TrimSpace(c.Query("q"))
+	if term == "" {
+		return badRequest("no search term provided")
+	}
+	pattern := containsPattern(term)
+
+	include, err := includeRelations(c, userIncludes)
+	if err != nil {
+		return err
+	}
+
+	users := []User{}
+	err = onReplica(db, func(db *bun.DB) error {
+		like := ilike(db) + " ? " + likeEscape(db)
+		query := db.NewSelect().Model(&users).
+			Where("account_id = ?", currentUser.AccountId).
+			WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+				q = q.Where("username "+like, pattern).WhereOr("email "+like, pattern)
+				for _, field := range userSearchMetadataFields() {
+					text, arg := jsonText(db, "metadata", field)
+					q = q.WhereOr(text+" "+like, arg, pattern)
+				}
+				return q
+			})
+		return orderBySimilarity(query.Apply(include), "username", term).
+			Limit(50).
+			Scan(ctx)
+	})
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return an empty array
+	}
+
+	publicUsers := []PublicUser{}
+	for _, user := range users {
+		publicUsers = append(publicUsers, *user.ToAdminUser())
+	}
+
+	body, err := sparseFields(c, render(c, publicUsers))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(body)
 }
 
 func createUser(c *fiber.Ctx, db *bun.DB) error {
-	user := new(User)
-	
-	if err := c.BodyParser(user); err != nil {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "invalid input"})
+	currentUser := c.Locals("user").(*User)
+
+	input := new(CreateUserInput)
+	if err := parseBody(c, input); err != nil {
+		return err
 	}
 
-	if _, err := user.New(db); err != nil {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "something went wrong"})
+	user, err := createAccountUser(c.UserContext(), currentUser, input, db)
+	if err != nil {
+		return err
 	}
 
-	return c.JSON(user.ToPublicUser())
+	return created(c, apiPath(c, "/users/"+user.ID.String()), render(c, user.ToPublicUser()))
 }
 
+// Gets a single user in the admin's account along with their active token count
 func getUser(c *fiber.Ctx, db *bun.DB) error {
-	ctx := context.Background()
-	user := new(User)
-	id := c.Params("id")
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	include, err := includeRelations(c, userIncludes)
+	if err != nil {
+		return err
+	}
+
+	user, err := findAccountUser(ctx, currentUser.AccountId, c.Params("id"), db, include)
+	if err != nil {
+		return err
+	}
+
+	tokenCount, err := db.NewSelect().Model((*Token)(nil)).Where("user_id = ?", user.ID).Count(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	publicUser := user.ToAdminUser()
+	publicUser.TokenCount = tokenCount
 
-	err := db.NewSelect().Model(user).Where("id = ?", id).Scan(ctx)
+	body, err := sparseFields(c, render(c, publicUser))
 	if err != nil {
-		fmt.Println(err)
-		return c.JSON(nil)
+		return err
 	}
 
-	return c.JSON(user.ToPublicUser())
+	return c.JSON(body)
 }
 
+// Changes only the fields the body sends, e.g. {"Role": "admin"} leaves
+// the user's metadata and everything else as it was
 func updateUser(c *fiber.Ctx, db *bun.DB) error {
-	ctx := context.Background()
-	user := new(User)
-	
-	if err := c.BodyParser(user); err != nil {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "invalid input"})
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(UpdateUserInput)
+	if err := parseBody(c, input); err != nil {
+		return err
+	}
+
+	user, err := findAccountUser(ctx, currentUser.AccountId, c.Params("id"), db)
+	if err != nil {
+		return err
 	}
 
-	if user.Password != "" {
-		user.Password, _ = hashPassword(user.Password)
+	if err := user.saveUpdate(ctx, input, sentFields(c, input), currentUser, db); err != nil {
+		return err
 	}
 
-	id := c.Params("id")
-	_, err := db.NewUpdate().Model(user).Where("id = ?", id).Exec(ctx)
+	return c.JSON(render(c, user.ToPublicUser()))
+}
+
+// Changes only what the patch changes, from an RFC 7386 merge patch, or
+// an RFC 6902 JSON patch sent as application/json-patch+json, e.g.
+// {"Metadata": {"plan": "pro"}} to set one metadata key
+func patchUser(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	user, err := findAccountUser(ctx, currentUser.AccountId, c.Params("id"), db)
+	if err != nil {
+		return err
+	}
+
+	// Patching changes the document in place, so keep one to compare against
+	before, err := toDocument(user.toUpdateInput())
+	if err != nil {
+		return internalError(err)
+	}
+	document, _ := toDocument(user.toUpdateInput())
+
+	after, err := patchDocument(c, document)
 	if err != nil {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "something went wrong"})
+		return err
+	}
+
+	input := new(UpdateUserInput)
+	if err := decodeDocument(after, input); err != nil {
+		return unprocessable("patch must leave valid fields").WithCode(codePatchFailed)
+	}
+	if err := validateInput(input); err != nil {
+		return err
 	}
 
-	return c.JSON(user.ToPublicUser())
+	if err := user.saveUpdate(ctx, input, changedKeys(before, after), currentUser, db); err != nil {
+		return err
+	}
+
+	return c.JSON(render(c, user.ToPublicUser()))
 }
 
 func updateUserMetadata(c *fiber.Ctx, db *bun.DB) error {
-	ctx := context.Background()
+	ctx := c.UserContext()
 	tokenString := getTokenStringFromHeaders(c)
 
 	if tokenString == "" {
-		return c.Status(401).JSON(fiber.Map{"message": "unauthorized"})
+		return unauthorized("unauthorized").WithCode(codeAuthUnauthorized)
 	}
 
-	currentUser, err := getUserFromJwt(tokenString, db)
+	currentUser, err := newAuthService(db).Authenticate(ctx, tokenString)
 	if err != nil {
-		fmt.Println(err)
-		return c.Status(401).JSON(fiber.Map{"message": "unauthorized"})
+		requestLogger(c).Error().Err(err).Send()
+		return unauthorized("unauthorized").WithCode(codeAuthUnauthorized)
 	}
+	c.Locals("user", currentUser)
 
 	body := new(User)
 	if err := c.BodyParser(body); err != nil {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "invalid input"})
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
 	}
 
 	// ONLY update metadata here
 	currentUser.Metadata = body.Metadata
+	currentUser.UpdatedAt = time.Now()
 
-	_, err = db.NewUpdate().Model(currentUser).Where("id = ?", currentUser.ID).Exec(ctx)
+	_, err = db.NewUpdate().Model(currentUser).Column("metadata", "updated_at").WherePK().Exec(ctx)
 	if err != nil {
-		fmt.Println(err)
-		return c.Status(400).JSON(fiber.Map{"message": "something went wrong"})
+		return internalError(err)
 	}
+	forgetUserTokens(currentUser.ID)
 
-	return c.JSON(currentUser.ToPublicUser())
+	return c.JSON(render(c, currentUser.ToPublicUser()))
 }
 
+// Soft deletes a user by default, or removes them and their tokens with ?hard=true
 func deleteUser(c *fiber.Ctx, db *bun.DB) error {
-	ctx := context.Background()
+	currentUser := c.Locals("user").(*User)
 
-	id := c.Params("id")
-	go db.NewDelete().Model(new(User)).Where("id = ?", id).Exec(ctx)
+	if err := validateUserChange(c.UserContext(), currentUser, c.Params("id"), db); err != nil {
+		return err
+	}
+
+	deleteAccountUser(currentUser.AccountId, c.Params("id"), c.Query("hard") == "true", requestLogger(c), db)
 
 	// Always return success so as not to enumerate
 	return c.JSON(fiber.Map{"success": true})
 }
 
+// Brings a soft deleted user back
+func restoreUser(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	id := c.Params("id")
+	user := new(User)
+	err := updateReturning(ctx, db, user, func(q bun.QueryBuilder) bun.QueryBuilder {
+		return q.WhereAllWithDeleted().Where("id = ?", id).Where("account_id = ?", currentUser.AccountId)
+	}, func(q *bun.UpdateQuery) *bun.UpdateQuery {
+		return q.Set("deleted_at = NULL")
+	})
+	if err != nil || user.ID == uuid.Nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("user not found").WithCode(codeUserNotFound)
+	}
+
+	return c.JSON(render(c, user.ToPublicUser()))
+}
+
+// Suspends or reactivates a user in the admin's account
+func setUserStatus(c *fiber.Ctx, db *bun.DB, status string) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	id := c.Params("id")
+	if id == currentUser.ID.String() {
+		return badRequest("cannot change your own status")
+	}
+	if err := validateUserChange(ctx, currentUser, id, db); err != nil {
+		return err
+	}
+
+	eventType := eventUserUnsuspended
+	if status == userStatusSuspended {
+		eventType = eventUserSuspended
+	}
+
+	user := new(User)
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := updateReturning(ctx, tx, user, func(q bun.QueryBuilder) bun.QueryBuilder {
+			return q.Where("id = ?", id).Where("account_id = ?", currentUser.AccountId)
+		}, func(q *bun.UpdateQuery) *bun.UpdateQuery {
+			return q.Set("status = ?", status).Set("updated_at = ?", time.Now())
+		})
+		if err != nil || user.ID == uuid.Nil {
+			return err
+		}
+		return recordEvent(ctx, tx, eventType, user.AccountId, user.ID, map[string]interface{}{
+			"by": currentUser.ID,
+		})
+	})
+	if err != nil || user.ID == uuid.Nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("user not found").WithCode(codeUserNotFound)
+	}
+	forgetUserTokens(user.ID)
+
+	return c.JSON(render(c, user.ToPublicUser()))
+}
+
 // ====================
 //      Utilities
 // ====================
 
-func (user *User) New(db *bun.DB) (sql.Result, error) {
-	ctx := context.Background()
+func (user *User) New(ctx context.Context, db *bun.DB) (sql.Result, error) {
+	if err := user.checkCredentials(ctx, db); err != nil {
+		return nil, err
+	}
+
+	user.Password, _ = hashPassword(user.Password)
+	return user.insert(ctx, db)
+}
+
+// Inserts a user whose credentials have been checked and whose password
+// is already hashed, recording that they were created
+func (user *User) insert(ctx context.Context, db *bun.DB) (sql.Result, error) {
+	var res sql.Result
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var err error
+		res, err = user.insertTx(ctx, tx)
+		return err
+	})
+	if err != nil {
+		return nil, userWriteError(err)
+	}
+
+	recordSignup(db, user.AccountId)
+	return res, nil
+}
+
+// Inserts the user and records it within tx, for callers writing other
+// rows alongside them. Signups are left to the caller to count once the
+// transaction commits.
+func (user *User) insertTx(ctx context.Context, tx bun.IDB) (sql.Result, error) {
+	user.ID = newId()
+	user.Status = userStatusActive
+
+	res, err := tx.NewInsert().Model(user).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = recordEvent(ctx, tx, eventUserCreated, user.AccountId, user.ID, map[string]interface{}{
+		"username": user.Username,
+		"email": user.Email,
+		"role": user.Role,
+		"anonymous": user.IsAnonymous,
+	})
+	return res, err
+}
+
+// The user's editable fields, as an update would send them
+func (user *User) toUpdateInput() *UpdateUserInput {
+	return &UpdateUserInput{
+		Username: user.Username,
+		Email: user.Email,
+		DisplayName: user.DisplayName,
+		Role: user.Role,
+		Metadata: user.Metadata,
+	}
+}
+
+// Looks up a user by id within an account, with anything apply adds to
+// the select, like ?include='s relations
+func findAccountUser(ctx context.Context, accountId uuid.UUID, id string, db *bun.DB, apply ...func(*bun.SelectQuery) *bun.SelectQuery) (*User, error) {
+	user := new(User)
+	query := db.NewSelect().Model(user).
+		Where("?TableAlias.id = ?", id).
+		Where("account_id = ?", accountId)
+	for _, fn := range apply {
+		query = query.Apply(fn)
+	}
+	err := query.Scan(ctx)
+	if err != nil {
+		logger.Debug().Err(err).Send()
+		return nil, notFound("user not found").WithCode(codeUserNotFound)
+	}
+
+	return user, nil
+}
+
+// Creates a validated user in the creator's account with the role they
+// asked for, if the creator may assign it
+func createAccountUser(ctx context.Context, creator *User, input *CreateUserInput, db *bun.DB) (*User, error) {
+	user := input.ToUser()
+
+	// Users are always created in the admin's own account
+	user.AccountId = creator.AccountId
+
+	user.Role = normalizeRoleName(input.Role)
+	if err := validateRoleAssignment(ctx, creator, user.Role, db); err != nil {
+		return nil, err
+	}
+
+	if _, err := user.New(ctx, db); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Applies the named fields of an update and writes only those columns
+func (user *User) saveUpdate(ctx context.Context, input *UpdateUserInput, fields []string, assigner *User, db *bun.DB) error {
+	if err := validateUserChange(ctx, assigner, user.ID.String(), db); err != nil {
+		return err
+	}
+
+	columns, err := user.applyUpdate(ctx, input, fields, assigner, db)
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	user.UpdatedAt = time.Now()
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().Model(user).
+			Column(append(columns, "updated_at")...).
+			WherePK().
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		err = recordEvent(ctx, tx, eventUserUpdated, user.AccountId, user.ID, map[string]interface{}{
+			"fields": columns,
+			"by": assigner.ID,
+		})
+		if err != nil || !stringInSlice("role", columns) {
+			return err
+		}
+		return recordEvent(ctx, tx, eventUserRoleChanged, user.AccountId, user.ID, map[string]interface{}{
+			"role": user.Role,
+			"by": assigner.ID,
+		})
+	})
+	if err != nil {
+		return userWriteError(err)
+	}
+	forgetUserTokens(user.ID)
+
+	return nil
+}
+
+// Soft deletes a user in the background, or removes them and their
+// tokens when hard. Nothing is reported so as not to enumerate.
+func deleteAccountUser(accountId uuid.UUID, id string, hard bool, log *zerolog.Logger, db *bun.DB) {
+	go func() {
+		ctx := context.Background()
+		err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			query := tx.NewDelete().Model(new(User)).
+				Where("id = ?", id).
+				Where("account_id = ?", accountId)
+			if hard {
+				query = query.WhereAllWithDeleted().ForceDelete()
+			}
+
+			res, err := query.Exec(ctx)
+			if err != nil {
+				return err
+			}
+
+			// Only the tokens of a user the account-scoped delete found
+			if count, _ := res.RowsAffected(); hard && count > 0 {
+				_, err := tx.NewDelete().Model(new(Token)).Where("user_id = ?", id).Exec(ctx)
+				if err != nil {
+					return err
+				}
+			}
 
+			return recordUserDeleted(ctx, tx, res, accountId, id, hard)
+		})
+		if err != nil {
+			log.Error().Err(err).Send()
+		}
+		if userId, err := uuid.Parse(id); err == nil {
+			forgetUserTokens(userId)
+		}
+	}()
+}
+
+// Records that an admin deleted a user, if the delete found them
+func recordUserDeleted(ctx context.Context, db bun.IDB, res sql.Result, accountId uuid.UUID, id string, hard bool) error {
+	userId, err := uuid.Parse(id)
+	if err != nil {
+		return nil
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return nil
+	}
+
+	return recordEvent(ctx, db, eventUserDeleted, accountId, userId, map[string]interface{}{
+		"self": false,
+		"hard": hard,
+	})
+}
+
+// Copies the named fields of an update onto the user, checking each, and
+// returns the columns to write
+func (user *User) applyUpdate(ctx context.Context, input *UpdateUserInput, fields []string, assigner *User, db *bun.DB) ([]string, error) {
+	columns := []string{}
+
+	for _, field := range fields {
+		switch field {
+			case "Username":
+				username := normalizeUsername(input.Username)
+				if username == "" {
+					return nil, badRequest("username cannot be empty")
+				}
+				if username != user.Username {
+					if err := validateUsername(ctx, username, user.AccountId, db); err != nil {
+						return nil, badRequest(err.Error())
+					}
+				}
+				user.Username = username
+				columns = append(columns, "username")
+			case "Email":
+				email := ""
+				if input.Email != "" {
+					normalized, err := normalizeEmail(input.Email)
+					if err != nil {
+						return nil, badRequest("invalid email")
+					}
+					email = normalized
+				}
+				user.Email = email
+				columns = append(columns, "email")
+			case "Password":
+				if input.Password == "" {
+					continue
+				}
+				password, err := hashPassword(input.Password)
+				if err != nil {
+					return nil, internalError(err)
+				}
+				user.Password = password
+				columns = append(columns, "password")
+			case "DisplayName":
+				user.DisplayName = input.DisplayName
+				columns = append(columns, "display_name")
+			case "Role":
+				role := normalizeRoleName(input.Role)
+				if err := validateRoleAssignment(ctx, assigner, role, db); err != nil {
+					return nil, err
+				}
+				user.Role = role
+				columns = append(columns, "role")
+			case "Metadata":
+				user.Metadata = input.Metadata
+				columns = append(columns, "metadata")
+			default:
+				return nil, badRequest(fmt.Sprintf("%s cannot be changed", field))
+		}
+	}
+
+	return columns, nil
+}
+
+// Normalizes the username and email and makes sure they're valid and
+// that a password was given. Whether they're taken is found out on
+// writing, see userWriteError. Problems with the credentials are
+// returned as AppErrors.
+func (user *User) checkCredentials(ctx context.Context, db *bun.DB) error {
+	user.Username = normalizeUsername(user.Username)
 	if user.Username == "" || user.Password == "" {
-		return nil, errors.New("no username or password")
+		return badRequest("no username or password")
 	}
 
-	found := new(User)
-	db.NewSelect().Model(found).Where("username = ?", user.Username).Where("account_id = ?", user.AccountId).Scan(ctx)
-	if found.Username == user.Username {
-		return nil, errors.New("username in use")
+	if err := validateUsername(ctx, user.Username, user.AccountId, db); err != nil {
+		return badRequest(err.Error())
 	}
 
-	user.ID = uuid.New()
-	user.Password, _ = hashPassword(user.Password)
+	// Credentials are only checked for users taking their first username,
+	// new or anonymous, so any reservation is someone else's. Their ID
+	// isn't trusted here as it may have come from the request.
+	if usernameOnCooldown(ctx, user.Username, user.AccountId, uuid.Nil, db) {
+		return conflict("username is reserved").WithCode(codeUsernameTaken)
+	}
+
+	if user.Email != "" {
+		email, err := normalizeEmail(user.Email)
+		if err != nil {
+			return badRequest("invalid email")
+		}
+		user.Email = email
+	}
+
+	return nil
+}
+
+// Turns a write that broke the users' unique indexes into a conflict.
+// Usernames and emails are only unique by those indexes, so two requests
+// racing for the same one can't both succeed. Soft deleted users keep
+// theirs so they can be restored. Anything else is an internal error.
+func userWriteError(err error) error {
+	switch uniqueViolation(err) {
+		case "account_id_lower_username_idx":
+			return conflict("username in use").WithCode(codeUsernameTaken)
+		case "account_id_email_idx":
+			return conflict("email in use").WithCode(codeUserEmailTaken)
+	}
+	return internalError(err)
+}
+
+// Narrows a user query to the account and, where set, a role, a status,
+// and a group by id or name
+func (filter userFilter) apply(query *bun.SelectQuery, accountId uuid.UUID) *bun.SelectQuery {
+	query = query.Where("account_id = ?", accountId)
 
-	return db.NewInsert().Model(user).Exec(ctx)
+	if filter.Role != "" {
+		query = query.Where("role = ?", filter.Role)
+	}
+
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+
+	// By name, or by id when it is one
+	if filter.Group != "" {
+		groupId, _ := uuid.Parse(filter.Group)
+		query = query.Where(
+			"?TableAlias.id IN (SELECT gm.user_id FROM group_members AS gm JOIN ? AS g ON g.id = gm.group_id WHERE g.account_id = ? AND (g.id = ? OR g.name = ?))",
+			bun.Ident("groups"), accountId, groupId, filter.Group,
+		)
+	}
+
+	return query
+}
+
+func filterUsers(c *fiber.Ctx, query *bun.SelectQuery, accountId uuid.UUID) *bun.SelectQuery {
+	filter := userFilter{Role: c.Query("role"), Status: c.Query("status"), Group: c.Query("group")}
+	query = filter.apply(query, accountId)
+
+	// ?tag=beta&tag=vip only matches users with every tag
+	tags := []string{}
+	c.Context().QueryArgs().VisitAll(func(key []byte, value []byte) {
+		if string(key) == "tag" {
+			if tag := normalizeTag(string(value)); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	})
+	for _, tag := range tags {
+		contains, arg := arrayContains(query, "tags", tag)
+		query = query.Where(contains, arg)
+	}
+
+	// ?metadata.plan=pro or ?metadata.address.city=paris become JSON containment
+	// checks, matching the value as a string or as the JSON scalar it parses to
+	c.Context().QueryArgs().VisitAll(func(key []byte, value []byte) {
+		path := strings.Split(string(key), ".")
+		if len(path) < 2 || path[0] != "metadata" {
+			return
+		}
+
+		candidates := []interface{}{string(value)}
+		var scalar interface{}
+		if err := json.Unmarshal(value, &scalar); err == nil {
+			switch scalar.(type) {
+				case float64, bool, nil:
+					candidates = append(candidates, scalar)
+			}
+		}
+
+		query = query.WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			for _, candidate := range candidates {
+				contains, args := jsonContains(q, "metadata", path[1:], candidate)
+				q = q.WhereOr(contains, args...)
+			}
+			return q
+		})
+	})
+
+	return query
+}
+
+// The metadata keys included in user search, configured as a
+// comma-separated list in USER_SEARCH_METADATA_FIELDS
+func userSearchMetadataFields() []string {
+	fields := []string{}
+	for _, field := range strings.Split(os.Getenv("USER_SEARCH_METADATA_FIELDS"), ",") {
+		field = strings.TrimSpace(field)
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// Usernames are unique regardless of case, so they are stored trimmed and lowercased
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// Checks a normalized username against the charset and length rules
+// and the global and per-account reserved lists
+func validateUsername(ctx context.Context, username string, accountId uuid.UUID, db *bun.DB) error {
+	if len(username) < 3 || len(username) > 32 {
+		return errors.New("username must be between 3 and 32 characters")
+	}
+
+	if !usernamePattern.MatchString(username) {
+		return errors.New("username may only contain letters, numbers, '.', '_' and '-'")
+	}
+
+	if stringInSlice(username, reservedUsernames()) {
+		return errors.New("username is reserved")
+	}
+
+	account := new(Account)
+	err := db.NewSelect().Model(account).Column("reserved_usernames").Where("id = ?", accountId).Scan(ctx)
+	if err == nil && stringInSlice(username, account.ReservedUsernames) {
+		return errors.New("username is reserved")
+	}
+
+	return nil
+}
+
+// The default reserved usernames plus any from RESERVED_USERNAMES
+func reservedUsernames() []string {
+	reserved := defaultReservedUsernames()
+	for _, username := range strings.Split(os.Getenv("RESERVED_USERNAMES"), ",") {
+		username = normalizeUsername(username)
+		if username != "" {
+			reserved = append(reserved, username)
+		}
+	}
+	return reserved
+}
+
+// Validates an email address and returns it trimmed and lowercased
+func normalizeEmail(email string) (string, error) {
+	address, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil || address.Name != "" {
+		return "", errors.New("invalid email")
+	}
+	return strings.ToLower(address.Address), nil
+}
+
+// Whether the user is allowed to authenticate
+func (user *User) IsActive() bool {
+	return user.Status != userStatusSuspended
 }
 
 func (user *User) ToPublicUser() *PublicUser {
@@ -259,11 +1045,38 @@ func (user *User) ToPublicUser() *PublicUser {
 
 	publicUser.ID = user.ID
 	publicUser.Username = user.Username
+	publicUser.Email = user.Email
+	publicUser.DisplayName = user.DisplayName
+	publicUser.AvatarURL = user.AvatarURL
 	publicUser.Role = user.Role
+	publicUser.Status = user.Status
+	publicUser.IsAnonymous = user.IsAnonymous
 	publicUser.Token = user.Token
 	publicUser.Metadata = user.Metadata
 	publicUser.CreatedAt = user.CreatedAt
 	publicUser.UpdatedAt = user.UpdatedAt
 
+	// Relations are only set when they were loaded
+	if user.Account != nil {
+		publicUser.Account = user.Account.ToPublicAccount()
+	}
+	for _, token := range user.Tokens {
+		publicUser.Tokens = append(publicUser.Tokens, token.ToPublicToken())
+	}
+
+	return publicUser
+}
+
+// The client-facing user with the activity fields only admins may see
+func (user *User) ToAdminUser() *PublicUser {
+	publicUser := user.ToPublicUser()
+
+	if !user.LastLoginAt.IsZero() {
+		lastLoginAt := user.LastLoginAt
+		publicUser.LastLoginAt = &lastLoginAt
+	}
+	publicUser.LoginCount = user.LoginCount
+	publicUser.Tags = user.Tags
+
 	return publicUser
 }
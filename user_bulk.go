@@ -0,0 +1,143 @@
+package goapi
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// Bulk user action request body
+type BulkUserInput struct {
+	IDs []uuid.UUID
+	Action string
+	Role string
+}
+
+// Outcome of a bulk action for a single user
+type BulkUserResult struct {
+	ID uuid.UUID
+	Success bool
+	Message string `json:",omitempty"`
+}
+
+// Bulk user actions
+const (
+	bulkActionDelete = "delete"
+	bulkActionSuspend = "suspend"
+	bulkActionUnsuspend = "unsuspend"
+	bulkActionRole = "role"
+)
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Applies one action to many users in the admin's account in a single transaction
+func bulkUpdateUsers(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(BulkUserInput)
+	if err := c.BodyParser(input); err != nil || len(input.IDs) == 0 {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	actions := []string{bulkActionDelete, bulkActionSuspend, bulkActionUnsuspend, bulkActionRole}
+	if !stringInSlice(input.Action, actions) {
+		return badRequest("invalid action")
+	}
+
+	if input.Action == bulkActionRole {
+		input.Role = normalizeRoleName(input.Role)
+		if err := validateRoleAssignment(ctx, currentUser, input.Role, db); err != nil {
+			return err
+		}
+	}
+
+	// Checked up front so the transaction isn't held open waiting on them
+	refused := map[uuid.UUID]bool{}
+	for _, id := range input.IDs {
+		if err := validateUserChange(ctx, currentUser, id.String(), db); err != nil {
+			refused[id] = true
+		}
+	}
+
+	results := []BulkUserResult{}
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		for _, id := range input.IDs {
+			result := BulkUserResult{ID: id}
+
+			if id == currentUser.ID {
+				result.Message = "cannot apply bulk actions to yourself"
+				results = append(results, result)
+				continue
+			}
+			if refused[id] {
+				result.Message = "only owners may change owners"
+				results = append(results, result)
+				continue
+			}
+
+			var res sql.Result
+			var err error
+			switch input.Action {
+				case bulkActionDelete:
+					res, err = tx.NewDelete().Model((*User)(nil)).
+						Where("id = ?", id).
+						Where("account_id = ?", currentUser.AccountId).
+						Exec(ctx)
+				case bulkActionSuspend, bulkActionUnsuspend:
+					status := userStatusSuspended
+					if input.Action == bulkActionUnsuspend {
+						status = userStatusActive
+					}
+					res, err = tx.NewUpdate().Model((*User)(nil)).
+						Set("status = ?", status).
+						Set("updated_at = ?", time.Now()).
+						Where("id = ?", id).
+						Where("account_id = ?", currentUser.AccountId).
+						Exec(ctx)
+				case bulkActionRole:
+					res, err = tx.NewUpdate().Model((*User)(nil)).
+						Set("role = ?", input.Role).
+						Set("updated_at = ?", time.Now()).
+						Where("id = ?", id).
+						Where("account_id = ?", currentUser.AccountId).
+						Exec(ctx)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if affected, _ := res.RowsAffected(); affected == 0 {
+				result.Message = "user not found"
+			} else {
+				result.Success = true
+			}
+			if result.Success && input.Action == bulkActionRole {
+				err := recordEvent(ctx, tx, eventUserRoleChanged, currentUser.AccountId, id, map[string]interface{}{
+					"role": input.Role,
+					"by": currentUser.ID,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			results = append(results, result)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return internalError(err)
+	}
+	forgetUserTokens(input.IDs...)
+
+	return c.JSON(results)
+}
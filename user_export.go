@@ -0,0 +1,126 @@
+package goapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/uptrace/bun"
+)
+
+// How many users are read from the DB at a time while exporting
+const userExportBatchSize = 500
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Streams the admin's account users as CSV, filtered like the user list.
+// Columns may be picked with ?columns=id,username,...
+func exportUsers(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+
+	columns := userExportColumns()
+	if requested := c.Query("columns"); requested != "" {
+		columns = []string{}
+		for _, column := range strings.Split(requested, ",") {
+			column = strings.TrimSpace(column)
+			if !stringInSlice(column, userExportColumns()) {
+				return badRequest(fmt.Sprintf("unknown column: %s", column))
+			}
+			columns = append(columns, column)
+		}
+	}
+
+	// The filters and logger have to be read before the handler returns
+	// since the stream is written after the request context is released
+	query := filterUsers(c, db.NewSelect(), currentUser.AccountId).
+		Order("created_at ASC", "id ASC")
+	log := requestLogger(c)
+
+	c.Set(fiber.HeaderContentType, "text/csv")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="users.csv"`)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx := context.Background()
+		writer := csv.NewWriter(w)
+		writer.Write(columns)
+
+		for offset := 0; ; offset += userExportBatchSize {
+			users := []User{}
+			err := query.Model(&users).Limit(userExportBatchSize).Offset(offset).Scan(ctx)
+			if err != nil {
+				log.Error().Err(err).Send()
+				break
+			}
+
+			for _, user := range users {
+				writer.Write(user.toExportRow(columns))
+			}
+			writer.Flush()
+			w.Flush()
+
+			if len(users) < userExportBatchSize {
+				break
+			}
+		}
+	})
+
+	return nil
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Every column that may be exported. Password hashes never are.
+func userExportColumns() []string {
+	return []string{
+		"id", "username", "email", "display_name", "role", "status",
+		"metadata", "last_login_at", "login_count", "created_at", "updated_at",
+	}
+}
+
+func (user *User) toExportRow(columns []string) []string {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+
+	row := []string{}
+	for _, column := range columns {
+		switch column {
+			case "id":
+				row = append(row, user.ID.String())
+			case "username":
+				row = append(row, user.Username)
+			case "email":
+				row = append(row, user.Email)
+			case "display_name":
+				row = append(row, user.DisplayName)
+			case "role":
+				row = append(row, user.Role)
+			case "status":
+				row = append(row, user.Status)
+			case "metadata":
+				metadata, _ := json.Marshal(user.Metadata)
+				row = append(row, string(metadata))
+			case "last_login_at":
+				row = append(row, formatTime(user.LastLoginAt))
+			case "login_count":
+				row = append(row, strconv.Itoa(user.LoginCount))
+			case "created_at":
+				row = append(row, formatTime(user.CreatedAt))
+			case "updated_at":
+				row = append(row, formatTime(user.UpdatedAt))
+		}
+	}
+	return row
+}
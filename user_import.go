@@ -0,0 +1,234 @@
+package goapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Users moved in from another provider, e.g. an Auth0 or Firebase export
+type ImportUsersInput struct {
+	Users []ImportUserInput `validate:"required,min=1,max=1000"`
+
+	// The project's hash parameters, needed for firebase-scrypt hashes
+	Firebase *FirebaseHashConfig
+}
+
+// A user to import. PasswordHash is kept as exported and checked in its
+// own format on the user's first login, then rehashed with bcrypt.
+type ImportUserInput struct {
+	Username string `validate:"required,min=3,max=32"`
+	Email string `validate:"omitempty,email,max=254"`
+	DisplayName string `validate:"max=100"`
+	Role string `validate:"max=64"`
+	Metadata map[string]interface{}
+	PasswordHash string `validate:"required"`
+	PasswordHashFormat string `validate:"required,oneof=bcrypt firebase-scrypt"`
+	PasswordSalt string // base64, firebase-scrypt only
+}
+
+// The hash_config of a Firebase project, as shown in its console or
+// returned by `firebase auth:export`
+type FirebaseHashConfig struct {
+	SignerKey string `validate:"required"` // base64
+	SaltSeparator string // base64
+	Rounds int `validate:"required,min=1,max=8"`
+	MemCost int `validate:"required,min=1,max=14"`
+}
+
+// Outcome of importing a single user
+type ImportUserResult struct {
+	Username string
+	ID uuid.UUID `json:",omitempty"`
+	Success bool
+	Message string `json:",omitempty"`
+}
+
+// Password hash formats that may be imported
+const (
+	passwordFormatBcrypt = "bcrypt"
+	passwordFormatFirebaseScrypt = "firebase-scrypt"
+)
+
+// The bcrypt cost new hashes are made with
+const passwordHashCost = 14
+
+// ====================
+//    Route Handlers
+// ====================
+
+// Creates users in the admin's account with the password hashes they had
+// elsewhere, so they keep their passwords. Each user is imported on its
+// own; one that fails doesn't stop the rest.
+func importUsers(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(ImportUsersInput)
+	if err := parseBody(c, input); err != nil {
+		return err
+	}
+	if input.Firebase != nil {
+		if err := validateInput(input.Firebase); err != nil {
+			return err
+		}
+	}
+
+	results := []ImportUserResult{}
+	for i := range input.Users {
+		result := ImportUserResult{Username: input.Users[i].Username}
+
+		user, err := importUser(ctx, currentUser, &input.Users[i], input.Firebase, db)
+		if err != nil {
+			var appErr *AppError
+			if !errors.As(err, &appErr) {
+				return internalError(err)
+			}
+			if appErr.Status >= fiber.StatusInternalServerError {
+				return err
+			}
+			result.Message = appErr.Message
+		} else {
+			result.ID = user.ID
+			result.Success = true
+		}
+		results = append(results, result)
+	}
+
+	return c.JSON(results)
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func importUser(ctx context.Context, creator *User, input *ImportUserInput, firebase *FirebaseHashConfig, db *bun.DB) (*User, error) {
+	if err := validateInput(input); err != nil {
+		return nil, badRequest("invalid user")
+	}
+
+	hash, err := importedPasswordHash(input, firebase)
+	if err != nil {
+		return nil, err
+	}
+
+	user := new(User)
+	user.AccountId = creator.AccountId
+	user.Username = input.Username
+	user.Email = input.Email
+	user.DisplayName = input.DisplayName
+	user.Metadata = input.Metadata
+	user.Password = hash
+
+	user.Role = normalizeRoleName(input.Role)
+	if err := validateRoleAssignment(ctx, creator, user.Role, db); err != nil {
+		return nil, err
+	}
+
+	if err := user.checkCredentials(ctx, db); err != nil {
+		return nil, err
+	}
+	if _, err := user.insert(ctx, db); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// The hash to store for an imported user. Bcrypt hashes are stored as
+// they are; Firebase's are stored along with the salt and the project's
+// parameters, as firebase-scrypt$rounds$memcost$separator$signer$salt$hash
+func importedPasswordHash(input *ImportUserInput, firebase *FirebaseHashConfig) (string, error) {
+	switch input.PasswordHashFormat {
+		case passwordFormatBcrypt:
+			if _, err := bcrypt.Cost([]byte(input.PasswordHash)); err != nil {
+				return "", badRequest("invalid password hash")
+			}
+			return input.PasswordHash, nil
+
+		case passwordFormatFirebaseScrypt:
+			if firebase == nil {
+				return "", badRequest("firebase hash config required")
+			}
+			for _, value := range []string{firebase.SaltSeparator, firebase.SignerKey, input.PasswordSalt, input.PasswordHash} {
+				if _, err := base64.StdEncoding.DecodeString(value); err != nil {
+					return "", badRequest("invalid password hash")
+				}
+			}
+			return strings.Join([]string{
+				passwordFormatFirebaseScrypt,
+				strconv.Itoa(firebase.Rounds),
+				strconv.Itoa(firebase.MemCost),
+				firebase.SaltSeparator,
+				firebase.SignerKey,
+				input.PasswordSalt,
+				input.PasswordHash,
+			}, "$"), nil
+
+		default:
+			return "", badRequest("invalid password hash format")
+	}
+}
+
+// Checks a password against a stored firebase-scrypt hash. Firebase
+// derives a key from the password with scrypt and uses it to encrypt the
+// project's signer key with AES-256-CTR; the result is the hash.
+func checkFirebaseScryptHash(password, hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 7 || parts[0] != passwordFormatFirebaseScrypt {
+		return false
+	}
+
+	rounds, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	memCost, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return false
+	}
+
+	decoded := [][]byte{}
+	for _, part := range parts[3:] {
+		value, err := base64.StdEncoding.DecodeString(part)
+		if err != nil {
+			return false
+		}
+		decoded = append(decoded, value)
+	}
+	separator, signerKey, salt, expected := decoded[0], decoded[1], decoded[2], decoded[3]
+
+	key, err := scrypt.Key([]byte(password), append(salt, separator...), 1<<memCost, rounds, 1, 32)
+	if err != nil {
+		return false
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return false
+	}
+	actual := make([]byte, len(signerKey))
+	cipher.NewCTR(block, bytes.Repeat([]byte{0}, aes.BlockSize)).XORKeyStream(actual, signerKey)
+
+	return subtle.ConstantTimeCompare(actual, expected) == 1
+}
+
+// Whether a stored hash should be replaced with a native one the next
+// time the password is known, i.e. it was imported or made with a lower
+// cost than new hashes are
+func passwordNeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < passwordHashCost
+}
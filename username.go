@@ -0,0 +1,165 @@
+package goapi
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// UsernameHistory DB model
+type UsernameHistory struct {
+	bun.BaseModel `bun:"table:username_histories"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	Username string // has idx
+	ReservedUntil time.Time `bun:",nullzero"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	UserId uuid.UUID `bun:",type:uuid"`
+	AccountId uuid.UUID `bun:",type:uuid"`
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func changeMyUsername(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+
+	input := new(User)
+	if err := c.BodyParser(input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	if err := currentUser.ChangeUsername(c.UserContext(), input.Username, db); err != nil {
+		return err
+	}
+
+	return c.JSON(render(c, currentUser.ToPublicUser()))
+}
+
+func changeUsername(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(User)
+	if err := c.BodyParser(input); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	if err := validateUserChange(ctx, currentUser, c.Params("id"), db); err != nil {
+		return err
+	}
+
+	user := new(User)
+	err := db.NewSelect().Model(user).
+		Where("id = ?", c.Params("id")).
+		Where("account_id = ?", currentUser.AccountId).
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		return notFound("user not found").WithCode(codeUserNotFound)
+	}
+
+	if err := user.ChangeUsername(ctx, input.Username, db); err != nil {
+		return err
+	}
+
+	return c.JSON(render(c, user.ToPublicUser()))
+}
+
+func getUsernameHistory(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	history := []UsernameHistory{}
+	err := db.NewSelect().Model(&history).
+		Where("user_id = ?", c.Params("id")).
+		Where("account_id = ?", currentUser.AccountId).
+		Order("created_at DESC").
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return an empty array
+	}
+
+	return c.JSON(history)
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// Renames the user, recording the old username in their history
+func (user *User) ChangeUsername(ctx context.Context, username string, db *bun.DB) error {
+	username = normalizeUsername(username)
+	if username == user.Username {
+		return nil
+	}
+
+	if err := validateUsername(ctx, username, user.AccountId, db); err != nil {
+		return badRequest(err.Error())
+	}
+
+	if usernameOnCooldown(ctx, username, user.AccountId, user.ID, db) {
+		return conflict("username is reserved").WithCode(codeUsernameTaken)
+	}
+
+	history := new(UsernameHistory)
+	history.ID = newId()
+	history.Username = user.Username
+	history.UserId = user.ID
+	history.AccountId = user.AccountId
+	if cooldown := usernameCooldown(); cooldown > 0 {
+		history.ReservedUntil = time.Now().Add(cooldown)
+	}
+
+	previous := user.Username
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewInsert().Model(history).Exec(ctx); err != nil {
+			return err
+		}
+
+		user.Username = username
+		user.UpdatedAt = time.Now()
+		_, err := tx.NewUpdate().Model(user).Column("username", "updated_at").WherePK().Exec(ctx)
+		return err
+	})
+	if err != nil {
+		user.Username = previous
+		return userWriteError(err)
+	}
+	forgetUserTokens(user.ID)
+
+	return nil
+}
+
+// Whether someone other than userId gave up the username too recently for it to be taken
+func usernameOnCooldown(ctx context.Context, username string, accountId uuid.UUID, userId uuid.UUID, db *bun.DB) bool {
+	exists, err := db.NewSelect().Model((*UsernameHistory)(nil)).
+		Where("account_id = ?", accountId).
+		Where("username = ?", username).
+		Where("user_id != ?", userId).
+		Where("reserved_until > ?", time.Now()).
+		Exists(ctx)
+	if err != nil {
+		logger.Error().Err(err).Send()
+	}
+	return exists
+}
+
+// How long an old username stays reserved, from USERNAME_COOLDOWN_DAYS
+func usernameCooldown() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("USERNAME_COOLDOWN_DAYS"))
+	if err != nil || days < 0 {
+		return 0
+	}
+	return time.Hour * 24 * time.Duration(days)
+}
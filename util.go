@@ -1,4 +1,14 @@
-package main
+package goapi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+)
 
 // A way to determine if a particular string is in a particular slice.
 func stringInSlice(a string, list []string) bool {
@@ -10,8 +20,42 @@ func stringInSlice(a string, list []string) bool {
 	return false
 }
 
-// A constant string slice of all roles that are admin and higher.
-// Currently "admin" and "owner"
-func adminRoles() []string {
-	return []string{"admin", "owner"}
-}
\ No newline at end of file
+// Usernames nobody may register, extended by RESERVED_USERNAMES
+// and each account's own reserved list
+func defaultReservedUsernames() []string {
+	return []string{"admin", "administrator", "root", "support", "system", "owner", "help", "security", "api"}
+}
+
+// A random URL-safe string for single-use links
+func generateSecureToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// The hex SHA-256 digest of a secret, so only digests are stored
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// The keys of a string map in a stable order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Responds 201 with the body, pointing Location at the new resource
+// when it has its own URL
+func created(c *fiber.Ctx, location string, body interface{}) error {
+	if location != "" {
+		c.Location(location)
+	}
+	return c.Status(fiber.StatusCreated).JSON(body)
+}
@@ -0,0 +1,101 @@
+package goapi
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Checks request bodies against their `validate` struct tags
+var validate = validator.New()
+
+// ====================
+//      Utilities
+// ====================
+
+// Parses the body into out and validates it, returning a 422 listing every
+// invalid field, e.g. {"fields": {"Password": "must be at least 8 characters"}}
+func parseBody(c *fiber.Ctx, out interface{}) error {
+	if err := c.BodyParser(out); err != nil {
+		requestLogger(c).Debug().Err(err).Send()
+		return badRequest("invalid input").WithCode(codeInvalidInput)
+	}
+
+	return validateInput(out)
+}
+
+// Validates a parsed input, returning a 422 listing every invalid field
+func validateInput(out interface{}) error {
+	err := validate.Struct(out)
+	if err == nil {
+		return nil
+	}
+
+	var fieldErrors validator.ValidationErrors
+	if !errors.As(err, &fieldErrors) {
+		return internalError(err)
+	}
+
+	fields := fiber.Map{}
+	for _, fieldError := range fieldErrors {
+		fields[fieldError.Field()] = validationMessage(fieldError)
+	}
+
+	return unprocessable("validation failed").WithCode(codeValidationFailed).With(fiber.Map{"fields": fields})
+}
+
+// The fields of out that the body actually sent, matched to the struct's
+// field names without regard to case, so an update can leave alone
+// whatever the client left out
+func sentFields(c *fiber.Ctx, out interface{}) []string {
+	keys := []string{}
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		body := map[string]json.RawMessage{}
+		json.Unmarshal(c.Body(), &body)
+		for key := range body {
+			keys = append(keys, key)
+		}
+	} else {
+		c.Request().PostArgs().VisitAll(func(key []byte, _ []byte) {
+			keys = append(keys, string(key))
+		})
+	}
+
+	fields := []string{}
+	outType := reflect.TypeOf(out).Elem()
+	for i := 0; i < outType.NumField(); i++ {
+		name := outType.Field(i).Name
+		for _, key := range keys {
+			if strings.EqualFold(key, name) {
+				fields = append(fields, name)
+				break
+			}
+		}
+	}
+	return fields
+}
+
+// Translated by errorHandler once the request's locale is known
+func validationMessage(fieldError validator.FieldError) localizedText {
+	switch fieldError.Tag() {
+		case "required":
+			return localize("is required")
+		case "required_without":
+			return localize("is required without %s", fieldError.Param())
+		case "min":
+			return localize("must be at least %s characters", fieldError.Param())
+		case "max":
+			return localize("must be at most %s characters", fieldError.Param())
+		case "email":
+			return localize("must be an email address")
+		case "url":
+			return localize("must be a URL")
+		case "oneof":
+			return localize("must be one of %s", fieldError.Param())
+	}
+	return localize("is invalid")
+}
@@ -0,0 +1,258 @@
+package goapi
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// An API version and how its responses differ. Every version serves the
+// same handlers; a version only changes how values are shaped, through
+// serializers keyed by the value's type. A version is deprecated by
+// setting API_<NAME>_DEPRECATED_AT and API_<NAME>_SUNSET_AT (RFC 3339),
+// after which it's answered with Deprecation and Sunset headers, and
+// once the sunset passes with 410s.
+type apiVersion struct {
+	Name string
+	Serializers map[reflect.Type]func(value interface{}) interface{}
+}
+
+const (
+	apiV1 = "v1"
+	apiV2 = "v2"
+)
+
+// PublicUser as v2 renders it, with snake_case keys
+type PublicUserV2 struct {
+	ID uuid.UUID `json:"id"`
+	Token string `json:"token,omitempty"`
+	Username string `json:"username"`
+	Email string `json:"email"`
+	DisplayName string `json:"display_name"`
+	AvatarURL string `json:"avatar_url"`
+	Role string `json:"role"`
+	Status string `json:"status"`
+	IsAnonymous bool `json:"is_anonymous"`
+	Metadata map[string]interface{} `json:"metadata"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+	LoginCount int `json:"login_count,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+	TokenCount int `json:"token_count,omitempty"`
+	PendingConsents []string `json:"pending_consents,omitempty"`
+	Account *PublicAccountV2 `json:"account,omitempty"`
+	Tokens []PublicTokenV2 `json:"tokens,omitempty"`
+}
+
+// PublicAccount as v2 renders it within a user
+type PublicAccountV2 struct {
+	ID uuid.UUID `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug,omitempty"`
+	Locale string `json:"locale,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PublicToken as v2 renders it within a user
+type PublicTokenV2 struct {
+	ID uuid.UUID `json:"id"`
+	Impersonated bool `json:"impersonated"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ====================
+//        Setup
+// ====================
+
+// Every version served, oldest first
+func apiVersions() []apiVersion {
+	return []apiVersion{
+		{Name: apiV1},
+		{
+			Name: apiV2,
+			Serializers: map[reflect.Type]func(interface{}) interface{}{
+				reflect.TypeOf(PublicUser{}): serializePublicUserV2,
+			},
+		},
+	}
+}
+
+// Mounts every route under each version's prefix
+func initVersionedRoutes(router fiber.Router, app *fiber.App, db *bun.DB, store Storage) {
+	deps := newHandlerDeps(db)
+	for _, version := range apiVersions() {
+		version := version
+		api := router.Group("/api/"+version.Name, func(c *fiber.Ctx) error {
+			return useApiVersion(c, version)
+		})
+
+		initAccountRoutes(api, newAccountHandlers(deps))
+		initUserRoutes(api, db, store)
+		initMeRoutes(api, db, store)
+		initInviteRoutes(api, db)
+		initConsentRoutes(api, db)
+		initRoleRoutes(api, db)
+		initAuthzRoutes(api, db)
+		initPolicyRoutes(api, db)
+		initGroupRoutes(api, db)
+		initAuditRoutes(api, db, store)
+		initAnalyticsRoutes(api, db)
+		initQuotaRoutes(api, db)
+		initFlagRoutes(api, db)
+		initReloadRoutes(api)
+		initSeedRoutes(api, db)
+		initMigrationRoutes(api, db)
+		initErrorCodeRoutes(api)
+		initCsrfRoutes(api)
+		initAuthRoutes(api, newAuthHandlers(deps))
+		initBatchRoutes(api, app, db)
+		initGraphqlRoutes(api, db)
+		initWebhookRoutes(api, db)
+		initEventRoutes(api, db)
+		initSocketRoutes(api, db)
+		initEmailTemplateRoutes(api, db)
+	}
+}
+
+// ====================
+//      Middleware
+// ====================
+
+// Remembers the request's version and signals its deprecation
+func useApiVersion(c *fiber.Ctx, version apiVersion) error {
+	c.Locals("apiVersion", version)
+
+	deprecatedAt, sunsetAt := versionLifecycle(version.Name)
+	if !deprecatedAt.IsZero() && time.Now().After(deprecatedAt) {
+		c.Set("Deprecation", fmt.Sprintf("@%d", deprecatedAt.Unix()))
+		if latest := apiVersions()[len(apiVersions())-1]; latest.Name != version.Name {
+			c.Append(fiber.HeaderLink, fmt.Sprintf("</api/%s>; rel=\"successor-version\"", latest.Name))
+		}
+	}
+	if !sunsetAt.IsZero() {
+		c.Set("Sunset", sunsetAt.UTC().Format(http.TimeFormat))
+		if time.Now().After(sunsetAt) {
+			return gone(fmt.Sprintf("api %s is no longer served", version.Name)).WithCode(codeApiVersionSunset)
+		}
+	}
+
+	return c.Next()
+}
+
+// ====================
+//      Utilities
+// ====================
+
+// The version the request came in on, v1 outside the versioned routes
+func requestApiVersion(c *fiber.Ctx) apiVersion {
+	if version, ok := c.Locals("apiVersion").(apiVersion); ok {
+		return version
+	}
+	return apiVersions()[0]
+}
+
+// A path under the request's version, e.g. apiPath(c, "/me") is "/api/v2/me"
+func apiPath(c *fiber.Ctx, path string) string {
+	return versionPrefix(requestApiVersion(c)) + path
+}
+
+// Where the version's routes are served, e.g. "/api/v1"
+func versionPrefix(version apiVersion) string {
+	return mountPrefix + "/api/" + version.Name
+}
+
+// Shapes a value, or a slice of values, with the request version's
+// serializer for its type. Values without one are returned as is.
+func render(c *fiber.Ctx, value interface{}) interface{} {
+	version := requestApiVersion(c)
+	if len(version.Serializers) == 0 || value == nil {
+		return value
+	}
+
+	reflected := reflect.ValueOf(value)
+	if reflected.Kind() == reflect.Ptr {
+		if reflected.IsNil() {
+			return value
+		}
+		reflected = reflected.Elem()
+	}
+
+	if reflected.Kind() == reflect.Slice {
+		serialize, ok := version.Serializers[reflected.Type().Elem()]
+		if !ok {
+			return value
+		}
+
+		// Keep the slice typed so callers can still tell what it holds
+		elemType := reflect.TypeOf(serialize(reflect.Zero(reflected.Type().Elem()).Interface()))
+		rendered := reflect.MakeSlice(reflect.SliceOf(elemType), reflected.Len(), reflected.Len())
+		for i := 0; i < reflected.Len(); i++ {
+			rendered.Index(i).Set(reflect.ValueOf(serialize(reflected.Index(i).Interface())))
+		}
+		return rendered.Interface()
+	}
+
+	if serialize, ok := version.Serializers[reflected.Type()]; ok {
+		return serialize(reflected.Interface())
+	}
+	return value
+}
+
+// When a version was deprecated and when it stops being served, either
+// of which may be zero
+func versionLifecycle(name string) (time.Time, time.Time) {
+	prefix := "API_" + strings.ToUpper(name)
+	deprecatedAt, _ := time.Parse(time.RFC3339, os.Getenv(prefix+"_DEPRECATED_AT"))
+	sunsetAt, _ := time.Parse(time.RFC3339, os.Getenv(prefix+"_SUNSET_AT"))
+	return deprecatedAt, sunsetAt
+}
+
+func serializePublicUserV2(value interface{}) interface{} {
+	user := value.(PublicUser)
+
+	var account *PublicAccountV2
+	if user.Account != nil {
+		account = &PublicAccountV2{
+			ID: user.Account.ID,
+			Name: user.Account.Name,
+			Slug: user.Account.Slug,
+			Locale: user.Account.Locale,
+			CreatedAt: user.Account.CreatedAt,
+		}
+	}
+	var tokens []PublicTokenV2
+	for _, token := range user.Tokens {
+		tokens = append(tokens, PublicTokenV2(token))
+	}
+
+	return &PublicUserV2{
+		ID: user.ID,
+		Token: user.Token,
+		Username: user.Username,
+		Email: user.Email,
+		DisplayName: user.DisplayName,
+		AvatarURL: user.AvatarURL,
+		Role: user.Role,
+		Status: user.Status,
+		IsAnonymous: user.IsAnonymous,
+		Metadata: user.Metadata,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+		LastLoginAt: user.LastLoginAt,
+		LoginCount: user.LoginCount,
+		Tags: user.Tags,
+		TokenCount: user.TokenCount,
+		PendingConsents: user.PendingConsents,
+		Account: account,
+		Tokens: tokens,
+	}
+}
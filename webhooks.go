@@ -0,0 +1,751 @@
+package goapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// Webhook DB model. An endpoint of the account's that's sent the events
+// it subscribes to.
+type Webhook struct {
+	bun.BaseModel `bun:"table:webhooks"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	URL string
+	Events []string `bun:",array"` // event types, or "*" for every type
+	Description string
+	Active bool `bun:",notnull,default:true"`
+	Secret string `json:"-"` // signs deliveries, only shown when set
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	AccountId uuid.UUID `bun:",type:uuid"` // has idx
+}
+
+// WebhookDelivery DB model. One event sent to one webhook, with the
+// result of its latest attempt.
+type WebhookDelivery struct {
+	bun.BaseModel `bun:"table:webhook_deliveries"`
+	ID uuid.UUID `bun:",pk,type:uuid"`
+	EventType string
+	Payload map[string]interface{} `bun:"type:jsonb"`
+	Status string `bun:",nullzero,notnull,default:'pending'"`
+	Attempts int `bun:",notnull,default:0"`
+	ResponseStatus int `bun:",nullzero"`
+	ResponseBody string `bun:",nullzero"` // the start of it
+	Error string `bun:",nullzero"`
+	NextAttemptAt time.Time `bun:",nullzero"` // has idx with status
+	DeliveredAt time.Time `bun:",nullzero"`
+	CreatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+	UpdatedAt time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	// Relations
+	WebhookId uuid.UUID `bun:",type:uuid"` // has idx
+	AccountId uuid.UUID `bun:",type:uuid"`
+	EventId uuid.UUID `bun:",type:uuid"`
+}
+
+// Fields a webhook is created with
+type WebhookInput struct {
+	URL string `validate:"required,url,max=2048"`
+	Events []string `validate:"required,min=1"`
+	Description string `validate:"max=200"`
+	Active *bool
+}
+
+// Fields that may change on a webhook. Only the fields sent are written.
+type UpdateWebhookInput struct {
+	URL string `validate:"omitempty,url,max=2048"`
+	Events []string
+	Description string `validate:"max=200"`
+	Active bool
+}
+
+// A webhook along with its secret, shown once when it's set
+type WebhookWithSecret struct {
+	Webhook
+	Secret string
+}
+
+// Delivery statuses
+const (
+	webhookDeliveryPending = "pending"
+	webhookDeliverySucceeded = "succeeded"
+	webhookDeliveryFailed = "failed"
+)
+
+const (
+	// How long a delivery is held by the worker sending it, so others
+	// don't send it too. Longer than any request may take.
+	webhookDeliveryLease = 5 * time.Minute
+
+	// How much of a response body is kept in the delivery log
+	webhookResponseBodyLimit = 1024
+)
+
+// Delivery attempts, by outcome
+var webhookDeliveryResults = expvar.NewMap("webhook_deliveries")
+
+// ====================
+//        Setup
+// ====================
+
+var _ bun.BeforeAppendModelHook = (*Webhook)(nil)
+func (w *Webhook) BeforeAppendModel(ctx context.Context, query bun.Query) error {
+	switch query.(type) {
+		case *bun.UpdateQuery:
+			w.UpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func initWebhookRoutes(api fiber.Router, db *bun.DB) {
+	routes := api.Group("/webhooks", func(c *fiber.Ctx) error {
+		return requireUser(c, db)
+	})
+
+	routes.Get("/events", permit(db, permissionWebhooksManage), func(c *fiber.Ctx) error {
+		return c.JSON(eventTypes())
+	})
+
+	routes.Get("/", permit(db, permissionWebhooksManage), func(c *fiber.Ctx) error {
+		return getWebhooks(c, db)
+	})
+
+	routes.Post("/", permit(db, permissionWebhooksManage), idempotent(db), func(c *fiber.Ctx) error {
+		return createWebhook(c, db)
+	})
+
+	routes.Get("/:id", permit(db, permissionWebhooksManage), func(c *fiber.Ctx) error {
+		return getWebhook(c, db)
+	})
+
+	routes.Put("/:id", permit(db, permissionWebhooksManage), func(c *fiber.Ctx) error {
+		return updateWebhook(c, db)
+	})
+
+	routes.Delete("/:id", permit(db, permissionWebhooksManage), func(c *fiber.Ctx) error {
+		return deleteWebhook(c, db)
+	})
+
+	routes.Post("/:id/secret", permit(db, permissionWebhooksManage), func(c *fiber.Ctx) error {
+		return rotateWebhookSecret(c, db)
+	})
+
+	routes.Get("/:id/deliveries", permit(db, permissionWebhooksManage), func(c *fiber.Ctx) error {
+		return getWebhookDeliveries(c, db)
+	})
+
+	routes.Post("/:id/deliveries/:deliveryId/redeliver", permit(db, permissionWebhooksManage), func(c *fiber.Ctx) error {
+		return redeliverWebhook(c, db)
+	})
+}
+
+// Retries due deliveries every 30 seconds. First attempts are made as
+// soon as their event is recorded.
+func startWebhookDeliveries(db *bun.DB) {
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		for range ticker.C {
+			retryWebhookDeliveries(db)
+		}
+	}()
+}
+
+// ====================
+//    Route Handlers
+// ====================
+
+func getWebhooks(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	webhooks := []Webhook{}
+	err := db.NewSelect().Model(&webhooks).
+		Where("account_id = ?", currentUser.AccountId).
+		Order("created_at ASC").
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return an empty array
+	}
+
+	return c.JSON(webhooks)
+}
+
+// Creates a webhook, e.g. {"URL": "https://example.com/hooks",
+// "Events": ["user.created", "login.failed"]}. The response has the
+// secret deliveries are signed with, which isn't shown again.
+func createWebhook(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(WebhookInput)
+	if err := parseBody(c, input); err != nil {
+		return err
+	}
+
+	if err := validateWebhookURL(input.URL); err != nil {
+		return err
+	}
+
+	events, err := normalizeEventTypes(input.Events)
+	if err != nil {
+		return err
+	}
+
+	secret, err := generateSecureToken()
+	if err != nil {
+		return internalError(err)
+	}
+
+	webhook := new(Webhook)
+	webhook.ID = newId()
+	webhook.AccountId = currentUser.AccountId
+	webhook.URL = input.URL
+	webhook.Events = events
+	webhook.Description = strings.TrimSpace(input.Description)
+	webhook.Active = input.Active == nil || *input.Active
+	webhook.Secret = secret
+	_, err = db.NewInsert().Model(webhook).Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return created(c, apiPath(c, "/webhooks/"+webhook.ID.String()), WebhookWithSecret{Webhook: *webhook, Secret: secret})
+}
+
+func getWebhook(c *fiber.Ctx, db *bun.DB) error {
+	currentUser := c.Locals("user").(*User)
+
+	webhook, err := findWebhook(c.UserContext(), c.Params("id"), currentUser.AccountId, db)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(webhook)
+}
+
+func updateWebhook(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	input := new(UpdateWebhookInput)
+	if err := parseBody(c, input); err != nil {
+		return err
+	}
+
+	webhook, err := findWebhook(ctx, c.Params("id"), currentUser.AccountId, db)
+	if err != nil {
+		return err
+	}
+
+	// Only write what was sent
+	columns := []string{"updated_at"}
+	for _, field := range sentFields(c, input) {
+		switch field {
+			case "URL":
+				if input.URL != "" {
+					if err := validateWebhookURL(input.URL); err != nil {
+						return err
+					}
+					webhook.URL = input.URL
+					columns = append(columns, "url")
+				}
+			case "Events":
+				events, err := normalizeEventTypes(input.Events)
+				if err != nil {
+					return err
+				}
+				webhook.Events = events
+				columns = append(columns, "events")
+			case "Description":
+				webhook.Description = strings.TrimSpace(input.Description)
+				columns = append(columns, "description")
+			case "Active":
+				webhook.Active = input.Active
+				columns = append(columns, "active")
+		}
+	}
+
+	_, err = db.NewUpdate().Model(webhook).Column(columns...).WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(webhook)
+}
+
+// Deletes a webhook and its delivery log, dropping anything unsent
+func deleteWebhook(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	webhook, err := findWebhook(ctx, c.Params("id"), currentUser.AccountId, db)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.NewDelete().Model(webhook).WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	_, err = db.NewDelete().Model((*WebhookDelivery)(nil)).Where("webhook_id = ?", webhook.ID).Exec(ctx)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Send()
+	}
+
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// Replaces a webhook's secret. Deliveries are signed with the new one
+// from then on, including retries.
+func rotateWebhookSecret(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	webhook, err := findWebhook(ctx, c.Params("id"), currentUser.AccountId, db)
+	if err != nil {
+		return err
+	}
+
+	secret, err := generateSecureToken()
+	if err != nil {
+		return internalError(err)
+	}
+
+	webhook.Secret = secret
+	_, err = db.NewUpdate().Model(webhook).Column("secret", "updated_at").WherePK().Exec(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	return c.JSON(WebhookWithSecret{Webhook: *webhook, Secret: secret})
+}
+
+// The webhook's latest 100 deliveries, optionally with one ?status=
+func getWebhookDeliveries(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	webhook, err := findWebhook(ctx, c.Params("id"), currentUser.AccountId, db)
+	if err != nil {
+		return err
+	}
+
+	deliveries := []WebhookDelivery{}
+	query := db.NewSelect().Model(&deliveries).
+		Where("webhook_id = ?", webhook.ID).
+		Order("created_at DESC").
+		Limit(100)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Scan(ctx); err != nil {
+		requestLogger(c).Error().Err(err).Send()
+		// Continue and simply return an empty array
+	}
+
+	return c.JSON(deliveries)
+}
+
+// Sends a delivery's event again as a new delivery, leaving the original
+// in the log as it was
+func redeliverWebhook(c *fiber.Ctx, db *bun.DB) error {
+	ctx := c.UserContext()
+	currentUser := c.Locals("user").(*User)
+
+	webhook, err := findWebhook(ctx, c.Params("id"), currentUser.AccountId, db)
+	if err != nil {
+		return err
+	}
+
+	original := new(WebhookDelivery)
+	err = db.NewSelect().Model(original).
+		Where("id = ?", c.Params("deliveryId")).
+		Where("webhook_id = ?", webhook.ID).
+		Scan(ctx)
+	if err != nil {
+		requestLogger(c).Debug().Err(err).Send()
+		return notFound("delivery not found").WithCode(codeWebhookDeliveryNotFound)
+	}
+
+	delivery, err := queueWebhookDelivery(ctx, db, webhook, original.EventId, original.EventType, original.Payload, true)
+	if err != nil {
+		return internalError(err)
+	}
+	go attemptWebhookDelivery(db, *delivery)
+
+	return c.Status(fiber.StatusAccepted).JSON(delivery)
+}
+
+// ====================
+//      Utilities
+// ====================
+
+func findWebhook(ctx context.Context, id string, accountId uuid.UUID, db *bun.DB) (*Webhook, error) {
+	webhook := new(Webhook)
+	err := db.NewSelect().Model(webhook).
+		Where("id = ?", id).
+		Where("account_id = ?", accountId).
+		Scan(ctx)
+	if err != nil {
+		logger.Debug().Err(err).Send()
+		return nil, notFound("webhook not found").WithCode(codeWebhookNotFound)
+	}
+
+	return webhook, nil
+}
+
+// Known event types, deduplicated, or "*" alone for every type
+func normalizeEventTypes(events []string) ([]string, error) {
+	normalized := []string{}
+	for _, event := range events {
+		event = strings.ToLower(strings.TrimSpace(event))
+		if event == "*" {
+			return []string{"*"}, nil
+		}
+		if !stringInSlice(event, eventTypes()) {
+			return nil, badRequest(fmt.Sprintf("unknown event: %s", event)).With(fiber.Map{"events": eventTypes()})
+		}
+		if !stringInSlice(event, normalized) {
+			normalized = append(normalized, event)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil, badRequest("no events provided")
+	}
+	return normalized, nil
+}
+
+// Queues the event for every active webhook of its account that
+// subscribes to it, or only the one webhook when webhookId is set. See
+// queueWebhookDelivery for leased.
+func queueWebhookDeliveries(ctx context.Context, db bun.IDB, event *Event, webhookId uuid.UUID, leased bool) ([]WebhookDelivery, error) {
+	webhooks := []Webhook{}
+	query := db.NewSelect().Model(&webhooks).
+		Where("account_id = ?", event.AccountId).
+		Where("active").
+		WhereGroup(" AND ", func(q *bun.SelectQuery) *bun.SelectQuery {
+			subscribed, arg := arrayContains(q, "events", event.Type)
+			everything, all := arrayContains(q, "events", "*")
+			return q.Where(subscribed, arg).WhereOr(everything, all)
+		})
+	if webhookId != uuid.Nil {
+		query = query.Where("id = ?", webhookId)
+	}
+	if err := query.Scan(ctx); err != nil {
+		return nil, err
+	}
+	if len(webhooks) == 0 {
+		return nil, nil
+	}
+
+	payload, err := toDocument(event)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []WebhookDelivery{}
+	for i := range webhooks {
+		delivery, err := queueWebhookDelivery(ctx, db, &webhooks[i], event.ID, event.Type, payload, leased)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+	return deliveries, nil
+}
+
+// Records a delivery. A leased delivery is held for the caller to send
+// right away, and the worker only retries it should that attempt never
+// finish. Otherwise it's due now, for the worker to send.
+func queueWebhookDelivery(ctx context.Context, db bun.IDB, webhook *Webhook, eventId uuid.UUID, eventType string, payload map[string]interface{}, leased bool) (*WebhookDelivery, error) {
+	delivery := new(WebhookDelivery)
+	delivery.ID = newId()
+	delivery.WebhookId = webhook.ID
+	delivery.AccountId = webhook.AccountId
+	delivery.EventId = eventId
+	delivery.EventType = eventType
+	delivery.Payload = payload
+	delivery.Status = webhookDeliveryPending
+	delivery.NextAttemptAt = time.Now()
+	if leased {
+		delivery.NextAttemptAt = delivery.NextAttemptAt.Add(webhookDeliveryLease)
+	}
+	_, err := db.NewInsert().Model(delivery).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return delivery, nil
+}
+
+// Leases the deliveries that are due and attempts each of them
+func retryWebhookDeliveries(db *bun.DB) {
+	ctx := context.Background()
+
+	deliveries := []WebhookDelivery{}
+	leasedUntil := time.Now().Add(webhookDeliveryLease)
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := forUpdate(tx.NewSelect().Model(&deliveries).
+			Where("status = ?", webhookDeliveryPending).
+			Where("next_attempt_at <= ?", time.Now()).
+			Order("next_attempt_at ASC").
+			Limit(100), true).
+			Scan(ctx)
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+
+		ids := []uuid.UUID{}
+		for i := range deliveries {
+			deliveries[i].NextAttemptAt = leasedUntil
+			ids = append(ids, deliveries[i].ID)
+		}
+		_, err = tx.NewUpdate().Model((*WebhookDelivery)(nil)).
+			Set("next_attempt_at = ?", leasedUntil).
+			Where("id IN (?)", bun.In(ids)).
+			Exec(ctx)
+		return err
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("webhook retry failed")
+		return
+	}
+
+	for _, delivery := range deliveries {
+		go attemptWebhookDelivery(db, delivery)
+	}
+}
+
+// POSTs the delivery's payload to its webhook and records the result.
+// Anything but a 2xx is retried with exponential backoff until
+// WEBHOOK_MAX_ATTEMPTS (default 8) attempts have failed.
+func attemptWebhookDelivery(db *bun.DB, delivery WebhookDelivery) {
+	ctx := context.Background()
+	log := logger.With().Str("delivery", delivery.ID.String()).Logger()
+
+	webhook := new(Webhook)
+	err := db.NewSelect().Model(webhook).Where("id = ?", delivery.WebhookId).Scan(ctx)
+	if err != nil || !webhook.Active {
+		delivery.Status = webhookDeliveryFailed
+		delivery.Error = "webhook was deleted or deactivated"
+		delivery.NextAttemptAt = time.Time{}
+		saveWebhookDelivery(db, &delivery)
+		return
+	}
+
+	delivery.Attempts++
+	delivery.ResponseStatus = 0
+	delivery.ResponseBody = ""
+	delivery.Error = ""
+
+	status, body, err := sendWebhook(webhook, &delivery)
+	delivery.ResponseStatus = status
+	delivery.ResponseBody = body
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	switch {
+		case err == nil && status >= 200 && status < 300:
+			delivery.Status = webhookDeliverySucceeded
+			delivery.DeliveredAt = time.Now()
+			delivery.NextAttemptAt = time.Time{}
+		case delivery.Attempts >= intSetting("WEBHOOK_MAX_ATTEMPTS"):
+			delivery.Status = webhookDeliveryFailed
+			delivery.NextAttemptAt = time.Time{}
+		default:
+			delivery.NextAttemptAt = time.Now().Add(retryDelay(delivery.Attempts))
+	}
+
+	outcome := delivery.Status
+	if outcome == webhookDeliveryPending {
+		outcome = "retrying"
+	}
+	webhookDeliveryResults.Add(outcome, 1)
+	log.Debug().Str("status", delivery.Status).Int("response", status).Int("attempt", delivery.Attempts).Msg("webhook attempted")
+
+	saveWebhookDelivery(db, &delivery)
+}
+
+func sendWebhook(webhook *Webhook, delivery *WebhookDelivery) (int, string, error) {
+	// Webhooks saved before URLs were checked are held to the same rules
+	if err := validateWebhookURL(webhook.URL); err != nil {
+		return 0, "", errWebhookTargetRefused
+	}
+
+	body, err := json.Marshal(delivery.Payload)
+	if err != nil {
+		return 0, "", err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	req.Header.Set(fiber.HeaderUserAgent, "goapi-webhooks")
+	req.Header.Set("Webhook-Id", delivery.ID.String())
+	req.Header.Set("Webhook-Event", delivery.EventType)
+	req.Header.Set("Webhook-Timestamp", timestamp)
+	req.Header.Set("Webhook-Signature", "v1="+signWebhook(webhook.Secret, timestamp, body))
+
+	client := &http.Client{
+		Timeout: time.Duration(intSetting("WEBHOOK_TIMEOUT_SECONDS")) * time.Second,
+		Transport: webhookTransport,
+		// Redirects aren't followed, so a webhook only ever reaches its own URL
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+
+	start, _ := io.ReadAll(io.LimitReader(res.Body, webhookResponseBodyLimit))
+	return res.StatusCode, string(start), nil
+}
+
+// Refuses webhook URLs that aren't https or that name an address inside
+// the deployment's network, unless WEBHOOK_ALLOW_PRIVATE is set for
+// development. Hostnames are checked again once resolved, see webhookTransport.
+func validateWebhookURL(raw string) error {
+	if os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true" {
+		return nil
+	}
+
+	invalid := badRequest("webhook URL must use https and a public address").WithCode(codeInvalidInput)
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Scheme != "https" || parsed.Hostname() == "" {
+		return invalid
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(parsed.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return invalid
+	}
+	if ip := net.ParseIP(host); ip != nil && !publicAddress(ip) {
+		return invalid
+	}
+	return nil
+}
+
+// Connects only to public addresses. The check runs on the address being
+// dialed, after DNS, so a hostname can't be rebound to an internal one.
+// Proxies from the environment aren't used, since they'd dial for us.
+var webhookTransport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			if os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true" {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+				return errWebhookTargetRefused
+			}
+			return nil
+		},
+	}).DialContext,
+	TLSHandshakeTimeout: 10 * time.Second,
+	MaxIdleConnsPerHost: 2,
+}
+
+var errWebhookTargetRefused = errors.New("webhook target refused: not a public https address")
+
+// Ranges that aren't covered by net.IP's own checks
+var nonPublicNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"), // carrier-grade NAT
+	mustParseCIDR("192.0.0.0/24"),
+	mustParseCIDR("198.18.0.0/15"), // benchmarking
+	mustParseCIDR("240.0.0.0/4"),
+	mustParseCIDR("64:ff9b::/96"), // NAT64, which can reach IPv4 internals
+}
+
+// Whether an address is on the internet at large, rather than loopback,
+// private, link-local (cloud metadata lives at 169.254.169.254), or reserved
+func publicAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// The hex HMAC-SHA256 of "<timestamp>.<body>" with the webhook's secret.
+// Receivers recompute it to check a delivery is genuine, and reject old
+// timestamps to stop replays.
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 1 minute after the first attempt, doubling each time, at most 6 hours
+func retryDelay(attempts int) time.Duration {
+	delay := time.Minute
+	for i := 1; i < attempts && delay < 6*time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > 6*time.Hour {
+		delay = 6 * time.Hour
+	}
+	return delay
+}
+
+func saveWebhookDelivery(db *bun.DB, delivery *WebhookDelivery) {
+	ctx := context.Background()
+	delivery.UpdatedAt = time.Now()
+	_, err := db.NewUpdate().Model(delivery).
+		Column("status", "attempts", "response_status", "response_body", "error", "next_attempt_at", "delivered_at", "updated_at").
+		WherePK().
+		Exec(ctx)
+	if err != nil {
+		logger.Error().Err(err).Str("delivery", delivery.ID.String()).Send()
+	}
+}